@@ -1,62 +1,366 @@
 package api
 
 import (
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"path"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jaym/clyper/metadata"
+	"github.com/jaym/clyper/objstore"
 	processor "github.com/jaym/clyper/processors"
+	"github.com/rs/zerolog/log"
 )
 
+type ApiConfig struct {
+	// DefaultShow is the slug of the show served by the routes that do not
+	// name one. Defaults to metadata.DefaultShowSlug.
+	DefaultShow string
+	// DefaultLanguage is the subtitle language captions and context are
+	// taken from when a request does not pass lang. Searches without lang
+	// cover every language. Defaults to metadata.DefaultLanguage.
+	DefaultLanguage string
+	GifOptions      processor.GifOptions
+	// RenderCache caches rendered GIFs, clips and stills in the object
+	// store. Nil disables the cache.
+	RenderCache *RenderCacheConfig
+	// RenderQueue limits how many renders run at once and how many can
+	// wait.
+	RenderQueue RenderQueueConfig
+	// Jobs configures the jobs submitted to POST /jobs.
+	Jobs JobsConfig
+	// RenderTimeout caps how long a render may take, renders that take
+	// longer get a 504. Zero means no limit.
+	RenderTimeout time.Duration
+	// Context stops render jobs when it is done, such as when the server
+	// shuts down. Defaults to context.Background().
+	Context context.Context
+	// Runner runs ffmpeg for renders. Defaults to processor.DefaultRunner.
+	Runner processor.Runner
+}
+
 type ApiHandler struct {
-	db           *metadata.Database
-	gifOptions   processor.GifOptions
-	objstorePath string
+	db              *metadata.Database
+	gifOptions      processor.GifOptions
+	store           objstore.ObjectStore
+	defaultShow     string
+	defaultLanguage string
+	cache           *renderCache
+	queue           *renderQueue
+	jobs            *jobStore
+	renderTimeout   time.Duration
+	runner          processor.Runner
+	// ctx is the context render jobs run in.
+	ctx context.Context
 }
 
-func NewApiHandler(db *metadata.Database, objstorePath string, gifOptions processor.GifOptions) http.Handler {
+func NewApiHandler(db *metadata.Database, store objstore.ObjectStore, cfg ApiConfig) http.Handler {
 	mux := http.NewServeMux()
 
+	defaultShow := metadata.DefaultShowSlug
+	if cfg.DefaultShow != "" {
+		defaultShow = cfg.DefaultShow
+	}
+
+	defaultLanguage := metadata.DefaultLanguage
+	if cfg.DefaultLanguage != "" {
+		defaultLanguage = cfg.DefaultLanguage
+	}
+
 	apiHandler := &ApiHandler{
-		db:           db,
-		objstorePath: objstorePath,
-		gifOptions:   gifOptions,
+		db:              db,
+		store:           store,
+		gifOptions:      cfg.GifOptions,
+		defaultShow:     defaultShow,
+		defaultLanguage: defaultLanguage,
+		queue:           newRenderQueue(cfg.RenderQueue),
+		renderTimeout:   cfg.RenderTimeout,
+		runner:          cfg.Runner,
+		ctx:             cfg.Context,
+	}
+	if apiHandler.ctx == nil {
+		apiHandler.ctx = context.Background()
+	}
+
+	if cfg.RenderCache != nil {
+		cache, err := newRenderCache(store, *cfg.RenderCache)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to load the render cache, renders will not be cached")
+		} else {
+			apiHandler.cache = cache
+		}
 	}
 
+	jobs, err := newJobStore(store, cfg.Jobs)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to load jobs, the jobs API is disabled")
+	} else {
+		apiHandler.jobs = jobs
+		mux.HandleFunc("POST /jobs", apiHandler.createJobHandler)
+		mux.HandleFunc("GET /jobs/{id}", apiHandler.jobHandler)
+		mux.HandleFunc("GET /jobs/{id}/result", apiHandler.jobResultHandler)
+	}
+
+	mux.HandleFunc("/shows", apiHandler.showsHandler)
+	mux.HandleFunc("/shows/{show}/episodes", apiHandler.episodesHandler)
+	mux.HandleFunc("/shows/{show}/languages", apiHandler.languagesHandler)
+	mux.HandleFunc("/shows/{show}/search", apiHandler.searchHandler)
+	mux.HandleFunc("/thumbs/{show}/{season}/{episode}/{timestamp}", apiHandler.thumbsHandler)
+	mux.HandleFunc("/thumb/{show}/{season}/{episode}/{timestamp}", apiHandler.thumbHandler)
+	mux.HandleFunc("/context/{show}/{season}/{episode}/{timestamp}", apiHandler.contextHandler)
+	mux.HandleFunc("/gif/{show}/{season}/{episode}/{start}/{end}", apiHandler.gifHandler)
+	mux.HandleFunc("/clip/{show}/{season}/{episode}/{start}/{end}", apiHandler.clipHandler)
+	mux.HandleFunc("/meme/{show}/{season}/{episode}/{timestamp}", apiHandler.memeHandler)
+
+	// Routes without a show serve the default show
 	mux.HandleFunc("/search", apiHandler.searchHandler)
 	mux.HandleFunc("/thumbs/{season}/{episode}/{timestamp}", apiHandler.thumbsHandler)
 	mux.HandleFunc("/thumb/{season}/{episode}/{timestamp}", apiHandler.thumbHandler)
+	mux.HandleFunc("/context/{season}/{episode}/{timestamp}", apiHandler.contextHandler)
 	mux.HandleFunc("/gif/{season}/{episode}/{start}/{end}", apiHandler.gifHandler)
+	mux.HandleFunc("/clip/{season}/{episode}/{start}/{end}", apiHandler.clipHandler)
+	mux.HandleFunc("/meme/{season}/{episode}/{timestamp}", apiHandler.memeHandler)
 
 	return allowCORS(mux)
 }
 
+// show returns the show named in the request path, or the default show for
+// routes that do not name one.
+func (h *ApiHandler) show(r *http.Request) string {
+	if show := r.PathValue("show"); show != "" {
+		return show
+	}
+	return h.defaultShow
+}
+
+// language returns the subtitle language passed in the lang query
+// parameter, or the default language. "*" selects every language.
+func (h *ApiHandler) language(r *http.Request) string {
+	if language := r.URL.Query().Get("lang"); language != "" {
+		return language
+	}
+	return h.defaultLanguage
+}
+
+func (h *ApiHandler) showsHandler(w http.ResponseWriter, r *http.Request) {
+	shows, err := h.db.ListShows(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to list shows", http.StatusInternalServerError)
+		return
+	}
+	if len(shows) == 0 {
+		shows = []metadata.Show{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shows)
+}
+
 func allowCORS(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count, X-Next-Cursor, X-Did-You-Mean, "+
+			"X-Animation-Fps, X-Animation-Scale, X-Animation-Colors, X-Animation-Dither, X-Animation-Quality, X-Animation-Attempts, X-Animation-Fits, "+
+			"ETag, X-Render-Cache, Retry-After, Location")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			// Preflight of a POST /jobs with a JSON body
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
 		h.ServeHTTP(w, r)
 	})
 }
 
+func (h *ApiHandler) episodesHandler(w http.ResponseWriter, r *http.Request) {
+	episodes, err := h.db.ListEpisodes(r.Context(), h.show(r))
+	if err != nil {
+		http.Error(w, "Failed to list episodes", http.StatusInternalServerError)
+		return
+	}
+	if len(episodes) == 0 {
+		http.Error(w, "Show not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(episodes)
+}
+
+func (h *ApiHandler) languagesHandler(w http.ResponseWriter, r *http.Request) {
+	languages, err := h.db.ListLanguages(r.Context(), h.show(r))
+	if err != nil {
+		http.Error(w, "Failed to list languages", http.StatusInternalServerError)
+		return
+	}
+	if len(languages) == 0 {
+		languages = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(languages)
+}
+
+// searchHandler searches the subtitles of a show. For compatibility it
+// returns a bare array of results unless envelope=true is passed, the
+// total, the cursor of the next page and the did you mean suggestion are
+// also sent as the X-Total-Count, X-Next-Cursor and X-Did-You-Mean headers.
 func (h *ApiHandler) searchHandler(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query().Get("q")
+	params := r.URL.Query()
+	query := params.Get("q")
+
+	// Without lang, search every language like before subtitles had one
+	opts := metadata.SearchOptions{
+		Language: params.Get("lang"),
+		Cursor:   params.Get("cursor"),
+	}
+	var err error
+	for _, filter := range []struct {
+		name  string
+		value **int
+	}{
+		{"season", &opts.Season},
+		{"episode_from", &opts.EpisodeFrom},
+		{"episode_to", &opts.EpisodeTo},
+		{"from", &opts.From},
+		{"to", &opts.To},
+	} {
+		*filter.value, err = optionalIntParam(params, filter.name)
+		if err != nil {
+			http.Error(w, "Invalid "+filter.name, http.StatusBadRequest)
+			return
+		}
+	}
+	limit, err := optionalIntParam(params, "limit")
+	if err != nil {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+	if limit != nil {
+		opts.Limit = *limit
+	}
+	opts.Fuzzy, _ = strconv.ParseBool(params.Get("fuzzy"))
+	envelope, _ := strconv.ParseBool(params.Get("envelope"))
+
 	// Handle the search logic
-	results, err := h.db.Search(r.Context(), query)
+	page, err := h.db.Search(r.Context(), h.show(r), query, opts)
+	if errors.Is(err, metadata.ErrInvalidQuery) || errors.Is(err, metadata.ErrInvalidCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to search", http.StatusInternalServerError)
 		return
 	}
-	if len(results) == 0 {
-		results = []metadata.SearchResult{}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	if page.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", page.NextCursor)
+	}
+	if page.Suggestion != "" {
+		w.Header().Set("X-Did-You-Mean", page.Suggestion)
+	}
+	if envelope {
+		json.NewEncoder(w).Encode(page)
+		return
+	}
+	json.NewEncoder(w).Encode(page.Results)
+}
+
+// optionalIntParam returns the non-negative integer query parameter name,
+// or nil if it is not set.
+func optionalIntParam(params url.Values, name string) (*int, error) {
+	if !params.Has(name) {
+		return nil, nil
+	}
+	value, err := strconv.Atoi(params.Get(name))
+	if err != nil || value < 0 {
+		return nil, fmt.Errorf("invalid %s", name)
+	}
+	return &value, nil
+}
+
+const (
+	// defaultContextSize is the number of subtitles returned on each side
+	// of the subtitle at the requested timestamp.
+	defaultContextSize = 2
+	// maxContextSize caps the before and after parameters.
+	maxContextSize = 50
+)
+
+type ContextItem struct {
+	Start    int    `json:"start"`
+	End      int    `json:"end"`
+	Text     string `json:"text"`
+	Language string `json:"language"`
+	// Current marks the subtitle shown at the requested timestamp.
+	Current bool `json:"current,omitempty"`
+}
+
+func (h *ApiHandler) contextHandler(w http.ResponseWriter, r *http.Request) {
+	season, err := strconv.Atoi(r.PathValue("season"))
+	if err != nil {
+		http.Error(w, "Invalid season", http.StatusBadRequest)
+		return
+	}
+	episode, err := strconv.Atoi(r.PathValue("episode"))
+	if err != nil {
+		http.Error(w, "Invalid episode", http.StatusBadRequest)
+		return
+	}
+	timestamp, err := strconv.Atoi(r.PathValue("timestamp"))
+	if err != nil {
+		http.Error(w, "Invalid timestamp", http.StatusBadRequest)
+		return
 	}
+
+	params := r.URL.Query()
+	sizes := map[string]int{"before": defaultContextSize, "after": defaultContextSize}
+	for name := range sizes {
+		value, err := optionalIntParam(params, name)
+		if err != nil {
+			http.Error(w, "Invalid "+name, http.StatusBadRequest)
+			return
+		}
+		if value != nil {
+			sizes[name] = min(*value, maxContextSize)
+		}
+	}
+
+	// Context only makes sense within one language
+	language := h.language(r)
+	if language == metadata.AnyLanguage {
+		language = h.defaultLanguage
+	}
+
+	subtitles, current, err := h.db.SubtitleContext(r.Context(), h.show(r), season, episode, language, timestamp, sizes["before"], sizes["after"])
+	if err != nil {
+		http.Error(w, "Failed to list subtitles", http.StatusInternalServerError)
+		return
+	}
+	if len(subtitles) == 0 {
+		http.Error(w, "Subtitles not found", http.StatusNotFound)
+		return
+	}
+
+	items := make([]ContextItem, 0, len(subtitles))
+	for i, subtitle := range subtitles {
+		items = append(items, ContextItem{
+			Start:    subtitle.Start,
+			End:      subtitle.End,
+			Text:     subtitle.Text,
+			Language: subtitle.Language,
+			Current:  i == current,
+		})
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(results)
+	json.NewEncoder(w).Encode(items)
 }
 
 type ThumbnailItem struct {
@@ -86,7 +390,7 @@ func (h *ApiHandler) thumbHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	thumbs, err := h.db.ListThumbnails(r.Context(), season, episode, timestamp, 1, false)
+	thumbs, err := h.db.ListThumbnails(r.Context(), h.show(r), season, episode, timestamp, 1, false)
 	if err != nil {
 		http.Error(w, "Failed to list thumbnails", http.StatusInternalServerError)
 		return
@@ -100,8 +404,7 @@ func (h *ApiHandler) thumbHandler(w http.ResponseWriter, r *http.Request) {
 	thumb := thumbs[0]
 
 	// Read the thumbnail object
-	thumbPath := path.Join(h.objstorePath, thumb.Key)
-	obj, err := os.Open(thumbPath)
+	obj, err := h.store.Open(thumb.Key)
 	if err != nil {
 		http.Error(w, "Failed to read thumbnail", http.StatusInternalServerError)
 		return
@@ -147,7 +450,7 @@ func (h *ApiHandler) thumbsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	thumbs, err := h.db.ListThumbnails(r.Context(), season, episode, timestamp, 25, reverse)
+	thumbs, err := h.db.ListThumbnails(r.Context(), h.show(r), season, episode, timestamp, 25, reverse)
 	if err != nil {
 		http.Error(w, "Failed to list thumbnails", http.StatusInternalServerError)
 		return
@@ -165,95 +468,106 @@ func (h *ApiHandler) thumbsHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(items)
 }
 
-func (h *ApiHandler) gifHandler(w http.ResponseWriter, r *http.Request) {
-	seasonStr := r.PathValue("season")
-	episodeStr := r.PathValue("episode")
-	startStr := r.PathValue("start")
-	endStr := r.PathValue("end")
-	// strip extension from endStr
-	endStr, _, _ = strings.Cut(endStr, ".")
-
-	b64Lines := r.URL.Query().Get("b64lines")
-	text := r.URL.Query().Get("text")
+// renderRequest parses the show, season and episode of a render route.
+func (h *ApiHandler) renderRequest(r *http.Request, kind string) (RenderRequest, error) {
+	req := RenderRequest{
+		Kind:     kind,
+		Show:     h.show(r),
+		Language: h.language(r),
+	}
+	var err error
+	req.Season, err = strconv.Atoi(r.PathValue("season"))
+	if err != nil {
+		return req, badRequest("Invalid season")
+	}
+	req.Episode, err = strconv.Atoi(r.PathValue("episode"))
+	if err != nil {
+		return req, badRequest("Invalid episode")
+	}
+	return req, nil
+}
 
-	season, err := strconv.Atoi(seasonStr)
+// rangeRequest parses a /gif or /clip route. The extension of end picks the
+// format.
+func (h *ApiHandler) rangeRequest(r *http.Request, kind string) (RenderRequest, error) {
+	req, err := h.renderRequest(r, kind)
 	if err != nil {
-		http.Error(w, "Invalid season", http.StatusBadRequest)
-		return
+		return req, err
 	}
-	episode, err := strconv.Atoi(episodeStr)
+	req.Start, err = strconv.Atoi(r.PathValue("start"))
 	if err != nil {
-		http.Error(w, "Invalid episode", http.StatusBadRequest)
-		return
+		return req, badRequest("Invalid start")
 	}
-	start, err := strconv.Atoi(startStr)
+	var endStr string
+	endStr, req.Format, _ = strings.Cut(r.PathValue("end"), ".")
+	req.End, err = strconv.Atoi(endStr)
 	if err != nil {
-		http.Error(w, "Invalid start", http.StatusBadRequest)
-		return
+		return req, badRequest("Invalid end")
 	}
-	end, err := strconv.Atoi(endStr)
+	err = parseCaptionParams(r.URL.Query(), &req)
 	if err != nil {
-		http.Error(w, "Invalid end", http.StatusBadRequest)
-		return
+		return req, badRequest("Invalid caption")
 	}
+	return req, nil
+}
 
-	if end < start {
-		http.Error(w, "Invalid time range", http.StatusBadRequest)
+func (h *ApiHandler) gifHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := h.rangeRequest(r, "gif")
+	if err != nil {
+		writeRequestError(w, err)
 		return
 	}
+	h.serveRenderRequest(w, r, req)
+}
 
-	if end-start > processor.MaxGifDurationMS {
-		http.Error(w, "Invalid time range", http.StatusBadRequest)
+func (h *ApiHandler) clipHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := h.rangeRequest(r, "clip")
+	if err != nil {
+		writeRequestError(w, err)
 		return
 	}
-
-	var captionLines string
-	if b64Lines != "" {
-		captionBytes, err := base64.StdEncoding.DecodeString(b64Lines)
+	if r.URL.Query().Has("audio") {
+		req.Audio, err = strconv.ParseBool(r.URL.Query().Get("audio"))
 		if err != nil {
-			http.Error(w, "Invalid caption", http.StatusBadRequest)
+			http.Error(w, "Invalid audio", http.StatusBadRequest)
 			return
 		}
-		captionLines = string(captionBytes)
-	} else {
-		captionLines = text
 	}
+	h.serveRenderRequest(w, r, req)
+}
 
-	videoFileKey, err := h.db.GetVideoFileKey(r.Context(), season, episode)
+func (h *ApiHandler) memeHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := h.renderRequest(r, "still")
 	if err != nil {
-		http.Error(w, "not found", http.StatusNotFound)
+		writeRequestError(w, err)
+		return
 	}
-	videoFilePath := path.Join(h.objstorePath, videoFileKey)
-
-	// Handle the GIF logic
-	outputDir, err := os.MkdirTemp("", "clyper")
+	// The extension of timestamp picks the format
+	var timestampStr string
+	timestampStr, req.Format, _ = strings.Cut(r.PathValue("timestamp"), ".")
+	req.Start, err = strconv.Atoi(timestampStr)
 	if err != nil {
-		http.Error(w, "Failed to create temp dir", http.StatusInternalServerError)
+		http.Error(w, "Invalid timestamp", http.StatusBadRequest)
 		return
 	}
-	defer os.RemoveAll(outputDir)
-
-	outputFile := path.Join(outputDir, "output.gif")
-	opts := h.gifOptions
-	opts.Text = captionLines
 
-	err = processor.MakeGif(videoFilePath, outputFile, start, end, opts)
-	if err != nil {
-		http.Error(w, "Failed to create gif", http.StatusInternalServerError)
-		return
+	params := r.URL.Query()
+	if params.Has("top") {
+		top := params.Get("top")
+		req.Top = &top
 	}
+	if params.Has("bottom") {
+		bottom := params.Get("bottom")
+		req.Bottom = &bottom
+	}
+	h.serveRenderRequest(w, r, req)
+}
 
-	// Read the GIF
-	gif, err := os.Open(outputFile)
+func (h *ApiHandler) serveRenderRequest(w http.ResponseWriter, r *http.Request, req RenderRequest) {
+	p, err := h.prepareRender(r.Context(), req)
 	if err != nil {
-		http.Error(w, "Failed to read gif", http.StatusInternalServerError)
+		writeRequestError(w, err)
 		return
 	}
-
-	// Serve the GIF
-	w.Header().Set("Content-Type", "image/gif")
-	// Cache the gif for 1 day
-	w.Header().Set("Cache-Control", "public, max-age=86400")
-	w.WriteHeader(http.StatusOK)
-	io.Copy(w, gif)
+	h.serveRender(w, r, p)
 }
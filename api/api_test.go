@@ -0,0 +1,507 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jaym/clyper/metadata"
+	"github.com/jaym/clyper/objstore"
+	processor "github.com/jaym/clyper/processors"
+)
+
+// requireFTS5 skips tests that need a database when go-sqlite3 was built
+// without FTS5, which needs the fts5 build tag.
+func requireFTS5(t *testing.T) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec("CREATE VIRTUAL TABLE probe USING fts5(text)")
+	if err != nil && strings.Contains(err.Error(), "no such module") {
+		t.Skip("sqlite was built without FTS5, run the tests with -tags fts5")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testEpisode returns season 1 episode 1 of the default show, with one
+// subtitle per text, each shown for a second with a second between them.
+func testEpisode(language string, texts ...string) metadata.EpisodeMetadata {
+	md := metadata.EpisodeMetadata{
+		Season:       1,
+		Episode:      1,
+		VideoFileKey: "internal/default/S01E01/video.mkv",
+	}
+	for i, text := range texts {
+		md.Subtitles = append(md.Subtitles, metadata.SubtitleMetadata{
+			Start:    i * 2000,
+			End:      i*2000 + 1000,
+			Text:     text,
+			Language: language,
+		})
+	}
+	return md
+}
+
+// newTestDatabase builds a database of episodes in store, along with their
+// videos, and opens it.
+func newTestDatabase(t *testing.T, store *objstore.LocalFSObjectStore, episodes ...metadata.EpisodeMetadata) *metadata.Database {
+	t.Helper()
+
+	for _, md := range episodes {
+		if err := store.Put(md.VideoFileKey, strings.NewReader("video")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	builder, err := metadata.NewDatabaseBuilder(metadata.DefaultDatabaseKey, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, md := range episodes {
+		if err := builder.AddEpisodeMetadata(md); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	dbPath, err := store.Path(metadata.DefaultDatabaseKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := metadata.OpenDatabase(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// captionRecorder is a FakeRunner that writes a small output for each
+// ffmpeg run and records the captions it was asked to burn in. Videos are
+// probed as 23.976 fps.
+type captionRecorder struct {
+	processor.FakeRunner
+
+	mu       sync.Mutex
+	captions []string
+}
+
+var srtFileRe = regexp.MustCompile(`[^\s'=\[\]]*subtitles\.srt`)
+
+func newCaptionRecorder() *captionRecorder {
+	c := &captionRecorder{}
+	c.ProbeFunc = func(fileName string, args []string) (string, error) {
+		return `{"streams": [{"index": 0, "codec_type": "video", "avg_frame_rate": "24000/1001"}]}`, nil
+	}
+	c.RunFunc = func(args []string) error {
+		caption := ""
+		for _, arg := range args {
+			if srtFile := srtFileRe.FindString(arg); srtFile != "" {
+				srt, err := os.ReadFile(srtFile)
+				if err != nil {
+					return err
+				}
+				caption = string(srt)
+			}
+		}
+		c.mu.Lock()
+		c.captions = append(c.captions, caption)
+		c.mu.Unlock()
+		return writeRenderOutputs(args)
+	}
+	return c
+}
+
+var renderOutputRe = regexp.MustCompile(`^/.*\.(gif|webp|apng|png|jpg|mp4|webm)$`)
+
+// writeRenderOutputs writes the files a render with args would have.
+func writeRenderOutputs(args []string) error {
+	for _, arg := range args {
+		if !renderOutputRe.MatchString(arg) {
+			continue
+		}
+		if _, err := os.Stat(arg); err == nil {
+			continue
+		}
+		if err := os.WriteFile(arg, []byte("render"), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastCaption returns the SRT of the last render, empty if it was not
+// captioned.
+func (c *captionRecorder) lastCaption(t *testing.T) string {
+	t.Helper()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.captions) == 0 {
+		t.Fatal("nothing was rendered")
+	}
+	return c.captions[len(c.captions)-1]
+}
+
+// newTestAPI serves episodes with renders run by a captionRecorder.
+func newTestAPI(t *testing.T, cfg ApiConfig, episodes ...metadata.EpisodeMetadata) (http.Handler, *captionRecorder) {
+	t.Helper()
+	requireFTS5(t)
+
+	store := objstore.NewLocalFSObjectStore(t.TempDir())
+	db := newTestDatabase(t, store, episodes...)
+	runner := newCaptionRecorder()
+	cfg.Runner = runner
+	return NewApiHandler(db, store, cfg), runner
+}
+
+func get(t *testing.T, handler http.Handler, url string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+	return w
+}
+
+func TestSearchLanguage(t *testing.T) {
+	eng := testEpisode("eng", "hello there")
+	spa := testEpisode("spa", "hola hello")
+	eng.Subtitles = append(eng.Subtitles, spa.Subtitles...)
+	handler, _ := newTestAPI(t, ApiConfig{}, eng)
+
+	for _, tc := range []struct {
+		url  string
+		want []string
+	}{
+		// Without lang every language is searched
+		{"/search?q=hello", []string{"eng", "spa"}},
+		{"/search?q=hello&lang=*", []string{"eng", "spa"}},
+		{"/search?q=hello&lang=spa", []string{"spa"}},
+		{"/search?q=hello&lang=fra", nil},
+	} {
+		t.Run(tc.url, func(t *testing.T) {
+			w := get(t, handler, tc.url)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %q", w.Code, w.Body)
+			}
+			var results []metadata.SearchResult
+			if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+				t.Fatal(err)
+			}
+			var languages []string
+			for _, result := range results {
+				languages = append(languages, result.Language)
+			}
+			sort.Strings(languages)
+			if !reflect.DeepEqual(languages, tc.want) {
+				t.Errorf("languages = %v, want %v", languages, tc.want)
+			}
+		})
+	}
+}
+
+func TestGifCaptions(t *testing.T) {
+	handler, runner := newTestAPI(t, ApiConfig{}, testEpisode("eng", "first line", "second line"))
+
+	for _, tc := range []struct {
+		name  string
+		query string
+		// want are the captions in the SRT, empty for none
+		want []string
+	}{
+		{"uncaptioned by default", "", nil},
+		{"text", "?text=hi", []string{"HI"}},
+		{"b64lines", "?b64lines=aGk=", []string{"HI"}},
+		{"static subtitles", "?captions=static", []string{"FIRST LINE\nSECOND LINE"}},
+		{"text wins over captions", "?captions=static&text=hi", []string{"HI"}},
+		{"timed subtitles", "?captions=timed", []string{"FIRST LINE", "SECOND LINE"}},
+		{"cue override", "?captions=timed&cue.1=changed", []string{"FIRST LINE", "CHANGED"}},
+		{"b64cue override", "?captions=timed&b64cue.0=aGk=", []string{"HI", "SECOND LINE"}},
+		{"hidden cue", "?captions=timed&cue.0=", []string{"SECOND LINE"}},
+		{"hidden static line", "?captions=static&cue.0=", []string{"SECOND LINE"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := get(t, handler, "/gif/1/1/0/3000.gif"+tc.query)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %q", w.Code, w.Body)
+			}
+			if got := srtTexts(runner.lastCaption(t)); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("captions = %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	// Timed subtitles are shown relative to the start of the clip
+	w := get(t, handler, "/gif/1/1/500/3000.gif?captions=timed")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", w.Code, w.Body)
+	}
+	want := "1\n00:00:00,000 --> 00:00:00,500\nFIRST LINE\n\n2\n00:00:01,500 --> 00:00:02,500\nSECOND LINE"
+	if got := strings.TrimSpace(runner.lastCaption(t)); got != want {
+		t.Errorf("timed captions = %q, want %q", got, want)
+	}
+
+	for _, query := range []string{"captions=bogus", "captions=timed&cue.x=hi", "captions=timed&b64cue.0=!"} {
+		if w := get(t, handler, "/gif/1/1/0/3000.gif?"+query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// srtTexts returns the text of each cue of an SRT file.
+func srtTexts(srt string) []string {
+	var texts []string
+	for _, cue := range strings.Split(strings.TrimSpace(srt), "\n\n") {
+		lines := strings.SplitN(cue, "\n", 3)
+		if len(lines) == 3 {
+			texts = append(texts, lines[2])
+		}
+	}
+	return texts
+}
+
+func TestSearchInvalidQuery(t *testing.T) {
+	handler, _ := newTestAPI(t, ApiConfig{}, testEpisode("eng", "hello there"))
+
+	for _, query := range []string{`%22hello`, `hello)`, `-hello`, `hello+OR`} {
+		w := get(t, handler, "/search?q="+query)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("q=%s: status = %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+		if !strings.HasPrefix(w.Body.String(), metadata.ErrInvalidQuery.Error()) {
+			t.Errorf("q=%s: body = %q, want it to explain the error", query, w.Body)
+		}
+	}
+}
+
+func TestSearchPagingHeaders(t *testing.T) {
+	handler, _ := newTestAPI(t, ApiConfig{}, testEpisode("eng", "cheese", "cheese", "cheese"))
+
+	w := get(t, handler, "/search?q=cheese&limit=2")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", w.Code, w.Body)
+	}
+	if got := w.Header().Get("X-Total-Count"); got != "3" {
+		t.Errorf("X-Total-Count = %q, want 3", got)
+	}
+	cursor := w.Header().Get("X-Next-Cursor")
+	if cursor == "" {
+		t.Fatal("first page has no X-Next-Cursor")
+	}
+	var results []metadata.SearchResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil || len(results) != 2 {
+		t.Fatalf("first page = %q, want a bare array of 2 results", w.Body)
+	}
+
+	w = get(t, handler, "/search?q=cheese&limit=2&envelope=true&cursor="+cursor)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", w.Code, w.Body)
+	}
+	if got := w.Header().Get("X-Total-Count"); got != "3" {
+		t.Errorf("X-Total-Count = %q, want 3", got)
+	}
+	if got := w.Header().Get("X-Next-Cursor"); got != "" {
+		t.Errorf("last page has X-Next-Cursor %q", got)
+	}
+	var page metadata.SearchPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Results) != 1 || page.Total != 3 || page.NextCursor != "" {
+		t.Fatalf("last page = %+v, want 1 of 3 results and no cursor", page)
+	}
+	if page.Results[0].Start == results[0].Start || page.Results[0].Start == results[1].Start {
+		t.Errorf("last page repeats a result of the first: %+v", page.Results[0])
+	}
+
+	for _, url := range []string{
+		"/search?q=cheese&cursor=garbage!",
+		"/search?q=cheese&limit=-1",
+		"/search?q=cheese&limit=ten",
+	} {
+		if w := get(t, handler, url); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", url, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	handler, _ := newTestAPI(t, ApiConfig{}, testEpisode("eng", "one", "two", "three", "four", "five"))
+
+	w := get(t, handler, "/context/1/1/4500?before=1&after=1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", w.Code, w.Body)
+	}
+	var items []ContextItem
+	if err := json.Unmarshal(w.Body.Bytes(), &items); err != nil {
+		t.Fatal(err)
+	}
+	want := []ContextItem{
+		{Start: 2000, End: 3000, Text: "two", Language: "eng"},
+		{Start: 4000, End: 5000, Text: "three", Language: "eng", Current: true},
+		{Start: 6000, End: 7000, Text: "four", Language: "eng"},
+	}
+	if !reflect.DeepEqual(items, want) {
+		t.Errorf("context = %+v, want %+v", items, want)
+	}
+
+	for url, code := range map[string]int{
+		"/context/1/1/4500?before=-1": http.StatusBadRequest,
+		"/context/1/1/4500?after=two": http.StatusBadRequest,
+		"/context/1/1/soon":           http.StatusBadRequest,
+		"/context/1/2/4500":           http.StatusNotFound,
+	} {
+		if w := get(t, handler, url); w.Code != code {
+			t.Errorf("%s: status = %d, want %d", url, w.Code, code)
+		}
+	}
+}
+
+func TestClip(t *testing.T) {
+	handler, runner := newTestAPI(t, ApiConfig{}, testEpisode("eng", "first line", "second line"))
+
+	for _, tc := range []struct {
+		url         string
+		contentType string
+		audio       bool
+	}{
+		{"/clip/1/1/0/3000.mp4", "video/mp4", false},
+		{"/clip/1/1/0/3000.webm?audio=true", "video/webm", true},
+	} {
+		w := get(t, handler, tc.url)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body %q", tc.url, w.Code, w.Body)
+		}
+		if got := w.Header().Get("Content-Type"); got != tc.contentType {
+			t.Errorf("%s: Content-Type = %q, want %q", tc.url, got, tc.contentType)
+		}
+		calls := runner.Calls()
+		args := calls[len(calls)-1].Args
+		if audio := !slices.Contains(args, "-an"); audio != tc.audio {
+			t.Errorf("%s: audio = %v, want %v", tc.url, audio, tc.audio)
+		}
+	}
+
+	for _, url := range []string{
+		"/clip/1/1/0/3000.gif",
+		"/clip/1/1/0/3000",
+		"/clip/1/1/3000/0.mp4",
+		"/clip/1/1/0/60000.mp4",
+		"/clip/1/1/0/3000.mp4?audio=loud",
+	} {
+		if w := get(t, handler, url); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", url, w.Code, http.StatusBadRequest)
+		}
+	}
+	if w := get(t, handler, "/clip/1/2/0/3000.mp4"); w.Code != http.StatusNotFound {
+		t.Errorf("missing episode: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestMeme(t *testing.T) {
+	handler, runner := newTestAPI(t, ApiConfig{}, testEpisode("eng", "first line", "second line"))
+
+	for _, tc := range []struct {
+		name        string
+		url         string
+		contentType string
+		want        []string
+	}{
+		{"subtitle at timestamp", "/meme/1/1/2500.jpg", "image/jpeg", []string{"SECOND LINE"}},
+		{"between subtitles", "/meme/1/1/1500.png", "image/png", nil},
+		{"top only", "/meme/1/1/2500.jpg?top=hello", "image/jpeg", []string{`{\an8}HELLO`}},
+		{"top and bottom", "/meme/1/1/2500.jpg?top=hello&bottom=there", "image/jpeg", []string{`{\an8}HELLO`, "THERE"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := get(t, handler, tc.url)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %q", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); got != tc.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tc.contentType)
+			}
+			if got := srtTexts(runner.lastCaption(t)); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("captions = %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	for _, url := range []string{"/meme/1/1/2500.gif", "/meme/1/1/soon.jpg", "/meme/1/1/-1.jpg"} {
+		if w := get(t, handler, url); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", url, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestGifAnimationHeaders(t *testing.T) {
+	handler, _ := newTestAPI(t, ApiConfig{}, testEpisode("eng", "first line"))
+
+	w := get(t, handler, "/gif/1/1/0/1000.webp")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", w.Code, w.Body)
+	}
+	// Every render of the fake runner fits, so the best rung is kept
+	for header, want := range map[string]string{
+		"Content-Type":         "image/webp",
+		"X-Animation-Fps":      "source",
+		"X-Animation-Scale":    "1",
+		"X-Animation-Quality":  "75",
+		"X-Animation-Attempts": "3",
+		"X-Animation-Fits":     "true",
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	handler, runner := newTestAPI(t, ApiConfig{}, testEpisode("eng", "first line"))
+
+	for _, tc := range []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"invalid seek", &processor.FFmpegError{Args: []string{"ffmpeg"}, Kind: processor.FFmpegErrorInvalidSeek}, http.StatusBadRequest, ErrorCodeInvalidSeek},
+		{"missing codec", &processor.FFmpegError{Args: []string{"ffmpeg"}, ExitCode: 1, Kind: processor.FFmpegErrorMissingCodec}, http.StatusNotImplemented, ErrorCodeMissingCodec},
+		{"missing font", &processor.FFmpegError{Args: []string{"ffmpeg"}, ExitCode: 1, Kind: processor.FFmpegErrorMissingFont}, http.StatusInternalServerError, ErrorCodeMissingFont},
+		{"timeout", &processor.TimeoutError{Op: "clip", Timeout: time.Minute}, http.StatusGatewayTimeout, ErrorCodeTimeout},
+		{"unknown", &processor.FFmpegError{Args: []string{"ffmpeg"}, ExitCode: 1, Kind: processor.FFmpegErrorUnknown}, http.StatusInternalServerError, ErrorCodeRenderFailed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			runner.RunFunc = func(args []string) error {
+				return tc.err
+			}
+			w := get(t, handler, "/clip/1/1/0/1000.mp4")
+			if w.Code != tc.status {
+				t.Errorf("status = %d, want %d", w.Code, tc.status)
+			}
+			var body ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q: %v", w.Body, err)
+			}
+			if body.Code != tc.code || body.Error == "" {
+				t.Errorf("body = %+v, want code %q", body, tc.code)
+			}
+		})
+	}
+}
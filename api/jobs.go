@@ -0,0 +1,447 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jaym/clyper/objstore"
+	processor "github.com/jaym/clyper/processors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultJobsPrefix is where render jobs and their results are kept in
+	// the object store.
+	DefaultJobsPrefix = "jobs/"
+	// DefaultJobTTL is how long finished jobs are kept.
+	DefaultJobTTL = 24 * time.Hour
+)
+
+type JobsConfig struct {
+	// Prefix is the object store prefix jobs are kept under. Defaults to
+	// DefaultJobsPrefix.
+	Prefix string `mapstructure:"prefix"`
+	// TTL is how long finished jobs and their results are kept. Defaults
+	// to DefaultJobTTL.
+	TTL time.Duration `mapstructure:"ttl"`
+}
+
+type JobStatus string
+
+const (
+	JobQueued  JobStatus = "queued"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+// Job is a render submitted to POST /jobs.
+type Job struct {
+	ID     string    `json:"id"`
+	Status JobStatus `json:"status"`
+	// Progress is the fraction of the render that is done, from 0 to 1.
+	Progress float64 `json:"progress"`
+	// Error says why a failed job failed.
+	Error string `json:"error,omitempty"`
+	// ErrorCode is the code of the ErrorResponse the render would have
+	// failed with, or ErrorCodeInterrupted.
+	ErrorCode string        `json:"error_code,omitempty"`
+	Request   RenderRequest `json:"request"`
+	// Format is the extension of the result.
+	Format      string `json:"format"`
+	ContentType string `json:"content_type"`
+	// Headers are served along with the result, such as the X-Animation-*
+	// headers of GIFs.
+	Headers   http.Header `json:"headers,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+func (j *Job) finished() bool {
+	return j.Status == JobDone || j.Status == JobFailed
+}
+
+// jobStore keeps jobs in memory and persists them to the object store, a
+// job as <id>.json and its result as <id>.<format>. Progress is only kept
+// in memory. Jobs that were queued or running when the server stopped are
+// failed when it starts again.
+type jobStore struct {
+	store  objstore.ObjectStore
+	prefix string
+	ttl    time.Duration
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+func newJobStore(store objstore.ObjectStore, cfg JobsConfig) (*jobStore, error) {
+	s := &jobStore{
+		store:  store,
+		prefix: DefaultJobsPrefix,
+		ttl:    DefaultJobTTL,
+		jobs:   map[string]*Job{},
+	}
+	if cfg.Prefix != "" {
+		s.prefix = strings.TrimSuffix(cfg.Prefix, "/") + "/"
+	}
+	if cfg.TTL > 0 {
+		s.ttl = cfg.TTL
+	}
+
+	objects, err := store.List(s.prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, ".json") {
+			continue
+		}
+		job, err := s.load(object.Key)
+		if err != nil {
+			log.Warn().Err(err).Str("key", object.Key).Msg("Failed to load job")
+			continue
+		}
+		s.jobs[job.ID] = job
+
+		if !job.finished() {
+			job.Status = JobFailed
+			job.Error = "Interrupted by a server restart"
+			job.ErrorCode = ErrorCodeInterrupted
+			job.UpdatedAt = time.Now()
+			err = s.save(job)
+			if err != nil {
+				log.Warn().Err(err).Str("job", job.ID).Msg("Failed to save job")
+			}
+		}
+	}
+	s.sweep()
+	return s, nil
+}
+
+func (s *jobStore) load(key string) (*Job, error) {
+	obj, err := s.store.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	job := &Job{}
+	err = json.NewDecoder(obj).Decode(job)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// save persists job. It is called without mu held, on a copy of the job
+// once it is shared, so slow stores do not hold up other requests. The
+// updates of a job are made one after the other by the goroutine running
+// it, so they are saved in order.
+func (s *jobStore) save(job *Job) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(s.prefix+job.ID+".json", bytes.NewReader(b))
+}
+
+func (s *jobStore) resultKey(job *Job) string {
+	return s.prefix + job.ID + "." + job.Format
+}
+
+// Create adds a queued job for req and returns a copy of it.
+func (s *jobStore) Create(req RenderRequest, p *preparedRender) (Job, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return Job{}, err
+	}
+
+	now := time.Now()
+	job := &Job{
+		ID:          hex.EncodeToString(id),
+		Status:      JobQueued,
+		Request:     req,
+		Format:      p.key.Format,
+		ContentType: p.contentType,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	err = s.save(job)
+	if err != nil {
+		return Job{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = job
+	return *job, nil
+}
+
+// Get returns a copy of the job with id.
+func (s *jobStore) Get(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// update applies fn to the job with id and persists it.
+func (s *jobStore) update(id string, fn func(job *Job)) {
+	s.mu.Lock()
+	job, ok := s.jobs[id]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	fn(job)
+	job.UpdatedAt = time.Now()
+	updated := *job
+	s.mu.Unlock()
+
+	err := s.save(&updated)
+	if err != nil {
+		log.Warn().Err(err).Str("job", id).Msg("Failed to save job")
+	}
+}
+
+func (s *jobStore) SetProgress(id string, done float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job, ok := s.jobs[id]; ok {
+		job.Progress = done
+	}
+}
+
+func (s *jobStore) Start(id string) {
+	s.update(id, func(job *Job) {
+		job.Status = JobRunning
+	})
+}
+
+func (s *jobStore) Fail(id string, failure ErrorResponse) {
+	s.update(id, func(job *Job) {
+		job.Status = JobFailed
+		job.Error = failure.Error
+		job.ErrorCode = failure.Code
+	})
+}
+
+// Finish stores the result of the job with id and marks it done.
+func (s *jobStore) Finish(id string, result io.Reader, header http.Header) error {
+	job, ok := s.Get(id)
+	if !ok {
+		return objstore.ErrNotExist
+	}
+	err := s.store.Put(s.resultKey(&job), result)
+	if err != nil {
+		return err
+	}
+	s.update(id, func(job *Job) {
+		job.Status = JobDone
+		job.Progress = 1
+		job.Headers = header
+	})
+	return nil
+}
+
+// OpenResult returns the result of a done job.
+func (s *jobStore) OpenResult(job *Job) (io.ReadCloser, error) {
+	return s.store.Open(s.resultKey(job))
+}
+
+// Delete removes the job with id and its result.
+func (s *jobStore) Delete(id string) {
+	s.mu.Lock()
+	job, ok := s.jobs[id]
+	delete(s.jobs, id)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	for _, key := range []string{s.resultKey(job), s.prefix + job.ID + ".json"} {
+		err := s.store.Delete(key)
+		if err != nil {
+			log.Warn().Err(err).Str("key", key).Msg("Failed to delete job")
+		}
+	}
+}
+
+// sweep deletes the jobs that finished more than ttl ago.
+func (s *jobStore) sweep() {
+	var expired []string
+	s.mu.Lock()
+	for id, job := range s.jobs {
+		if job.finished() && time.Since(job.UpdatedAt) > s.ttl {
+			expired = append(expired, id)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, id := range expired {
+		s.Delete(id)
+	}
+}
+
+// createJobHandler submits the render described by the RenderRequest in
+// the request body. It responds with a 202 and the queued job, whose status
+// can be polled at the URL in the Location header.
+func (h *ApiHandler) createJobHandler(w http.ResponseWriter, r *http.Request) {
+	var req RenderRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid job", http.StatusBadRequest)
+		return
+	}
+	p, err := h.prepareRender(r.Context(), req)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	h.jobs.sweep()
+
+	job, err := h.jobs.Create(req, p)
+	if err != nil {
+		http.Error(w, "Failed to create job", http.StatusInternalServerError)
+		return
+	}
+
+	if obj, header, ok := h.openCachedRender(p.key.hash()); ok {
+		go h.finishCachedJob(job.ID, obj, header)
+	} else {
+		waiter, err := h.queue.enqueue(h.queue.client(r))
+		if err != nil {
+			h.jobs.Delete(job.ID)
+			writeQueueError(w, h.queue, err)
+			return
+		}
+		go h.runJob(job.ID, p, waiter)
+	}
+
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJob(w, http.StatusAccepted, &job)
+}
+
+// runJob renders a job once its turn in the render queue comes.
+func (h *ApiHandler) runJob(id string, p *preparedRender, waiter *renderWaiter) {
+	// Jobs outlive the request that submitted them
+	ctx := h.ctx
+	release, err := h.queue.wait(ctx, waiter)
+	if err != nil {
+		h.jobs.Fail(id, ErrorResponse{Error: "Interrupted by the server shutting down", Code: ErrorCodeInterrupted})
+		return
+	}
+	defer release()
+	h.jobs.Start(id)
+
+	outputDir, err := os.MkdirTemp("", "clyper")
+	if err != nil {
+		log.Error().Err(err).Str("job", id).Msg("Failed to create temp dir")
+		h.jobs.Fail(id, ErrorResponse{Error: "Failed to create " + p.key.Kind, Code: ErrorCodeRenderFailed})
+		return
+	}
+	defer os.RemoveAll(outputDir)
+
+	ctx = processor.WithProgress(ctx, func(done float64) {
+		h.jobs.SetProgress(id, done)
+	})
+	outputFile, header, err := h.runRender(ctx, p, outputDir)
+	if h.ctx.Err() != nil {
+		h.jobs.Fail(id, ErrorResponse{Error: "Interrupted by the server shutting down", Code: ErrorCodeInterrupted})
+		return
+	}
+	if err != nil {
+		logRenderError(err).Str("job", id).Msg("Failed to render job")
+		_, failure := renderFailure(p, err)
+		h.jobs.Fail(id, failure)
+		return
+	}
+	// Free the worker before the render is uploaded
+	release()
+
+	h.cacheRender(p.key.hash(), p.key.Format, outputFile, header)
+
+	output, err := os.Open(outputFile)
+	if err != nil {
+		log.Error().Err(err).Str("job", id).Msg("Failed to read render")
+		h.jobs.Fail(id, ErrorResponse{Error: "Failed to read " + p.key.Kind, Code: ErrorCodeRenderFailed})
+		return
+	}
+	defer output.Close()
+	h.finishJob(id, output, header)
+}
+
+// finishCachedJob finishes a job with a render from the render cache.
+func (h *ApiHandler) finishCachedJob(id string, obj io.ReadCloser, header http.Header) {
+	defer obj.Close()
+	h.finishJob(id, obj, header)
+}
+
+func (h *ApiHandler) finishJob(id string, result io.Reader, header http.Header) {
+	err := h.jobs.Finish(id, result, header)
+	if err != nil {
+		log.Error().Err(err).Str("job", id).Msg("Failed to store job result")
+		h.jobs.Fail(id, ErrorResponse{Error: "Failed to store result", Code: ErrorCodeRenderFailed})
+	}
+}
+
+func (h *ApiHandler) jobHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.jobs.Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	writeJob(w, http.StatusOK, &job)
+}
+
+func (h *ApiHandler) jobResultHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.jobs.Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	switch job.Status {
+	case JobFailed:
+		http.Error(w, "Job failed", http.StatusConflict)
+		return
+	case JobQueued, JobRunning:
+		http.Error(w, "Job not done", http.StatusConflict)
+		return
+	}
+
+	result, err := h.jobs.OpenResult(&job)
+	if errors.Is(err, objstore.ErrNotExist) {
+		http.Error(w, "Job result not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read job result", http.StatusInternalServerError)
+		return
+	}
+	defer result.Close()
+
+	for name, values := range job.Headers {
+		w.Header()[name] = values
+	}
+	serveRenderContent(w, r, job.ContentType, result)
+}
+
+func writeJob(w http.ResponseWriter, status int, job *Job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(job)
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jaym/clyper/objstore"
+	processor "github.com/jaym/clyper/processors"
+)
+
+func postJob(t *testing.T, handler http.Handler, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(body)))
+	return w
+}
+
+// waitForJob polls the job at url until it is finished.
+func waitForJob(t *testing.T, handler http.Handler, url string) Job {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := get(t, handler, url)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: status = %d, body %q", url, w.Code, w.Body)
+		}
+		var job Job
+		if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+			t.Fatal(err)
+		}
+		if job.finished() {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job is still %s", job.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJobs(t *testing.T) {
+	handler, _ := newTestAPI(t, ApiConfig{RenderCache: &RenderCacheConfig{}}, testEpisode("eng", "first line"))
+
+	for _, cached := range []bool{false, true} {
+		w := postJob(t, handler, `{"kind": "gif", "season": 1, "episode": 1, "start": 0, "end": 1000, "format": "webp", "text": "hi"}`)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("status = %d, body %q", w.Code, w.Body)
+		}
+		location := w.Header().Get("Location")
+		if !strings.HasPrefix(location, "/jobs/") {
+			t.Fatalf("Location = %q", location)
+		}
+
+		job := waitForJob(t, handler, location)
+		if job.Status != JobDone || job.Progress != 1 || job.Format != "webp" {
+			t.Fatalf("cached %v: job = %+v, want it done", cached, job)
+		}
+
+		w = get(t, handler, location+"/result")
+		if w.Code != http.StatusOK {
+			t.Fatalf("cached %v: result status = %d, body %q", cached, w.Code, w.Body)
+		}
+		if got := w.Header().Get("Content-Type"); got != "image/webp" {
+			t.Errorf("cached %v: Content-Type = %q, want image/webp", cached, got)
+		}
+		if w.Header().Get("X-Animation-Fits") != "true" {
+			t.Errorf("cached %v: result is served without the animation headers", cached)
+		}
+		if w.Body.String() != "render" {
+			t.Errorf("cached %v: result = %q, want the render", cached, w.Body)
+		}
+	}
+
+	for body, code := range map[string]int{
+		`not json`: http.StatusBadRequest,
+		`{"kind": "video", "season": 1, "episode": 1}`:                        http.StatusBadRequest,
+		`{"kind": "gif", "season": 1, "episode": 1, "start": 2000, "end": 0}`: http.StatusBadRequest,
+		`{"kind": "gif", "season": 1, "episode": 2, "start": 0, "end": 1000}`: http.StatusNotFound,
+	} {
+		if w := postJob(t, handler, body); w.Code != code {
+			t.Errorf("%s: status = %d, want %d", body, w.Code, code)
+		}
+	}
+	if w := get(t, handler, "/jobs/missing"); w.Code != http.StatusNotFound {
+		t.Errorf("missing job: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestJobFailed(t *testing.T) {
+	handler, runner := newTestAPI(t, ApiConfig{}, testEpisode("eng", "first line"))
+	runner.RunFunc = func(args []string) error {
+		return errors.New("ffmpeg crashed")
+	}
+
+	w := postJob(t, handler, `{"kind": "clip", "season": 1, "episode": 1, "start": 0, "end": 1000, "format": "mp4"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, body %q", w.Code, w.Body)
+	}
+	location := w.Header().Get("Location")
+	job := waitForJob(t, handler, location)
+	if job.Status != JobFailed || job.ErrorCode != ErrorCodeRenderFailed {
+		t.Errorf("job = %+v, want it failed", job)
+	}
+	if w := get(t, handler, location+"/result"); w.Code != http.StatusConflict {
+		t.Errorf("result of a failed job: status = %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestJobsInterrupted(t *testing.T) {
+	requireFTS5(t)
+	store := objstore.NewLocalFSObjectStore(t.TempDir())
+	db := newTestDatabase(t, store, testEpisode("eng", "first line"))
+
+	// Renders run until the test lets them finish
+	finish := make(chan struct{})
+	runner := &processor.FakeRunner{RunFunc: func(args []string) error {
+		<-finish
+		return writeRenderOutputs(args)
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := NewApiHandler(db, store, ApiConfig{Runner: runner, Context: ctx, RenderQueue: RenderQueueConfig{Workers: 1}})
+
+	var locations []string
+	for range 2 {
+		w := postJob(t, handler, `{"kind": "still", "season": 1, "episode": 1, "start": 500, "format": "jpg"}`)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("status = %d, body %q", w.Code, w.Body)
+		}
+		locations = append(locations, w.Header().Get("Location"))
+	}
+	// Restarting fails jobs that did not finish
+	restarted := NewApiHandler(db, store, ApiConfig{Runner: runner})
+	for _, location := range locations {
+		job := waitForJob(t, restarted, location)
+		if job.Status != JobFailed || job.ErrorCode != ErrorCodeInterrupted {
+			t.Errorf("after a restart job = %+v, want it interrupted", job)
+		}
+	}
+
+	// Shutting down interrupts the running job and the one waiting for it
+	cancel()
+	close(finish)
+	for _, location := range locations {
+		job := waitForJob(t, handler, location)
+		if job.Status != JobFailed || job.ErrorCode != ErrorCodeInterrupted {
+			t.Errorf("after shutting down job = %+v, want it interrupted", job)
+		}
+	}
+}
+
+// blockingPutStore is an object store whose writes wait for release once
+// block is set.
+type blockingPutStore struct {
+	*objstore.LocalFSObjectStore
+	block   atomic.Bool
+	putting chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingPutStore) Put(key string, r io.Reader) error {
+	if s.block.Load() {
+		s.putting <- struct{}{}
+		<-s.release
+	}
+	return s.LocalFSObjectStore.Put(key, r)
+}
+
+func TestJobStoreSavesUnlocked(t *testing.T) {
+	store := &blockingPutStore{
+		LocalFSObjectStore: objstore.NewLocalFSObjectStore(t.TempDir()),
+		putting:            make(chan struct{}),
+		release:            make(chan struct{}),
+	}
+	jobs, err := newJobStore(store, JobsConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := jobs.Create(RenderRequest{Kind: "gif"}, &preparedRender{key: renderKey{Format: "gif"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.block.Store(true)
+	started := make(chan struct{})
+	go func() {
+		defer close(started)
+		jobs.Start(job.ID)
+	}()
+	<-store.putting
+
+	// The job can be read and make progress while it is being saved
+	read := make(chan Job)
+	go func() {
+		jobs.SetProgress(job.ID, 0.5)
+		got, _ := jobs.Get(job.ID)
+		read <- got
+	}()
+	select {
+	case got := <-read:
+		if got.Status != JobRunning || got.Progress != 0.5 {
+			t.Errorf("job = %+v, want it running and half done", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get waited for the job to be saved")
+	}
+	close(store.release)
+	<-started
+
+	saved, err := jobs.load(DefaultJobsPrefix + job.ID + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Status != JobRunning {
+		t.Errorf("saved status = %s, want %s", saved.Status, JobRunning)
+	}
+}
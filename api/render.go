@@ -0,0 +1,625 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaym/clyper/objstore"
+	processor "github.com/jaym/clyper/processors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultRenderTimeout is how long the server lets a render take.
+const DefaultRenderTimeout = 2 * time.Minute
+
+// RenderRequest describes a GIF, clip or still. It is what POST /jobs
+// takes, and what the /gif, /clip and /meme routes parse their path and
+// query into.
+type RenderRequest struct {
+	// Kind is gif, clip or still.
+	Kind string `json:"kind"`
+	// Show defaults to the default show.
+	Show    string `json:"show,omitempty"`
+	Season  int    `json:"season"`
+	Episode int    `json:"episode"`
+	// Start and End are in milliseconds. Stills are taken at Start.
+	Start int `json:"start"`
+	End   int `json:"end,omitempty"`
+	// Format is the extension of the output: gif (the default), webp or
+	// apng for GIFs, mp4 or webm for clips and jpg or png for stills.
+	Format string `json:"format,omitempty"`
+	// Language is the language of the subtitles captions are taken from.
+	Language string `json:"lang,omitempty"`
+	// Text captions the whole GIF or clip.
+	Text *string `json:"text,omitempty"`
+	// Captions captions a GIF or clip without Text with its subtitles:
+	// CaptionsStatic shows them all for the whole clip and CaptionsTimed
+	// each as it is spoken. Empty leaves it uncaptioned.
+	Captions string `json:"captions,omitempty"`
+	// Cues replaces the text of subtitles, keyed by their index among the
+	// subtitles of the GIF or clip. An empty text hides the subtitle.
+	Cues map[int]string `json:"cues,omitempty"`
+	// Audio keeps the sound of clips.
+	Audio bool `json:"audio,omitempty"`
+	// Top and Bottom caption stills. Without either, stills are captioned
+	// with the subtitle spoken at Start.
+	Top    *string `json:"top,omitempty"`
+	Bottom *string `json:"bottom,omitempty"`
+}
+
+// Caption modes of a RenderRequest.
+const (
+	CaptionsNone   = ""
+	CaptionsStatic = "static"
+	CaptionsTimed  = "timed"
+)
+
+// requestError is an error with the response it should be reported with.
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+func badRequest(message string) error {
+	return &requestError{status: http.StatusBadRequest, message: message}
+}
+
+// writeRequestError writes the response for an error returned by
+// prepareRender.
+func writeRequestError(w http.ResponseWriter, err error) {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		http.Error(w, reqErr.message, reqErr.status)
+		return
+	}
+	http.Error(w, "Failed to prepare render", http.StatusInternalServerError)
+}
+
+// preparedRender is a validated RenderRequest, ready to be rendered once
+// there is a worker for it.
+type preparedRender struct {
+	key         renderKey
+	contentType string
+	// render writes the output to outputFile and returns any headers to
+	// serve it with, and must stop when ctx is done.
+	render func(ctx context.Context, videoFilePath string, outputFile string) (http.Header, error)
+}
+
+// prepareRender validates req and looks up the video and captions it
+// needs. Errors are *requestError for invalid or unknown requests.
+func (h *ApiHandler) prepareRender(ctx context.Context, req RenderRequest) (*preparedRender, error) {
+	if req.Show == "" {
+		req.Show = h.defaultShow
+	}
+	if req.Language == "" {
+		req.Language = h.defaultLanguage
+	}
+
+	switch req.Kind {
+	case "gif":
+		return h.prepareAnimation(ctx, req)
+	case "clip":
+		return h.prepareClip(ctx, req)
+	case "still":
+		return h.prepareStill(ctx, req)
+	default:
+		return nil, badRequest("Invalid kind")
+	}
+}
+
+func (h *ApiHandler) prepareAnimation(ctx context.Context, req RenderRequest) (*preparedRender, error) {
+	format, err := processor.ParseAnimationFormat(req.Format)
+	if err != nil {
+		return nil, badRequest("Invalid format")
+	}
+	if req.Start < 0 || req.End < req.Start || req.End-req.Start > processor.MaxGifDurationMS {
+		return nil, badRequest("Invalid time range")
+	}
+
+	captionLines, captions, err := h.captions(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	videoFileKey, source, err := h.sourceVideo(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := h.gifOptions
+	opts.Format = format
+	opts.Text = captionLines
+	opts.Captions = captions
+	opts.Timeout = h.renderTimeout
+	opts.Runner = h.runner
+
+	return &preparedRender{
+		key:         renderKey{Kind: "gif", Video: videoFileKey, Source: source, Start: req.Start, End: req.End, Format: string(format), Options: opts},
+		contentType: format.ContentType(),
+		render: func(ctx context.Context, videoFilePath string, outputFile string) (http.Header, error) {
+			result, err := processor.MakeAnimation(ctx, videoFilePath, outputFile, req.Start, req.End, opts)
+			if err != nil {
+				return nil, err
+			}
+			header := http.Header{}
+			setAnimationHeaders(header, result)
+			return header, nil
+		},
+	}, nil
+}
+
+func (h *ApiHandler) prepareClip(ctx context.Context, req RenderRequest) (*preparedRender, error) {
+	format, err := processor.ParseClipFormat(req.Format)
+	if err != nil {
+		return nil, badRequest("Invalid format")
+	}
+	if req.Start < 0 || req.End < req.Start || req.End-req.Start > processor.MaxClipDurationMS {
+		return nil, badRequest("Invalid time range")
+	}
+
+	captionLines, captions, err := h.captions(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	videoFileKey, source, err := h.sourceVideo(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := processor.ClipOptions{
+		Format:    format,
+		Audio:     req.Audio,
+		Text:      captionLines,
+		Captions:  captions,
+		FontName:  h.gifOptions.FontName,
+		FontColor: h.gifOptions.FontColor,
+		FontsDir:  h.gifOptions.FontsDir,
+		Timeout:   h.renderTimeout,
+		Runner:    h.runner,
+	}
+
+	return &preparedRender{
+		key:         renderKey{Kind: "clip", Video: videoFileKey, Source: source, Start: req.Start, End: req.End, Format: string(format), Options: opts},
+		contentType: format.ContentType(),
+		render: func(ctx context.Context, videoFilePath string, outputFile string) (http.Header, error) {
+			return nil, processor.MakeClip(ctx, videoFilePath, outputFile, req.Start, req.End, opts)
+		},
+	}, nil
+}
+
+func (h *ApiHandler) prepareStill(ctx context.Context, req RenderRequest) (*preparedRender, error) {
+	format, err := processor.ParseStillFormat(req.Format)
+	if err != nil {
+		return nil, badRequest("Invalid format")
+	}
+	timestamp := req.Start
+	if timestamp < 0 {
+		return nil, badRequest("Invalid timestamp")
+	}
+
+	var top, bottom string
+	if req.Top != nil {
+		top = *req.Top
+	}
+	if req.Bottom != nil {
+		bottom = *req.Bottom
+	}
+	if req.Top == nil && req.Bottom == nil {
+		// Caption with the subtitle spoken at timestamp
+		subtitles, err := h.db.ListSubtitles(ctx, req.Show, req.Season, req.Episode, req.Language, timestamp, timestamp+1)
+		if err != nil {
+			return nil, &requestError{status: http.StatusInternalServerError, message: "Failed to list subtitles"}
+		}
+		lines := make([]string, 0, len(subtitles))
+		for _, subtitle := range subtitles {
+			lines = append(lines, subtitle.Text)
+		}
+		bottom = strings.Join(lines, "\n")
+	}
+
+	videoFileKey, source, err := h.sourceVideo(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := processor.StillOptions{
+		Format:     format,
+		TopText:    top,
+		BottomText: bottom,
+		FontName:   h.gifOptions.FontName,
+		FontColor:  h.gifOptions.FontColor,
+		FontsDir:   h.gifOptions.FontsDir,
+		Timeout:    h.renderTimeout,
+		Runner:     h.runner,
+	}
+
+	return &preparedRender{
+		key:         renderKey{Kind: "image", Video: videoFileKey, Source: source, Start: timestamp, End: timestamp, Format: string(format), Options: opts},
+		contentType: format.ContentType(),
+		render: func(ctx context.Context, videoFilePath string, outputFile string) (http.Header, error) {
+			return nil, processor.MakeStill(ctx, videoFilePath, outputFile, timestamp, opts)
+		},
+	}, nil
+}
+
+// sourceVideo returns the key of the video of req, and a version of it
+// that changes whenever the video is written again.
+func (h *ApiHandler) sourceVideo(ctx context.Context, req RenderRequest) (string, string, error) {
+	videoFileKey, err := h.db.GetVideoFileKey(ctx, req.Show, req.Season, req.Episode)
+	if err != nil {
+		return "", "", &requestError{status: http.StatusNotFound, message: "not found"}
+	}
+	info, err := h.store.Stat(videoFileKey)
+	if errors.Is(err, objstore.ErrNotExist) {
+		return "", "", &requestError{status: http.StatusNotFound, message: "Video not found"}
+	}
+	if err != nil {
+		return "", "", &requestError{status: http.StatusInternalServerError, message: "Failed to read video"}
+	}
+	return videoFileKey, fmt.Sprintf("%d-%d", info.Size, info.ModTime.UnixNano()), nil
+}
+
+// captions returns the captions of a GIF or clip. Text is shown for the
+// whole clip, otherwise the clip is captioned with its subtitles if
+// req.Captions asks for them.
+func (h *ApiHandler) captions(ctx context.Context, req RenderRequest) (string, []processor.Caption, error) {
+	if req.Text != nil {
+		return *req.Text, nil, nil
+	}
+	switch req.Captions {
+	case CaptionsNone:
+		return "", nil, nil
+	case CaptionsStatic, CaptionsTimed:
+	default:
+		return "", nil, badRequest("Invalid captions")
+	}
+	for index := range req.Cues {
+		if index < 0 {
+			return "", nil, badRequest("Invalid caption")
+		}
+	}
+
+	// Caption with the subtitles spoken during the clip
+	subtitles, err := h.db.ListSubtitles(ctx, req.Show, req.Season, req.Episode, req.Language, req.Start, req.End)
+	if err != nil {
+		return "", nil, &requestError{status: http.StatusInternalServerError, message: "Failed to list subtitles"}
+	}
+	for i := range subtitles {
+		if text, ok := req.Cues[i]; ok {
+			subtitles[i].Text = text
+		}
+	}
+
+	if req.Captions == CaptionsStatic {
+		lines := make([]string, 0, len(subtitles))
+		for _, subtitle := range subtitles {
+			// Subtitles hidden by an override leave no blank line
+			if strings.TrimSpace(subtitle.Text) != "" {
+				lines = append(lines, subtitle.Text)
+			}
+		}
+		return strings.Join(lines, "\n"), nil, nil
+	}
+
+	// Show every subtitle when it is spoken, relative to the start of the
+	// clip
+	captions := make([]processor.Caption, 0, len(subtitles))
+	for _, subtitle := range subtitles {
+		captions = append(captions, processor.Caption{
+			Start: max(subtitle.Start, req.Start) - req.Start,
+			End:   min(subtitle.End, req.End) - req.Start,
+			Text:  subtitle.Text,
+		})
+	}
+	return "", captions, nil
+}
+
+// parseCaptionParams reads the caption query parameters of the /gif and
+// /clip routes into req. b64lines or text caption the whole clip,
+// captions=static shows all the subtitles for the whole clip and
+// captions=timed each as it is spoken. Without any, the clip is not
+// captioned.
+func parseCaptionParams(params url.Values, req *RenderRequest) error {
+	if b64Lines := params.Get("b64lines"); b64Lines != "" {
+		captionBytes, err := base64.StdEncoding.DecodeString(b64Lines)
+		if err != nil {
+			return err
+		}
+		text := string(captionBytes)
+		req.Text = &text
+	} else if params.Has("text") {
+		text := params.Get("text")
+		req.Text = &text
+	}
+	req.Captions = params.Get("captions")
+
+	cues, err := captionOverrides(params)
+	if err != nil {
+		return err
+	}
+	req.Cues = cues
+	return nil
+}
+
+// captionOverrides returns the caption text passed for individual
+// subtitles of a GIF, keyed by their index among the subtitles of the clip.
+// cue.N sets the text of the Nth subtitle, b64cue.N sets it base64 encoded.
+// An empty text hides the subtitle.
+func captionOverrides(params url.Values) (map[int]string, error) {
+	overrides := map[int]string{}
+	for name, values := range params {
+		prefix, indexStr, found := strings.Cut(name, ".")
+		if !found || (prefix != "cue" && prefix != "b64cue") {
+			continue
+		}
+		index, err := strconv.Atoi(indexStr)
+		if err != nil || index < 0 {
+			return nil, fmt.Errorf("invalid %s", name)
+		}
+		text := values[0]
+		if prefix == "b64cue" {
+			decoded, err := base64.StdEncoding.DecodeString(text)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s", name)
+			}
+			text = string(decoded)
+		}
+		overrides[index] = text
+	}
+	return overrides, nil
+}
+
+// serveRender serves a prepared render. Requests for a render the client
+// already has get a 304, renders in the render cache are served from it,
+// and anything else is rendered once the render queue has a worker for it.
+func (h *ApiHandler) serveRender(w http.ResponseWriter, r *http.Request, p *preparedRender) {
+	hash := p.key.hash()
+	etag := `"` + hash + `"`
+	setCacheHeaders := func() {
+		w.Header().Set("ETag", etag)
+		// Cache renders for 1 day
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+	}
+	if etagMatches(r, etag) {
+		setCacheHeaders()
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if obj, header, ok := h.openCachedRender(hash); ok {
+		defer obj.Close()
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		setCacheHeaders()
+		w.Header().Set("X-Render-Cache", "hit")
+		serveRenderContent(w, r, p.contentType, obj)
+		return
+	}
+
+	release, err := h.queue.Acquire(r.Context(), h.queue.client(r))
+	if errors.Is(err, ErrTooManyRenders) || errors.Is(err, ErrRenderQueueFull) {
+		writeQueueError(w, h.queue, err)
+		return
+	}
+	if err != nil {
+		// The client went away while waiting
+		return
+	}
+	defer release()
+
+	outputDir, err := os.MkdirTemp("", "clyper")
+	if err != nil {
+		http.Error(w, "Failed to create temp dir", http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(outputDir)
+
+	outputFile, header, err := h.runRender(r.Context(), p, outputDir)
+	if r.Context().Err() != nil {
+		// The client went away and ffmpeg was stopped
+		return
+	}
+	if err != nil {
+		logRenderError(err).Str("hash", hash).Msg("Failed to render")
+		status, body := renderFailure(p, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body) // nolint: errcheck
+		return
+	}
+	// Free the worker before the render is uploaded and served
+	release()
+
+	h.cacheRender(hash, p.key.Format, outputFile, header)
+
+	output, err := os.Open(outputFile)
+	if err != nil {
+		http.Error(w, "Failed to read "+p.key.Kind, http.StatusInternalServerError)
+		return
+	}
+	defer output.Close()
+
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	setCacheHeaders()
+	w.Header().Set("X-Render-Cache", "miss")
+	serveRenderContent(w, r, p.contentType, output)
+}
+
+// Codes of the ErrorResponse of a failed render.
+const (
+	ErrorCodeTimeout      = "timeout"
+	ErrorCodeInvalidSeek  = "invalid_seek"
+	ErrorCodeMissingCodec = "missing_codec"
+	ErrorCodeMissingFont  = "missing_font"
+	ErrorCodeRenderFailed = "render_failed"
+	// ErrorCodeInterrupted is the code of jobs stopped by the server
+	// shutting down.
+	ErrorCodeInterrupted = "interrupted"
+)
+
+// ErrorResponse is the body of a failed render.
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// renderFailure returns the status and body p failing with err is reported
+// with.
+func renderFailure(p *preparedRender, err error) (int, ErrorResponse) {
+	if errors.As(err, new(*processor.TimeoutError)) {
+		return http.StatusGatewayTimeout, ErrorResponse{
+			Error: "Timed out creating " + p.key.Kind,
+			Code:  ErrorCodeTimeout,
+		}
+	}
+
+	var ffmpegErr *processor.FFmpegError
+	if errors.As(err, &ffmpegErr) {
+		switch ffmpegErr.Kind {
+		case processor.FFmpegErrorInvalidSeek:
+			return http.StatusBadRequest, ErrorResponse{
+				Error: "Time is outside the video",
+				Code:  ErrorCodeInvalidSeek,
+			}
+		case processor.FFmpegErrorMissingCodec:
+			return http.StatusNotImplemented, ErrorResponse{
+				Error: "Server cannot encode " + p.key.Format,
+				Code:  ErrorCodeMissingCodec,
+			}
+		case processor.FFmpegErrorMissingFont:
+			return http.StatusInternalServerError, ErrorResponse{
+				Error: "Caption font not available",
+				Code:  ErrorCodeMissingFont,
+			}
+		}
+	}
+	return http.StatusInternalServerError, ErrorResponse{
+		Error: "Failed to create " + p.key.Kind,
+		Code:  ErrorCodeRenderFailed,
+	}
+}
+
+// logRenderError starts an error log for a failed render, with the end of
+// ffmpeg's stderr if it was ffmpeg that failed.
+func logRenderError(err error) *zerolog.Event {
+	event := log.Error().Err(err)
+	var ffmpegErr *processor.FFmpegError
+	if errors.As(err, &ffmpegErr) {
+		event = event.Str("kind", string(ffmpegErr.Kind)).Str("stderr", ffmpegErr.Stderr)
+	}
+	return event
+}
+
+// runRender renders p into outputDir and returns the path of the output.
+func (h *ApiHandler) runRender(ctx context.Context, p *preparedRender, outputDir string) (string, http.Header, error) {
+	videoFilePath, err := h.locateVideo(p.key.Video, outputDir)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read video: %v", err)
+	}
+
+	outputFile := path.Join(outputDir, "output."+p.key.Format)
+	header, err := p.render(ctx, videoFilePath, outputFile)
+	if err != nil {
+		return "", nil, err
+	}
+	return outputFile, header, nil
+}
+
+// openCachedRender returns the render of hash from the render cache, if it
+// is there.
+func (h *ApiHandler) openCachedRender(hash string) (io.ReadCloser, http.Header, bool) {
+	if h.cache == nil {
+		return nil, nil, false
+	}
+	obj, header, err := h.cache.Open(hash)
+	if err != nil {
+		if !errors.Is(err, objstore.ErrNotExist) {
+			log.Warn().Err(err).Str("hash", hash).Msg("Failed to read cached render")
+		}
+		return nil, nil, false
+	}
+	return obj, header, true
+}
+
+func (h *ApiHandler) cacheRender(hash string, ext string, outputFile string, header http.Header) {
+	if h.cache == nil {
+		return
+	}
+	err := h.cache.Put(hash, ext, outputFile, header)
+	if err != nil {
+		log.Warn().Err(err).Str("hash", hash).Msg("Failed to cache render")
+	}
+}
+
+// writeQueueError writes the response for a render the queue turned away.
+func writeQueueError(w http.ResponseWriter, queue *renderQueue, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(queue.RetryAfter()))
+	if errors.Is(err, ErrTooManyRenders) {
+		http.Error(w, "Too many renders, try again later", http.StatusTooManyRequests)
+		return
+	}
+	http.Error(w, "Server busy, try again later", http.StatusServiceUnavailable)
+}
+
+// serveRenderContent writes a render. Seekable renders are served with
+// http.ServeContent, which handles the range requests browsers use to play
+// video.
+func serveRenderContent(w http.ResponseWriter, r *http.Request, contentType string, content io.Reader) {
+	w.Header().Set("Content-Type", contentType)
+	if seeker, ok := content.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", time.Time{}, seeker)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, content)
+}
+
+// setAnimationHeaders reports the parameters MakeAnimation chose to meet
+// the desired max size.
+func setAnimationHeaders(header http.Header, result *processor.AnimationResult) {
+	fps := "source"
+	if result.Params.FPS > 0 {
+		fps = strconv.Itoa(result.Params.FPS)
+	}
+	header.Set("X-Animation-Fps", fps)
+	header.Set("X-Animation-Scale", strconv.FormatFloat(result.Params.Scale, 'f', -1, 64))
+	header.Set("X-Animation-Colors", strconv.Itoa(result.Params.Colors))
+	header.Set("X-Animation-Dither", result.Params.Dither)
+	header.Set("X-Animation-Quality", strconv.Itoa(result.Params.Quality))
+	header.Set("X-Animation-Attempts", strconv.Itoa(result.Attempts))
+	header.Set("X-Animation-Fits", strconv.FormatBool(result.Fits))
+}
+
+// locateVideo returns a path or URL ffmpeg can read the video at key from.
+// Stores that cannot hand one out have the video copied into workDir.
+func (h *ApiHandler) locateVideo(key string, workDir string) (string, error) {
+	if locator, ok := h.store.(objstore.Locator); ok {
+		return locator.Locate(key)
+	}
+
+	videoFilePath := path.Join(workDir, path.Base(key))
+	err := objstore.Fetch(h.store, key, videoFilePath)
+	if err != nil {
+		return "", err
+	}
+	return videoFilePath, nil
+}
@@ -0,0 +1,268 @@
+package api
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jaym/clyper/objstore"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultRenderCachePrefix is where rendered GIFs, clips and stills are
+	// cached in the object store.
+	DefaultRenderCachePrefix = "cache/renders/"
+	// DefaultRenderCacheSize is the default size of the render cache in
+	// bytes.
+	DefaultRenderCacheSize = 1024 * 1024 * 1024
+)
+
+type RenderCacheConfig struct {
+	// Prefix is the object store prefix renders are cached under. Defaults
+	// to DefaultRenderCachePrefix.
+	Prefix string `mapstructure:"prefix"`
+	// MaxSize is the size in bytes the cache is kept under by evicting the
+	// least recently used renders. Defaults to DefaultRenderCacheSize.
+	MaxSize int64 `mapstructure:"max_size"`
+}
+
+// renderVersion is part of every render key. Bump it when a change to the
+// renderers changes their output, so stale renders are not served.
+const renderVersion = 1
+
+// renderKey identifies a render by everything that goes into it. Renders
+// with equal keys are interchangeable, so the hash of the key is both the
+// cache key and the ETag.
+type renderKey struct {
+	Version int    `json:"version"`
+	Kind    string `json:"kind"`
+	Video   string `json:"video"`
+	// Source changes when the video is written again, such as when the
+	// episode is preprocessed again, which keeps its key.
+	Source  string `json:"source"`
+	Start   int    `json:"start"`
+	End     int    `json:"end"`
+	Format  string `json:"format"`
+	Options any    `json:"options"`
+}
+
+func (k renderKey) hash() string {
+	k.Version = renderVersion
+	b, _ := json.Marshal(k)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// renderCacheEntry is a cached render, its object is <hash>.<ext> and the
+// response headers it was served with are in <hash>.json.
+type renderCacheEntry struct {
+	hash string
+	ext  string
+	size int64
+}
+
+// renderCache caches renders in the object store, evicting the least
+// recently used once they add up to more than maxSize. Recency is tracked
+// in memory, and seeded from the modification times of the cached objects
+// when the server starts.
+type renderCache struct {
+	store   objstore.ObjectStore
+	prefix  string
+	maxSize int64
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+}
+
+func newRenderCache(store objstore.ObjectStore, cfg RenderCacheConfig) (*renderCache, error) {
+	c := &renderCache{
+		store:   store,
+		prefix:  DefaultRenderCachePrefix,
+		maxSize: DefaultRenderCacheSize,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+	if cfg.Prefix != "" {
+		c.prefix = strings.TrimSuffix(cfg.Prefix, "/") + "/"
+	}
+	if cfg.MaxSize > 0 {
+		c.maxSize = cfg.MaxSize
+	}
+
+	objects, err := store.List(c.prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(objects, func(i, j int) bool {
+		return objects[i].ModTime.Before(objects[j].ModTime)
+	})
+
+	sizes := map[string]int64{}
+	exts := map[string]string{}
+	for _, object := range objects {
+		name := path.Base(object.Key)
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		hash, ext, _ := strings.Cut(name, ".")
+		sizes[hash] += object.Size
+		if ext != "json" {
+			exts[hash] = ext
+		}
+	}
+	for _, object := range objects {
+		hash, _, _ := strings.Cut(path.Base(object.Key), ".")
+		ext, ok := exts[hash]
+		if _, seen := c.entries[hash]; seen || !ok {
+			continue
+		}
+		c.entries[hash] = c.lru.PushFront(&renderCacheEntry{hash: hash, ext: ext, size: sizes[hash]})
+		c.size += sizes[hash]
+	}
+	c.deleteObjects(c.evict())
+	return c, nil
+}
+
+func (c *renderCache) objectKey(hash string, ext string) string {
+	return c.prefix + hash + "." + ext
+}
+
+// Open returns the cached render of hash and the headers it was served
+// with, or objstore.ErrNotExist.
+func (c *renderCache) Open(hash string) (io.ReadCloser, http.Header, error) {
+	c.mu.Lock()
+	element, ok := c.entries[hash]
+	if ok {
+		c.lru.MoveToFront(element)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, nil, objstore.ErrNotExist
+	}
+	entry := element.Value.(*renderCacheEntry)
+
+	header := http.Header{}
+	meta, err := c.store.Open(c.objectKey(hash, "json"))
+	if err != nil {
+		c.forgetMissing(element, err)
+		return nil, nil, err
+	}
+	defer meta.Close()
+	err = json.NewDecoder(meta).Decode(&header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	obj, err := c.store.Open(c.objectKey(hash, entry.ext))
+	if err != nil {
+		c.forgetMissing(element, err)
+		return nil, nil, err
+	}
+	return obj, header, nil
+}
+
+// forgetMissing takes a render out of the cache if err says its objects
+// are gone, such as when they were deleted by an eviction that raced with
+// the render being cached again.
+func (c *renderCache) forgetMissing(element *list.Element, err error) {
+	if !errors.Is(err, objstore.ErrNotExist) {
+		return
+	}
+	entry := element.Value.(*renderCacheEntry)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[entry.hash] != element {
+		return
+	}
+	c.lru.Remove(element)
+	delete(c.entries, entry.hash)
+	c.size -= entry.size
+}
+
+// Put caches the render in the local file src under hash, along with the
+// headers it is served with.
+func (c *renderCache) Put(hash string, ext string, src string, header http.Header) error {
+	meta, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	err = c.store.Put(c.objectKey(hash, "json"), bytes.NewReader(meta))
+	if err != nil {
+		return err
+	}
+	err = objstore.PutFile(c.store, c.objectKey(hash, ext), src)
+	if err != nil {
+		return err
+	}
+	info, err := c.store.Stat(c.objectKey(hash, ext))
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if element, ok := c.entries[hash]; ok {
+		c.size -= element.Value.(*renderCacheEntry).size
+		c.lru.Remove(element)
+	}
+	entry := &renderCacheEntry{hash: hash, ext: ext, size: info.Size + int64(len(meta))}
+	c.entries[hash] = c.lru.PushFront(entry)
+	c.size += entry.size
+	evicted := c.evict()
+	c.mu.Unlock()
+
+	c.deleteObjects(evicted)
+	return nil
+}
+
+// evict takes the least recently used renders out of the cache until it
+// fits in maxSize, and returns them for deleteObjects. It must be called
+// with mu held.
+func (c *renderCache) evict() []*renderCacheEntry {
+	var evicted []*renderCacheEntry
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		entry := c.lru.Remove(c.lru.Back()).(*renderCacheEntry)
+		delete(c.entries, entry.hash)
+		c.size -= entry.size
+		evicted = append(evicted, entry)
+	}
+	return evicted
+}
+
+// deleteObjects deletes the objects of evicted renders. It is called
+// without mu held, so deleting from a remote store does not hold up other
+// requests. A render cached again in the meantime may lose its objects,
+// Open then forgets it and it is rendered again.
+func (c *renderCache) deleteObjects(evicted []*renderCacheEntry) {
+	for _, entry := range evicted {
+		for _, key := range []string{c.objectKey(entry.hash, entry.ext), c.objectKey(entry.hash, "json")} {
+			err := c.store.Delete(key)
+			if err != nil {
+				log.Warn().Err(err).Str("key", key).Msg("Failed to evict cached render")
+			}
+		}
+	}
+}
+
+// etagMatches reports whether the If-None-Match header of r matches etag.
+func etagMatches(r *http.Request, etag string) bool {
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
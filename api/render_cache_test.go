@@ -0,0 +1,268 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaym/clyper/objstore"
+)
+
+// putRender caches a render of size bytes under hash.
+func putRender(t *testing.T, c *renderCache, hash string, size int) {
+	t.Helper()
+
+	src := filepath.Join(t.TempDir(), hash+".gif")
+	if err := os.WriteFile(src, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put(hash, "gif", src, http.Header{"X-Hash": {hash}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// cached reports whether hash is in the render cache, checking its headers
+// if it is.
+func cached(t *testing.T, c *renderCache, hash string) bool {
+	t.Helper()
+
+	obj, header, err := c.Open(hash)
+	if errors.Is(err, objstore.ErrNotExist) {
+		return false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	if _, err := io.ReadAll(obj); err != nil {
+		t.Fatal(err)
+	}
+	if got := header.Get("X-Hash"); got != hash {
+		t.Errorf("headers of %s are those of %q", hash, got)
+	}
+	return true
+}
+
+func TestRenderCacheEviction(t *testing.T) {
+	store := objstore.NewLocalFSObjectStore(t.TempDir())
+	// Room for two renders and their headers
+	c, err := newRenderCache(store, RenderCacheConfig{MaxSize: 250})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putRender(t, c, "a", 100)
+	putRender(t, c, "b", 100)
+	// Reading a makes b the least recently used
+	if !cached(t, c, "a") {
+		t.Fatal("a is not cached")
+	}
+	putRender(t, c, "c", 100)
+
+	for hash, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if got := cached(t, c, hash); got != want {
+			t.Errorf("%s cached = %v, want %v", hash, got, want)
+		}
+	}
+	objects, err := store.List(DefaultRenderCachePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 4 {
+		t.Errorf("cache holds %d objects, want a and c with their headers", len(objects))
+	}
+}
+
+func TestRenderCacheReload(t *testing.T) {
+	store := objstore.NewLocalFSObjectStore(t.TempDir())
+	c, err := newRenderCache(store, RenderCacheConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	putRender(t, c, "old", 100)
+	putRender(t, c, "new", 100)
+
+	// Recency is seeded from modification times
+	now := time.Now()
+	for hash, age := range map[string]time.Duration{"old": time.Hour, "new": time.Minute} {
+		for _, ext := range []string{"gif", "json"} {
+			p, err := store.Path(c.objectKey(hash, ext))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(p, now.Add(-age), now.Add(-age)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	c, err = newRenderCache(store, RenderCacheConfig{MaxSize: 150})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached(t, c, "old") {
+		t.Error("the least recently used render was not evicted on load")
+	}
+	if !cached(t, c, "new") {
+		t.Error("the most recently used render was evicted on load")
+	}
+}
+
+func TestRenderCacheRequests(t *testing.T) {
+	handler, runner := newTestAPI(t, ApiConfig{RenderCache: &RenderCacheConfig{}}, testEpisode("eng", "first line"))
+	renders := func() int { return len(runner.Calls()) }
+
+	w := get(t, handler, "/gif/1/1/0/1000.gif?text=hi")
+	if w.Code != http.StatusOK || w.Header().Get("X-Render-Cache") != "miss" {
+		t.Fatalf("first request: status %d, X-Render-Cache %q", w.Code, w.Header().Get("X-Render-Cache"))
+	}
+	etag := w.Header().Get("ETag")
+	rendered := renders()
+
+	w = get(t, handler, "/gif/1/1/0/1000.gif?text=hi")
+	if w.Code != http.StatusOK || w.Header().Get("X-Render-Cache") != "hit" {
+		t.Fatalf("second request: status %d, X-Render-Cache %q", w.Code, w.Header().Get("X-Render-Cache"))
+	}
+	if w.Header().Get("ETag") != etag || w.Header().Get("X-Animation-Fits") != "true" {
+		t.Errorf("cached render is served with headers %v", w.Header())
+	}
+	if renders() != rendered {
+		t.Error("a cached render was rendered again")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/gif/1/1/0/1000.gif?text=hi", nil)
+	req.Header.Set("If-None-Match", `W/"other", `+etag)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: status = %d, want %d", rec.Code, http.StatusNotModified)
+	}
+
+	w = get(t, handler, "/gif/1/1/0/1000.gif?text=bye")
+	if w.Header().Get("X-Render-Cache") != "miss" || w.Header().Get("ETag") == etag {
+		t.Errorf("other text: X-Render-Cache %q, ETag %q", w.Header().Get("X-Render-Cache"), w.Header().Get("ETag"))
+	}
+}
+
+func TestRenderCacheSourceChanged(t *testing.T) {
+	requireFTS5(t)
+	store := objstore.NewLocalFSObjectStore(t.TempDir())
+	md := testEpisode("eng", "first line")
+	db := newTestDatabase(t, store, md)
+	handler := NewApiHandler(db, store, ApiConfig{RenderCache: &RenderCacheConfig{}, Runner: newCaptionRecorder()})
+
+	w := get(t, handler, "/gif/1/1/0/1000.gif?text=hi")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", w.Code, w.Body)
+	}
+	etag := w.Header().Get("ETag")
+
+	// Preprocessing the episode again writes its video under the same key
+	if err := store.Put(md.VideoFileKey, strings.NewReader("preprocessed again")); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/gif/1/1/0/1000.gif?text=hi", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Render-Cache") != "miss" {
+		t.Errorf("status %d, X-Render-Cache %q, want the new video rendered", rec.Code, rec.Header().Get("X-Render-Cache"))
+	}
+	if rec.Header().Get("ETag") == etag {
+		t.Error("the ETag did not change with the video")
+	}
+
+	if err := store.Delete(md.VideoFileKey); err != nil {
+		t.Fatal(err)
+	}
+	if w := get(t, handler, "/gif/1/1/0/1000.gif?text=hi"); w.Code != http.StatusNotFound {
+		t.Errorf("missing video: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+// blockingDeleteStore is an object store whose deletes wait for release.
+type blockingDeleteStore struct {
+	*objstore.LocalFSObjectStore
+	deleting chan struct{}
+	release  chan struct{}
+}
+
+func (s *blockingDeleteStore) Delete(key string) error {
+	select {
+	case s.deleting <- struct{}{}:
+	default:
+	}
+	<-s.release
+	return s.LocalFSObjectStore.Delete(key)
+}
+
+func TestRenderCacheEvictionUnlocked(t *testing.T) {
+	store := &blockingDeleteStore{
+		LocalFSObjectStore: objstore.NewLocalFSObjectStore(t.TempDir()),
+		deleting:           make(chan struct{}, 1),
+		release:            make(chan struct{}),
+	}
+	c, err := newRenderCache(store, RenderCacheConfig{MaxSize: 150})
+	if err != nil {
+		t.Fatal(err)
+	}
+	putRender(t, c, "a", 100)
+
+	src := filepath.Join(t.TempDir(), "b.gif")
+	if err := os.WriteFile(src, make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Caching b evicts a
+	done := make(chan error)
+	go func() {
+		done <- c.Put("b", "gif", src, http.Header{})
+	}()
+	<-store.deleting
+
+	// The cache can be read while a is being deleted
+	opened := make(chan bool)
+	go func() {
+		obj, _, err := c.Open("b")
+		if err == nil {
+			obj.Close()
+		}
+		opened <- err == nil
+	}()
+	select {
+	case ok := <-opened:
+		if !ok {
+			t.Error("b is not cached")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Open waited for an eviction to be deleted")
+	}
+	close(store.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenderCacheForgetsMissing(t *testing.T) {
+	store := objstore.NewLocalFSObjectStore(t.TempDir())
+	c, err := newRenderCache(store, RenderCacheConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	putRender(t, c, "a", 100)
+	if err := store.Delete(c.objectKey("a", "gif")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := c.Open("a"); !errors.Is(err, objstore.ErrNotExist) {
+		t.Fatalf("err = %v, want objstore.ErrNotExist", err)
+	}
+	if _, ok := c.entries["a"]; ok || c.size != 0 {
+		t.Errorf("a render without objects is still cached, size %d", c.size)
+	}
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRenderQueueSize is the number of renders that can wait for a
+	// worker across all clients.
+	DefaultRenderQueueSize = 64
+	// DefaultRenderQueueSizePerClient is the number of renders one client
+	// can have waiting for a worker.
+	DefaultRenderQueueSizePerClient = 4
+)
+
+var (
+	// ErrRenderQueueFull is returned when the server has too many renders
+	// waiting.
+	ErrRenderQueueFull = errors.New("render queue is full")
+	// ErrTooManyRenders is returned when a client has too many renders
+	// waiting.
+	ErrTooManyRenders = errors.New("too many renders waiting for this client")
+)
+
+type RenderQueueConfig struct {
+	// Workers is the number of renders run at once. Defaults to the number
+	// of CPUs.
+	Workers int `mapstructure:"workers"`
+	// MaxQueued is the number of renders that can wait for a worker.
+	// Defaults to DefaultRenderQueueSize.
+	MaxQueued int `mapstructure:"max_queued"`
+	// MaxQueuedPerClient is the number of renders a client can have
+	// waiting. Defaults to DefaultRenderQueueSizePerClient.
+	MaxQueuedPerClient int `mapstructure:"max_queued_per_client"`
+	// ClientHeader is the request header that identifies clients, such as
+	// X-Forwarded-For behind a proxy. Of a list of addresses the last is
+	// used, the one the proxy added, as clients can send the rest. Clients
+	// are identified by their remote address if it is not set.
+	ClientHeader string `mapstructure:"client_header"`
+}
+
+type renderWaiter struct {
+	client string
+	ready  chan struct{}
+}
+
+// renderQueue limits the number of renders run at once. Renders that have
+// to wait are queued per client and started round robin across clients, so
+// one client queueing many renders cannot starve the others.
+type renderQueue struct {
+	workers            int
+	maxQueued          int
+	maxQueuedPerClient int
+	clientHeader       string
+
+	mu      sync.Mutex
+	running int
+	queued  int
+	// clients lists the clients with waiting renders, in the order they
+	// are next served.
+	clients []string
+	waiting map[string][]*renderWaiter
+	// average is the moving average of how long renders take.
+	average time.Duration
+}
+
+func newRenderQueue(cfg RenderQueueConfig) *renderQueue {
+	q := &renderQueue{
+		workers:            runtime.NumCPU(),
+		maxQueued:          DefaultRenderQueueSize,
+		maxQueuedPerClient: DefaultRenderQueueSizePerClient,
+		clientHeader:       cfg.ClientHeader,
+		waiting:            map[string][]*renderWaiter{},
+		average:            5 * time.Second,
+	}
+	if cfg.Workers > 0 {
+		q.workers = cfg.Workers
+	}
+	if cfg.MaxQueued > 0 {
+		q.maxQueued = cfg.MaxQueued
+	}
+	if cfg.MaxQueuedPerClient > 0 {
+		q.maxQueuedPerClient = cfg.MaxQueuedPerClient
+	}
+	return q
+}
+
+// client returns the identity r is queued under.
+func (q *renderQueue) client(r *http.Request) string {
+	if q.clientHeader != "" {
+		if value := r.Header.Get(q.clientHeader); value != "" {
+			// Proxies append the address they saw to what the client sent
+			return strings.TrimSpace(value[strings.LastIndex(value, ",")+1:])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Acquire waits for a worker for client. The returned function must be
+// called once the render is done. It fails with ErrRenderQueueFull or
+// ErrTooManyRenders if the render cannot be queued, or with the error of
+// ctx if it is done before a worker is free.
+func (q *renderQueue) Acquire(ctx context.Context, client string) (func(), error) {
+	waiter, err := q.enqueue(client)
+	if err != nil {
+		return nil, err
+	}
+	return q.wait(ctx, waiter)
+}
+
+// enqueue queues a render for client without waiting for a worker.
+func (q *renderQueue) enqueue(client string) (*renderWaiter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	waiter := &renderWaiter{client: client, ready: make(chan struct{})}
+	if q.running < q.workers && q.queued == 0 {
+		q.running++
+		close(waiter.ready)
+		return waiter, nil
+	}
+	if q.queued >= q.maxQueued {
+		return nil, ErrRenderQueueFull
+	}
+	if len(q.waiting[client]) >= q.maxQueuedPerClient {
+		return nil, ErrTooManyRenders
+	}
+
+	if len(q.waiting[client]) == 0 {
+		q.clients = append(q.clients, client)
+	}
+	q.waiting[client] = append(q.waiting[client], waiter)
+	q.queued++
+	return waiter, nil
+}
+
+// wait waits for the worker of a render queued by enqueue. See Acquire.
+func (q *renderQueue) wait(ctx context.Context, waiter *renderWaiter) (func(), error) {
+	select {
+	case <-waiter.ready:
+		return q.releaser(), nil
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-waiter.ready:
+		// A worker was handed over as ctx was done, pass it on
+		q.running--
+		q.dispatch()
+	default:
+		q.remove(waiter)
+	}
+	return nil, ctx.Err()
+}
+
+func (q *renderQueue) releaser() func() {
+	start := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.average = (q.average*7 + time.Since(start)) / 8
+			q.running--
+			q.dispatch()
+		})
+	}
+}
+
+// dispatch starts waiting renders while there are free workers, taking the
+// next render of each client in turn. It must be called with mu held.
+func (q *renderQueue) dispatch() {
+	for q.running < q.workers && len(q.clients) > 0 {
+		client := q.clients[0]
+		q.clients = q.clients[1:]
+
+		waiters := q.waiting[client]
+		waiter := waiters[0]
+		if len(waiters) == 1 {
+			delete(q.waiting, client)
+		} else {
+			q.waiting[client] = waiters[1:]
+			q.clients = append(q.clients, client)
+		}
+
+		q.queued--
+		q.running++
+		close(waiter.ready)
+	}
+}
+
+// remove takes a waiter that gave up out of the queue. It must be called
+// with mu held.
+func (q *renderQueue) remove(waiter *renderWaiter) {
+	waiters := q.waiting[waiter.client]
+	for i, w := range waiters {
+		if w != waiter {
+			continue
+		}
+		waiters = append(waiters[:i:i], waiters[i+1:]...)
+		q.queued--
+		break
+	}
+	if len(waiters) > 0 {
+		q.waiting[waiter.client] = waiters
+		return
+	}
+
+	delete(q.waiting, waiter.client)
+	for i, client := range q.clients {
+		if client == waiter.client {
+			q.clients = append(q.clients[:i:i], q.clients[i+1:]...)
+			break
+		}
+	}
+}
+
+// RetryAfter estimates how many seconds it will take for the queue to have
+// room again.
+func (q *renderQueue) RetryAfter() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	rounds := float64(q.queued)/float64(q.workers) + 1
+	return max(1, int(math.Ceil(rounds*q.average.Seconds())))
+}
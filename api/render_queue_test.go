@@ -0,0 +1,150 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// acquired reports whether waiter has been given a worker.
+func acquired(waiter *renderWaiter) bool {
+	select {
+	case <-waiter.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestRenderQueueFairness(t *testing.T) {
+	q := newRenderQueue(RenderQueueConfig{Workers: 1, MaxQueued: 10, MaxQueuedPerClient: 10})
+
+	release, err := q.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a queues three renders before b queues one, b still goes second
+	var order []string
+	var waiters []*renderWaiter
+	for _, client := range []string{"a", "a", "a", "b"} {
+		waiter, err := q.enqueue(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waiters = append(waiters, waiter)
+	}
+	for range waiters {
+		release()
+		for i, waiter := range waiters {
+			if waiter != nil && acquired(waiter) {
+				order = append(order, waiter.client)
+				waiters[i] = nil
+				release, _ = q.wait(context.Background(), waiter)
+			}
+		}
+	}
+	want := []string{"a", "b", "a", "a"}
+	if len(order) != len(want) {
+		t.Fatalf("order = %q, want %q", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("order = %q, want %q", order, want)
+		}
+	}
+	release()
+	if q.running != 0 || q.queued != 0 {
+		t.Errorf("running %d, queued %d after every render is done", q.running, q.queued)
+	}
+}
+
+func TestRenderQueueLimits(t *testing.T) {
+	q := newRenderQueue(RenderQueueConfig{Workers: 1, MaxQueued: 3, MaxQueuedPerClient: 2})
+
+	if _, err := q.Acquire(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range []string{"a", "a", "b"} {
+		if _, err := q.enqueue(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := q.enqueue("c"); !errors.Is(err, ErrRenderQueueFull) {
+		t.Errorf("full queue: err = %v, want ErrRenderQueueFull", err)
+	}
+
+	q = newRenderQueue(RenderQueueConfig{Workers: 1, MaxQueued: 3, MaxQueuedPerClient: 2})
+	if _, err := q.Acquire(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range []string{"a", "a"} {
+		if _, err := q.enqueue(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := q.enqueue("a"); !errors.Is(err, ErrTooManyRenders) {
+		t.Errorf("client over its limit: err = %v, want ErrTooManyRenders", err)
+	}
+	if _, err := q.enqueue("b"); err != nil {
+		t.Errorf("other client: err = %v", err)
+	}
+	if got := q.RetryAfter(); got < 1 {
+		t.Errorf("RetryAfter = %d, want at least 1", got)
+	}
+}
+
+func TestRenderQueueCancel(t *testing.T) {
+	q := newRenderQueue(RenderQueueConfig{Workers: 1})
+
+	release, err := q.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := q.Acquire(ctx, "b"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want the error of the context", err)
+	}
+	if q.queued != 0 || len(q.clients) != 0 || len(q.waiting) != 0 {
+		t.Errorf("a render that gave up is still queued: %d, %q", q.queued, q.clients)
+	}
+
+	// A worker handed to a render that gave up is passed on
+	waiter, err := q.enqueue("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := q.enqueue("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	cancelled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	if !acquired(waiter) {
+		t.Fatal("b was not given the worker")
+	}
+	// Both cases of the select are ready, wait may return either way
+	if release, err := q.wait(cancelled, waiter); err == nil {
+		release()
+	}
+	if !acquired(next) {
+		t.Error("the worker was not passed on to c")
+	}
+}
+
+func TestRenderQueueClient(t *testing.T) {
+	q := newRenderQueue(RenderQueueConfig{ClientHeader: "X-Forwarded-For"})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	if got := q.client(r); got != "10.0.0.1" {
+		t.Errorf("without the header client = %q, want the remote address", got)
+	}
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8")
+	if got := q.client(r); got != "5.6.7.8" {
+		t.Errorf("client = %q, want the address the proxy added", got)
+	}
+}
@@ -1,13 +1,17 @@
 package clyper
 
-import "github.com/spf13/viper"
+import (
+	processor "github.com/jaym/clyper/processors"
+	"github.com/spf13/viper"
+)
 
 type ServerConfig struct {
 	Listen string `mapstructure:"listen"`
 }
 
 type Config struct {
-	Server ServerConfig `mapstructure:"server"`
+	Server     ServerConfig                 `mapstructure:"server"`
+	Preprocess processor.PreprocessorConfig `mapstructure:"preprocess"`
 }
 
 func LoadConfig() (*Config, error) {
@@ -1,7 +1,10 @@
 package clyper
 
 import (
+	"path"
+
 	processor "github.com/jaym/clyper/processors"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 )
 
@@ -10,8 +13,9 @@ var makeCmd = &cobra.Command{
 }
 
 var gifCmd = &cobra.Command{
-	Use:  "gif input_file output_file",
-	Args: cobra.ExactArgs(2),
+	Use:   "gif input_file output_file",
+	Short: "Make a gif, webp or apng animation, the format is taken from the output file extension",
+	Args:  cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
 		start, _ := cmd.Flags().GetInt("start")
 		end, _ := cmd.Flags().GetInt("end")
@@ -20,13 +24,89 @@ var gifCmd = &cobra.Command{
 		fontColor, _ := cmd.Flags().GetString("font-color")
 		fontsDir, _ := cmd.Flags().GetString("fonts-dir")
 		desiredMaxSize, _ := cmd.Flags().GetFloat32("desired-max-size")
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+
+		format, err := processor.ParseAnimationFormat(path.Ext(args[1]))
+		cobra.CheckErr(err)
 
-		err := processor.MakeGif(args[0], args[1], start, end, processor.GifOptions{
+		result, err := processor.MakeAnimation(cmd.Context(), args[0], args[1], start, end, processor.GifOptions{
+			Format:         format,
 			Text:           text,
 			FontName:       fontName,
 			FontColor:      fontColor,
 			FontsDir:       fontsDir,
 			DesiredMaxSize: int(desiredMaxSize * 1024 * 1024),
+			Timeout:        timeout,
+		})
+		cobra.CheckErr(err)
+
+		log.Info().
+			Int("fps", result.Params.FPS).
+			Float64("scale", result.Params.Scale).
+			Int("colors", result.Params.Colors).
+			Str("dither", result.Params.Dither).
+			Int("quality", result.Params.Quality).
+			Int64("size", result.Size).
+			Bool("fits", result.Fits).
+			Int("attempts", result.Attempts).
+			Msg("Rendered animation")
+	},
+}
+
+var clipCmd = &cobra.Command{
+	Use:   "clip input_file output_file",
+	Short: "Make an mp4 or webm clip, the format is taken from the output file extension",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		start, _ := cmd.Flags().GetInt("start")
+		end, _ := cmd.Flags().GetInt("end")
+		text, _ := cmd.Flags().GetString("text")
+		audio, _ := cmd.Flags().GetBool("audio")
+		fontName, _ := cmd.Flags().GetString("font-name")
+		fontColor, _ := cmd.Flags().GetString("font-color")
+		fontsDir, _ := cmd.Flags().GetString("fonts-dir")
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+
+		format, err := processor.ParseClipFormat(path.Ext(args[1]))
+		cobra.CheckErr(err)
+
+		err = processor.MakeClip(cmd.Context(), args[0], args[1], start, end, processor.ClipOptions{
+			Format:    format,
+			Audio:     audio,
+			Text:      text,
+			FontName:  fontName,
+			FontColor: fontColor,
+			FontsDir:  fontsDir,
+			Timeout:   timeout,
+		})
+		cobra.CheckErr(err)
+	},
+}
+
+var stillCmd = &cobra.Command{
+	Use:   "still input_file output_file",
+	Short: "Make a jpg or png of a single frame, the format is taken from the output file extension",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		timestamp, _ := cmd.Flags().GetInt("timestamp")
+		top, _ := cmd.Flags().GetString("top")
+		bottom, _ := cmd.Flags().GetString("bottom")
+		fontName, _ := cmd.Flags().GetString("font-name")
+		fontColor, _ := cmd.Flags().GetString("font-color")
+		fontsDir, _ := cmd.Flags().GetString("fonts-dir")
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+
+		format, err := processor.ParseStillFormat(path.Ext(args[1]))
+		cobra.CheckErr(err)
+
+		err = processor.MakeStill(cmd.Context(), args[0], args[1], timestamp, processor.StillOptions{
+			Format:     format,
+			TopText:    top,
+			BottomText: bottom,
+			FontName:   fontName,
+			FontColor:  fontColor,
+			FontsDir:   fontsDir,
+			Timeout:    timeout,
 		})
 		cobra.CheckErr(err)
 	},
@@ -40,10 +120,35 @@ func init() {
 	gifCmd.Flags().String("font-color", "", "font color")
 	gifCmd.Flags().String("fonts-dir", "", "directory containing fonts")
 	gifCmd.Flags().Float32("desired-max-size", 2.0, "desired max size in MB")
+	gifCmd.Flags().Duration("timeout", 0, "give up after this long (default no limit)")
 	gifCmd.MarkFlagRequired("start")
 	gifCmd.MarkFlagRequired("end")
 
 	makeCmd.AddCommand(gifCmd)
 
+	clipCmd.Flags().Int("start", 0, "start time in milliseconds")
+	clipCmd.Flags().Int("end", 0, "end time in milliseconds")
+	clipCmd.Flags().String("text", "", "text to overlay on the clip")
+	clipCmd.Flags().Bool("audio", false, "keep the audio of the input")
+	clipCmd.Flags().String("font-name", "", "font name")
+	clipCmd.Flags().String("font-color", "", "font color")
+	clipCmd.Flags().String("fonts-dir", "", "directory containing fonts")
+	clipCmd.Flags().Duration("timeout", 0, "give up after this long (default no limit)")
+	clipCmd.MarkFlagRequired("start")
+	clipCmd.MarkFlagRequired("end")
+
+	makeCmd.AddCommand(clipCmd)
+
+	stillCmd.Flags().Int("timestamp", 0, "time of the frame in milliseconds")
+	stillCmd.Flags().String("top", "", "text to overlay at the top of the image")
+	stillCmd.Flags().String("bottom", "", "text to overlay at the bottom of the image")
+	stillCmd.Flags().String("font-name", "", "font name")
+	stillCmd.Flags().String("font-color", "", "font color")
+	stillCmd.Flags().String("fonts-dir", "", "directory containing fonts")
+	stillCmd.Flags().Duration("timeout", 0, "give up after this long (default no limit)")
+	stillCmd.MarkFlagRequired("timestamp")
+
+	makeCmd.AddCommand(stillCmd)
+
 	rootCmd.AddCommand(makeCmd)
 }
@@ -2,11 +2,21 @@ package clyper
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
 
+	"github.com/jaym/clyper/objstore"
 	processor "github.com/jaym/clyper/processors"
 	"github.com/spf13/cobra"
 )
 
+// ExitCodePartialFailure is the exit code of `preprocess run` when the
+// database was built but some files failed to process.
+const ExitCodePartialFailure = 2
+
 var preprocessCmd = &cobra.Command{
 	Use: "preprocess",
 }
@@ -15,8 +25,12 @@ var subs = &cobra.Command{
 	Use:  "subs input_file output_dir",
 	Args: cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
-		p := processor.NewSubtitleExtractor(processor.SubtitleExtractorConfig{})
-		meta, err := p.Run(args[0], args[1])
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+
+		p := processor.NewSubtitleExtractor(processor.SubtitleExtractorConfig{
+			Timeout: timeout,
+		})
+		meta, err := p.Run(cmd.Context(), args[0], args[1])
 		cobra.CheckErr(err)
 		// Pretty print the metadata as json
 		o, _ := json.MarshalIndent(meta, "", "  ")
@@ -30,13 +44,15 @@ var thumbs = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		width, _ := cmd.Flags().GetInt("width")
 		height, _ := cmd.Flags().GetInt("height")
+		timeout, _ := cmd.Flags().GetDuration("timeout")
 
 		p := processor.NewThumbnailer(processor.ThumbnailerConfig{
-			Width:  width,
-			Height: height,
+			Width:   width,
+			Height:  height,
+			Timeout: timeout,
 		})
 
-		meta, err := p.Run(args[0], args[1])
+		meta, err := p.Run(cmd.Context(), args[0], args[1])
 		cobra.CheckErr(err)
 		// Pretty print the metadata as json
 		o, _ := json.MarshalIndent(meta, "", "  ")
@@ -50,13 +66,15 @@ var downscale = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		width, _ := cmd.Flags().GetInt("width")
 		height, _ := cmd.Flags().GetInt("height")
+		timeout, _ := cmd.Flags().GetDuration("timeout")
 
 		p := processor.NewDownscaler(processor.DownscalerConfig{
-			Width:  width,
-			Height: height,
+			Width:   width,
+			Height:  height,
+			Timeout: timeout,
 		})
 
-		meta, err := p.Run(args[0], args[1])
+		meta, err := p.Run(cmd.Context(), args[0], args[1])
 		cobra.CheckErr(err)
 		// Pretty print the metadata as json
 		o, _ := json.MarshalIndent(meta, "", "  ")
@@ -65,36 +83,184 @@ var downscale = &cobra.Command{
 }
 
 var run = &cobra.Command{
-	Use:  "run input_dir output_dir",
+	Use:   "run input_dir output",
+	Short: "Preprocess a directory of episodes into an object store",
+	Long: `Preprocess a directory of episodes into an object store.
+
+The output is either a local directory or an S3 location of the form
+s3://bucket/prefix?endpoint=...&region=...&path_style=true`,
 	Args: cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
-		p := processor.NewPreprocessor(processor.PreprocessorConfig{
-			Downscaler: &processor.DownscalerConfig{
-				Width: 640,
-			},
-			Thumbnailer: &processor.ThumbnailerConfig{
-				Width: 160,
-			},
-			SubtitleExtractor: &processor.SubtitleExtractorConfig{},
-		})
+		reportPath, _ := cmd.Flags().GetString("report")
+
+		cfg, err := preprocessorConfig(cmd)
+		cobra.CheckErr(err)
+
+		p, err := processor.NewPreprocessor(*cfg)
+		cobra.CheckErr(err)
+
+		store, err := objstore.Open(args[1])
+		cobra.CheckErr(err)
+
+		report, err := p.Process(cmd.Context(), args[0], store)
+		if report != nil && reportPath != "" {
+			o, _ := json.MarshalIndent(report, "", "  ")
+			if reportPath == "-" {
+				cmd.Println(string(o))
+			} else {
+				cobra.CheckErr(os.WriteFile(reportPath, o, 0644))
+			}
+		}
+		if errors.Is(err, processor.ErrFilesFailed) {
+			// The database was built, but not from every file
+			for _, failure := range report.Failed {
+				cmd.PrintErrf("failed: %s: %s\n", failure.Path, failure.Error)
+			}
+			cmd.PrintErrf("Error: %v\n", err)
+			os.Exit(ExitCodePartialFailure)
+		}
+		cobra.CheckErr(err)
+	},
+}
+
+var scan = &cobra.Command{
+	Use:   "scan input_dir",
+	Short: "Show what each file in input_dir would be processed as",
+	Long: `Show what each file in input_dir would be processed as, without
+processing anything. Files that map to the same episode are flagged as
+collisions, which preprocess run refuses to process.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		cfg, err := preprocessorConfig(cmd)
+		cobra.CheckErr(err)
+
+		p, err := processor.NewPreprocessor(*cfg)
+		cobra.CheckErr(err)
 
-		err := p.Process(args[0], args[1])
+		result, err := p.Scan(args[0])
 		cobra.CheckErr(err)
+
+		if asJSON {
+			o, _ := json.MarshalIndent(result, "", "  ")
+			cmd.Println(string(o))
+		} else {
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "PATH\tSHOW\tSEASON\tEPISODE\tKIND\tTITLE\tRULE")
+			for _, e := range result.Entries {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\t%s\n", e.Path, e.Show, e.Season, e.Episode, e.Kind, e.Title, e.Rule)
+			}
+			w.Flush()
+
+			for _, c := range result.Collisions {
+				cmd.PrintErrf("collision: %s S%02dE%02d: %s\n", c.Show, c.Season, c.Episode, strings.Join(c.Paths, ", "))
+			}
+		}
+
+		if len(result.Collisions) > 0 {
+			cobra.CheckErr(fmt.Errorf("%w: %d episodes", processor.ErrEpisodeCollision, len(result.Collisions)))
+		}
 	},
 }
 
+// preprocessorConfig returns the preprocess section of the config file with
+// the command line flags applied on top.
+func preprocessorConfig(cmd *cobra.Command) (*processor.PreprocessorConfig, error) {
+	config, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg := config.Preprocess
+
+	if cfg.Downscaler == nil {
+		cfg.Downscaler = &processor.DownscalerConfig{Width: 640}
+	}
+	if cfg.Thumbnailer == nil {
+		cfg.Thumbnailer = &processor.ThumbnailerConfig{Width: 160}
+	}
+	if cfg.SubtitleExtractor == nil {
+		cfg.SubtitleExtractor = &processor.SubtitleExtractorConfig{}
+	}
+
+	flags := cmd.Flags()
+	if flags.Changed("show") {
+		cfg.Show, _ = flags.GetString("show")
+	}
+	if flags.Changed("show-name") {
+		cfg.ShowName, _ = flags.GetString("show-name")
+	}
+	if flags.Changed("show-from-dir") {
+		cfg.ShowFromDirectory, _ = flags.GetBool("show-from-dir")
+	}
+	if flags.Lookup("jobs") != nil && flags.Changed("jobs") {
+		cfg.Jobs, _ = flags.GetInt("jobs")
+	}
+	if flags.Lookup("subtitle-languages") != nil && flags.Changed("subtitle-languages") {
+		cfg.SubtitleLanguages, _ = flags.GetStringSlice("subtitle-languages")
+	}
+	if flags.Lookup("sidecar-subtitles") != nil && flags.Changed("sidecar-subtitles") {
+		policy, _ := flags.GetString("sidecar-subtitles")
+		cfg.SidecarSubtitles = processor.SidecarSubtitlePolicy(policy)
+	}
+	if flags.Lookup("ocr") != nil && flags.Changed("ocr") {
+		if ocr, _ := flags.GetBool("ocr"); !ocr {
+			cfg.OCR = nil
+		} else if cfg.OCR == nil {
+			cfg.OCR = &processor.OCRConfig{}
+		}
+	}
+	if flags.Lookup("incremental") != nil && flags.Changed("incremental") {
+		cfg.Incremental, _ = flags.GetBool("incremental")
+	}
+	if flags.Lookup("continue-on-error") != nil && flags.Changed("continue-on-error") {
+		cfg.ContinueOnError, _ = flags.GetBool("continue-on-error")
+	}
+	if flags.Lookup("probe-timeout") != nil && flags.Changed("probe-timeout") {
+		cfg.ProbeTimeout, _ = flags.GetDuration("probe-timeout")
+	}
+	if flags.Lookup("ffmpeg-timeout") != nil && flags.Changed("ffmpeg-timeout") {
+		cfg.FFmpegTimeout, _ = flags.GetDuration("ffmpeg-timeout")
+	}
+
+	return &cfg, nil
+}
+
+func addShowFlags(cmd *cobra.Command) {
+	cmd.Flags().String("show", "", "Slug of the show all files belong to")
+	cmd.Flags().String("show-name", "", "Display name of the show given with --show")
+	cmd.Flags().Bool("show-from-dir", false, "Take the show from the first directory below input_dir")
+}
+
 func init() {
 	rootCmd.AddCommand(preprocessCmd)
+	subs.Flags().Duration("timeout", 0, "Give up on ffmpeg after this long (default no limit)")
 	preprocessCmd.AddCommand(subs)
 
 	thumbs.Flags().Int("width", 320, "Width of the thumbnail")
 	thumbs.Flags().Int("height", -1, "Height of the thumbnail")
 	thumbs.Flags().Int("fps", 1, "Frames per second")
+	thumbs.Flags().Duration("timeout", 0, "Give up on ffmpeg after this long (default no limit)")
 	preprocessCmd.AddCommand(thumbs)
 
 	downscale.Flags().Int("width", 640, "Width of the thumbnail")
 	downscale.Flags().Int("height", -1, "Height of the thumbnail")
+	downscale.Flags().Duration("timeout", 0, "Give up on ffmpeg after this long (default no limit)")
 	preprocessCmd.AddCommand(downscale)
 
+	run.Flags().Bool("incremental", false, "Update the existing metadata database instead of rebuilding it")
+	addShowFlags(run)
+	run.Flags().Int("jobs", 1, "Number of files to process concurrently")
+	run.Flags().StringSlice("subtitle-languages", nil, "Subtitle languages to index, such as eng,spa (default every language)")
+	run.Flags().String("sidecar-subtitles", string(processor.SidecarSubtitlesFallback), "How subtitle files next to a video are used: fallback, prefer or ignore")
+	run.Flags().Bool("ocr", false, "OCR image based (PGS, DVD) subtitle streams with tesseract, or the command in the ocr config")
+	run.Flags().Bool("continue-on-error", false, "Skip files that fail to process instead of aborting")
+	run.Flags().Duration("probe-timeout", 0, "Give up on a file when ffprobe takes longer than this (default no limit)")
+	run.Flags().Duration("ffmpeg-timeout", 0, "Give up on a file when ffmpeg takes longer than this to process it (default no limit)")
+	run.Flags().String("report", "", "Write a JSON report of processed and failed files to this path (- for stdout)")
 	preprocessCmd.AddCommand(run)
+
+	addShowFlags(scan)
+	scan.Flags().Bool("json", false, "Print the result as JSON")
+	preprocessCmd.AddCommand(scan)
 }
@@ -1,11 +1,18 @@
 package clyper
 
 import (
+	"context"
+	"errors"
+	"net"
 	"net/http"
+	"os"
 	"path"
+	"runtime"
+	"time"
 
 	"github.com/jaym/clyper/api"
 	"github.com/jaym/clyper/metadata"
+	"github.com/jaym/clyper/objstore"
 	processor "github.com/jaym/clyper/processors"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
@@ -20,17 +27,88 @@ var serveCmd = &cobra.Command{
 		objstorePath, _ := cmd.Flags().GetString("objstore")
 		fontsDir, _ := cmd.Flags().GetString("fonts-dir")
 		fontName, _ := cmd.Flags().GetString("font-name")
+		defaultShow, _ := cmd.Flags().GetString("default-show")
+		defaultLanguage, _ := cmd.Flags().GetString("default-language")
+		renderCacheSize, _ := cmd.Flags().GetInt64("render-cache-size")
+		renderWorkers, _ := cmd.Flags().GetInt("render-workers")
+		renderQueueSize, _ := cmd.Flags().GetInt("render-queue-size")
+		renderQueueSizePerClient, _ := cmd.Flags().GetInt("render-queue-size-per-client")
+		clientHeader, _ := cmd.Flags().GetString("client-header")
+		jobTTL, _ := cmd.Flags().GetDuration("job-ttl")
+		renderTimeout, _ := cmd.Flags().GetDuration("render-timeout")
 
-		db, err := metadata.OpenDatabase(path.Join(objstorePath, dbPath))
+		store, err := objstore.Open(objstorePath)
 		cobra.CheckErr(err)
 
-		httpHandler := api.NewApiHandler(db, objstorePath, processor.GifOptions{
-			FontsDir: fontsDir,
-			FontName: fontName,
+		// sqlite needs the database on local disk. Remote stores are
+		// copied to a temporary file for the lifetime of the server.
+		var dbFile string
+		if local, ok := store.(*objstore.LocalFSObjectStore); ok {
+			dbFile, err = local.Path(dbPath)
+			cobra.CheckErr(err)
+		} else {
+			tmpDir, err := os.MkdirTemp("", "clyper-db")
+			cobra.CheckErr(err)
+			defer os.RemoveAll(tmpDir)
+
+			dbFile = path.Join(tmpDir, path.Base(dbPath))
+			log.Info().Str("key", dbPath).Msg("Downloading database")
+			cobra.CheckErr(objstore.Fetch(store, dbPath, dbFile))
+		}
+
+		db, err := metadata.OpenDatabase(dbFile)
+		cobra.CheckErr(err)
+
+		var renderCache *api.RenderCacheConfig
+		if renderCacheSize > 0 {
+			renderCache = &api.RenderCacheConfig{MaxSize: renderCacheSize * 1024 * 1024}
+		}
+
+		httpHandler := api.NewApiHandler(db, store, api.ApiConfig{
+			DefaultShow:     defaultShow,
+			DefaultLanguage: defaultLanguage,
+			GifOptions: processor.GifOptions{
+				FontsDir: fontsDir,
+				FontName: fontName,
+			},
+			RenderCache: renderCache,
+			RenderQueue: api.RenderQueueConfig{
+				Workers:            renderWorkers,
+				MaxQueued:          renderQueueSize,
+				MaxQueuedPerClient: renderQueueSizePerClient,
+				ClientHeader:       clientHeader,
+			},
+			Jobs: api.JobsConfig{
+				TTL: jobTTL,
+			},
+			RenderTimeout: renderTimeout,
+			Context:       cmd.Context(),
 		})
 
+		server := &http.Server{
+			Addr:    addr,
+			Handler: httpHandler,
+			// Requests are cancelled on shutdown, which stops their renders
+			BaseContext: func(net.Listener) context.Context {
+				return cmd.Context()
+			},
+		}
+		shutdown := make(chan struct{})
+		go func() {
+			defer close(shutdown)
+			<-cmd.Context().Done()
+			log.Info().Msg("Shutting down")
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			server.Shutdown(ctx) // nolint: errcheck
+		}()
+
 		log.Info().Str("addr", addr).Msg("Listening")
-		err = http.ListenAndServe(addr, httpHandler)
+		err = server.ListenAndServe()
+		if errors.Is(err, http.ErrServerClosed) {
+			<-shutdown
+			return
+		}
 		cobra.CheckErr(err)
 	},
 }
@@ -39,9 +117,18 @@ func init() {
 	rootCmd.AddCommand(serveCmd)
 
 	serveCmd.Flags().String("addr", ":8991", "address to listen on")
-	serveCmd.Flags().String("objstore", "/data", "path to the object store")
-	serveCmd.Flags().String("db", "internal/metadata.db", "path to the database")
+	serveCmd.Flags().String("objstore", "/data", "path or s3:// location of the object store")
+	serveCmd.Flags().String("db", metadata.DefaultDatabaseKey, "object store key of the database")
 	serveCmd.Flags().String("fonts-dir", "", "path to the fonts directory")
 	serveCmd.Flags().String("font-name", "", "default font name")
+	serveCmd.Flags().String("default-show", metadata.DefaultShowSlug, "show served by the routes that do not name one")
+	serveCmd.Flags().String("default-language", metadata.DefaultLanguage, "subtitle language captions and context use when a request does not pass lang")
+	serveCmd.Flags().Int64("render-cache-size", api.DefaultRenderCacheSize/(1024*1024), "size in MB of the cache of rendered gifs, clips and images in the object store, 0 disables it")
+	serveCmd.Flags().Int("render-workers", runtime.NumCPU(), "number of gifs, clips and images rendered at once")
+	serveCmd.Flags().Int("render-queue-size", api.DefaultRenderQueueSize, "number of renders that can wait for a worker before requests get a 503")
+	serveCmd.Flags().Int("render-queue-size-per-client", api.DefaultRenderQueueSizePerClient, "number of renders one client can have waiting before its requests get a 429")
+	serveCmd.Flags().String("client-header", "", "request header identifying clients for fair queuing, such as X-Forwarded-For behind a proxy")
+	serveCmd.Flags().Duration("render-timeout", api.DefaultRenderTimeout, "give up on renders that take longer than this with a 504, 0 disables it")
+	serveCmd.Flags().Duration("job-ttl", api.DefaultJobTTL, "how long finished render jobs and their results are kept")
 
 }
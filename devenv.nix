@@ -80,6 +80,11 @@ in
     go run --tags fts5 ./apps/clyper preprocess run testing/samplevideo testing/samplevideo-output
   '';
 
+  # rebuild the sample metadata database after a schema change
+  scripts.update-sample-db.exec = ''
+    go test --tags fts5 ./metadata -run TestSampleDatabase -update-sample-db
+  '';
+
   # start the backend api server
   scripts.backend.exec = ''
     go run --tags fts5 ./apps/clyper serve \
@@ -3,20 +3,37 @@ package metadata
 import (
 	"context"
 	"database/sql"
+	"errors"
 )
 
 type Database struct {
 	db                 *sql.DB
 	preparedStatements map[preparedStatementKey]*sql.Stmt
+	vocabulary         vocabulary
 }
 
 const (
 	searchStmt             preparedStatementKey = "searchStmt"
+	searchCountStmt        preparedStatementKey = "searchCountStmt"
 	listThumbsForwardStmt  preparedStatementKey = "listThumbsForwardsStmt"
 	listThumbsBackwardStmt preparedStatementKey = "listThumbsBackwardsStmt"
 	videoFileStmt          preparedStatementKey = "videoFileStmt"
+	listShowsStmt          preparedStatementKey = "listShowsStmt"
+	listEpisodesInShowStmt preparedStatementKey = "listEpisodesInShowStmt"
+	subtitlesInRangeStmt   preparedStatementKey = "subtitlesInRangeStmt"
+	listLanguagesStmt      preparedStatementKey = "listLanguagesStmt"
+	subtitlesBeforeStmt    preparedStatementKey = "subtitlesBeforeStmt"
+	subtitlesAfterStmt     preparedStatementKey = "subtitlesAfterStmt"
 )
 
+// episodeIDQuery selects the id of the episode identified by show slug,
+// season and episode.
+const episodeIDQuery = `SELECT episodes.id FROM episodes INNER JOIN shows ON shows.id = episodes.show_id WHERE shows.slug = ? AND episodes.season = ? AND episodes.episode = ?`
+
+// ErrSchemaOutdated is returned by OpenDatabase for databases written by an
+// older version of clyper.
+var ErrSchemaOutdated = errors.New("database schema is out of date, rebuild it or run an incremental preprocess")
+
 func OpenDatabase(dbPath string) (*Database, error) {
 	// Open the database as read-only
 	db, err := sql.Open("sqlite3", dbPath)
@@ -24,12 +41,35 @@ func OpenDatabase(dbPath string) (*Database, error) {
 		return nil, err
 	}
 
+	var version int
+	err = db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		db.Close() // nolint: errcheck
+		return nil, err
+	}
+	latest, err := latestSchemaVersion()
+	if err != nil {
+		db.Close() // nolint: errcheck
+		return nil, err
+	}
+	if version < latest {
+		db.Close() // nolint: errcheck
+		return nil, ErrSchemaOutdated
+	}
+
 	preparedStatements := make(map[preparedStatementKey]*sql.Stmt)
 	for key, query := range map[preparedStatementKey]string{
-		searchStmt:             `SELECT episodes.season, episodes.episode, subtitles.start_ts, subtitles.end_ts, subtitles.text FROM subtitles INNER JOIN subtitles_fts ON subtitles.rowid = subtitles_fts.rowid INNER JOIN episodes ON subtitles.episode_id=episodes.id WHERE subtitles_fts MATCH ? limit 100`,
-		listThumbsForwardStmt:  `SELECT storage_key, start_ts, end_ts FROM thumbnails WHERE episode_id = (SELECT id from episodes where season = ? AND episode = ?) AND start_ts >= ? ORDER BY start_ts ASC LIMIT ?`,
-		listThumbsBackwardStmt: `SELECT storage_key, start_ts, end_ts FROM thumbnails WHERE episode_id = (SELECT id from episodes where season = ? AND episode = ?) AND start_ts <= ? ORDER BY start_ts DESC LIMIT ?`,
-		videoFileStmt:          `SELECT storage_key FROM videos WHERE episode_id = (SELECT id from episodes where season = ? AND episode = ?)`,
+		searchStmt:             searchQuery,
+		searchCountStmt:        searchCountQuery,
+		listThumbsForwardStmt:  `SELECT storage_key, start_ts, end_ts FROM thumbnails WHERE episode_id = (` + episodeIDQuery + `) AND start_ts >= ? ORDER BY start_ts ASC LIMIT ?`,
+		listThumbsBackwardStmt: `SELECT storage_key, start_ts, end_ts FROM thumbnails WHERE episode_id = (` + episodeIDQuery + `) AND start_ts <= ? ORDER BY start_ts DESC LIMIT ?`,
+		videoFileStmt:          `SELECT storage_key FROM videos WHERE episode_id = (` + episodeIDQuery + `)`,
+		listShowsStmt:          `SELECT slug, name FROM shows ORDER BY slug`,
+		subtitlesInRangeStmt:   `SELECT start_ts, end_ts, text, language FROM subtitles WHERE episode_id = (` + episodeIDQuery + `) AND language = ? AND end_ts > ? AND start_ts < ? ORDER BY start_ts ASC`,
+		subtitlesBeforeStmt:    `SELECT start_ts, end_ts, text, language FROM subtitles WHERE episode_id = (` + episodeIDQuery + `) AND language = ? AND start_ts <= ? ORDER BY start_ts DESC, id DESC LIMIT ?`,
+		subtitlesAfterStmt:     `SELECT start_ts, end_ts, text, language FROM subtitles WHERE episode_id = (` + episodeIDQuery + `) AND language = ? AND start_ts > ? ORDER BY start_ts ASC, id ASC LIMIT ?`,
+		listLanguagesStmt:      `SELECT DISTINCT subtitles.language FROM subtitles INNER JOIN episodes ON subtitles.episode_id = episodes.id INNER JOIN shows ON shows.id = episodes.show_id WHERE shows.slug = ? ORDER BY subtitles.language`,
+		listEpisodesInShowStmt: `SELECT episodes.season, episodes.episode, episodes.kind, episodes.title FROM episodes INNER JOIN shows ON shows.id = episodes.show_id WHERE shows.slug = ? ORDER BY episodes.season, episodes.episode`,
 	} {
 		stmt, err := db.Prepare(query)
 		if err != nil {
@@ -46,68 +86,181 @@ func OpenDatabase(dbPath string) (*Database, error) {
 	}, nil
 }
 
-type SearchResult struct {
-	Season  int    `json:"season"`
-	Episode int    `json:"episode"`
-	Start   int    `json:"start"`
-	End     int    `json:"end"`
-	Text    string `json:"text"`
+func (d *Database) ListThumbnails(ctx context.Context, show string, season int, episode int, timestamp int, count int, reverse bool) ([]ThumbMetadata, error) {
+	var stmtKey preparedStatementKey
+	if reverse {
+		stmtKey = listThumbsBackwardStmt
+	} else {
+		stmtKey = listThumbsForwardStmt
+	}
+
+	rows, err := d.preparedStatements[stmtKey].QueryContext(ctx, show, season, episode, timestamp, count)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []ThumbMetadata
+	for rows.Next() {
+		result := ThumbMetadata{}
+		err := rows.Scan(&result.Key, &result.Start, &result.End)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (d *Database) GetVideoFileKey(ctx context.Context, show string, season int, episode int) (string, error) {
+	var key string
+	err := d.preparedStatements[videoFileStmt].QueryRowContext(ctx, show, season, episode).Scan(&key)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
 }
 
-func (d *Database) Search(ctx context.Context, queryString string) ([]SearchResult, error) {
-	rows, err := d.preparedStatements[searchStmt].QueryContext(ctx, queryString)
+func (d *Database) ListShows(ctx context.Context) ([]Show, error) {
+	rows, err := d.preparedStatements[listShowsStmt].QueryContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var results []SearchResult
+	var results []Show
 	for rows.Next() {
-		var result SearchResult
-		err := rows.Scan(&result.Season, &result.Episode, &result.Start, &result.End, &result.Text)
+		var result Show
+		err := rows.Scan(&result.Slug, &result.Name)
 		if err != nil {
 			return nil, err
 		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// ListEpisodes lists the episodes, specials and movies of show.
+func (d *Database) ListEpisodes(ctx context.Context, show string) ([]EpisodeInfo, error) {
+	rows, err := d.preparedStatements[listEpisodesInShowStmt].QueryContext(ctx, show)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
+	var results []EpisodeInfo
+	for rows.Next() {
+		var result EpisodeInfo
+		err := rows.Scan(&result.Season, &result.Episode, &result.Kind, &result.Title)
+		if err != nil {
+			return nil, err
+		}
 		results = append(results, result)
 	}
+	return results, nil
+}
+
+// ListSubtitles returns the subtitles in language that are shown between
+// start and end, in the order they appear.
+func (d *Database) ListSubtitles(ctx context.Context, show string, season int, episode int, language string, start int, end int) ([]SubtitleMetadata, error) {
+	rows, err := d.preparedStatements[subtitlesInRangeStmt].QueryContext(ctx, show, season, episode, language, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
+	var results []SubtitleMetadata
+	for rows.Next() {
+		var result SubtitleMetadata
+		err := rows.Scan(&result.Start, &result.End, &result.Text, &result.Language)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
 	return results, nil
 }
 
-func (d *Database) ListThumbnails(ctx context.Context, season int, episode int, timestamp int, count int, reverse bool) ([]ThumbMetadata, error) {
-	var stmtKey preparedStatementKey
-	if reverse {
-		stmtKey = listThumbsBackwardStmt
-	} else {
-		stmtKey = listThumbsForwardStmt
+// SubtitleContext returns the subtitles in language around timestamp, up to
+// before subtitles preceding and after subtitles following the subtitle
+// shown at timestamp, in the order they appear. The subtitle at timestamp is
+// the one being shown then, or the next one to be shown if timestamp falls
+// between two subtitles. Its index in the results is returned alongside
+// them, and is -1 if there is none, because timestamp is after the last
+// subtitle or the episode has no subtitles in language.
+func (d *Database) SubtitleContext(ctx context.Context, show string, season int, episode int, language string, timestamp int, before int, after int) ([]SubtitleMetadata, int, error) {
+	// Fetch one more subtitle on each side, either may turn out to be the
+	// one at timestamp
+	preceding, err := d.querySubtitles(ctx, subtitlesBeforeStmt, show, season, episode, language, timestamp, before+1)
+	if err != nil {
+		return nil, -1, err
 	}
+	following, err := d.querySubtitles(ctx, subtitlesAfterStmt, show, season, episode, language, timestamp, after+1)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	current := -1
+	switch {
+	case len(preceding) > 0 && preceding[0].End > timestamp:
+		// The last subtitle to start is still shown
+		following = following[:min(after, len(following))]
+		current = len(preceding) - 1
+	case len(following) > 0:
+		// Between subtitles, the next one is the one at timestamp
+		preceding = preceding[:min(before, len(preceding))]
+		following = following[:min(after+1, len(following))]
+		current = len(preceding)
+	default:
+		// After the last subtitle
+		preceding = preceding[:min(before, len(preceding))]
+	}
+
+	results := make([]SubtitleMetadata, 0, len(preceding)+len(following))
+	for i := len(preceding) - 1; i >= 0; i-- {
+		results = append(results, preceding[i])
+	}
+	results = append(results, following...)
+	return results, current, nil
+}
 
-	rows, err := d.preparedStatements[stmtKey].QueryContext(ctx, season, episode, timestamp, count)
+func (d *Database) querySubtitles(ctx context.Context, key preparedStatementKey, args ...any) ([]SubtitleMetadata, error) {
+	rows, err := d.preparedStatements[key].QueryContext(ctx, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var results []ThumbMetadata
+	var results []SubtitleMetadata
 	for rows.Next() {
-		result := ThumbMetadata{}
-		err := rows.Scan(&result.Key, &result.Start, &result.End)
+		var result SubtitleMetadata
+		err := rows.Scan(&result.Start, &result.End, &result.Text, &result.Language)
 		if err != nil {
 			return nil, err
 		}
 		results = append(results, result)
 	}
-	return results, nil
+	return results, rows.Err()
 }
 
-func (d *Database) GetVideoFileKey(ctx context.Context, season int, episode int) (string, error) {
-	var key string
-	err := d.preparedStatements[videoFileStmt].QueryRowContext(ctx, season, episode).Scan(&key)
+// ListLanguages returns the subtitle languages available for show.
+func (d *Database) ListLanguages(ctx context.Context, show string) ([]string, error) {
+	rows, err := d.preparedStatements[listLanguagesStmt].QueryContext(ctx, show)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return key, nil
+	defer rows.Close()
+
+	var results []string
+	for rows.Next() {
+		var result string
+		err := rows.Scan(&result)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
 }
 
 func (d *Database) Close() error {
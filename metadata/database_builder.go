@@ -2,6 +2,7 @@ package metadata
 
 import (
 	"database/sql"
+	"errors"
 	"os"
 	"path"
 
@@ -14,63 +15,101 @@ import (
 type preparedStatementKey string
 
 const (
-	insertEpisodeStmt   preparedStatementKey = "insertEpisodeStmt"
-	insertThumbnailStmt preparedStatementKey = "insertThumbnailStmt"
-	insertVideoStmt     preparedStatementKey = "insertVideoStmt"
-	insertSubtitlStmt   preparedStatementKey = "insertSubtitleStmt"
+	insertEpisodeStmt     preparedStatementKey = "insertEpisodeStmt"
+	insertThumbnailStmt   preparedStatementKey = "insertThumbnailStmt"
+	insertVideoStmt       preparedStatementKey = "insertVideoStmt"
+	insertSubtitlStmt     preparedStatementKey = "insertSubtitleStmt"
+	selectEpisodeIDStmt   preparedStatementKey = "selectEpisodeIDStmt"
+	listEpisodesStmt      preparedStatementKey = "listEpisodesStmt"
+	deleteThumbnailsStmt  preparedStatementKey = "deleteThumbnailsStmt"
+	deleteVideosStmt      preparedStatementKey = "deleteVideosStmt"
+	deleteSubtitlesStmt   preparedStatementKey = "deleteSubtitlesStmt"
+	deleteEpisodeByIDStmt preparedStatementKey = "deleteEpisodeByIDStmt"
+	insertShowStmt        preparedStatementKey = "insertShowStmt"
+	selectShowIDStmt      preparedStatementKey = "selectShowIDStmt"
+	deleteEmptyShowsStmt  preparedStatementKey = "deleteEmptyShowsStmt"
 )
 
+// DefaultDatabaseKey is the object store key the metadata database is
+// written to.
+const DefaultDatabaseKey = "internal/metadata.db"
+
 type DatabaseBuilder struct {
-	objReader          objstore.ObjectReader
+	store              objstore.ObjectStore
 	db                 *sql.DB
 	preparedStatements map[preparedStatementKey]*sql.Stmt
-	outputDatabasePath string
+	outputDatabaseKey  string
+	tmpDir             string
 	tmpDatabasePath    string
 }
 
-func NewDatabaseBuilder(dbPath string, objReader objstore.ObjectReader) (*DatabaseBuilder, error) {
-	dbPathDirName := path.Dir(dbPath)
-	tmpDbPath := path.Join(dbPathDirName, "tmp.db")
-	_, err := os.Stat(tmpDbPath)
-	if err == nil {
-		// Remove the temporary database
-		err = os.Remove(tmpDbPath)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to remove temporary database")
-			return nil, err
-		}
-	}
-	db, err := sql.Open("sqlite3", tmpDbPath)
+// NewDatabaseBuilder creates a builder that assembles the database in a
+// local temporary directory and uploads it to dbKey in store on Build.
+func NewDatabaseBuilder(dbKey string, store objstore.ObjectStore) (*DatabaseBuilder, error) {
+	return newDatabaseBuilder(dbKey, store, false)
+}
+
+// NewIncrementalDatabaseBuilder creates a builder that starts from the
+// database currently stored at dbKey, so only changed episodes need to be
+// written. If there is no database at dbKey yet, it starts from an empty one.
+func NewIncrementalDatabaseBuilder(dbKey string, store objstore.ObjectStore) (*DatabaseBuilder, error) {
+	return newDatabaseBuilder(dbKey, store, true)
+}
+
+func newDatabaseBuilder(dbKey string, store objstore.ObjectStore, incremental bool) (*DatabaseBuilder, error) {
+	tmpDir, err := os.MkdirTemp("", "clyper-db")
 	if err != nil {
+		log.Error().Err(err).Msg("Failed to create temporary directory")
 		return nil, err
 	}
+	tmpDbPath := path.Join(tmpDir, "tmp.db")
 
-	// Execute the schema
-	schemaBytes, err := SchemaFS.ReadFile("schema.sql")
+	if incremental {
+		err = objstore.Fetch(store, dbKey, tmpDbPath)
+		if errors.Is(err, objstore.ErrNotExist) {
+			log.Info().Str("key", dbKey).Msg("No existing database, starting from an empty one")
+		} else if err != nil {
+			os.RemoveAll(tmpDir) // nolint: errcheck
+			log.Error().Err(err).Msg("Failed to fetch the existing database")
+			return nil, err
+		}
+	}
+
+	db, err := sql.Open("sqlite3", tmpDbPath)
 	if err != nil {
-		db.Close() // nolint: errcheck
-		log.Error().Err(err).Msg("Failed to read schema.sql")
+		os.RemoveAll(tmpDir) // nolint: errcheck
 		return nil, err
 	}
 
-	// Execute the schema
-	_, err = db.Exec(string(schemaBytes))
+	// Create the schema. This also upgrades databases written by older
+	// versions.
+	err = migrate(db)
 	if err != nil {
-		db.Close() // nolint: errcheck
-		log.Error().Err(err).Msg("Failed to execute schema.sql")
+		db.Close()           // nolint: errcheck
+		os.RemoveAll(tmpDir) // nolint: errcheck
 		return nil, err
 	}
 
 	preparedStatements := make(map[preparedStatementKey]*sql.Stmt)
 	for key, stmt := range map[preparedStatementKey]string{
-		insertEpisodeStmt:   `INSERT INTO episodes (season, episode) VALUES (?, ?)`,
-		insertThumbnailStmt: `INSERT INTO thumbnails (episode_id, storage_key, start_ts, end_ts) VALUES (?, ?, ?, ?)`,
-		insertVideoStmt:     `INSERT INTO videos (episode_id, storage_key) VALUES (?, ?)`,
-		insertSubtitlStmt:   `INSERT INTO subtitles (episode_id, text, start_ts, end_ts) VALUES (?, ?,?, ?)`,
+		insertEpisodeStmt:     `INSERT INTO episodes (show_id, season, episode, kind, title, source_fingerprint) VALUES (?, ?, ?, ?, ?, ?)`,
+		insertThumbnailStmt:   `INSERT INTO thumbnails (episode_id, storage_key, start_ts, end_ts) VALUES (?, ?, ?, ?)`,
+		insertVideoStmt:       `INSERT INTO videos (episode_id, storage_key) VALUES (?, ?)`,
+		insertSubtitlStmt:     `INSERT INTO subtitles (episode_id, text, start_ts, end_ts, language) VALUES (?, ?, ?, ?, ?)`,
+		selectEpisodeIDStmt:   `SELECT episodes.id FROM episodes INNER JOIN shows ON shows.id = episodes.show_id WHERE shows.slug = ? AND episodes.season = ? AND episodes.episode = ?`,
+		listEpisodesStmt:      `SELECT shows.slug, episodes.season, episodes.episode, episodes.source_fingerprint, COALESCE(videos.storage_key, '') FROM episodes INNER JOIN shows ON shows.id = episodes.show_id LEFT JOIN videos ON videos.episode_id = episodes.id ORDER BY shows.slug, episodes.season, episodes.episode`,
+		deleteThumbnailsStmt:  `DELETE FROM thumbnails WHERE episode_id = ?`,
+		deleteVideosStmt:      `DELETE FROM videos WHERE episode_id = ?`,
+		deleteSubtitlesStmt:   `DELETE FROM subtitles WHERE episode_id = ?`,
+		deleteEpisodeByIDStmt: `DELETE FROM episodes WHERE id = ?`,
+		insertShowStmt:        `INSERT INTO shows (slug, name) VALUES (?, ?) ON CONFLICT (slug) DO NOTHING`,
+		selectShowIDStmt:      `SELECT id FROM shows WHERE slug = ?`,
+		deleteEmptyShowsStmt:  `DELETE FROM shows WHERE id NOT IN (SELECT show_id FROM episodes)`,
 	} {
 		preparedStmt, err := db.Prepare(stmt)
 		if err != nil {
-			db.Close() // nolint: errcheck
+			db.Close()           // nolint: errcheck
+			os.RemoveAll(tmpDir) // nolint: errcheck
 			log.Error().Err(err).Msg("Failed to prepare statement")
 			return nil, err
 		}
@@ -79,17 +118,27 @@ func NewDatabaseBuilder(dbPath string, objReader objstore.ObjectReader) (*Databa
 	}
 
 	return &DatabaseBuilder{
-		objReader:          objReader,
+		store:              store,
 		db:                 db,
 		preparedStatements: preparedStatements,
-		outputDatabasePath: dbPath,
+		outputDatabaseKey:  dbKey,
+		tmpDir:             tmpDir,
 		tmpDatabasePath:    tmpDbPath,
 	}, nil
 }
 
 func (b *DatabaseBuilder) Build() error {
+	defer b.Close() // nolint: errcheck
+
+	// Remove shows that no longer have any episodes
+	_, err := b.preparedStatements[deleteEmptyShowsStmt].Exec()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to remove empty shows")
+		return err
+	}
+
 	// Compact the database
-	_, err := b.db.Exec("VACUUM")
+	_, err = b.db.Exec("VACUUM")
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to compact the database")
 		return err
@@ -102,19 +151,73 @@ func (b *DatabaseBuilder) Build() error {
 		return err
 	}
 
-	// Move the temporary database to the output path
-	err = os.Rename(b.tmpDatabasePath, b.outputDatabasePath)
+	// Upload the temporary database to the object store
+	err = objstore.PutFile(b.store, b.outputDatabaseKey, b.tmpDatabasePath)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to move the temporary database")
+		log.Error().Err(err).Msg("Failed to upload the database")
 		return err
 	}
 
 	return nil
 }
 
+// Close discards the database being built and removes its temporary
+// directory. Builders that are not built, such as when processing was
+// cancelled, must be closed. It does nothing after Build or a previous
+// Close.
+func (b *DatabaseBuilder) Close() error {
+	err := b.db.Close()
+	rmErr := os.RemoveAll(b.tmpDir)
+	if err != nil {
+		return err
+	}
+	return rmErr
+}
+
+// AddEpisodeMetadata inserts the episode, replacing any episode already in
+// the database with the same show, season and episode number.
 func (b *DatabaseBuilder) AddEpisodeMetadata(metadata EpisodeMetadata) error {
+	show := metadata.Show
+	if show == "" {
+		show = DefaultShowSlug
+	}
+	showName := metadata.ShowName
+	if showName == "" {
+		showName = show
+	}
+	kind := metadata.Kind
+	if kind == "" {
+		kind = KindEpisode
+	}
+
+	tx, err := b.db.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to begin transaction")
+		return err
+	}
+	defer tx.Rollback() // nolint: errcheck
+
+	err = b.removeEpisode(tx, show, metadata.Season, metadata.Episode)
+	if err != nil {
+		return err
+	}
+
+	// Insert the show if this is its first episode
+	_, err = tx.Stmt(b.preparedStatements[insertShowStmt]).Exec(show, showName)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to insert show")
+		return err
+	}
+
+	var showID int64
+	err = tx.Stmt(b.preparedStatements[selectShowIDStmt]).QueryRow(show).Scan(&showID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get show ID")
+		return err
+	}
+
 	// Insert the episode
-	res, err := b.preparedStatements[insertEpisodeStmt].Exec(metadata.Season, metadata.Episode)
+	res, err := tx.Stmt(b.preparedStatements[insertEpisodeStmt]).Exec(showID, metadata.Season, metadata.Episode, kind, metadata.Title, metadata.SourceFingerprint)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to insert episode")
 		return err
@@ -127,8 +230,9 @@ func (b *DatabaseBuilder) AddEpisodeMetadata(metadata EpisodeMetadata) error {
 	}
 
 	// Insert the thumbnails
+	insertThumbnail := tx.Stmt(b.preparedStatements[insertThumbnailStmt])
 	for _, thumb := range metadata.Thumbs {
-		_, err = b.preparedStatements[insertThumbnailStmt].Exec(episodeID, thumb.Key, thumb.Start, thumb.End)
+		_, err = insertThumbnail.Exec(episodeID, thumb.Key, thumb.Start, thumb.End)
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to insert thumbnail")
 			return err
@@ -136,19 +240,112 @@ func (b *DatabaseBuilder) AddEpisodeMetadata(metadata EpisodeMetadata) error {
 	}
 
 	// Insert the video
-	_, err = b.preparedStatements[insertVideoStmt].Exec(episodeID, metadata.VideoFileKey)
+	_, err = tx.Stmt(b.preparedStatements[insertVideoStmt]).Exec(episodeID, metadata.VideoFileKey)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to insert video")
 		return err
 	}
 
+	insertSubtitle := tx.Stmt(b.preparedStatements[insertSubtitlStmt])
 	for _, s := range metadata.Subtitles {
-		_, err = b.preparedStatements[insertSubtitlStmt].Exec(episodeID, s.Text, s.Start, s.End)
+		language := s.Language
+		if language == "" {
+			language = DefaultLanguage
+		}
+		_, err = insertSubtitle.Exec(episodeID, s.Text, s.Start, s.End, language)
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to insert subtitle")
 			return err
 		}
 	}
 
+	return tx.Commit()
+}
+
+// RemoveEpisode deletes the episode and everything attached to it. Removing
+// an episode that is not in the database is not an error.
+func (b *DatabaseBuilder) RemoveEpisode(show string, season int, episode int) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to begin transaction")
+		return err
+	}
+	defer tx.Rollback() // nolint: errcheck
+
+	err = b.removeEpisode(tx, show, season, episode)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (b *DatabaseBuilder) removeEpisode(tx *sql.Tx, show string, season int, episode int) error {
+	var episodeID int64
+	err := tx.Stmt(b.preparedStatements[selectEpisodeIDStmt]).QueryRow(show, season, episode).Scan(&episodeID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to look up episode")
+		return err
+	}
+
+	// Subtitles are removed from the full text index by the subtitles_ad
+	// trigger.
+	for _, key := range []preparedStatementKey{
+		deleteThumbnailsStmt,
+		deleteVideosStmt,
+		deleteSubtitlesStmt,
+		deleteEpisodeByIDStmt,
+	} {
+		_, err = tx.Stmt(b.preparedStatements[key]).Exec(episodeID)
+		if err != nil {
+			log.Error().Err(err).Str("stmt", string(key)).Msg("Failed to remove episode")
+			return err
+		}
+	}
+
 	return nil
 }
+
+// StoredEpisode is an episode that is already present in the database.
+type StoredEpisode struct {
+	Show    string
+	Season  int
+	Episode int
+	// SourceFingerprint is the EpisodeMetadata.SourceFingerprint the episode
+	// was stored with. It is empty for episodes stored before fingerprints
+	// were recorded.
+	SourceFingerprint string
+	VideoFileKey      string
+}
+
+// Matches reports whether md was processed from the same source, with the
+// same settings, as the stored episode, so it does not need rewriting.
+func (e StoredEpisode) Matches(md *EpisodeMetadata) bool {
+	return e.SourceFingerprint != "" &&
+		e.SourceFingerprint == md.SourceFingerprint &&
+		e.VideoFileKey == md.VideoFileKey
+}
+
+// Episodes lists the episodes currently in the database, ordered by show,
+// season and episode.
+func (b *DatabaseBuilder) Episodes() ([]StoredEpisode, error) {
+	rows, err := b.preparedStatements[listEpisodesStmt].Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []StoredEpisode
+	for rows.Next() {
+		var result StoredEpisode
+		err := rows.Scan(&result.Show, &result.Season, &result.Episode, &result.SourceFingerprint, &result.VideoFileKey)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
@@ -0,0 +1,318 @@
+package metadata
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jaym/clyper/objstore"
+)
+
+// requireFTS5 skips tests that need a database when go-sqlite3 was built
+// without FTS5, which needs the fts5 build tag.
+func requireFTS5(t *testing.T) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec("CREATE VIRTUAL TABLE probe USING fts5(text)")
+	if err != nil && strings.Contains(err.Error(), "no such module") {
+		t.Skip("sqlite was built without FTS5, run the tests with -tags fts5")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testEpisode returns the metadata of an episode of show with one subtitle
+// per text, each shown for a second with a second between them.
+func testEpisode(show string, season int, episode int, fingerprint string, texts ...string) EpisodeMetadata {
+	md := EpisodeMetadata{
+		Show:              show,
+		Season:            season,
+		Episode:           episode,
+		VideoFileKey:      "internal/" + show + "/video.mkv",
+		SourceFingerprint: fingerprint,
+	}
+	for i, text := range texts {
+		md.Subtitles = append(md.Subtitles, SubtitleMetadata{
+			Start: i * 2000,
+			End:   i*2000 + 1000,
+			Text:  text,
+		})
+	}
+	return md
+}
+
+// buildDatabase builds a database of episodes in store with builder and
+// opens it.
+func buildDatabase(t *testing.T, store *objstore.LocalFSObjectStore, builder *DatabaseBuilder, episodes ...EpisodeMetadata) *Database {
+	t.Helper()
+
+	for _, md := range episodes {
+		if err := builder.AddEpisodeMetadata(md); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	return openTestDatabase(t, store)
+}
+
+func openTestDatabase(t *testing.T, store *objstore.LocalFSObjectStore) *Database {
+	t.Helper()
+
+	dbPath, err := store.Path(DefaultDatabaseKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDatabase(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestDatabase builds a fresh database of episodes.
+func newTestDatabase(t *testing.T, episodes ...EpisodeMetadata) *Database {
+	t.Helper()
+	requireFTS5(t)
+
+	store := objstore.NewLocalFSObjectStore(t.TempDir())
+	builder, err := NewDatabaseBuilder(DefaultDatabaseKey, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buildDatabase(t, store, builder, episodes...)
+}
+
+func storedEpisodes(t *testing.T, builder *DatabaseBuilder) map[string]StoredEpisode {
+	t.Helper()
+
+	episodes, err := builder.Episodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := map[string]StoredEpisode{}
+	for _, ep := range episodes {
+		results[ep.Show] = ep
+	}
+	return results
+}
+
+func subtitleTexts(t *testing.T, db *Database, show string) []string {
+	t.Helper()
+
+	subs, err := db.ListSubtitles(context.Background(), show, 1, 1, DefaultLanguage, 0, 1000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var texts []string
+	for _, s := range subs {
+		texts = append(texts, s.Text)
+	}
+	return texts
+}
+
+func TestIncrementalDatabaseBuilder(t *testing.T) {
+	requireFTS5(t)
+	store := objstore.NewLocalFSObjectStore(t.TempDir())
+
+	// There is no database yet, the incremental builder starts empty
+	builder, err := NewIncrementalDatabaseBuilder(DefaultDatabaseKey, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if episodes := storedEpisodes(t, builder); len(episodes) != 0 {
+		t.Fatalf("new database has episodes: %v", episodes)
+	}
+	buildDatabase(t, store, builder,
+		testEpisode("unchanged", 1, 1, "fp-unchanged", "unchanged line"),
+		testEpisode("changed", 1, 1, "fp-old", "old line"),
+		testEpisode("removed", 1, 1, "fp-removed", "removed line"),
+	).Close()
+
+	builder, err = NewIncrementalDatabaseBuilder(DefaultDatabaseKey, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := storedEpisodes(t, builder)
+	if len(stored) != 3 {
+		t.Fatalf("expected 3 stored episodes, got %v", stored)
+	}
+
+	unchanged := testEpisode("unchanged", 1, 1, "fp-unchanged", "unchanged line")
+	changed := testEpisode("changed", 1, 1, "fp-new", "new line")
+	added := testEpisode("added", 1, 1, "fp-added", "added line")
+	if !stored["unchanged"].Matches(&unchanged) {
+		t.Errorf("unchanged episode does not match %+v", stored["unchanged"])
+	}
+	if stored["changed"].Matches(&changed) {
+		t.Errorf("changed episode matches %+v", stored["changed"])
+	}
+	rescaled := unchanged
+	rescaled.VideoFileKey = "internal/unchanged/other.mkv"
+	if stored["unchanged"].Matches(&rescaled) {
+		t.Errorf("episode with a new video key matches %+v", stored["unchanged"])
+	}
+
+	if err := builder.RemoveEpisode("removed", 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	// Removing a missing episode is not an error
+	if err := builder.RemoveEpisode("missing", 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	db := buildDatabase(t, store, builder, changed, added)
+
+	ctx := context.Background()
+	shows, err := db.ListShows(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var slugs []string
+	for _, show := range shows {
+		slugs = append(slugs, show.Slug)
+	}
+	// The show of the removed episode has no episodes left and is gone
+	if want := []string{"added", "changed", "unchanged"}; !reflect.DeepEqual(slugs, want) {
+		t.Errorf("shows = %q, want %q", slugs, want)
+	}
+
+	for show, want := range map[string][]string{
+		"unchanged": {"unchanged line"},
+		"changed":   {"new line"},
+		"added":     {"added line"},
+		"removed":   nil,
+	} {
+		if got := subtitleTexts(t, db, show); !reflect.DeepEqual(got, want) {
+			t.Errorf("subtitles of %s = %q, want %q", show, got, want)
+		}
+	}
+
+	// The old subtitles of the changed episode are gone from the index too
+	page, err := db.Search(ctx, "changed", "old", SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Results) != 0 {
+		t.Errorf("search for a replaced subtitle returned %+v", page.Results)
+	}
+
+	builder, err = NewIncrementalDatabaseBuilder(DefaultDatabaseKey, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer builder.Build() // nolint: errcheck
+	stored = storedEpisodes(t, builder)
+	if got := stored["changed"].SourceFingerprint; got != "fp-new" {
+		t.Errorf("changed episode has fingerprint %q, want fp-new", got)
+	}
+	if !stored["added"].Matches(&added) {
+		t.Errorf("added episode does not match %+v", stored["added"])
+	}
+}
+
+func TestStoredEpisodeWithoutFingerprintNeverMatches(t *testing.T) {
+	md := testEpisode("legacy", 1, 1, "")
+	stored := StoredEpisode{Show: "legacy", Season: 1, Episode: 1, VideoFileKey: md.VideoFileKey}
+	if stored.Matches(&md) {
+		t.Errorf("episode stored without a fingerprint matches")
+	}
+}
+
+func TestMigrateUpgradesBaselineDatabase(t *testing.T) {
+	requireFTS5(t)
+	dir := t.TempDir()
+	store := objstore.NewLocalFSObjectStore(dir)
+
+	// A database written before migrations existed, by an incremental
+	// builder that indexed episodes by season and episode alone
+	baseline, err := SchemaFS.ReadFile("schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "internal"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "internal", "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(string(baseline) + `
+		CREATE UNIQUE INDEX episodes_season_episode ON episodes (season, episode);
+		INSERT INTO episodes (season, episode) VALUES (1, 1);
+		INSERT INTO subtitles (episode_id, start_ts, end_ts, text) VALUES (1, 0, 1000, 'hello');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if _, err := OpenDatabase(filepath.Join(dir, "internal", "metadata.db")); err != ErrSchemaOutdated {
+		t.Fatalf("opening a baseline database returned %v, want ErrSchemaOutdated", err)
+	}
+
+	builder, err := NewIncrementalDatabaseBuilder(DefaultDatabaseKey, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := storedEpisodes(t, builder)
+	if ep, ok := stored[DefaultShowSlug]; !ok || ep.SourceFingerprint != "" {
+		t.Errorf("baseline episode was not migrated: %v", stored)
+	}
+	upgraded := buildDatabase(t, store, builder, testEpisode("other", 1, 1, "fp", "hi"))
+	if got := subtitleTexts(t, upgraded, DefaultShowSlug); !reflect.DeepEqual(got, []string{"hello"}) {
+		t.Errorf("subtitles after migration = %q", got)
+	}
+	if got := subtitleTexts(t, upgraded, "other"); !reflect.DeepEqual(got, []string{"hi"}) {
+		t.Errorf("subtitles of another show's S01E01 = %q", got)
+	}
+}
+
+func TestDatabaseBuilderClose(t *testing.T) {
+	requireFTS5(t)
+	store := objstore.NewLocalFSObjectStore(t.TempDir())
+
+	builder, err := NewIncrementalDatabaseBuilder(DefaultDatabaseKey, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.AddEpisodeMetadata(testEpisode("show", 1, 1, "fp", "hello")); err != nil {
+		t.Fatal(err)
+	}
+	// A builder that is not built leaves nothing behind once closed
+	if err := builder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(builder.tmpDir); !os.IsNotExist(err) {
+		t.Errorf("temporary directory is left after Close: %v", err)
+	}
+	if err := builder.Close(); err != nil {
+		t.Errorf("closing again returned %v", err)
+	}
+	if _, err := store.Stat(DefaultDatabaseKey); err == nil {
+		t.Error("closing the builder uploaded the database")
+	}
+
+	builder, err = NewDatabaseBuilder(DefaultDatabaseKey, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buildDatabase(t, store, builder, testEpisode("show", 1, 1, "fp", "hello"))
+	if _, err := os.Stat(builder.tmpDir); !os.IsNotExist(err) {
+		t.Errorf("temporary directory is left after Build: %v", err)
+	}
+	if err := builder.Close(); err != nil {
+		t.Errorf("closing after Build returned %v", err)
+	}
+}
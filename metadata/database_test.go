@@ -0,0 +1,52 @@
+package metadata
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestSubtitleContext(t *testing.T) {
+	// Subtitles are shown for a second, from 1s with a second between them
+	md := testEpisode(DefaultShowSlug, 1, 1, "")
+	for i, text := range []string{"one", "two", "three", "four", "five"} {
+		md.Subtitles = append(md.Subtitles, SubtitleMetadata{Start: 1000 + i*2000, End: 2000 + i*2000, Text: text})
+	}
+	db := newTestDatabase(t, md)
+
+	for _, tc := range []struct {
+		name      string
+		language  string
+		timestamp int
+		before    int
+		after     int
+		want      []string
+		current   int
+	}{
+		{"before the first subtitle", DefaultLanguage, 0, 1, 1, []string{"one", "two"}, 0},
+		{"inside a subtitle", DefaultLanguage, 5500, 1, 1, []string{"two", "three", "four"}, 1},
+		{"start of a subtitle", DefaultLanguage, 5000, 1, 1, []string{"two", "three", "four"}, 1},
+		{"inside without context", DefaultLanguage, 5500, 0, 0, []string{"three"}, 0},
+		{"inside the last subtitle", DefaultLanguage, 9500, 2, 2, []string{"three", "four", "five"}, 2},
+		{"between subtitles", DefaultLanguage, 4500, 1, 1, []string{"two", "three", "four"}, 1},
+		{"end of a subtitle", DefaultLanguage, 6000, 1, 1, []string{"three", "four", "five"}, 1},
+		{"between with more context than there is", DefaultLanguage, 4500, 10, 10, []string{"one", "two", "three", "four", "five"}, 2},
+		{"after the last subtitle", DefaultLanguage, 20000, 2, 2, []string{"four", "five"}, -1},
+		{"after the last subtitle without context", DefaultLanguage, 20000, 0, 2, nil, -1},
+		{"no subtitles", "spa", 5500, 2, 2, nil, -1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			subtitles, current, err := db.SubtitleContext(context.Background(), DefaultShowSlug, 1, 1, tc.language, tc.timestamp, tc.before, tc.after)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var texts []string
+			for _, subtitle := range subtitles {
+				texts = append(texts, subtitle.Text)
+			}
+			if !reflect.DeepEqual(texts, tc.want) || current != tc.current {
+				t.Errorf("SubtitleContext(%d, %d, %d) = %q, %d, want %q, %d", tc.timestamp, tc.before, tc.after, texts, current, tc.want, tc.current)
+			}
+		})
+	}
+}
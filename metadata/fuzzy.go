@@ -0,0 +1,212 @@
+package metadata
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// maxFuzzyAlternatives is the number of similar words a search term is
+	// expanded to in fuzzy searches.
+	maxFuzzyAlternatives = 5
+	// minFuzzyWordLength is the length of the shortest word that is
+	// corrected. Shorter words have too many neighbours to guess from.
+	minFuzzyWordLength = 4
+)
+
+// wordRegex matches the words of a query the way the FTS5 unicode61
+// tokenizer splits them.
+var wordRegex = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+// vocabulary is the set of words in the subtitles, loaded from the
+// subtitles_vocab table the first time it is needed. It is loaded outside
+// of any request context, so one cancelled request cannot fail the load
+// for all that follow.
+type vocabulary struct {
+	once sync.Once
+	err  error
+	// docs is the number of subtitles each word appears in.
+	docs map[string]int
+	// byLength lists the words of each length in runes.
+	byLength map[int][]string
+}
+
+func (v *vocabulary) load(d *Database) error {
+	v.once.Do(func() {
+		rows, err := d.db.QueryContext(context.Background(), "SELECT term, doc FROM subtitles_vocab")
+		if err != nil {
+			v.err = err
+			return
+		}
+		defer rows.Close()
+
+		v.docs = map[string]int{}
+		v.byLength = map[int][]string{}
+		for rows.Next() {
+			var term string
+			var docs int
+			err := rows.Scan(&term, &docs)
+			if err != nil {
+				v.err = err
+				return
+			}
+			v.docs[term] = docs
+			length := len([]rune(term))
+			v.byLength[length] = append(v.byLength[length], term)
+		}
+		v.err = rows.Err()
+	})
+	return v.err
+}
+
+type wordCandidate struct {
+	word     string
+	distance int
+	docs     int
+}
+
+// similar returns the words within the edit distance allowed for word,
+// closest and most common first, including word itself if it is known.
+func (v *vocabulary) similar(word string, limit int) []string {
+	length := len([]rune(word))
+	maxDistance := 0
+	switch {
+	case length >= 7:
+		maxDistance = 2
+	case length >= minFuzzyWordLength:
+		maxDistance = 1
+	}
+
+	var candidates []wordCandidate
+	if docs, ok := v.docs[word]; ok {
+		candidates = append(candidates, wordCandidate{word: word, docs: docs})
+	}
+	for l := length - maxDistance; maxDistance > 0 && l <= length+maxDistance; l++ {
+		for _, term := range v.byLength[l] {
+			if term == word {
+				continue
+			}
+			if distance := editDistance(word, term, maxDistance); distance <= maxDistance {
+				candidates = append(candidates, wordCandidate{word: term, distance: distance, docs: v.docs[term]})
+			}
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		if candidates[i].docs != candidates[j].docs {
+			return candidates[i].docs > candidates[j].docs
+		}
+		return candidates[i].word < candidates[j].word
+	})
+
+	words := make([]string, 0, min(limit, len(candidates)))
+	for i := 0; i < len(candidates) && i < limit; i++ {
+		words = append(words, candidates[i].word)
+	}
+	return words
+}
+
+// editDistance returns the optimal string alignment distance between a and
+// b, the number of insertions, deletions, substitutions and transpositions
+// of adjacent characters that turn one into the other. It stops counting
+// once the distance exceeds maxDistance.
+func editDistance(a string, b string, maxDistance int) int {
+	ra, rb := []rune(a), []rune(b)
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin > maxDistance {
+			return maxDistance + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(rb)]
+}
+
+// normalizeWord folds a word the way the FTS5 unicode61 tokenizer does,
+// lower case and without diacritics.
+func normalizeWord(word string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(t, word)
+	if err != nil {
+		folded = word
+	}
+	return strings.ToLower(folded)
+}
+
+// fuzzyExpander returns the termExpander used for fuzzy searches. Each word
+// of a search term matches any of the words most similar to it.
+func (v *vocabulary) fuzzyExpander() termExpander {
+	return func(word string) []string {
+		alternatives := v.similar(normalizeWord(word), maxFuzzyAlternatives)
+		if len(alternatives) == 0 {
+			return []string{word}
+		}
+		return alternatives
+	}
+}
+
+// suggest rewrites query with every word that does not appear in any
+// subtitle replaced by the closest word that does. It returns an empty
+// string if there is nothing to correct.
+func (v *vocabulary) suggest(query string) string {
+	var suggestion strings.Builder
+	changed := false
+	last := 0
+	for _, loc := range wordRegex.FindAllStringIndex(query, -1) {
+		word := query[loc[0]:loc[1]]
+		suggestion.WriteString(query[last:loc[0]])
+		last = loc[1]
+
+		isOperator := word == "AND" || word == "OR" || word == "NOT"
+		isPrefix := loc[1] < len(query) && query[loc[1]] == '*'
+		normalized := normalizeWord(word)
+		if _, known := v.docs[normalized]; known || isOperator || isPrefix {
+			suggestion.WriteString(word)
+			continue
+		}
+
+		similar := v.similar(normalized, 1)
+		if len(similar) == 0 {
+			suggestion.WriteString(word)
+			continue
+		}
+		suggestion.WriteString(similar[0])
+		changed = true
+	}
+	suggestion.WriteString(query[last:])
+
+	if !changed {
+		return ""
+	}
+	return suggestion.String()
+}
@@ -0,0 +1,147 @@
+package metadata
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// testVocabulary returns a vocabulary of words, with the number of
+// subtitles each appears in.
+func testVocabulary(docs map[string]int) *vocabulary {
+	v := &vocabulary{docs: docs, byLength: map[int][]string{}}
+	for word := range docs {
+		length := len([]rune(word))
+		v.byLength[length] = append(v.byLength[length], word)
+	}
+	// Already loaded
+	v.once.Do(func() {})
+	return v
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		max  int
+		want int
+	}{
+		{"cheese", "cheese", 2, 0},
+		{"cheese", "cheeze", 2, 1},
+		{"chese", "cheese", 2, 1},
+		{"cheese", "chees", 2, 1},
+		// A transposition of adjacent letters is one edit
+		{"recieve", "receive", 2, 1},
+		{"teh", "the", 2, 1},
+		{"elefant", "elephant", 2, 2},
+		{"", "abc", 5, 3},
+		{"café", "cafe", 2, 1},
+		// Counting stops past the maximum
+		{"elefunt", "elephant", 2, 3},
+		{"abcdefgh", "zyxwvuts", 2, 3},
+	} {
+		if got := editDistance(tc.a, tc.b, tc.max); got != tc.want {
+			t.Errorf("editDistance(%q, %q, %d) = %d, want %d", tc.a, tc.b, tc.max, got, tc.want)
+		}
+	}
+}
+
+func TestVocabularySimilar(t *testing.T) {
+	v := testVocabulary(map[string]int{
+		"bat": 3, "chess": 1, "cheese": 4, "receive": 2, "elephant": 1,
+		"card": 1, "care": 5, "cart": 2, "carts": 1, "carton": 9,
+	})
+
+	for _, tc := range []struct {
+		word string
+		want []string
+	}{
+		// 3 letter words are only matched exactly
+		{"cat", []string{}},
+		{"bat", []string{"bat"}},
+		// 4 to 6 letter words are allowed one edit
+		{"ches", []string{"chess"}},
+		{"cheeze", []string{"cheese"}},
+		{"chese", []string{"cheese", "chess"}},
+		{"chezze", []string{}},
+		// 7 letter words and longer are allowed two
+		{"recieve", []string{"receive"}},
+		{"elefant", []string{"elephant"}},
+		{"elefunt", []string{}},
+		// The word itself first, then the closest and most common
+		{"cart", []string{"cart", "care", "card", "carts"}},
+	} {
+		if got := v.similar(tc.word, maxFuzzyAlternatives); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("similar(%q) = %q, want %q", tc.word, got, tc.want)
+		}
+	}
+
+	if got := v.similar("cart", 2); !reflect.DeepEqual(got, []string{"cart", "care"}) {
+		t.Errorf("similar(\"cart\", 2) = %q, want the 2 closest", got)
+	}
+}
+
+func TestVocabularySuggest(t *testing.T) {
+	v := testVocabulary(map[string]int{"hello": 2, "world": 3, "receive": 1, "the": 9, "cat": 1})
+
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"hello wrold", "hello world"},
+		{`"Helo world"`, `"hello world"`},
+		{"recieve -wrold", "receive -world"},
+		// Operators and prefixes are kept
+		{"wrold OR helo", "world OR hello"},
+		{"wro* helo", "wro* hello"},
+		// Known words are not corrected, so there is nothing to suggest
+		{"hello world", ""},
+		{"HELLO", ""},
+		// Nor are words too short or too far from any known word
+		{"teh", ""},
+		{"cta", ""},
+		{"xyzzy", ""},
+	} {
+		if got := v.suggest(tc.query); got != tc.want {
+			t.Errorf("suggest(%q) = %q, want %q", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestFuzzySearch(t *testing.T) {
+	db := newTestDatabase(t, testEpisode(DefaultShowSlug, 1, 1, "", "I will receive it", "Welcome home", "Nothing else"))
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		query      string
+		fuzzy      bool
+		want       []string
+		suggestion string
+	}{
+		{"recieve", false, nil, "receive"},
+		{"recieve", true, []string{"I will receive it"}, ""},
+		{"welcom", true, []string{"Welcome home"}, ""},
+		// Known words are kept as they were written
+		{"wélcome hoem", false, nil, "wélcome home"},
+		{"wélcome hoem", true, []string{"Welcome home"}, ""},
+		// Short words are not corrected
+		{"hom", true, nil, ""},
+		// and neither are words too far from any other
+		{"xyzzy", true, nil, ""},
+		{"xyzzy", false, nil, ""},
+	} {
+		page, err := db.Search(ctx, DefaultShowSlug, tc.query, SearchOptions{Fuzzy: tc.fuzzy})
+		if err != nil {
+			t.Fatalf("%q: %v", tc.query, err)
+		}
+		var texts []string
+		for _, result := range page.Results {
+			texts = append(texts, result.Text)
+		}
+		if !reflect.DeepEqual(texts, tc.want) {
+			t.Errorf("Search(%q, fuzzy %v) = %q, want %q", tc.query, tc.fuzzy, texts, tc.want)
+		}
+		if page.Suggestion != tc.suggestion {
+			t.Errorf("Search(%q, fuzzy %v) suggested %q, want %q", tc.query, tc.fuzzy, page.Suggestion, tc.suggestion)
+		}
+	}
+}
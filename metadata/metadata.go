@@ -1,14 +1,54 @@
 package metadata
 
+import (
+	"strings"
+	"unicode"
+)
+
+// DefaultShowSlug is the show episodes belong to when none is given.
+const DefaultShowSlug = "default"
+
+// DefaultLanguage is the language of subtitles that do not name one. Codes
+// are the ISO 639-2 codes ffmpeg tags streams with.
+const DefaultLanguage = "eng"
+
+// Kinds of content stored in the episodes table.
+const (
+	// KindEpisode is a regular episode of a show.
+	KindEpisode = "episode"
+	// KindSpecial is an extra or special, stored in season 0 of its show.
+	KindSpecial = "special"
+	// KindMovie is a film. Unless told otherwise, each movie is its own
+	// show with the movie stored as season 0, episode 1.
+	KindMovie = "movie"
+)
+
 type EpisodeMetadata struct {
+	// Show is the slug of the show the episode belongs to. Empty means
+	// DefaultShowSlug.
+	Show string `json:"show,omitempty"`
+	// ShowName is the human readable name of the show.
+	ShowName string `json:"show_name,omitempty"`
 	// Season is the season number of the episode.
 	Season int `json:"season"`
 	// Episode is the episode number of the episode.
-	Episode      int                `json:"episode"`
+	Episode int `json:"episode"`
+	// Kind is one of KindEpisode, KindSpecial or KindMovie. Empty means
+	// KindEpisode.
+	Kind string `json:"kind,omitempty"`
+	// Title is the title of a movie or special, if known.
+	Title        string             `json:"title,omitempty"`
 	Thumbs       []ThumbMetadata    `json:"thumbs"`
 	Subtitles    []SubtitleMetadata `json:"subtitles"`
 	VideoFileKey string             `json:"video_file_key"`
-	SubsFileKey  string             `json:"subs_file_key"`
+	// SubsFileKey is the subtitle file of the first language extracted.
+	SubsFileKey string `json:"subs_file_key"`
+	// SubsFileKeys maps each language extracted to its subtitle file.
+	SubsFileKeys map[string]string `json:"subs_file_keys,omitempty"`
+	// SourceFingerprint identifies the version of the source video and
+	// sidecar subtitles the episode was processed from. It changes when
+	// they are edited or replaced.
+	SourceFingerprint string `json:"source_fingerprint,omitempty"`
 }
 
 type ThumbMetadata struct {
@@ -21,4 +61,38 @@ type SubtitleMetadata struct {
 	Start int    `json:"start"`
 	End   int    `json:"end"`
 	Text  string `json:"text"`
+	// Language of the subtitle. Empty means DefaultLanguage.
+	Language string `json:"language,omitempty"`
+}
+
+// EpisodeInfo describes an episode, special or movie of a show.
+type EpisodeInfo struct {
+	Season  int    `json:"season"`
+	Episode int    `json:"episode"`
+	Kind    string `json:"kind"`
+	Title   string `json:"title"`
+}
+
+type Show struct {
+	Slug string `json:"slug"`
+	Name string `json:"name"`
+}
+
+// Slugify turns a show name into a slug usable in URLs and object store
+// keys, e.g. "The Office (US)" becomes "the-office-us".
+func Slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
 }
@@ -0,0 +1,17 @@
+-- Episodes belong to a show. Episodes from databases created before shows
+-- existed are assigned to the default show.
+CREATE TABLE `shows` (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    slug VARCHAR(255) NOT NULL UNIQUE,
+    name TEXT NOT NULL
+);
+
+INSERT INTO `shows` (slug, name) SELECT 'default', 'default' WHERE EXISTS (SELECT 1 FROM `episodes`);
+
+ALTER TABLE `episodes` ADD COLUMN show_id INT REFERENCES shows(id);
+
+UPDATE `episodes` SET show_id = (SELECT id FROM `shows` WHERE slug = 'default');
+
+DROP INDEX IF EXISTS `episodes_season_episode`;
+
+CREATE UNIQUE INDEX `episodes_show_season_episode` ON `episodes` (show_id, season, episode);
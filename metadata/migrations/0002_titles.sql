@@ -0,0 +1,7 @@
+-- Standalone titles such as movies and specials are stored alongside
+-- episodes, distinguished by their kind.
+ALTER TABLE `episodes` ADD COLUMN kind VARCHAR(16) NOT NULL DEFAULT 'episode';
+
+ALTER TABLE `episodes` ADD COLUMN title TEXT NOT NULL DEFAULT '';
+
+UPDATE `episodes` SET kind = 'special' WHERE season = 0;
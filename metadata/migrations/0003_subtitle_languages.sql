@@ -0,0 +1,5 @@
+-- Subtitles are stored for every language an episode has. Subtitles from
+-- databases created before languages were tracked are English.
+ALTER TABLE `subtitles` ADD COLUMN language VARCHAR(16) NOT NULL DEFAULT 'eng';
+
+CREATE INDEX `subtitles_episode_language_start` ON `subtitles` (episode_id, language, start_ts);
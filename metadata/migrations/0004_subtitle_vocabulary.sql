@@ -0,0 +1,3 @@
+-- The distinct words of all subtitles and how many subtitles contain them,
+-- used to correct misspelled search terms.
+CREATE VIRTUAL TABLE `subtitles_vocab` USING fts5vocab(`subtitles_fts`, 'row');
@@ -0,0 +1,4 @@
+-- The fingerprint of the source files each episode was processed from, so
+-- incremental updates can tell when a source was edited or replaced.
+-- Episodes from older databases have none and are processed again.
+ALTER TABLE `episodes` ADD COLUMN source_fingerprint TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,335 @@
+package metadata
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// ErrInvalidQuery is returned for search queries that cannot be parsed.
+var ErrInvalidQuery = errors.New("invalid search query")
+
+// ParseQuery translates a user search query into an FTS5 match expression.
+// Every term is quoted, so punctuation in user input cannot be mistaken for
+// FTS5 syntax. The query syntax is:
+//
+//	hello world          subtitles with both words
+//	"hello world"        the exact phrase
+//	hel*                 words starting with hel
+//	hello OR goodbye     either word
+//	hello NOT world      hello but not world, also written hello -world
+//	(hello OR hi) world  grouping
+//
+// Operators must be upper case, lower case "and", "or" and "not" are
+// searched for like any other word.
+func ParseQuery(query string) (string, error) {
+	return parseQuery(query, nil)
+}
+
+// termExpander returns the words a word of a search term matches.
+type termExpander func(word string) []string
+
+// parseQuery is ParseQuery with every word of the search terms replaced by
+// the words expand returns, if it is not nil. Words of a phrase are
+// replaced by the first of them, prefixes are left as they are.
+func parseQuery(query string, expand termExpander) (string, error) {
+	tokens, err := tokenizeQuery(query)
+	if err != nil {
+		return "", err
+	}
+
+	p := &queryParser{tokens: tokens, expand: expand}
+	expr, err := p.parseOr()
+	if err != nil {
+		return "", err
+	}
+	if p.pos < len(p.tokens) {
+		return "", fmt.Errorf("%w: unexpected %s", ErrInvalidQuery, p.tokens[p.pos])
+	}
+	if expr == "" {
+		return "", fmt.Errorf("%w: no words to search for", ErrInvalidQuery)
+	}
+	return expr, nil
+}
+
+type queryTokenKind int
+
+const (
+	termToken queryTokenKind = iota
+	phraseToken
+	andToken
+	orToken
+	notToken
+	openToken
+	closeToken
+)
+
+type queryToken struct {
+	kind   queryTokenKind
+	text   string
+	prefix bool
+}
+
+func (t queryToken) String() string {
+	switch t.kind {
+	case openToken:
+		return `"("`
+	case closeToken:
+		return `")"`
+	case phraseToken:
+		return fmt.Sprintf(`phrase "%s"`, t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+func tokenizeQuery(query string) ([]queryToken, error) {
+	var tokens []queryToken
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, queryToken{kind: openToken, text: "("})
+			i++
+		case r == ')':
+			tokens = append(tokens, queryToken{kind: closeToken, text: ")"})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("%w: unterminated quote", ErrInvalidQuery)
+			}
+			token := queryToken{kind: phraseToken, text: string(runes[i+1 : end])}
+			i = end + 1
+			if i < len(runes) && runes[i] == '*' {
+				token.prefix = true
+				i++
+			}
+			tokens = append(tokens, token)
+		case r == '-' && (len(tokens) == 0 || i == 0 || unicode.IsSpace(runes[i-1]) || runes[i-1] == '('):
+			// A leading minus negates the following term
+			tokens = append(tokens, queryToken{kind: notToken, text: "-"})
+			i++
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && runes[end] != '(' && runes[end] != ')' && runes[end] != '"' {
+				end++
+			}
+			word := string(runes[i:end])
+			i = end
+
+			switch word {
+			case "AND":
+				tokens = append(tokens, queryToken{kind: andToken, text: word})
+			case "OR":
+				tokens = append(tokens, queryToken{kind: orToken, text: word})
+			case "NOT":
+				tokens = append(tokens, queryToken{kind: notToken, text: word})
+			default:
+				token := queryToken{kind: termToken, text: word}
+				if strings.HasSuffix(word, "*") {
+					token.text = strings.TrimRight(word, "*")
+					token.prefix = true
+				}
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+	expand termExpander
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return queryToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// parseOr parses terms joined by OR.
+func (p *queryParser) parseOr() (string, error) {
+	var parts []string
+	for {
+		part, err := p.parseAnd()
+		if err != nil {
+			return "", err
+		}
+		if part != "" {
+			parts = append(parts, part)
+		}
+
+		token, ok := p.peek()
+		if !ok || token.kind != orToken {
+			break
+		}
+		p.pos++
+		if part == "" {
+			return "", fmt.Errorf("%w: OR needs a term on both sides", ErrInvalidQuery)
+		}
+		if next, ok := p.peek(); !ok || next.kind == orToken || next.kind == closeToken {
+			return "", fmt.Errorf("%w: OR needs a term on both sides", ErrInvalidQuery)
+		}
+	}
+	return group(parts, " OR "), nil
+}
+
+// parseAnd parses terms joined by AND or nothing at all, some of which may
+// be negated. FTS5 only has a binary NOT, so the negated terms are
+// excluded from the conjunction of the others.
+func (p *queryParser) parseAnd() (string, error) {
+	var include, exclude []string
+	for {
+		token, ok := p.peek()
+		if !ok || token.kind == orToken || token.kind == closeToken {
+			break
+		}
+
+		if token.kind == andToken {
+			p.pos++
+			if len(include)+len(exclude) == 0 {
+				return "", fmt.Errorf("%w: AND needs a term on both sides", ErrInvalidQuery)
+			}
+			if next, ok := p.peek(); !ok || next.kind == andToken || next.kind == orToken || next.kind == closeToken {
+				return "", fmt.Errorf("%w: AND needs a term on both sides", ErrInvalidQuery)
+			}
+			continue
+		}
+
+		negated := false
+		if token.kind == notToken {
+			negated = true
+			p.pos++
+		}
+
+		operand, err := p.parseOperand()
+		if err != nil {
+			return "", err
+		}
+		if operand == "" {
+			continue
+		}
+		if negated {
+			exclude = append(exclude, operand)
+		} else {
+			include = append(include, operand)
+		}
+	}
+
+	if len(include) == 0 {
+		if len(exclude) > 0 {
+			return "", fmt.Errorf("%w: NOT needs a term to exclude from", ErrInvalidQuery)
+		}
+		return "", nil
+	}
+
+	expr := group(include, " AND ")
+	for _, term := range exclude {
+		expr += " NOT " + term
+	}
+	if len(exclude) > 0 {
+		expr = "(" + expr + ")"
+	}
+	return expr, nil
+}
+
+// parseOperand parses a term, phrase or parenthesised group. It returns an
+// empty string for terms without any searchable characters.
+func (p *queryParser) parseOperand() (string, error) {
+	token, ok := p.peek()
+	if !ok {
+		return "", fmt.Errorf("%w: expected a term at the end of the query", ErrInvalidQuery)
+	}
+	p.pos++
+
+	switch token.kind {
+	case termToken, phraseToken:
+		if !hasSearchableText(token.text) {
+			if token.kind == phraseToken && token.text == "" {
+				return "", fmt.Errorf("%w: empty phrase", ErrInvalidQuery)
+			}
+			return "", nil
+		}
+		if p.expand != nil && !token.prefix {
+			return p.expandTerm(token), nil
+		}
+		return quoteTerm(token.text, token.prefix), nil
+	case openToken:
+		expr, err := p.parseOr()
+		if err != nil {
+			return "", err
+		}
+		closing, ok := p.peek()
+		if !ok || closing.kind != closeToken {
+			return "", fmt.Errorf("%w: missing closing parenthesis", ErrInvalidQuery)
+		}
+		p.pos++
+		return expr, nil
+	case closeToken:
+		return "", fmt.Errorf("%w: unexpected closing parenthesis", ErrInvalidQuery)
+	}
+	return "", fmt.Errorf("%w: expected a term but found %s", ErrInvalidQuery, token)
+}
+
+// expandTerm replaces the words of a term with the words they expand to.
+func (p *queryParser) expandTerm(token queryToken) string {
+	words := wordRegex.FindAllString(token.text, -1)
+	if token.kind == phraseToken {
+		for i, word := range words {
+			if alternatives := p.expand(word); len(alternatives) > 0 {
+				words[i] = alternatives[0]
+			}
+		}
+		return quoteTerm(strings.Join(words, " "), false)
+	}
+
+	parts := make([]string, 0, len(words))
+	for _, word := range words {
+		var alternatives []string
+		for _, alternative := range p.expand(word) {
+			alternatives = append(alternatives, quoteTerm(alternative, false))
+		}
+		if len(alternatives) == 0 {
+			alternatives = []string{quoteTerm(word, false)}
+		}
+		parts = append(parts, group(alternatives, " OR "))
+	}
+	return group(parts, " AND ")
+}
+
+func quoteTerm(text string, prefix bool) string {
+	quoted := `"` + strings.ReplaceAll(text, `"`, `""`) + `"`
+	if prefix {
+		quoted += "*"
+	}
+	return quoted
+}
+
+func hasSearchableText(text string) bool {
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func group(parts []string, operator string) string {
+	if len(parts) == 1 {
+		return parts[0]
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "(" + strings.Join(parts, operator) + ")"
+}
@@ -0,0 +1,176 @@
+package metadata
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"hello", `"hello"`},
+		{"hello world", `("hello" AND "world")`},
+		{"hello AND world", `("hello" AND "world")`},
+		{"  hello   world  ", `("hello" AND "world")`},
+
+		// Phrases
+		{`"hello world"`, `"hello world"`},
+		{`"hello world" again`, `("hello world" AND "again")`},
+		{`say"hello world"`, `("say" AND "hello world")`},
+
+		// Prefixes
+		{"hel*", `"hel"*`},
+		{"hel** wor*", `("hel"* AND "wor"*)`},
+		{`"hello wor"*`, `"hello wor"*`},
+
+		// Negation
+		{"hello NOT world", `("hello" NOT "world")`},
+		{"hello -world", `("hello" NOT "world")`},
+		{"-world hello", `("hello" NOT "world")`},
+		{"hello -world -there", `("hello" NOT "world" NOT "there")`},
+		{"(hello) -world", `("hello" NOT "world")`},
+		{"well-known", `"well-known"`},
+
+		// Alternatives and grouping
+		{"hello OR goodbye", `("hello" OR "goodbye")`},
+		{"(hello OR hi) world", `(("hello" OR "hi") AND "world")`},
+		{"hello OR hi -world", `("hello" OR ("hi" NOT "world"))`},
+		{"((hello))", `"hello"`},
+
+		// Lower case operators are words
+		{"this or that", `("this" AND "or" AND "that")`},
+		{"not and", `("not" AND "and")`},
+
+		// Field filters and other FTS5 syntax are searched for as text
+		{"text:hello", `"text:hello"`},
+		{"season:1 hello", `("season:1" AND "hello")`},
+		{"NEAR(hello world)", `("NEAR" AND ("hello" AND "world"))`},
+		{"hello^ {world} +there", `("hello^" AND "{world}" AND "+there")`},
+		{`don't`, `"don't"`},
+
+		// Terms without letters or digits are dropped
+		{"hello ... world", `("hello" AND "world")`},
+		{"hello !", `"hello"`},
+		{"¡hola!", `"¡hola!"`},
+	} {
+		got, err := ParseQuery(tc.query)
+		if err != nil {
+			t.Errorf("ParseQuery(%q) error = %v", tc.query, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("ParseQuery(%q) = %s, want %s", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"", "no words to search for"},
+		{"   ", "no words to search for"},
+		{"... !!", "no words to search for"},
+		{`"hello world`, "unterminated quote"},
+		{`hello "world`, "unterminated quote"},
+		{`"hello" "`, "unterminated quote"},
+		{`""`, "empty phrase"},
+		{"(hello", "missing closing parenthesis"},
+		{"hello)", `unexpected ")"`},
+		{")", `unexpected ")"`},
+		{"()", "no words to search for"},
+		{"OR hello", "OR needs a term on both sides"},
+		{"hello OR", "OR needs a term on both sides"},
+		{"hello OR OR world", "OR needs a term on both sides"},
+		{"(hello OR) world", "OR needs a term on both sides"},
+		{"AND hello", "AND needs a term on both sides"},
+		{"hello AND", "AND needs a term on both sides"},
+		{"hello AND OR world", "AND needs a term on both sides"},
+		{"NOT hello", "NOT needs a term to exclude from"},
+		{"-hello", "NOT needs a term to exclude from"},
+		{"hello NOT", "expected a term at the end of the query"},
+		{"hello -", "expected a term at the end of the query"},
+	} {
+		_, err := ParseQuery(tc.query)
+		if !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("ParseQuery(%q) error = %v, want ErrInvalidQuery", tc.query, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("ParseQuery(%q) error = %q, want it to mention %q", tc.query, err, tc.want)
+		}
+	}
+}
+
+// TestParseQueryIsValidFTS5 checks that the expressions ParseQuery returns
+// for queries full of FTS5 syntax are accepted by FTS5 and match what they
+// should.
+func TestParseQueryIsValidFTS5(t *testing.T) {
+	requireFTS5(t)
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`CREATE VIRTUAL TABLE subtitles USING fts5(text, language UNINDEXED)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{
+		"Hello world",
+		"Goodbye world",
+		"Hello there",
+		"text: near the end",
+	} {
+		if _, err := db.Exec(`INSERT INTO subtitles (text, language) VALUES (?, 'eng')`, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  int
+	}{
+		{"hello", 2},
+		{`"hello world"`, 1},
+		{"hel*", 2},
+		{"hello -world", 1},
+		{"hello OR goodbye", 3},
+		{"(hello OR goodbye) world", 2},
+		{"world NOT (hello OR nothing)", 1},
+		{"text:near", 1},
+		{"language:eng", 0},
+		{"NEAR(hello world)", 0},
+		{"hello^ world", 1},
+		{`"text" *`, 1},
+		{`hello"`, -1},
+	} {
+		expr, err := ParseQuery(tc.query)
+		if tc.want < 0 {
+			if err == nil {
+				t.Errorf("ParseQuery(%q) = %s, want an error", tc.query, expr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseQuery(%q) error = %v", tc.query, err)
+			continue
+		}
+
+		var count int
+		err = db.QueryRow(`SELECT count(*) FROM subtitles WHERE subtitles MATCH ?`, expr).Scan(&count)
+		if err != nil {
+			t.Errorf("FTS5 rejected %s for %q: %v", expr, tc.query, err)
+			continue
+		}
+		if count != tc.want {
+			t.Errorf("%q matched %d subtitles, want %d", tc.query, count, tc.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jaym/clyper/objstore"
+)
+
+var updateSampleDatabase = flag.Bool("update-sample-db", false, "rebuild the sample database in testing/samplevideo-output")
+
+// sampleOutputDir is the checked in preprocess output of the sample video.
+const sampleOutputDir = "../testing/samplevideo-output"
+
+// TestSampleDatabase checks that the sample database is at the latest
+// schema version. After changing the schema, rebuild it from the episode
+// metadata next to it with:
+//
+//	go test -tags fts5 ./metadata -run TestSampleDatabase -update-sample-db
+func TestSampleDatabase(t *testing.T) {
+	requireFTS5(t)
+
+	store := objstore.NewLocalFSObjectStore(sampleOutputDir)
+	if *updateSampleDatabase {
+		rebuildSampleDatabase(t, store)
+	}
+
+	db := openTestDatabase(t, store)
+	episodes, err := db.ListEpisodes(context.Background(), DefaultShowSlug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(episodes) != 1 || episodes[0].Season != 1 || episodes[0].Episode != 1 {
+		t.Errorf("sample database has episodes %+v", episodes)
+	}
+}
+
+func rebuildSampleDatabase(t *testing.T, store *objstore.LocalFSObjectStore) {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(sampleOutputDir, "internal", "*", "*", "METADATA.*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no episode metadata in the sample output")
+	}
+
+	builder, err := NewDatabaseBuilder(DefaultDatabaseKey, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var md EpisodeMetadata
+		if err := json.Unmarshal(b, &md); err != nil {
+			t.Fatal(err)
+		}
+		if err := builder.AddEpisodeMetadata(md); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+}
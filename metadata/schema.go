@@ -1,6 +1,92 @@
 package metadata
 
-import "embed"
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
 
-//go:embed schema.sql
+	"github.com/rs/zerolog/log"
+)
+
+//go:embed schema.sql migrations/*.sql
 var SchemaFS embed.FS
+
+// migrate brings the database up to date. schema.sql creates the original
+// tables if they are missing, then every migration newer than the
+// database's user_version is applied in order.
+func migrate(db *sql.DB) error {
+	schemaBytes, err := SchemaFS.ReadFile("schema.sql")
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to read schema.sql")
+		return err
+	}
+
+	_, err = db.Exec(string(schemaBytes))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to execute schema.sql")
+		return err
+	}
+
+	migrations, err := schemaMigrations()
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to read the schema version")
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		migrationBytes, err := SchemaFS.ReadFile(migrations[i])
+		if err != nil {
+			return err
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(string(migrationBytes))
+		if err == nil {
+			// PRAGMA does not accept bound parameters
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+		}
+		if err != nil {
+			tx.Rollback() // nolint: errcheck
+			log.Error().Err(err).Str("migration", migrations[i]).Msg("Failed to apply migration")
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		log.Info().Str("migration", migrations[i]).Msg("Applied migration")
+	}
+
+	return nil
+}
+
+// schemaMigrations returns the embedded migrations in the order they are
+// applied.
+func schemaMigrations() ([]string, error) {
+	migrations, err := fs.Glob(SchemaFS, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(migrations)
+	return migrations, nil
+}
+
+// latestSchemaVersion is the user_version of a fully migrated database.
+func latestSchemaVersion() (int, error) {
+	migrations, err := schemaMigrations()
+	if err != nil {
+		return 0, err
+	}
+	return len(migrations), nil
+}
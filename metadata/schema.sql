@@ -1,12 +1,12 @@
 BEGIN TRANSACTION;
 
-CREATE TABLE `episodes` (
+CREATE TABLE IF NOT EXISTS `episodes` (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     season INT NOT NULL,
     episode INT NOT NULL
 );
 
-CREATE TABLE `thumbnails` (
+CREATE TABLE IF NOT EXISTS `thumbnails` (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     episode_id INT NOT NULL,
     storage_key VARCHAR(255) NOT NULL,
@@ -15,14 +15,14 @@ CREATE TABLE `thumbnails` (
     FOREIGN KEY (episode_id) REFERENCES episodes(id)
 );
 
-CREATE TABLE `videos` (
+CREATE TABLE IF NOT EXISTS `videos` (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     episode_id INT NOT NULL,
     storage_key VARCHAR(255) NOT NULL,
     FOREIGN KEY (episode_id) REFERENCES episodes(id)
 );
 
-CREATE TABLE `subtitles` (
+CREATE TABLE IF NOT EXISTS `subtitles` (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     episode_id INT NOT NULL,
     start_ts INT NOT NULL,
@@ -31,14 +31,25 @@ CREATE TABLE `subtitles` (
     FOREIGN KEY (episode_id) REFERENCES episodes(id)
 );
 
-CREATE VIRTUAL TABLE `subtitles_fts` USING fts5(
+CREATE VIRTUAL TABLE IF NOT EXISTS `subtitles_fts` USING fts5(
     text,
     content=`subtitles`,
 );
 
-CREATE TRIGGER `subtitles_ai` AFTER INSERT ON `subtitles`
+CREATE TRIGGER IF NOT EXISTS `subtitles_ai` AFTER INSERT ON `subtitles`
 BEGIN
     INSERT INTO `subtitles_fts` (rowid, text) VALUES (new.id, new.text);
 END;
 
+CREATE TRIGGER IF NOT EXISTS `subtitles_ad` AFTER DELETE ON `subtitles`
+BEGIN
+    INSERT INTO `subtitles_fts` (`subtitles_fts`, rowid, text) VALUES ('delete', old.id, old.text);
+END;
+
+CREATE TRIGGER IF NOT EXISTS `subtitles_au` AFTER UPDATE ON `subtitles`
+BEGIN
+    INSERT INTO `subtitles_fts` (`subtitles_fts`, rowid, text) VALUES ('delete', old.id, old.text);
+    INSERT INTO `subtitles_fts` (rowid, text) VALUES (new.id, new.text);
+END;
+
 COMMIT;
\ No newline at end of file
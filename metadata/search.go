@@ -0,0 +1,271 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+)
+
+// AnyLanguage matches subtitles of every language.
+const AnyLanguage = "*"
+
+const (
+	// DefaultSearchLimit is the number of results returned per page when
+	// SearchOptions.Limit is not set.
+	DefaultSearchLimit = 100
+	// MaxSearchLimit is the largest page size Search returns.
+	MaxSearchLimit = 500
+)
+
+// ErrInvalidCursor is returned for cursors that were not returned by Search.
+var ErrInvalidCursor = errors.New("invalid search cursor")
+
+// searchFilters narrows a subtitles_fts match down to the options of a
+// search. Filters that are not set are passed as -1.
+const searchFilters = `subtitles_fts MATCH :match
+	AND shows.slug = :show
+	AND (:language = '*' OR subtitles.language = :language)
+	AND (:season < 0 OR episodes.season = :season)
+	AND (:episode_from < 0 OR episodes.episode >= :episode_from)
+	AND (:episode_to < 0 OR episodes.episode <= :episode_to)
+	AND (:from < 0 OR subtitles.end_ts > :from)
+	AND (:to < 0 OR subtitles.start_ts < :to)`
+
+const searchJoins = `FROM subtitles_fts
+	INNER JOIN subtitles ON subtitles.rowid = subtitles_fts.rowid
+	INNER JOIN episodes ON subtitles.episode_id = episodes.id
+	INNER JOIN shows ON shows.id = episodes.show_id`
+
+// searchQuery returns a page of results ordered by relevance. Pages after
+// the first start after the sort key of the last result of the previous
+// page.
+const searchQuery = `SELECT show, season, episode, kind, title, start_ts, end_ts, text, language, snippet, score, id FROM (
+	SELECT shows.slug AS show, episodes.season AS season, episodes.episode AS episode, episodes.kind AS kind, episodes.title AS title,
+		subtitles.id AS id, subtitles.start_ts AS start_ts, subtitles.end_ts AS end_ts, subtitles.text AS text, subtitles.language AS language,
+		snippet(subtitles_fts, 0, char(1), char(2), '…', 32) AS snippet, bm25(subtitles_fts) AS score
+	` + searchJoins + `
+	WHERE ` + searchFilters + `
+)
+WHERE NOT :after OR (score, season, episode, start_ts, id) > (:after_score, :after_season, :after_episode, :after_start, :after_id)
+ORDER BY score, season, episode, start_ts, id
+LIMIT :limit`
+
+const searchCountQuery = `SELECT COUNT(*) ` + searchJoins + ` WHERE ` + searchFilters
+
+type SearchResult struct {
+	Show     string `json:"show"`
+	Season   int    `json:"season"`
+	Episode  int    `json:"episode"`
+	Kind     string `json:"kind"`
+	Title    string `json:"title,omitempty"`
+	Start    int    `json:"start"`
+	End      int    `json:"end"`
+	Text     string `json:"text"`
+	Language string `json:"language"`
+	// Snippet is the HTML escaped text with the matched words wrapped in
+	// <mark> tags.
+	Snippet string `json:"snippet"`
+	// Score is the bm25 relevance of the result, higher is better.
+	Score float64 `json:"score"`
+}
+
+// SearchOptions narrow down and page through the results of Search. Nil
+// filters are not applied.
+type SearchOptions struct {
+	// Language is the subtitle language searched. Empty or AnyLanguage
+	// searches every language.
+	Language string
+	// Season only returns results from this season.
+	Season *int
+	// EpisodeFrom and EpisodeTo only return results from episodes in this
+	// inclusive range.
+	EpisodeFrom *int
+	EpisodeTo   *int
+	// From and To only return subtitles shown between these timestamps, in
+	// milliseconds from the start of the episode.
+	From *int
+	To   *int
+	// Limit is the number of results per page. Defaults to
+	// DefaultSearchLimit and is capped at MaxSearchLimit.
+	Limit int
+	// Cursor continues from the page that returned it as NextCursor.
+	Cursor string
+	// Fuzzy also matches words spelled slightly differently from the words
+	// of the query, such as "recieve" for "receive".
+	Fuzzy bool
+}
+
+// SearchPage is one page of search results.
+type SearchPage struct {
+	Results []SearchResult `json:"results"`
+	// Total is the number of results across all pages.
+	Total int `json:"total"`
+	// NextCursor fetches the next page, it is empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+	// Suggestion is the query with misspelled words corrected, set when
+	// nothing matched the query.
+	Suggestion string `json:"did_you_mean,omitempty"`
+}
+
+// searchCursor is the sort key of the last result of a page.
+type searchCursor struct {
+	Score   float64 `json:"s"`
+	Season  int     `json:"n"`
+	Episode int     `json:"e"`
+	Start   int     `json:"t"`
+	ID      int64   `json:"i"`
+}
+
+func (c searchCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSearchCursor(cursor string) (*searchCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	// Anything Search did not encode is rejected rather than guessed at
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	var c searchCursor
+	err = decoder.Decode(&c)
+	if err != nil || decoder.More() {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+// snippetReplacer turns the markers the search statement wraps matches in
+// into HTML, after the text around them has been escaped.
+var snippetReplacer = strings.NewReplacer("\x01", "<mark>", "\x02", "</mark>")
+
+// Search searches the subtitles of show. The query uses the syntax
+// described by ParseQuery, errors parsing it wrap ErrInvalidQuery. Results
+// are ordered by relevance. When nothing matches, the page suggests a
+// corrected query if the query has words that are in no subtitle.
+func (d *Database) Search(ctx context.Context, show string, queryString string, opts SearchOptions) (*SearchPage, error) {
+	var expand termExpander
+	if opts.Fuzzy {
+		err := d.vocabulary.load(d)
+		if err != nil {
+			return nil, err
+		}
+		expand = d.vocabulary.fuzzyExpander()
+	}
+
+	match, err := parseQuery(queryString, expand)
+	if err != nil {
+		return nil, err
+	}
+
+	language := opts.Language
+	if language == "" {
+		language = AnyLanguage
+	}
+	limit := DefaultSearchLimit
+	if opts.Limit > 0 {
+		limit = min(opts.Limit, MaxSearchLimit)
+	}
+
+	filters := []any{
+		sql.Named("match", match),
+		sql.Named("show", show),
+		sql.Named("language", language),
+		sql.Named("season", optionalFilter(opts.Season)),
+		sql.Named("episode_from", optionalFilter(opts.EpisodeFrom)),
+		sql.Named("episode_to", optionalFilter(opts.EpisodeTo)),
+		sql.Named("from", optionalFilter(opts.From)),
+		sql.Named("to", optionalFilter(opts.To)),
+	}
+
+	var total int
+	err = d.preparedStatements[searchCountStmt].QueryRowContext(ctx, filters...).Scan(&total)
+	if err != nil {
+		return nil, translateSearchError(err)
+	}
+
+	after := &searchCursor{}
+	if opts.Cursor != "" {
+		after, err = decodeSearchCursor(opts.Cursor)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Fetch one more result than needed to know if there is another page
+	args := append(filters,
+		sql.Named("after", opts.Cursor != ""),
+		sql.Named("after_score", after.Score),
+		sql.Named("after_season", after.Season),
+		sql.Named("after_episode", after.Episode),
+		sql.Named("after_start", after.Start),
+		sql.Named("after_id", after.ID),
+		sql.Named("limit", limit+1),
+	)
+	rows, err := d.preparedStatements[searchStmt].QueryContext(ctx, args...)
+	if err != nil {
+		return nil, translateSearchError(err)
+	}
+	defer rows.Close()
+
+	page := &SearchPage{Results: []SearchResult{}, Total: total}
+	var last searchCursor
+	for rows.Next() {
+		if len(page.Results) == limit {
+			page.NextCursor = last.encode()
+			break
+		}
+
+		var result SearchResult
+		var bm25 float64
+		var id int64
+		err := rows.Scan(&result.Show, &result.Season, &result.Episode, &result.Kind, &result.Title, &result.Start, &result.End, &result.Text, &result.Language, &result.Snippet, &bm25, &id)
+		if err != nil {
+			return nil, err
+		}
+		result.Snippet = snippetReplacer.Replace(html.EscapeString(result.Snippet))
+		// bm25 is negative, with better matches further from zero
+		result.Score = -bm25
+
+		page.Results = append(page.Results, result)
+		last = searchCursor{Score: bm25, Season: result.Season, Episode: result.Episode, Start: result.Start, ID: id}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, translateSearchError(err)
+	}
+
+	if page.Total == 0 {
+		err = d.vocabulary.load(d)
+		if err != nil {
+			return nil, err
+		}
+		page.Suggestion = d.vocabulary.suggest(queryString)
+	}
+	return page, nil
+}
+
+func optionalFilter(value *int) int {
+	if value == nil {
+		return -1
+	}
+	return *value
+}
+
+// translateSearchError reports FTS5 syntax errors, which ParseQuery should
+// have prevented, as invalid queries rather than database failures.
+func translateSearchError(err error) error {
+	if err != nil && strings.Contains(err.Error(), "fts5: syntax error") {
+		return fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+	return err
+}
@@ -0,0 +1,156 @@
+package metadata
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// pagingDatabase has 3 episodes with 4 equally relevant matches each, so
+// the order of results comes down to the tie breakers.
+func pagingDatabase(t *testing.T) *Database {
+	t.Helper()
+
+	var episodes []EpisodeMetadata
+	for episode := 3; episode >= 1; episode-- {
+		md := testEpisode(DefaultShowSlug, 1, episode, "", "cheese", "more cheese", "cheese", "no match", "cheese")
+		md.VideoFileKey = fmt.Sprintf("internal/S01E%02d/video.mkv", episode)
+		episodes = append(episodes, md)
+	}
+	return newTestDatabase(t, episodes...)
+}
+
+type resultKey struct {
+	Episode int
+	Start   int
+}
+
+func resultKeys(results []SearchResult) []resultKey {
+	var keys []resultKey
+	for _, result := range results {
+		keys = append(keys, resultKey{result.Episode, result.Start})
+	}
+	return keys
+}
+
+func TestSearchPagination(t *testing.T) {
+	db := pagingDatabase(t)
+	ctx := context.Background()
+
+	all, err := db.Search(ctx, DefaultShowSlug, "cheese", SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all.Total != 12 || len(all.Results) != 12 || all.NextCursor != "" {
+		t.Fatalf("single page has %d of %d results, cursor %q, want all 12 and no cursor", len(all.Results), all.Total, all.NextCursor)
+	}
+	// "more cheese" is a weaker match than "cheese", ties are ordered by
+	// episode and time
+	for i := 1; i < len(all.Results); i++ {
+		prev, cur := all.Results[i-1], all.Results[i]
+		if cur.Score > prev.Score || (cur.Score == prev.Score && (cur.Episode < prev.Episode || cur.Episode == prev.Episode && cur.Start < prev.Start)) {
+			t.Errorf("result %d %+v is ordered after %+v", i, cur, prev)
+		}
+	}
+
+	for _, limit := range []int{1, 3, 5, 11, 12} {
+		t.Run(fmt.Sprintf("limit %d", limit), func(t *testing.T) {
+			var paged []SearchResult
+			cursor := ""
+			for pages := 0; ; pages++ {
+				if pages > len(all.Results) {
+					t.Fatal("paging does not end")
+				}
+				page, err := db.Search(ctx, DefaultShowSlug, "cheese", SearchOptions{Limit: limit, Cursor: cursor})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if page.Total != all.Total {
+					t.Errorf("page %d total = %d, want %d", pages, page.Total, all.Total)
+				}
+				if len(page.Results) > limit {
+					t.Errorf("page %d has %d results, want at most %d", pages, len(page.Results), limit)
+				}
+				paged = append(paged, page.Results...)
+				if page.NextCursor == "" {
+					break
+				}
+				cursor = page.NextCursor
+			}
+			if got, want := resultKeys(paged), resultKeys(all.Results); !reflect.DeepEqual(got, want) {
+				t.Errorf("pages returned %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSearchPaginationWithFilters(t *testing.T) {
+	db := pagingDatabase(t)
+	ctx := context.Background()
+
+	season, from := 1, 3000
+	all, err := db.Search(ctx, DefaultShowSlug, "cheese", SearchOptions{Season: &season, From: &from})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two matches of each episode end after 3s
+	if all.Total != 6 || len(all.Results) != 6 {
+		t.Fatalf("filtered search has %d of %d results, want 6", len(all.Results), all.Total)
+	}
+
+	var paged []SearchResult
+	opts := SearchOptions{Season: &season, From: &from, Limit: 4}
+	for _, wantResults := range []int{4, 2} {
+		page, err := db.Search(ctx, DefaultShowSlug, "cheese", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Results) != wantResults || page.Total != 6 {
+			t.Fatalf("page has %d of %d results, want %d of 6", len(page.Results), page.Total, wantResults)
+		}
+		paged = append(paged, page.Results...)
+		opts.Cursor = page.NextCursor
+	}
+	if opts.Cursor != "" {
+		t.Errorf("last page has cursor %q", opts.Cursor)
+	}
+	if got, want := resultKeys(paged), resultKeys(all.Results); !reflect.DeepEqual(got, want) {
+		t.Errorf("pages returned %v, want %v", got, want)
+	}
+}
+
+func TestSearchInvalidCursor(t *testing.T) {
+	db := pagingDatabase(t)
+	ctx := context.Background()
+
+	encode := func(s string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+	for _, cursor := range []string{
+		"not a cursor!",
+		"////",
+		encode("not json"),
+		encode(`["s", 1]`),
+		encode(`{"s": "high"}`),
+		encode(`{"s": -1, "admin": true}`),
+		encode(`{"s": -1}{"s": -2}`),
+		base64.StdEncoding.EncodeToString([]byte(`{"s":-1,"n":1,"e":1,"t":0,"i":1}`)) + "=",
+	} {
+		_, err := db.Search(ctx, DefaultShowSlug, "cheese", SearchOptions{Cursor: cursor})
+		if !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("cursor %q: error = %v, want ErrInvalidCursor", cursor, err)
+		}
+	}
+
+	// A well formed cursor past every result returns an empty last page
+	page, err := db.Search(ctx, DefaultShowSlug, "cheese", SearchOptions{Cursor: searchCursor{Season: 99}.encode()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Results) != 0 || page.NextCursor != "" || page.Total != 12 {
+		t.Errorf("page past the end = %+v, want no results of 12", page)
+	}
+}
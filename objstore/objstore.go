@@ -1,23 +1,296 @@
 package objstore
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// ErrNotExist is returned when the requested key does not exist in the store.
+var ErrNotExist = errors.New("object does not exist")
+
+// ErrInvalidKey is returned for keys that would resolve outside of the
+// store, such as keys containing ".." elements.
+var ErrInvalidKey = errors.New("invalid object key")
+
 type ObjectReader interface {
 	Open(key string) (io.ReadCloser, error)
 }
 
-type LocalFSObjectReader struct {
+type ObjectInfo struct {
+	// Key is the key of the object, relative to the root of the store.
+	Key string `json:"key"`
+	// Size is the size of the object in bytes.
+	Size int64 `json:"size"`
+	// ModTime is the time the object was last written.
+	ModTime time.Time `json:"mod_time"`
+}
+
+// ObjectStore is a flat key/value store for the preprocessor output. Keys
+// are slash separated paths such as "public/01/01/thumb_00000200.jpg".
+type ObjectStore interface {
+	ObjectReader
+	// Put writes the contents of r to key, replacing any existing object.
+	Put(key string, r io.Reader) error
+	// Stat returns information about key, or ErrNotExist.
+	Stat(key string) (*ObjectInfo, error)
+	// List returns all objects whose key starts with prefix, sorted by key.
+	List(prefix string) ([]ObjectInfo, error)
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(key string) error
+}
+
+// Locator is implemented by stores that can hand out a location (a file
+// path or URL) that ffmpeg can read from directly, without first copying
+// the object to local disk.
+type Locator interface {
+	Locate(key string) (string, error)
+}
+
+// Open returns the object store described by location. A location of the
+// form s3://bucket/prefix selects the S3 backend, anything else is treated
+// as a local directory. The S3 backend accepts the endpoint, region and
+// path_style query parameters, which is how S3 compatible servers such as
+// MinIO are targeted:
+//
+//	s3://clyper/output?endpoint=http://localhost:9000&region=us-east-1&path_style=true
+func Open(location string) (ObjectStore, error) {
+	if !strings.HasPrefix(location, "s3://") {
+		return NewLocalFSObjectStore(location), nil
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object store location %q: %v", location, err)
+	}
+
+	cfg := S3Config{
+		Bucket:   u.Host,
+		Prefix:   strings.TrimPrefix(u.Path, "/"),
+		Endpoint: u.Query().Get("endpoint"),
+		Region:   u.Query().Get("region"),
+	}
+	if pathStyle := u.Query().Get("path_style"); pathStyle != "" {
+		cfg.ForcePathStyle, err = strconv.ParseBool(pathStyle)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path_style %q: %v", pathStyle, err)
+		}
+	}
+
+	return NewS3ObjectStore(cfg)
+}
+
+// Fetch copies the object at key into the local file dst.
+func Fetch(store ObjectReader, key string, dst string) error {
+	obj, err := store.Open(key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, obj)
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// PutFile uploads the local file src to key.
+func PutFile(store ObjectStore, key string, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return store.Put(key, f)
+}
+
+type LocalFSObjectStore struct {
 	basePath string
 }
 
+func NewLocalFSObjectStore(basePath string) *LocalFSObjectStore {
+	return &LocalFSObjectStore{basePath: basePath}
+}
+
+// LocalFSObjectReader is the previous name of LocalFSObjectStore.
+//
+// Deprecated: Use LocalFSObjectStore.
+type LocalFSObjectReader = LocalFSObjectStore
+
+// NewLocalFSObjectReader returns a store rooted at basePath.
+//
+// Deprecated: Use NewLocalFSObjectStore.
 func NewLocalFSObjectReader(basePath string) *LocalFSObjectReader {
-	return &LocalFSObjectReader{basePath: basePath}
+	return NewLocalFSObjectStore(basePath)
+}
+
+// Path returns the location of key on the local filesystem. Keys containing
+// ".." elements are rejected with ErrInvalidKey so they cannot escape the
+// root of the store.
+func (s *LocalFSObjectStore) Path(key string) (string, error) {
+	err := checkKey(key)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(s.basePath, key), nil
+}
+
+// checkKey returns ErrInvalidKey if key contains ".." elements.
+func checkKey(key string) error {
+	for _, elem := range strings.Split(key, "/") {
+		if elem == ".." {
+			return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+		}
+	}
+	return nil
+}
+
+func (s *LocalFSObjectStore) Locate(key string) (string, error) {
+	return s.Path(key)
+}
+
+func (s *LocalFSObjectStore) Open(key string) (io.ReadCloser, error) {
+	p, err := s.Path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotExist
+	}
+	return f, err
+}
+
+func (s *LocalFSObjectStore) Put(key string, r io.Reader) error {
+	dst, err := s.Path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(path.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see a partial object
+	tmp, err := os.CreateTemp(path.Dir(dst), "."+path.Base(dst)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // nolint: errcheck
+
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close() // nolint: errcheck
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (s *LocalFSObjectStore) Stat(key string) (*ObjectInfo, error) {
+	p, err := s.Path(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, ErrNotExist
+	}
+	return &ObjectInfo{
+		Key:     key,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}, nil
+}
+
+func (s *LocalFSObjectStore) List(prefix string) ([]ObjectInfo, error) {
+	// Only walk the deepest directory that can contain the prefix
+	root := s.basePath
+	if dir, _ := path.Split(prefix); dir != "" {
+		var err error
+		root, err = s.Path(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var objects []ObjectInfo
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.basePath, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{
+			Key:     key,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
 }
 
-func (r *LocalFSObjectReader) Open(key string) (io.ReadCloser, error) {
-	return os.Open(path.Join(r.basePath, key))
+func (s *LocalFSObjectStore) Delete(key string) error {
+	p, err := s.Path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
 }
@@ -0,0 +1,275 @@
+package objstore
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOpenLocation(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+
+	tests := []struct {
+		location string
+		local    string
+		bucket   string
+		prefix   string
+		wantErr  bool
+	}{
+		{location: "/srv/clyper", local: "/srv/clyper"},
+		{location: "output", local: "output"},
+		{location: "s3://clyper", bucket: "clyper"},
+		{location: "s3://clyper/output/", bucket: "clyper", prefix: "output"},
+		{location: "s3://clyper/a/b?endpoint=http://localhost:9000&region=us-east-1&path_style=true", bucket: "clyper", prefix: "a/b"},
+		{location: "s3://clyper?path_style=maybe", wantErr: true},
+		{location: "s3://clyper/%zz", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.location, func(t *testing.T) {
+			store, err := Open(tt.location)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %T", store)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			switch s := store.(type) {
+			case *LocalFSObjectStore:
+				if tt.local == "" {
+					t.Fatalf("expected an S3 store, got a local store")
+				}
+				if s.basePath != tt.local {
+					t.Errorf("basePath = %q, want %q", s.basePath, tt.local)
+				}
+			case *S3ObjectStore:
+				if tt.bucket == "" {
+					t.Fatalf("expected a local store, got an S3 store")
+				}
+				if s.bucket != tt.bucket {
+					t.Errorf("bucket = %q, want %q", s.bucket, tt.bucket)
+				}
+				if s.prefix != tt.prefix {
+					t.Errorf("prefix = %q, want %q", s.prefix, tt.prefix)
+				}
+			default:
+				t.Fatalf("unexpected store type %T", store)
+			}
+		})
+	}
+}
+
+func TestOpenLocationS3Options(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	store, err := Open("s3://clyper?endpoint=http://localhost:9000&region=eu-west-2&path_style=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := store.(*S3ObjectStore).client.Config
+	if got := *cfg.Endpoint; got != "http://localhost:9000" {
+		t.Errorf("endpoint = %q", got)
+	}
+	if got := *cfg.Region; got != "eu-west-2" {
+		t.Errorf("region = %q", got)
+	}
+	if !*cfg.S3ForcePathStyle {
+		t.Errorf("expected path style addressing")
+	}
+}
+
+// testObjectStore runs the same behaviour checks against any ObjectStore.
+func testObjectStore(t *testing.T, store ObjectStore) {
+	t.Helper()
+
+	_, err := store.Stat("public/01/01/missing.jpg")
+	if !errors.Is(err, ErrNotExist) {
+		t.Fatalf("Stat of a missing key returned %v, want ErrNotExist", err)
+	}
+	_, err = store.Open("public/01/01/missing.jpg")
+	if !errors.Is(err, ErrNotExist) {
+		t.Fatalf("Open of a missing key returned %v, want ErrNotExist", err)
+	}
+
+	objects := map[string]string{
+		"internal/metadata.db":            "db",
+		"public/01/01/thumb_00000200.jpg": "thumb 200",
+		"public/01/01/thumb_00000400.jpg": "thumb 400",
+		"public/01/02/thumb_00000200.jpg": "other episode",
+	}
+	for key, data := range objects {
+		if err := store.Put(key, strings.NewReader(data)); err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+	}
+
+	// Replacing an object overwrites its contents
+	if err := store.Put("internal/metadata.db", strings.NewReader("new db")); err != nil {
+		t.Fatal(err)
+	}
+	r, err := store.Open("internal/metadata.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new db" {
+		t.Errorf("Open returned %q, want %q", data, "new db")
+	}
+
+	info, err := store.Stat("public/01/01/thumb_00000400.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Key != "public/01/01/thumb_00000400.jpg" || info.Size != int64(len("thumb 400")) {
+		t.Errorf("Stat returned %+v", info)
+	}
+	if info.ModTime.IsZero() {
+		t.Errorf("Stat returned a zero ModTime")
+	}
+
+	listKeys := func(prefix string) []string {
+		t.Helper()
+		infos, err := store.List(prefix)
+		if err != nil {
+			t.Fatalf("List(%q): %v", prefix, err)
+		}
+		var keys []string
+		for _, info := range infos {
+			keys = append(keys, info.Key)
+		}
+		return keys
+	}
+
+	if got, want := listKeys("public/01/01/"), []string{
+		"public/01/01/thumb_00000200.jpg",
+		"public/01/01/thumb_00000400.jpg",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List(public/01/01/) = %q, want %q", got, want)
+	}
+	if got, want := listKeys("public/01/0"), []string{
+		"public/01/01/thumb_00000200.jpg",
+		"public/01/01/thumb_00000400.jpg",
+		"public/01/02/thumb_00000200.jpg",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List(public/01/0) = %q, want %q", got, want)
+	}
+	if got := listKeys("public/02/"); len(got) != 0 {
+		t.Errorf("List(public/02/) = %q, want nothing", got)
+	}
+	if got := listKeys(""); len(got) != len(objects) {
+		t.Errorf("List() = %q, want %d objects", got, len(objects))
+	}
+
+	if err := store.Delete("public/01/01/thumb_00000200.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("public/01/01/thumb_00000200.jpg"); err != nil {
+		t.Fatalf("deleting a missing key returned %v", err)
+	}
+	if got, want := listKeys("public/01/01/"), []string{
+		"public/01/01/thumb_00000400.jpg",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List after Delete = %q, want %q", got, want)
+	}
+}
+
+func TestLocalFSObjectStore(t *testing.T) {
+	dir := t.TempDir()
+	store := NewLocalFSObjectStore(dir)
+	testObjectStore(t, store)
+
+	// Put must not leave temporary files behind
+	entries, err := os.ReadDir(filepath.Join(dir, "internal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "metadata.db" {
+		t.Errorf("unexpected files in internal/: %v", entries)
+	}
+
+	p, err := store.Locate("internal/metadata.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != filepath.Join(dir, "internal/metadata.db") {
+		t.Errorf("Locate returned %q", p)
+	}
+}
+
+func TestLocalFSObjectStoreRejectsEscapingKeys(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	store := NewLocalFSObjectStore(root)
+
+	err := os.WriteFile(filepath.Join(parent, "secret"), []byte("secret"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"../secret", "public/../../secret", ".."} {
+		if _, err := store.Path(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Path(%q) returned %v, want ErrInvalidKey", key, err)
+		}
+		if _, err := store.Open(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Open(%q) returned %v, want ErrInvalidKey", key, err)
+		}
+		if err := store.Put(key, strings.NewReader("x")); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Put(%q) returned %v, want ErrInvalidKey", key, err)
+		}
+		if _, err := store.Stat(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Stat(%q) returned %v, want ErrInvalidKey", key, err)
+		}
+		if err := store.Delete(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Delete(%q) returned %v, want ErrInvalidKey", key, err)
+		}
+	}
+	if _, err := store.List("../"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("List(../) returned %v, want ErrInvalidKey", err)
+	}
+
+	// Dots inside a file name are fine
+	if err := store.Put("public/a..b.jpg", strings.NewReader("x")); err != nil {
+		t.Errorf("Put(public/a..b.jpg) returned %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(parent, "secret")); err != nil {
+		t.Errorf("file outside the store was touched: %v", err)
+	}
+}
+
+func TestLocalFSObjectReaderAlias(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "key"), []byte("value"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reader ObjectReader = NewLocalFSObjectReader(dir)
+	r, err := reader.Open("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "value" {
+		t.Errorf("Open returned %q", data)
+	}
+}
@@ -0,0 +1,224 @@
+package objstore
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// DefaultPresignExpiry is how long URLs handed out by S3ObjectStore.Locate
+// stay valid.
+const DefaultPresignExpiry = time.Hour
+
+type S3Config struct {
+	// Bucket is the name of the bucket objects are stored in.
+	Bucket string `mapstructure:"bucket"`
+	// Prefix is prepended to every key, allowing several stores to share a
+	// bucket.
+	Prefix string `mapstructure:"prefix"`
+	// Region is the region of the bucket. Defaults to the AWS SDK's region
+	// resolution.
+	Region string `mapstructure:"region"`
+	// Endpoint overrides the S3 endpoint, for use with S3 compatible
+	// servers such as MinIO.
+	Endpoint string `mapstructure:"endpoint"`
+	// ForcePathStyle uses path style addressing (http://host/bucket/key)
+	// instead of virtual hosted buckets. Most S3 compatible servers need it.
+	ForcePathStyle bool `mapstructure:"force_path_style"`
+}
+
+// S3ObjectStore stores objects in an S3 compatible bucket. Credentials are
+// resolved using the standard AWS SDK chain (environment, shared config,
+// instance role).
+type S3ObjectStore struct {
+	bucket   string
+	prefix   string
+	client   *s3.S3
+	uploader *s3manager.Uploader
+}
+
+func NewS3ObjectStore(cfg S3Config) (*S3ObjectStore, error) {
+	awsCfg := aws.NewConfig()
+	if cfg.Region != "" {
+		awsCfg = awsCfg.WithRegion(cfg.Region)
+	}
+	if cfg.Endpoint != "" {
+		awsCfg = awsCfg.WithEndpoint(cfg.Endpoint)
+	}
+	if cfg.ForcePathStyle {
+		awsCfg = awsCfg.WithS3ForcePathStyle(true)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsCfg,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.New(sess)
+	return &S3ObjectStore{
+		bucket:   cfg.Bucket,
+		prefix:   strings.Trim(cfg.Prefix, "/"),
+		client:   client,
+		uploader: s3manager.NewUploaderWithClient(client),
+	}, nil
+}
+
+// objectKey returns the key of key in the bucket. It is the prefix and key
+// joined with a slash, keeping any trailing slash of key so that listing a
+// directory does not also list its siblings. Keys containing ".." elements
+// are rejected with ErrInvalidKey, as they are by LocalFSObjectStore.
+func (s *S3ObjectStore) objectKey(key string) (string, error) {
+	err := checkKey(key)
+	if err != nil {
+		return "", err
+	}
+	if s.prefix == "" {
+		return key, nil
+	}
+	return s.prefix + "/" + key, nil
+}
+
+func (s *S3ObjectStore) storeKey(objectKey string) string {
+	if s.prefix == "" {
+		return objectKey
+	}
+	return strings.TrimPrefix(objectKey, s.prefix+"/")
+}
+
+func (s *S3ObjectStore) Open(key string) (io.ReadCloser, error) {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return nil, err
+	}
+	out, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		return nil, translateS3Error(err)
+	}
+	return out.Body, nil
+}
+
+func (s *S3ObjectStore) Put(key string, r io.Reader) error {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return err
+	}
+	_, err = s.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(objectKey),
+		Body:   r,
+	})
+	return err
+}
+
+func (s *S3ObjectStore) Stat(key string) (*ObjectInfo, error) {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return nil, err
+	}
+	out, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		return nil, translateS3Error(err)
+	}
+	return &ObjectInfo{
+		Key:     key,
+		Size:    aws.Int64Value(out.ContentLength),
+		ModTime: aws.TimeValue(out.LastModified),
+	}, nil
+}
+
+func (s *S3ObjectStore) List(prefix string) ([]ObjectInfo, error) {
+	objectPrefix, err := s.objectKey(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []ObjectInfo
+	err = s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(objectPrefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if !strings.HasPrefix(aws.StringValue(obj.Key), objectPrefix) {
+				continue
+			}
+			objects = append(objects, ObjectInfo{
+				Key:     s.storeKey(aws.StringValue(obj.Key)),
+				Size:    aws.Int64Value(obj.Size),
+				ModTime: aws.TimeValue(obj.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, translateS3Error(err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+func (s *S3ObjectStore) Delete(key string) error {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(objectKey),
+	})
+	return translateS3Error(err)
+}
+
+// Locate returns a presigned URL for key. ffmpeg reads it over HTTP using
+// range requests, so seeking into a video does not download all of it.
+func (s *S3ObjectStore) Locate(key string) (string, error) {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return "", err
+	}
+	req, _ := s.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(objectKey),
+	})
+	return req.Presign(DefaultPresignExpiry)
+}
+
+func translateS3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusNotFound {
+		return ErrNotExist
+	}
+
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return ErrNotExist
+		}
+	}
+	return err
+}
@@ -0,0 +1,271 @@
+package objstore
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a minimal in-memory implementation of the parts of the S3 API
+// used by S3ObjectStore, in the spirit of a local MinIO server. It only
+// understands path style addressing.
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	mtimes  map[string]time.Time
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		bucket:  bucket,
+		objects: map[string][]byte{},
+		mtimes:  map[string]time.Time{},
+	}
+}
+
+type fakeS3Contents struct {
+	Key          string `xml:"Key"`
+	Size         int64  `xml:"Size"`
+	LastModified string `xml:"LastModified"`
+}
+
+type fakeS3ListResult struct {
+	XMLName     xml.Name         `xml:"ListBucketResult"`
+	Name        string           `xml:"Name"`
+	Prefix      string           `xml:"Prefix"`
+	KeyCount    int              `xml:"KeyCount"`
+	IsTruncated bool             `xml:"IsTruncated"`
+	Contents    []fakeS3Contents `xml:"Contents"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, r.URL.Query().Get("prefix"))
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			f.error(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		f.objects[key] = data
+		f.mtimes[key] = time.Now().UTC().Truncate(time.Second)
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, len(data)))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.Header().Set("Last-Modified", f.mtimes[key].Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(data) // nolint: errcheck
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		delete(f.mtimes, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	result := fakeS3ListResult{Name: f.bucket, Prefix: prefix}
+	for key, data := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		result.Contents = append(result.Contents, fakeS3Contents{
+			Key:          key,
+			Size:         int64(len(data)),
+			LastModified: f.mtimes[key].Format(time.RFC3339),
+		})
+	}
+	sort.Slice(result.Contents, func(i, j int) bool {
+		return result.Contents[i].Key < result.Contents[j].Key
+	})
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result) // nolint: errcheck
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var keys []string
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func newTestS3Store(t *testing.T, prefix string) (*S3ObjectStore, *fakeS3) {
+	t.Helper()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+
+	fake := newFakeS3("clyper")
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	store, err := NewS3ObjectStore(S3Config{
+		Bucket:         "clyper",
+		Prefix:         prefix,
+		Region:         "us-east-1",
+		Endpoint:       srv.URL,
+		ForcePathStyle: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, fake
+}
+
+func TestS3ObjectStore(t *testing.T) {
+	store, fake := newTestS3Store(t, "")
+	testObjectStore(t, store)
+
+	want := []string{
+		"internal/metadata.db",
+		"public/01/01/thumb_00000400.jpg",
+		"public/01/02/thumb_00000200.jpg",
+	}
+	if got := fake.keys(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("bucket contains %q, want %q", got, want)
+	}
+}
+
+func TestS3ObjectStorePrefix(t *testing.T) {
+	store, fake := newTestS3Store(t, "/output/")
+	testObjectStore(t, store)
+
+	for _, key := range fake.keys() {
+		if !strings.HasPrefix(key, "output/") {
+			t.Errorf("object %q was written outside of the prefix", key)
+		}
+	}
+}
+
+func TestS3ObjectStoreLocate(t *testing.T) {
+	store, _ := newTestS3Store(t, "output")
+
+	u, err := store.Locate("internal/01/01/downscale_640_-1.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(u, "/clyper/output/internal/01/01/downscale_640_-1.mkv?") {
+		t.Errorf("Locate returned %q", u)
+	}
+	if !strings.Contains(u, "X-Amz-Signature=") {
+		t.Errorf("Locate returned an unsigned URL %q", u)
+	}
+}
+
+func TestS3ObjectStoreListSiblings(t *testing.T) {
+	store, fake := newTestS3Store(t, "output")
+
+	other, err := NewS3ObjectStore(S3Config{
+		Bucket:         "clyper",
+		Prefix:         "output2",
+		Region:         "us-east-1",
+		Endpoint:       store.client.Endpoint,
+		ForcePathStyle: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"public/a.jpg", "publicity/b.jpg"} {
+		if err := store.Put(key, strings.NewReader("x")); err != nil {
+			t.Fatal(err)
+		}
+		if err := other.Put(key, strings.NewReader("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(fake.keys()) != 4 {
+		t.Fatalf("bucket contains %q", fake.keys())
+	}
+
+	for prefix, want := range map[string][]string{
+		"":        {"public/a.jpg", "publicity/b.jpg"},
+		"public/": {"public/a.jpg"},
+		"public":  {"public/a.jpg", "publicity/b.jpg"},
+	} {
+		objects, err := store.List(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, object := range objects {
+			got = append(got, object.Key)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("List(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+}
+
+func TestS3ObjectStoreRejectsEscapingKeys(t *testing.T) {
+	store, fake := newTestS3Store(t, "output")
+
+	for _, key := range []string{"../secret", "public/../../secret", ".."} {
+		if _, err := store.Open(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Open(%q) returned %v, want ErrInvalidKey", key, err)
+		}
+		if err := store.Put(key, strings.NewReader("x")); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Put(%q) returned %v, want ErrInvalidKey", key, err)
+		}
+		if _, err := store.Stat(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Stat(%q) returned %v, want ErrInvalidKey", key, err)
+		}
+		if err := store.Delete(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Delete(%q) returned %v, want ErrInvalidKey", key, err)
+		}
+		if _, err := store.Locate(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Locate(%q) returned %v, want ErrInvalidKey", key, err)
+		}
+	}
+	if _, err := store.List("../"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("List(../) returned %v, want ErrInvalidKey", err)
+	}
+	if keys := fake.keys(); len(keys) != 0 {
+		t.Errorf("bucket contains %q", keys)
+	}
+}
@@ -0,0 +1,166 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	ffmpeg_go "github.com/u2takey/ffmpeg-go"
+)
+
+// AnimationFormat is the image format an animation is encoded in.
+type AnimationFormat string
+
+const (
+	AnimationFormatGIF  AnimationFormat = "gif"
+	AnimationFormatWebP AnimationFormat = "webp"
+	AnimationFormatAPNG AnimationFormat = "apng"
+)
+
+// ParseAnimationFormat returns the animation format for a file extension,
+// with or without the leading dot. Files without an extension are GIFs.
+func ParseAnimationFormat(ext string) (AnimationFormat, error) {
+	switch strings.ToLower(strings.TrimPrefix(ext, ".")) {
+	case "", "gif":
+		return AnimationFormatGIF, nil
+	case "webp":
+		return AnimationFormatWebP, nil
+	case "apng", "png":
+		return AnimationFormatAPNG, nil
+	}
+	return "", fmt.Errorf("unsupported animation format %q, expected gif, webp or apng", ext)
+}
+
+// ContentType returns the MIME type of animations in format.
+func (f AnimationFormat) ContentType() string {
+	return "image/" + string(f)
+}
+
+// animationEncoder describes how MakeAnimation encodes a format.
+type animationEncoder struct {
+	// palette formats are limited to 256 colours, which are picked for
+	// each animation with palettegen.
+	palette bool
+	// outputArgs are the ffmpeg output arguments of the format.
+	outputArgs ffmpeg_go.KwArgs
+}
+
+var animationEncoders = map[AnimationFormat]animationEncoder{
+	AnimationFormatGIF: {
+		palette:    true,
+		outputArgs: ffmpeg_go.KwArgs{"f": "gif"},
+	},
+	AnimationFormatWebP: {
+		outputArgs: ffmpeg_go.KwArgs{
+			"f":                 "webp",
+			"c:v":               "libwebp",
+			"loop":              "0",
+			"compression_level": "4",
+		},
+	},
+	AnimationFormatAPNG: {
+		palette:    true,
+		outputArgs: ffmpeg_go.KwArgs{"f": "apng", "plays": "0"},
+	},
+}
+
+// AnimationParams are the encoding parameters of an animation.
+type AnimationParams struct {
+	// FPS is the frame rate, 0 keeps the frame rate of the video.
+	FPS int `json:"fps"`
+	// Scale is the size relative to the video.
+	Scale float64 `json:"scale"`
+	// Colors is the palette size of palette formats.
+	Colors int `json:"colors"`
+	// Dither is the paletteuse dithering of palette formats.
+	Dither string `json:"dither"`
+	// Quality is the encoder quality, from 0 to 100, of other formats.
+	Quality int `json:"quality"`
+}
+
+// animationLadder lists the parameters MakeAnimation tries, best quality
+// and largest first. Each rung gives up a little quality for a smaller
+// file, so sizes decrease down the ladder as long as no rung raises the
+// frame rate of the video, which animationLadderFor sees to.
+var animationLadder = []AnimationParams{
+	{FPS: 0, Scale: 1, Colors: 128, Dither: "sierra2_4a", Quality: 75},
+	{FPS: 0, Scale: 1, Colors: 64, Dither: "sierra2_4a", Quality: 70},
+	{FPS: 15, Scale: 1, Colors: 64, Dither: "bayer", Quality: 65},
+	{FPS: 12, Scale: 1, Colors: 64, Dither: "bayer", Quality: 60},
+	{FPS: 12, Scale: 0.75, Colors: 64, Dither: "bayer", Quality: 55},
+	{FPS: 10, Scale: 0.75, Colors: 32, Dither: "bayer", Quality: 50},
+	{FPS: 10, Scale: 0.5, Colors: 32, Dither: "none", Quality: 45},
+	{FPS: 8, Scale: 0.5, Colors: 16, Dither: "none", Quality: 40},
+}
+
+// animationLadderFor returns animationLadder for a video with a frame rate
+// of sourceFPS, 0 if it is not known. Rungs at or above it keep the frame
+// rate of the video instead, as raising it duplicates frames and can make
+// a rung larger than the one before it.
+func animationLadderFor(sourceFPS float64) []AnimationParams {
+	ladder := make([]AnimationParams, len(animationLadder))
+	for i, params := range animationLadder {
+		if sourceFPS > 0 && float64(params.FPS) >= sourceFPS {
+			params.FPS = 0
+		}
+		ladder[i] = params
+	}
+	return ladder
+}
+
+// sourceFrameRate returns the frame rate of the first video stream of
+// inputFile, or 0 if it is not known.
+func sourceFrameRate(ctx context.Context, runner Runner, inputFile string) (float64, error) {
+	streams, _, err := ProbeStreams(ctx, runner, inputFile)
+	if err != nil {
+		return 0, err
+	}
+	for _, stream := range streams {
+		if stream.CodecType == "video" {
+			return stream.FrameRate(), nil
+		}
+	}
+	return 0, nil
+}
+
+// AnimationResult describes the animation MakeAnimation rendered.
+type AnimationResult struct {
+	Params AnimationParams
+	// Size is the size of the file in bytes.
+	Size int64
+	// Fits is false if even the smallest rendering is larger than the
+	// desired max size.
+	Fits bool
+	// Attempts is the number of renderings it took to find Params.
+	Attempts int
+}
+
+// renderAnimation encodes stream, which lasts duration, to file with params.
+func renderAnimation(ctx context.Context, runner Runner, stream *ffmpeg_go.Stream, file string, duration time.Duration, encoder animationEncoder, format AnimationFormat, params AnimationParams) error {
+	if params.FPS > 0 {
+		stream = stream.Filter("fps", ffmpeg_go.Args{fmt.Sprintf("fps=%d", params.FPS)})
+	}
+	if params.Scale > 0 && params.Scale < 1 {
+		stream = stream.Filter("scale", ffmpeg_go.Args{fmt.Sprintf("trunc(iw*%g/2)*2:-2", params.Scale)}, ffmpeg_go.KwArgs{"flags": "lanczos"})
+	}
+
+	outputArgs := ffmpeg_go.KwArgs{}
+	for k, v := range encoder.outputArgs {
+		outputArgs[k] = v
+	}
+	if encoder.palette {
+		split := stream.Split()
+		palette := split.Get("1").Filter("palettegen", ffmpeg_go.Args{fmt.Sprintf("max_colors=%d", params.Colors)})
+		stream = ffmpeg_go.Filter([]*ffmpeg_go.Stream{split.Get("0"), palette}, "paletteuse", ffmpeg_go.Args{"dither=" + params.Dither})
+	} else {
+		outputArgs["q:v"] = strconv.Itoa(params.Quality)
+	}
+
+	err := runner.Run(ctx, stream.Output(file, outputArgs).OverWriteOutput(), duration)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", format, err)
+	}
+	return nil
+}
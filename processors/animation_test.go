@@ -0,0 +1,255 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseAnimationFormat(t *testing.T) {
+	for ext, want := range map[string]AnimationFormat{
+		"":      AnimationFormatGIF,
+		".gif":  AnimationFormatGIF,
+		"GIF":   AnimationFormatGIF,
+		".webp": AnimationFormatWebP,
+		"apng":  AnimationFormatAPNG,
+		".png":  AnimationFormatAPNG,
+	} {
+		format, err := ParseAnimationFormat(ext)
+		if err != nil || format != want {
+			t.Errorf("ParseAnimationFormat(%q) = %q, %v, want %q", ext, format, err, want)
+		}
+	}
+	for _, ext := range []string{".mp4", "jpg"} {
+		if _, err := ParseAnimationFormat(ext); err == nil {
+			t.Errorf("ParseAnimationFormat(%q) succeeded", ext)
+		}
+	}
+}
+
+func TestMakeAnimationFormats(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		format AnimationFormat
+		// muxer is the -f of the output
+		muxer   string
+		palette bool
+	}{
+		{"default", "", "gif", true},
+		{"gif", AnimationFormatGIF, "gif", true},
+		{"webp", AnimationFormatWebP, "webp", false},
+		{"apng", AnimationFormatAPNG, "apng", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			runner := &FakeRunner{RunFunc: writeFakeOutputs}
+			outputFile := filepath.Join(t.TempDir(), "out")
+			_, err := MakeAnimation(context.Background(), "/videos/in.mkv", outputFile, 0, 2000, GifOptions{Format: tc.format, Runner: runner})
+			if err != nil {
+				t.Fatal(err)
+			}
+			calls := ffmpegCalls(runner)
+			if len(calls) == 0 {
+				t.Fatal("ffmpeg was not run")
+			}
+			for _, call := range calls {
+				if got := argValue(call.Args, "-f"); got != tc.muxer {
+					t.Errorf("-f = %q, want %q", got, tc.muxer)
+				}
+				filters := argValue(call.Args, "-filter_complex")
+				if palette := strings.Contains(filters, "palettegen"); palette != tc.palette {
+					t.Errorf("palette = %v, want %v: %q", palette, tc.palette, filters)
+				}
+				if quality := slices.Contains(call.Args, "-q:v"); quality == tc.palette {
+					t.Errorf("quality set = %v for palette %v: %q", quality, tc.palette, call.Args)
+				}
+			}
+		})
+	}
+
+	_, err := MakeAnimation(context.Background(), "/videos/in.mkv", filepath.Join(t.TempDir(), "out"), 0, 2000, GifOptions{Format: "mp4", Runner: &FakeRunner{}})
+	if err == nil {
+		t.Error("MakeAnimation succeeded in an unsupported format")
+	}
+}
+
+func TestMakeGif(t *testing.T) {
+	runner := &FakeRunner{RunFunc: writeFakeOutputs}
+	err := MakeGif("/videos/in.mkv", filepath.Join(t.TempDir(), "out"), 0, 2000, GifOptions{Format: AnimationFormatWebP, Runner: runner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, call := range ffmpegCalls(runner) {
+		if got := argValue(call.Args, "-f"); got != "gif" {
+			t.Errorf("-f = %q, want gif", got)
+		}
+	}
+}
+
+// ffmpegCalls returns the ffmpeg runs recorded by runner, leaving out
+// probes.
+func ffmpegCalls(runner *FakeRunner) []FakeCall {
+	var calls []FakeCall
+	for _, call := range runner.Calls() {
+		if call.Program == "ffmpeg" {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// probeFrameRate returns a ProbeFunc for a video of rate, such as "24/1".
+func probeFrameRate(rate string) func(string, []string) (string, error) {
+	return func(fileName string, args []string) (string, error) {
+		return fmt.Sprintf(`{"streams": [{"index": 0, "codec_type": "video", "avg_frame_rate": %q}]}`, rate), nil
+	}
+}
+
+// ladderRunner is a FakeRunner that renders rung i of animationLadder to
+// sizes[i] bytes, from a 24 fps video.
+func ladderRunner(sizes []int) *FakeRunner {
+	return &FakeRunner{ProbeFunc: probeFrameRate("24/1"), RunFunc: func(args []string) error {
+		// The output is only followed by -y
+		output := args[len(args)-2]
+		var rung int
+		if _, err := fmt.Sscanf(filepath.Base(output), "%d.", &rung); err != nil {
+			return err
+		}
+		return os.WriteFile(output, make([]byte, sizes[rung]), 0644)
+	}}
+}
+
+func TestMakeAnimationSizeSearch(t *testing.T) {
+	sizes := []int{800, 700, 600, 500, 400, 300, 200, 100}
+
+	for _, tc := range []struct {
+		name    string
+		maxSize int
+		rung    int
+		fits    bool
+	}{
+		{"best fits", 1000, 0, true},
+		{"middle fits", 450, 4, true},
+		{"exact size fits", 300, 5, true},
+		{"only smallest fits", 150, 7, true},
+		{"nothing fits", 50, 7, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			runner := ladderRunner(sizes)
+			outputFile := filepath.Join(t.TempDir(), "out.gif")
+			result, err := MakeAnimation(context.Background(), "/videos/in.mkv", outputFile, 0, 2000, GifOptions{DesiredMaxSize: tc.maxSize, Runner: runner})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Params != animationLadder[tc.rung] || result.Fits != tc.fits {
+				t.Errorf("result = %+v, want rung %d %+v, fits %v", result, tc.rung, animationLadder[tc.rung], tc.fits)
+			}
+			if result.Size != int64(sizes[tc.rung]) {
+				t.Errorf("size = %d, want %d", result.Size, sizes[tc.rung])
+			}
+			info, err := os.Stat(outputFile)
+			if err != nil || info.Size() != int64(sizes[tc.rung]) {
+				t.Errorf("output = %v, %v, want %d bytes", info, err, sizes[tc.rung])
+			}
+			// A binary search over the ladder renders each rung at most once
+			if calls := len(ffmpegCalls(runner)); result.Attempts != calls || calls > bits.Len(uint(len(animationLadder))) {
+				t.Errorf("attempts = %d, ran ffmpeg %d times", result.Attempts, calls)
+			}
+		})
+	}
+}
+
+func TestAnimationLadderFor(t *testing.T) {
+	for _, tc := range []struct {
+		rate string
+		fps  float64
+		// capped are the rungs that keep the frame rate of the video
+		capped []int
+	}{
+		{"24000/1001", 23.976, []int{0, 1}},
+		{"12/1", 12, []int{0, 1, 2, 3, 4}},
+		{"8", 8, []int{0, 1, 2, 3, 4, 5, 6, 7}},
+		{"0/0", 0, []int{0, 1}},
+		{"", 0, []int{0, 1}},
+	} {
+		fps := ProbeStream{AvgFrameRate: tc.rate}.FrameRate()
+		if fps < tc.fps-0.001 || fps > tc.fps+0.001 {
+			t.Errorf("FrameRate(%q) = %g, want %g", tc.rate, fps, tc.fps)
+		}
+		var capped []int
+		for i, params := range animationLadderFor(fps) {
+			if params.FPS == 0 {
+				capped = append(capped, i)
+			} else if params.FPS != animationLadder[i].FPS {
+				t.Errorf("%q: rung %d has %d fps, want %d", tc.rate, i, params.FPS, animationLadder[i].FPS)
+			}
+		}
+		if !slices.Equal(capped, tc.capped) {
+			t.Errorf("%q: rungs %v keep the frame rate of the video, want %v", tc.rate, capped, tc.capped)
+		}
+	}
+}
+
+func TestMakeAnimationLowFrameRate(t *testing.T) {
+	// Rendered at 15 fps, a 12 fps video has duplicated frames and gets
+	// larger than at its own rate
+	sizes := []int{800, 700, 650, 600, 500, 450, 420, 100}
+	runner := ladderRunner(sizes)
+	runner.ProbeFunc = probeFrameRate("12/1")
+	writeRung := runner.RunFunc
+	runner.RunFunc = func(args []string) error {
+		if strings.Contains(argValue(args, "-filter_complex"), "fps=fps=15") {
+			return os.WriteFile(args[len(args)-2], make([]byte, 900), 0644)
+		}
+		return writeRung(args)
+	}
+
+	// Rung 2 fits once it keeps the frame rate of the video, a search
+	// rendering it at 15 fps would skip it for rung 3
+	result, err := MakeAnimation(context.Background(), "/videos/in.mkv", filepath.Join(t.TempDir(), "out.gif"), 0, 2000, GifOptions{DesiredMaxSize: 660, Runner: runner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := animationLadder[2]
+	want.FPS = 0
+	if result.Params != want || result.Size != 650 {
+		t.Errorf("result = %+v, want rung 2 at the frame rate of the video", result)
+	}
+	for _, call := range ffmpegCalls(runner) {
+		if filters := argValue(call.Args, "-filter_complex"); strings.Contains(filters, "fps=fps=15") || strings.Contains(filters, "fps=fps=12") {
+			t.Errorf("rendered at or above the frame rate of the video: %q", filters)
+		}
+	}
+}
+
+func TestMakeAnimationUnknownFrameRate(t *testing.T) {
+	// Without a frame rate the sizes may not decrease down the ladder
+	sizes := []int{800, 350, 900, 600, 500, 450, 420, 100}
+
+	// The first rung that fits is found, a binary search would skip it
+	// for rung 7
+	runner := ladderRunner(sizes)
+	runner.ProbeFunc = probeFrameRate("0/0")
+	result, err := MakeAnimation(context.Background(), "/videos/in.mkv", filepath.Join(t.TempDir(), "out.gif"), 0, 2000, GifOptions{DesiredMaxSize: 400, Runner: runner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Params != animationLadder[1] || result.Attempts != 2 || !result.Fits {
+		t.Errorf("result = %+v, want rung 1 after 2 attempts", result)
+	}
+
+	// Videos that cannot be probed are searched the same way
+	runner = ladderRunner(sizes)
+	runner.ProbeFunc = nil
+	result, err = MakeAnimation(context.Background(), "/videos/in.mkv", filepath.Join(t.TempDir(), "out.gif"), 0, 2000, GifOptions{DesiredMaxSize: 50, Runner: runner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Params != animationLadder[7] || result.Fits || result.Attempts != len(animationLadder) {
+		t.Errorf("result = %+v, want the last rung after trying every rung", result)
+	}
+}
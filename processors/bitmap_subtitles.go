@@ -0,0 +1,307 @@
+package processor
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asticode/go-astisub"
+	"github.com/rs/zerolog/log"
+	ffmpeg_go "github.com/u2takey/ffmpeg-go"
+)
+
+// defaultBitmapSubtitleDuration is how long a bitmap subtitle is shown when
+// the stream does not say when it is cleared.
+const defaultBitmapSubtitleDuration = 5 * time.Second
+
+// BitmapSubtitle is a subtitle image and the time it is shown.
+type BitmapSubtitle struct {
+	Start time.Duration
+	End   time.Duration
+	Image image.Image
+}
+
+// SubtitleDecoder decodes an image based subtitle stream of the video at
+// inputFilePath into the images it shows, in order, reading the stream with
+// runner. It must stop when ctx is done.
+type SubtitleDecoder interface {
+	Decode(ctx context.Context, runner Runner, inputFilePath string, streamIndex int) ([]BitmapSubtitle, error)
+}
+
+// DefaultSubtitleDecoders are the subtitle decoders used for each codec
+// when PreprocessorConfig.SubtitleDecoders is not set.
+var DefaultSubtitleDecoders = map[string]SubtitleDecoder{
+	"hdmv_pgs_subtitle": PGSDecoder{},
+	"dvd_subtitle":      DVDSubtitleDecoder{},
+}
+
+// DefaultOCRCommand runs tesseract, which must be installed along with the
+// language data for every language that is recognised.
+var DefaultOCRCommand = []string{"tesseract", "{image}", "stdout", "-l", "{language}", "--psm", "6"}
+
+// DefaultOCRLanguages map the ISO 639-2/B codes streams are tagged with to
+// tesseract's language names, where they differ.
+var DefaultOCRLanguages = map[string]string{
+	"chi": "chi_sim",
+	"cze": "ces",
+	"dut": "nld",
+	"fre": "fra",
+	"ger": "deu",
+	"gre": "ell",
+	"ice": "isl",
+	"may": "msa",
+	"per": "fas",
+	"rum": "ron",
+	"slo": "slk",
+	"und": "eng",
+}
+
+type OCRConfig struct {
+	// Command is the OCR program and its arguments. "{image}" is replaced
+	// with the path of a PNG of one subtitle, black text on white, and
+	// "{language}" with the OCR language. The text is read from stdout.
+	// Defaults to DefaultOCRCommand, an empty command is an error.
+	Command []string `mapstructure:"command"`
+	// Languages maps subtitle languages to the names Command expects.
+	// Entries are added to DefaultOCRLanguages, languages in neither are
+	// passed as is.
+	Languages map[string]string `mapstructure:"languages"`
+	// Timeout caps how long Command may take for one image. Zero means no
+	// limit.
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// subtitlePacket is a packet of a subtitle stream as reported by ffprobe.
+type subtitlePacket struct {
+	PTS      time.Duration
+	Duration time.Duration
+	Data     []byte
+}
+
+type ffprobePacketsOutput struct {
+	Packets []struct {
+		PTSTime      string `json:"pts_time"`
+		DurationTime string `json:"duration_time"`
+		Data         string `json:"data"`
+	} `json:"packets"`
+	Streams []struct {
+		Extradata string `json:"extradata"`
+	} `json:"streams"`
+}
+
+// probeSubtitlePackets reads the packets and codec extradata of a subtitle
+// stream with ffprobe.
+func probeSubtitlePackets(ctx context.Context, runner Runner, inputFilePath string, streamIndex int) ([]subtitlePacket, []byte, error) {
+	probeStr, err := runner.Probe(ctx, inputFilePath, ffmpeg_go.KwArgs{
+		"select_streams": strconv.Itoa(streamIndex),
+		"show_packets":   "",
+		"show_data":      "",
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error probing subtitle stream %d: %w", streamIndex, err)
+	}
+
+	var probe ffprobePacketsOutput
+	err = json.Unmarshal([]byte(probeStr), &probe)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error unmarshalling ffprobe packets: %v", err)
+	}
+
+	var extradata []byte
+	if len(probe.Streams) > 0 {
+		extradata, err = parseHexDump(probe.Streams[0].Extradata)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parsing extradata of stream %d: %v", streamIndex, err)
+		}
+	}
+
+	packets := make([]subtitlePacket, 0, len(probe.Packets))
+	for _, p := range probe.Packets {
+		pts, err := parseSeconds(p.PTSTime)
+		if err != nil {
+			continue
+		}
+		duration, _ := parseSeconds(p.DurationTime)
+		data, err := parseHexDump(p.Data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parsing packet at %s: %v", pts, err)
+		}
+		packets = append(packets, subtitlePacket{PTS: pts, Duration: duration, Data: data})
+	}
+	return packets, extradata, nil
+}
+
+func parseSeconds(s string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// parseHexDump parses the hex dumps ffprobe prints for -show_data. Each
+// line is an offset, 41 columns of hex and the printable characters:
+//
+//	00000000: 0000 0000 0000 0000 0000 0000 0000 0000  ................
+func parseHexDump(dump string) ([]byte, error) {
+	var data []byte
+	for _, line := range strings.Split(dump, "\n") {
+		_, rest, found := strings.Cut(line, ": ")
+		if !found {
+			continue
+		}
+		if len(rest) > 41 {
+			rest = rest[:41]
+		}
+		b, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(rest), " ", ""))
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, b...)
+	}
+	return data, nil
+}
+
+// closeBitmapSubtitles fills in the end of subtitles that are shown until
+// the next one.
+func closeBitmapSubtitles(subtitles []BitmapSubtitle) []BitmapSubtitle {
+	for i := range subtitles {
+		if subtitles[i].End > subtitles[i].Start {
+			continue
+		}
+		subtitles[i].End = subtitles[i].Start + defaultBitmapSubtitleDuration
+		if i+1 < len(subtitles) && subtitles[i+1].Start < subtitles[i].End {
+			subtitles[i].End = subtitles[i+1].Start
+		}
+	}
+	return subtitles
+}
+
+// ocrSubtitleTrack decodes the image based subtitle stream of track,
+// recognises the text of every image and writes the result as SRT to
+// outputPath.
+func (p *Preprocessor) ocrSubtitleTrack(ctx context.Context, inputFilePath string, track subtitleTrack, workDir string, outputPath string) error {
+	decoder, ok := p.config.SubtitleDecoders[track.codec]
+	if !ok {
+		return fmt.Errorf("no subtitle decoder for %s", track.codec)
+	}
+
+	decodeCtx, cancel := withTimeout(ctx, "ffprobe", p.config.ProbeTimeout)
+	bitmaps, err := decoder.Decode(decodeCtx, p.config.Runner, inputFilePath, track.index)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("error decoding %s subtitle stream %d: %w", track.codec, track.index, err)
+	}
+
+	language := track.language
+	if ocrLanguage, ok := p.config.OCR.Languages[language]; ok {
+		language = ocrLanguage
+	}
+
+	log.Info().Str("path", inputFilePath).Int("stream", track.index).Int("images", len(bitmaps)).Msg("running ocr on subtitles")
+
+	subs := astisub.NewSubtitles()
+	for i, bitmap := range bitmaps {
+		imagePath := filepath.Join(workDir, fmt.Sprintf("ocr_%d_%06d.png", track.index, i))
+		err := writeOCRImage(imagePath, bitmap.Image)
+		if err != nil {
+			return fmt.Errorf("error writing ocr image: %v", err)
+		}
+
+		text, err := p.recogniseText(ctx, imagePath, language)
+		if err != nil {
+			return err
+		}
+		if text == "" {
+			continue
+		}
+
+		item := &astisub.Item{StartAt: bitmap.Start, EndAt: bitmap.End}
+		for _, line := range strings.Split(text, "\n") {
+			item.Lines = append(item.Lines, astisub.Line{Items: []astisub.LineItem{{Text: line}}})
+		}
+		subs.Items = append(subs.Items, item)
+	}
+
+	if len(subs.Items) == 0 {
+		return fmt.Errorf("no text recognised in %s subtitle stream %d", track.codec, track.index)
+	}
+	return subs.Write(outputPath)
+}
+
+// recogniseText runs the OCR command on the image at imagePath.
+func (p *Preprocessor) recogniseText(ctx context.Context, imagePath string, language string) (string, error) {
+	ctx, cancel := withTimeout(ctx, "ocr", p.config.OCR.Timeout)
+	defer cancel()
+
+	args := make([]string, 0, len(p.config.OCR.Command))
+	for _, arg := range p.config.OCR.Command {
+		arg = strings.ReplaceAll(arg, "{image}", imagePath)
+		arg = strings.ReplaceAll(arg, "{language}", language)
+		args = append(args, arg)
+	}
+
+	out, err := command(ctx, args[0], args[1:]...).Output()
+	if err != nil && ctx.Err() != nil {
+		return "", context.Cause(ctx)
+	}
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return "", fmt.Errorf("ocr command failed: %v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("ocr command failed: %v", err)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// writeOCRImage writes img as a padded grayscale PNG with dark text on a
+// white background, which OCR engines read best. Subtitles are light text
+// with a dark outline, so the ink is the opaque light pixels.
+func writeOCRImage(imagePath string, img image.Image) error {
+	const padding = 10
+
+	bounds := img.Bounds()
+	out := image.NewGray(image.Rect(0, 0, bounds.Dx()+2*padding, bounds.Dy()+2*padding))
+	for i := range out.Pix {
+		out.Pix[i] = 0xff
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			luma := (299*int(c.R) + 587*int(c.G) + 114*int(c.B)) / 1000
+			ink := luma * int(c.A) / 0xff
+			out.SetGray(x-bounds.Min.X+padding, y-bounds.Min.Y+padding, color.Gray{Y: uint8(0xff - ink)})
+		}
+	}
+
+	f, err := os.Create(imagePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = png.Encode(f, out)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,412 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hexDumpLine formats data like a line of ffprobe's -show_data output.
+func hexDumpLine(offset int, data []byte) string {
+	var groups []string
+	for i := 0; i < len(data); i += 2 {
+		groups = append(groups, fmt.Sprintf("%x", data[i:min(i+2, len(data))]))
+	}
+	ascii := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return '.'
+		}
+		return r
+	}, string(data))
+	return fmt.Sprintf("%08x: %-39s  %s", offset, strings.Join(groups, " "), ascii)
+}
+
+func TestParseHexDump(t *testing.T) {
+	data := []byte("\x14\x00\x02abcdef0123456789\xff")
+	dump := "\n" + hexDumpLine(0, data[:16]) + "\n" + hexDumpLine(16, data[16:]) + "\n"
+
+	got, err := parseHexDump(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("parseHexDump(%q) = %x, want %x", dump, got, data)
+	}
+
+	if got, err := parseHexDump(""); err != nil || len(got) != 0 {
+		t.Errorf("parseHexDump(\"\") = %x, %v, want nothing", got, err)
+	}
+	if _, err := parseHexDump("00000000: 0g00"); err == nil {
+		t.Error("parseHexDump accepted invalid hex")
+	}
+}
+
+func TestDecodePGSRLE(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		rle    []byte
+		width  int
+		height int
+		want   []byte
+	}{
+		{
+			name:  "single pixels and short runs",
+			rle:   []byte{1, 2, 0x00, 0x02, 0x00, 0x00, 0x00, 0x84, 3, 0x00, 0x00},
+			width: 4, height: 2,
+			want: []byte{1, 2, 0, 0, 3, 3, 3, 3},
+		},
+		{
+			name:  "long run",
+			rle:   []byte{0x00, 0xc0 | 0x01, 0x04, 5, 0x00, 0x00},
+			width: 260, height: 1,
+			want: bytes.Repeat([]byte{5}, 260),
+		},
+		{
+			name:  "end of line pads the line",
+			rle:   []byte{7, 0x00, 0x00, 8, 8, 8, 0x00, 0x00},
+			width: 3, height: 2,
+			want: []byte{7, 0, 0, 8, 8, 8},
+		},
+		{
+			name:  "truncated data is padded",
+			rle:   []byte{9, 0x00},
+			width: 2, height: 2,
+			want: []byte{9, 0, 0, 0},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := decodePGSRLE(tc.rle, tc.width, tc.height)
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("decodePGSRLE = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// pgsSegment returns a PGS segment of the given type.
+func pgsSegment(segmentType byte, payload ...byte) []byte {
+	return append([]byte{segmentType, byte(len(payload) >> 8), byte(len(payload))}, payload...)
+}
+
+type testPGSObject struct {
+	id      uint16
+	x, y    int
+	cropped bool
+	rle     []byte
+	w, h    int
+}
+
+// pgsCompositionFixture returns a presentation composition segment showing
+// objects with the given palette.
+func pgsCompositionFixture(paletteOnly bool, paletteID byte, objects ...testPGSObject) []byte {
+	payload := []byte{0x07, 0x80, 0x04, 0x38, 0x10, 0x00, 0x01, 0x80, 0x00, paletteID, byte(len(objects))}
+	if paletteOnly {
+		payload[8] = 0x80
+	}
+	for _, o := range objects {
+		var flags byte
+		if o.cropped {
+			flags = 0x80
+		}
+		payload = binary.BigEndian.AppendUint16(payload, o.id)
+		payload = append(payload, 0, flags)
+		payload = binary.BigEndian.AppendUint16(payload, uint16(o.x))
+		payload = binary.BigEndian.AppendUint16(payload, uint16(o.y))
+		if o.cropped {
+			payload = append(payload, 0, 0, 0, 0, 0, 2, 0, 1)
+		}
+	}
+	return pgsSegment(pgsCompositionSegment, payload...)
+}
+
+// pgsObjectFixture returns an object definition segment with all of o.
+func pgsObjectFixture(o testPGSObject) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, o.id)
+	size := len(o.rle) + 4
+	payload = append(payload, 0, 0xc0, byte(size>>16), byte(size>>8), byte(size))
+	payload = binary.BigEndian.AppendUint16(payload, uint16(o.w))
+	payload = binary.BigEndian.AppendUint16(payload, uint16(o.h))
+	return pgsSegment(pgsObjectSegment, append(payload, o.rle...)...)
+}
+
+func TestDecodePGS(t *testing.T) {
+	// Palette 0 has a transparent entry 0, white entry 1 and half
+	// transparent red entry 2. Entries are Y, Cr, Cb and alpha.
+	palette := pgsSegment(pgsPaletteSegment,
+		0, 0,
+		0, 0, 128, 128, 0,
+		1, 235, 128, 128, 255,
+		2, 81, 240, 90, 128,
+	)
+	white := color.NRGBA{A: 255}
+	white.R, white.G, white.B = color.YCbCrToRGB(235, 128, 128)
+	red := color.NRGBA{A: 128}
+	red.R, red.G, red.B = color.YCbCrToRGB(81, 90, 240)
+
+	// The first object is cropped, which adds 8 bytes to its composition
+	// entry that must be skipped to read the second
+	top := testPGSObject{id: 0, x: 10, y: 20, cropped: true, w: 4, h: 2,
+		rle: []byte{1, 1, 0x00, 0x02, 0x00, 0x00, 0x00, 0x84, 1, 0x00, 0x00}}
+	bottom := testPGSObject{id: 1, x: 10, y: 30, w: 2, h: 1,
+		rle: []byte{2, 1, 0x00, 0x00}}
+
+	var shown []byte
+	shown = append(shown, pgsCompositionFixture(false, 0, top, bottom)...)
+	shown = append(shown, palette...)
+	shown = append(shown, pgsObjectFixture(top)...)
+	shown = append(shown, pgsObjectFixture(bottom)...)
+	shown = append(shown, pgsSegment(pgsEndSegment)...)
+
+	cleared := append(pgsCompositionFixture(false, 0), pgsSegment(pgsEndSegment)...)
+	paletteUpdate := append(pgsCompositionFixture(true, 0, top), pgsSegment(pgsEndSegment)...)
+	shownAgain := append(pgsCompositionFixture(false, 0, top), pgsSegment(pgsEndSegment)...)
+
+	subtitles, err := decodePGS([]subtitlePacket{
+		{PTS: 1 * time.Second, Data: shown},
+		{PTS: 3 * time.Second, Data: cleared},
+		// A palette only update does not end or start a subtitle
+		{PTS: 5 * time.Second, Data: paletteUpdate},
+		{PTS: 6 * time.Second, Data: shownAgain},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var times [][2]time.Duration
+	for _, subtitle := range subtitles {
+		times = append(times, [2]time.Duration{subtitle.Start, subtitle.End})
+	}
+	// The last subtitle is never cleared, so it is shown for the default
+	// duration
+	wantTimes := [][2]time.Duration{
+		{1 * time.Second, 3 * time.Second},
+		{6 * time.Second, 6*time.Second + defaultBitmapSubtitleDuration},
+	}
+	if !reflect.DeepEqual(times, wantTimes) {
+		t.Fatalf("times = %v, want %v", times, wantTimes)
+	}
+
+	img := subtitles[0].Image
+	if got, want := img.Bounds(), image.Rect(10, 20, 14, 31); got != want {
+		t.Errorf("bounds = %v, want %v", got, want)
+	}
+	for _, tc := range []struct {
+		x, y int
+		want color.NRGBA
+	}{
+		{10, 20, white},
+		{11, 20, white},
+		{12, 20, color.NRGBA{}},
+		{13, 21, white},
+		// Between the objects
+		{10, 25, color.NRGBA{}},
+		{10, 30, red},
+		{11, 30, white},
+	} {
+		if got := color.NRGBAModel.Convert(img.At(tc.x, tc.y)); got != tc.want {
+			t.Errorf("pixel %d,%d = %v, want %v", tc.x, tc.y, got, tc.want)
+		}
+	}
+
+	if got, want := subtitles[1].Image.Bounds(), image.Rect(10, 20, 14, 22); got != want {
+		t.Errorf("bounds of the second subtitle = %v, want %v", got, want)
+	}
+}
+
+func TestDecodePGSErrors(t *testing.T) {
+	object := testPGSObject{id: 0, w: 1, h: 1, rle: []byte{1}}
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"truncated segment", []byte{pgsPaletteSegment, 0x00, 0x10, 0x00}, "truncated pgs segment"},
+		{"short composition", pgsSegment(pgsCompositionSegment, 1, 2, 3), "short pgs composition segment"},
+		{"short object", pgsSegment(pgsObjectSegment, 0, 0, 0, 0x80, 0, 0), "short pgs object segment"},
+		{
+			"missing palette",
+			bytes.Join([][]byte{pgsCompositionFixture(false, 3, object), pgsObjectFixture(object), pgsSegment(pgsEndSegment)}, nil),
+			"missing palette 3",
+		},
+		{
+			"missing object",
+			bytes.Join([][]byte{pgsCompositionFixture(false, 0, object), pgsSegment(pgsPaletteSegment, 0, 0), pgsSegment(pgsEndSegment)}, nil),
+			"missing object 0",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := decodePGS([]subtitlePacket{{PTS: time.Second, Data: tc.data}})
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("decodePGS error = %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+// dvdSubtitlePacket returns a 4x2 DVD subtitle shown from the packet time
+// until stopDelay ticks later. The top line is two pixels of color 1 and
+// two of color 2, the bottom line is filled with color 3.
+func dvdSubtitlePacket(stopDelay uint16) []byte {
+	packet := []byte{
+		0, 0, // size
+		0, 7, // control offset
+		0x9a,       // top field: 2 pixels of color 1, 2 of color 2
+		0x00, 0x03, // bottom field: color 3 to the end of the line
+	}
+	const second = 7 + 24
+	packet = append(packet,
+		0, 0, 0, second,
+		dvdSubStart,
+		// Colors 3, 2, 1 and 0 are palette entries 15, 10, 5 and 0
+		dvdSubPalette, 0xfa, 0x50,
+		// Alphas 3, 2, 1 and 0
+		dvdSubAlpha, 0xf8, 0xf0,
+		// x 0 to 3, y 0 to 1
+		dvdSubCoordinates, 0x00, 0x00, 0x03, 0x00, 0x00, 0x01,
+		dvdSubRLEOffsets, 0, 4, 0, 5,
+		dvdSubEnd,
+	)
+	packet = append(packet, byte(stopDelay>>8), byte(stopDelay), 0, second, dvdSubStop, dvdSubEnd)
+	binary.BigEndian.PutUint16(packet, uint16(len(packet)))
+	return packet
+}
+
+func TestDecodeDVDSubtitle(t *testing.T) {
+	palette := parseDVDSubPalette(nil)
+	img, start, stop, err := decodeDVDSubtitle(dvdSubtitlePacket(88), palette)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start != 0 {
+		t.Errorf("start = %v, want 0", start)
+	}
+	if want := 88 * 1024 * time.Second / 90000; stop != want {
+		t.Errorf("stop = %v, want %v", stop, want)
+	}
+	if got, want := img.Bounds(), image.Rect(0, 0, 4, 2); got != want {
+		t.Fatalf("bounds = %v, want %v", got, want)
+	}
+
+	gray := func(entry uint8, alpha uint8) color.NRGBA {
+		return color.NRGBA{R: entry * 0x11, G: entry * 0x11, B: entry * 0x11, A: alpha}
+	}
+	want := [2][4]color.NRGBA{
+		{gray(5, 0xff), gray(5, 0xff), gray(10, 0x88), gray(10, 0x88)},
+		{gray(15, 0xff), gray(15, 0xff), gray(15, 0xff), gray(15, 0xff)},
+	}
+	for y, row := range want {
+		for x, c := range row {
+			if got := color.NRGBAModel.Convert(img.At(x, y)); got != c {
+				t.Errorf("pixel %d,%d = %v, want %v", x, y, got, c)
+			}
+		}
+	}
+
+	_, _, _, err = decodeDVDSubtitle([]byte{0, 4, 0, 40}, palette)
+	if err == nil {
+		t.Error("decodeDVDSubtitle accepted a control sequence out of range")
+	}
+	_, _, _, err = decodeDVDSubtitle([]byte{0, 9, 0, 4, 0, 0, 0, 4, 0x42}, palette)
+	if err == nil || !strings.Contains(err.Error(), "unknown command 0x42") {
+		t.Errorf("decodeDVDSubtitle error = %v, want an unknown command", err)
+	}
+}
+
+func TestDecodeDVDSubtitles(t *testing.T) {
+	palette := parseDVDSubPalette(nil)
+	subtitles, err := decodeDVDSubtitles([]subtitlePacket{
+		{PTS: 1 * time.Second, Data: dvdSubtitlePacket(90000 / 1024)},
+		// Without a stop delay the packet duration is used
+		{PTS: 10 * time.Second, Duration: 2 * time.Second, Data: dvdSubtitlePacket(0)},
+		// Without either, the subtitle is shown until the next one
+		{PTS: 20 * time.Second, Data: dvdSubtitlePacket(0)},
+		{PTS: 21 * time.Second, Data: dvdSubtitlePacket(0)},
+	}, palette)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var times [][2]time.Duration
+	for _, subtitle := range subtitles {
+		times = append(times, [2]time.Duration{subtitle.Start, subtitle.End})
+	}
+	want := [][2]time.Duration{
+		{1 * time.Second, 1*time.Second + 87*1024*time.Second/90000},
+		{10 * time.Second, 12 * time.Second},
+		{20 * time.Second, 21 * time.Second},
+		{21 * time.Second, 21*time.Second + defaultBitmapSubtitleDuration},
+	}
+	if !reflect.DeepEqual(times, want) {
+		t.Errorf("times = %v, want %v", times, want)
+	}
+}
+
+func TestParseDVDSubPalette(t *testing.T) {
+	palette := parseDVDSubPalette([]byte("size: 720x480\npalette: ff0000, 00ff00, zzz, 0000ff\n"))
+	for i, want := range map[int]color.NRGBA{
+		0: {R: 0xff, A: 0xff},
+		1: {G: 0xff, A: 0xff},
+		// Invalid entries keep the grayscale default
+		2:  {R: 0x22, G: 0x22, B: 0x22, A: 0xff},
+		3:  {B: 0xff, A: 0xff},
+		15: {R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+	} {
+		if palette[i] != want {
+			t.Errorf("palette[%d] = %v, want %v", i, palette[i], want)
+		}
+	}
+}
+
+func TestCloseBitmapSubtitles(t *testing.T) {
+	second := time.Second
+	subtitles := closeBitmapSubtitles([]BitmapSubtitle{
+		// Ended subtitles are kept
+		{Start: 1 * second, End: 2 * second},
+		// Open subtitles end when the next starts
+		{Start: 3 * second},
+		{Start: 4 * second},
+		// or after the default duration if the next starts later
+		{Start: 20 * second, End: 20 * second},
+		{Start: 30 * second, End: 31 * second},
+		{Start: 40 * second},
+	})
+
+	var times [][2]time.Duration
+	for _, subtitle := range subtitles {
+		times = append(times, [2]time.Duration{subtitle.Start, subtitle.End})
+	}
+	want := [][2]time.Duration{
+		{1 * second, 2 * second},
+		{3 * second, 4 * second},
+		{4 * second, 4*second + defaultBitmapSubtitleDuration},
+		{20 * second, 20*second + defaultBitmapSubtitleDuration},
+		{30 * second, 31 * second},
+		{40 * second, 40*second + defaultBitmapSubtitleDuration},
+	}
+	if !reflect.DeepEqual(times, want) {
+		t.Errorf("times = %v, want %v", times, want)
+	}
+}
+
+func TestNewPreprocessorOCRCommand(t *testing.T) {
+	p, err := NewPreprocessor(PreprocessorConfig{OCR: &OCRConfig{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.config.OCR.Command, DefaultOCRCommand) {
+		t.Errorf("OCR command = %v, want the default", p.config.OCR.Command)
+	}
+
+	for _, command := range [][]string{{}, {""}} {
+		_, err := NewPreprocessor(PreprocessorConfig{OCR: &OCRConfig{Command: command}})
+		if err == nil {
+			t.Errorf("NewPreprocessor accepted OCR command %q", command)
+		}
+	}
+}
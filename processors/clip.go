@@ -0,0 +1,145 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	ffmpeg_go "github.com/u2takey/ffmpeg-go"
+)
+
+const MaxClipDurationMS = 30000
+
+// ClipFormat is the container and codecs a clip is encoded with.
+type ClipFormat string
+
+const (
+	// ClipFormatMP4 is H.264 video and AAC audio in an MP4 container.
+	ClipFormatMP4 ClipFormat = "mp4"
+	// ClipFormatWebM is VP9 video and Opus audio in a WebM container.
+	ClipFormatWebM ClipFormat = "webm"
+)
+
+// ParseClipFormat returns the clip format for a file extension, with or
+// without the leading dot.
+func ParseClipFormat(ext string) (ClipFormat, error) {
+	switch format := ClipFormat(strings.ToLower(strings.TrimPrefix(ext, "."))); format {
+	case ClipFormatMP4, ClipFormatWebM:
+		return format, nil
+	}
+	return "", fmt.Errorf("unsupported clip format %q, expected mp4 or webm", ext)
+}
+
+// ContentType returns the MIME type of clips in format.
+func (f ClipFormat) ContentType() string {
+	return "video/" + string(f)
+}
+
+type ClipOptions struct {
+	Format ClipFormat
+	// Audio keeps the audio of the source, if it has any.
+	Audio     bool
+	Text      string
+	Captions  []Caption
+	FontName  string
+	FontColor string
+	FontsDir  string
+	// Timeout caps how long the render may take. Zero means no limit.
+	Timeout time.Duration `json:"-"`
+	// Runner runs ffmpeg. Defaults to DefaultRunner.
+	Runner Runner `json:"-"`
+}
+
+// clipEncoderArgs are the output arguments of each clip format.
+var clipEncoderArgs = map[ClipFormat]ffmpeg_go.KwArgs{
+	ClipFormatMP4: {
+		"c:v":      "libx264",
+		"preset":   "veryfast",
+		"crf":      "23",
+		"pix_fmt":  "yuv420p",
+		"movflags": "+faststart",
+		"c:a":      "aac",
+		"b:a":      "128k",
+	},
+	ClipFormatWebM: {
+		"c:v":      "libvpx-vp9",
+		"crf":      "32",
+		"b:v":      "0",
+		"deadline": "realtime",
+		"cpu-used": "8",
+		"row-mt":   "1",
+		"pix_fmt":  "yuv420p",
+		"c:a":      "libopus",
+		"b:a":      "96k",
+	},
+}
+
+// MakeClip encodes the video between startTime and endTime, in milliseconds,
+// to outputFile with the same captions MakeAnimation draws. ffmpeg is
+// killed if ctx is cancelled, or with a *TimeoutError once opts.Timeout has
+// passed.
+func MakeClip(ctx context.Context, inputFile string, outputFile string, startTime int, endTime int, opts ClipOptions) error {
+	if endTime < startTime {
+		return ErrInvalidTimeRange
+	}
+	if endTime-startTime > MaxClipDurationMS {
+		return ErrInvalidTimeRange
+	}
+
+	format := opts.Format
+	if format == "" {
+		format = ClipFormatMP4
+	}
+	encoderArgs, ok := clipEncoderArgs[format]
+	if !ok {
+		return fmt.Errorf("unsupported clip format %q", format)
+	}
+
+	ctx, cancel := withTimeout(ctx, "clip", opts.Timeout)
+	defer cancel()
+
+	input := ffmpeg_go.Input(inputFile, ffmpeg_go.KwArgs{
+		"ss": fmt.Sprintf("%dms", startTime),
+		"to": fmt.Sprintf("%dms", endTime),
+	})
+
+	tmpDir, err := os.MkdirTemp("", "clyper")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	video, err := addCaptions(input, tmpDir, opts.Text, opts.Captions, captionStyle{
+		fontName:  opts.FontName,
+		fontColor: opts.FontColor,
+		fontsDir:  opts.FontsDir,
+	})
+	if err != nil {
+		return err
+	}
+	// Both encoders need even dimensions for yuv420p
+	video = video.Filter("scale", ffmpeg_go.Args{"trunc(iw/2)*2:trunc(ih/2)*2"})
+
+	streams := []*ffmpeg_go.Stream{video}
+	kwargs := ffmpeg_go.KwArgs{"f": string(format)}
+	for k, v := range encoderArgs {
+		kwargs[k] = v
+	}
+	if opts.Audio {
+		// The ? keeps sources without audio from failing
+		streams = append(streams, input.Get("a?"))
+	} else {
+		delete(kwargs, "c:a")
+		delete(kwargs, "b:a")
+		kwargs["an"] = ""
+	}
+
+	duration := time.Duration(endTime-startTime) * time.Millisecond
+	err = runnerOrDefault(opts.Runner).Run(ctx, ffmpeg_go.Output(streams, outputFile, kwargs).OverWriteOutput(), duration)
+	if err != nil {
+		return fmt.Errorf("failed to create clip: %w", err)
+	}
+	return nil
+}
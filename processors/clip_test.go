@@ -0,0 +1,115 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// argValue returns the argument after flag in args, or "" if flag is not
+// there.
+func argValue(args []string, flag string) string {
+	i := slices.Index(args, flag)
+	if i < 0 || i+1 >= len(args) {
+		return ""
+	}
+	return args[i+1]
+}
+
+func TestParseClipFormat(t *testing.T) {
+	for ext, want := range map[string]ClipFormat{"mp4": ClipFormatMP4, ".webm": ClipFormatWebM, ".MP4": ClipFormatMP4} {
+		format, err := ParseClipFormat(ext)
+		if err != nil || format != want {
+			t.Errorf("ParseClipFormat(%q) = %q, %v, want %q", ext, format, err, want)
+		}
+	}
+	for _, ext := range []string{"", "gif", "mkv"} {
+		if _, err := ParseClipFormat(ext); err == nil {
+			t.Errorf("ParseClipFormat(%q) succeeded", ext)
+		}
+	}
+}
+
+func TestMakeClip(t *testing.T) {
+	outputFile := filepath.Join(t.TempDir(), "clip")
+
+	for _, tc := range []struct {
+		name   string
+		opts   ClipOptions
+		codecs []string
+	}{
+		{"mp4 defaults", ClipOptions{}, []string{"libx264"}},
+		{"mp4 with audio", ClipOptions{Format: ClipFormatMP4, Audio: true}, []string{"libx264", "aac"}},
+		{"webm", ClipOptions{Format: ClipFormatWebM}, []string{"libvpx-vp9"}},
+		{"webm with audio", ClipOptions{Format: ClipFormatWebM, Audio: true}, []string{"libvpx-vp9", "libopus"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			runner := &FakeRunner{}
+			tc.opts.Runner = runner
+			if err := MakeClip(context.Background(), "/videos/in.mkv", outputFile, 1000, 3000, tc.opts); err != nil {
+				t.Fatal(err)
+			}
+			calls := runner.Calls()
+			if len(calls) != 1 {
+				t.Fatalf("ran %d commands, want 1", len(calls))
+			}
+			args := calls[0].Args
+
+			if got := argValue(args, "-ss"); got != "1000ms" {
+				t.Errorf("-ss = %q, want 1000ms", got)
+			}
+			if got := argValue(args, "-to"); got != "3000ms" {
+				t.Errorf("-to = %q, want 3000ms", got)
+			}
+			codecs := []string{argValue(args, "-c:v")}
+			if audio := argValue(args, "-c:a"); audio != "" {
+				codecs = append(codecs, audio)
+			}
+			if !slices.Equal(codecs, tc.codecs) {
+				t.Errorf("codecs = %q, want %q", codecs, tc.codecs)
+			}
+			if tc.opts.Audio == slices.Contains(args, "-an") {
+				t.Errorf("audio %v, args %q", tc.opts.Audio, args)
+			}
+			if tc.opts.Audio && !slices.Contains(args, "0:a?") {
+				t.Errorf("audio is not mapped from the source: %q", args)
+			}
+			// Without captions there is no subtitles filter
+			if strings.Contains(strings.Join(args, " "), "subtitles=") {
+				t.Errorf("uncaptioned clip has a subtitles filter: %q", args)
+			}
+		})
+	}
+}
+
+func TestMakeClipInvalid(t *testing.T) {
+	runner := &FakeRunner{}
+	outputFile := filepath.Join(t.TempDir(), "clip.mp4")
+
+	for _, tc := range []struct {
+		name       string
+		start, end int
+		format     ClipFormat
+		// invalidRange is set when the time range is what is wrong
+		invalidRange bool
+	}{
+		{"end before start", 2000, 1000, ClipFormatMP4, true},
+		{"too long", 0, MaxClipDurationMS + 1, ClipFormatMP4, true},
+		{"unknown format", 0, 1000, "mkv", false},
+	} {
+		opts := ClipOptions{Format: tc.format, Runner: runner}
+		err := MakeClip(context.Background(), "/videos/in.mkv", outputFile, tc.start, tc.end, opts)
+		if err == nil {
+			t.Errorf("%s: MakeClip succeeded", tc.name)
+		}
+		if tc.invalidRange && !errors.Is(err, ErrInvalidTimeRange) {
+			t.Errorf("%s: err = %v, want ErrInvalidTimeRange", tc.name, err)
+		}
+	}
+	if calls := runner.Calls(); len(calls) != 0 {
+		t.Errorf("ran %d commands for invalid clips", len(calls))
+	}
+}
@@ -1,8 +1,11 @@
 package processor
 
 import (
+	"context"
 	"fmt"
-	"os/exec"
+	"time"
+
+	ffmpeg_go "github.com/u2takey/ffmpeg-go"
 )
 
 type Downscaler struct {
@@ -10,6 +13,10 @@ type Downscaler struct {
 	width int
 	// height is the height of the thumbnail
 	height int
+	// timeout caps how long ffmpeg may run
+	timeout time.Duration
+	// runner runs ffmpeg
+	runner Runner
 }
 
 type DownscalerConfig struct {
@@ -17,6 +24,10 @@ type DownscalerConfig struct {
 	Width int `mapstructure:"width"`
 	// Height is the height of the thumbnail
 	Height int `mapstructure:"height"`
+	// Timeout caps how long ffmpeg may run. Zero means no limit.
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Runner runs ffmpeg. Defaults to DefaultRunner.
+	Runner Runner `mapstructure:"-" json:"-"`
 }
 
 // NewDownscaler creates a new Downscaler instance
@@ -30,8 +41,10 @@ func NewDownscaler(cfg DownscalerConfig) *Downscaler {
 		height = cfg.Height
 	}
 	return &Downscaler{
-		width:  width,
-		height: height,
+		width:   width,
+		height:  height,
+		timeout: cfg.Timeout,
+		runner:  runnerOrDefault(cfg.Runner),
 	}
 }
 
@@ -40,24 +53,23 @@ type DownscalerMetadata struct {
 	Name string `json:"name"`
 }
 
-// Run runs the downscaler processor.
-func (d *Downscaler) Run(inputFilePath string, outputDir string) (*DownscalerMetadata, error) {
+// Run runs the downscaler processor. ffmpeg is killed if ctx is cancelled,
+// or with a *TimeoutError once the timeout has passed.
+func (d *Downscaler) Run(ctx context.Context, inputFilePath string, outputDir string) (*DownscalerMetadata, error) {
+	ctx, cancel := withTimeout(ctx, "downscale", d.timeout)
+	defer cancel()
+
 	fname := "downscaled.mp4"
 	outputPath := fmt.Sprintf("%s/%s", outputDir, fname)
-	cmd := exec.Command(
-		"ffmpeg",
-		"-i", inputFilePath,
-		"-vf", fmt.Sprintf("scale=%d:%d", d.width, d.height),
-		"-an",
-		"-c:v", "libx264",
-		"-crf", "18",
-		"-preset", "fast",
-		outputPath,
-	)
-
-	output, err := cmd.CombinedOutput()
+	err := d.runner.Run(ctx, ffmpeg_go.Input(inputFilePath).Output(outputPath, ffmpeg_go.KwArgs{
+		"vf":     fmt.Sprintf("scale=%d:%d", d.width, d.height),
+		"an":     "",
+		"c:v":    "libx264",
+		"crf":    "18",
+		"preset": "fast",
+	}), 0)
 	if err != nil {
-		return nil, fmt.Errorf("error running ffmpeg: %v, output: %s", err, string(output))
+		return nil, fmt.Errorf("error downscaling: %w", err)
 	}
 	return &DownscalerMetadata{Name: fname}, nil
 }
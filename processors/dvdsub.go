@@ -0,0 +1,219 @@
+package processor
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DVD subtitle control commands
+const (
+	dvdSubForcedStart = 0x00
+	dvdSubStart       = 0x01
+	dvdSubStop        = 0x02
+	dvdSubPalette     = 0x03
+	dvdSubAlpha       = 0x04
+	dvdSubCoordinates = 0x05
+	dvdSubRLEOffsets  = 0x06
+	dvdSubEnd         = 0xff
+)
+
+// DVDSubtitleDecoder decodes DVD (dvd_subtitle, VobSub) subtitle streams.
+type DVDSubtitleDecoder struct{}
+
+func (DVDSubtitleDecoder) Decode(ctx context.Context, runner Runner, inputFilePath string, streamIndex int) ([]BitmapSubtitle, error) {
+	packets, extradata, err := probeSubtitlePackets(ctx, runner, inputFilePath, streamIndex)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDVDSubtitles(packets, parseDVDSubPalette(extradata))
+}
+
+// parseDVDSubPalette reads the palette from the .idx style header of the
+// stream, e.g. "palette: 000000, f0f0f0, ...". Streams without one get a
+// grayscale palette.
+func parseDVDSubPalette(extradata []byte) [16]color.NRGBA {
+	var palette [16]color.NRGBA
+	for i := range palette {
+		v := uint8(i * 0x11)
+		palette[i] = color.NRGBA{R: v, G: v, B: v, A: 0xff}
+	}
+
+	for _, line := range strings.Split(string(extradata), "\n") {
+		key, value, found := strings.Cut(line, ":")
+		if !found || strings.TrimSpace(key) != "palette" {
+			continue
+		}
+		for i, entry := range strings.Split(value, ",") {
+			if i >= len(palette) {
+				break
+			}
+			rgb, err := strconv.ParseUint(strings.TrimSpace(entry), 16, 32)
+			if err != nil {
+				continue
+			}
+			palette[i] = color.NRGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: 0xff}
+		}
+	}
+	return palette
+}
+
+// decodeDVDSubtitles decodes the subtitle packets of a DVD subtitle stream.
+// Every packet is one image, whose start and stop are given as delays from
+// the packet timestamp.
+func decodeDVDSubtitles(packets []subtitlePacket, palette [16]color.NRGBA) ([]BitmapSubtitle, error) {
+	var subtitles []BitmapSubtitle
+	for _, packet := range packets {
+		img, start, stop, err := decodeDVDSubtitle(packet.Data, palette)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding dvd subtitle at %s: %v", packet.PTS, err)
+		}
+		if img == nil {
+			continue
+		}
+
+		subtitle := BitmapSubtitle{Start: packet.PTS + start, Image: img}
+		if stop > start {
+			subtitle.End = packet.PTS + stop
+		} else if packet.Duration > 0 {
+			subtitle.End = packet.PTS + packet.Duration
+		}
+		subtitles = append(subtitles, subtitle)
+	}
+	return closeBitmapSubtitles(subtitles), nil
+}
+
+// decodeDVDSubtitle decodes a single subtitle packet. The image is nil for
+// packets that do not show anything.
+func decodeDVDSubtitle(data []byte, palette [16]color.NRGBA) (img image.Image, start time.Duration, stop time.Duration, err error) {
+	if len(data) < 4 {
+		return nil, 0, 0, fmt.Errorf("short packet")
+	}
+
+	var colors, alphas [4]uint8
+	var x1, x2, y1, y2 int
+	var topOffset, bottomOffset int
+	hasImage := false
+	for offset := int(binary.BigEndian.Uint16(data[2:4])); ; {
+		if offset+4 > len(data) {
+			return nil, 0, 0, fmt.Errorf("control sequence out of range")
+		}
+		// Delays are in units of 1024 ticks of the 90kHz clock
+		delay := time.Duration(binary.BigEndian.Uint16(data[offset:offset+2])) * 1024 * time.Second / 90000
+		next := int(binary.BigEndian.Uint16(data[offset+2 : offset+4]))
+
+		pos := offset + 4
+	commands:
+		for pos < len(data) {
+			cmd := data[pos]
+			pos++
+			switch cmd {
+			case dvdSubForcedStart, dvdSubStart:
+				start = delay
+			case dvdSubStop:
+				stop = delay
+			case dvdSubPalette, dvdSubAlpha:
+				if pos+2 > len(data) {
+					return nil, 0, 0, fmt.Errorf("short command")
+				}
+				values := &colors
+				if cmd == dvdSubAlpha {
+					values = &alphas
+				}
+				values[3], values[2] = data[pos]>>4, data[pos]&0x0f
+				values[1], values[0] = data[pos+1]>>4, data[pos+1]&0x0f
+				pos += 2
+			case dvdSubCoordinates:
+				if pos+6 > len(data) {
+					return nil, 0, 0, fmt.Errorf("short command")
+				}
+				x1 = int(data[pos])<<4 | int(data[pos+1])>>4
+				x2 = int(data[pos+1]&0x0f)<<8 | int(data[pos+2])
+				y1 = int(data[pos+3])<<4 | int(data[pos+4])>>4
+				y2 = int(data[pos+4]&0x0f)<<8 | int(data[pos+5])
+				hasImage = true
+				pos += 6
+			case dvdSubRLEOffsets:
+				if pos+4 > len(data) {
+					return nil, 0, 0, fmt.Errorf("short command")
+				}
+				topOffset = int(binary.BigEndian.Uint16(data[pos : pos+2]))
+				bottomOffset = int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+				pos += 4
+			case dvdSubEnd:
+				break commands
+			default:
+				return nil, 0, 0, fmt.Errorf("unknown command 0x%02x", cmd)
+			}
+		}
+
+		if next <= offset {
+			break
+		}
+		offset = next
+	}
+
+	width, height := x2-x1+1, y2-y1+1
+	if !hasImage || width <= 0 || height <= 0 {
+		return nil, start, stop, nil
+	}
+
+	rgba := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for field, fieldOffset := range []int{topOffset, bottomOffset} {
+		r := &nibbleReader{data: data, pos: fieldOffset * 2}
+		for y := field; y < height; y += 2 {
+			for x := 0; x < width; {
+				index, length := r.run()
+				if length == 0 || x+length > width {
+					length = width - x
+				}
+				c := palette[colors[index]]
+				c.A = alphas[index] * 0x11
+				for i := 0; i < length; i++ {
+					rgba.SetNRGBA(x+i, y, c)
+				}
+				x += length
+			}
+			r.alignToByte()
+		}
+	}
+	return rgba, start, stop, nil
+}
+
+// nibbleReader reads the 4 bit units DVD subtitles are run length encoded
+// in. pos counts nibbles.
+type nibbleReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *nibbleReader) next() int {
+	i := r.pos / 2
+	r.pos++
+	if i >= len(r.data) {
+		return 0
+	}
+	if r.pos%2 == 1 {
+		return int(r.data[i] >> 4)
+	}
+	return int(r.data[i] & 0x0f)
+}
+
+// run reads one run, returning its color index and length. A length of 0
+// fills the rest of the line.
+func (r *nibbleReader) run() (int, int) {
+	v := r.next()
+	for t := 4; v < t && t <= 0x40; t <<= 2 {
+		v = v<<4 | r.next()
+	}
+	return v & 3, v >> 2
+}
+
+func (r *nibbleReader) alignToByte() {
+	r.pos += r.pos % 2
+}
@@ -0,0 +1,132 @@
+package processor
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// EpisodeRule maps file paths to season and episode numbers.
+//
+// Some examples:
+//
+//	{Name: "x", Pattern: `(?P<season>\d+)x(?P<episode>\d+)`}
+//	{Name: "dirs", Pattern: `Season (?P<season>\d+)/Episode (?P<episode>\d+)`}
+//	{Name: "anime", Directory: "One Piece", Pattern: ` - (?P<absolute>\d+) `}
+type EpisodeRule struct {
+	// Name identifies the rule in the output of `preprocess scan`.
+	Name string `mapstructure:"name"`
+	// Directory restricts the rule to files below this directory, relative
+	// to the input directory. Empty applies the rule everywhere.
+	Directory string `mapstructure:"directory"`
+	// Pattern is a regular expression matched against the slash separated
+	// path of the file relative to the input directory, so it can match on
+	// directory names as well as the file name. It must have either the
+	// named groups "season" and "episode", or the named group "absolute"
+	// for absolute episode numbering.
+	Pattern string `mapstructure:"pattern"`
+	// Season is the season of files matched by an absolute numbering
+	// pattern. Defaults to 1.
+	Season int `mapstructure:"season"`
+}
+
+// DefaultEpisodeRules recognise episodes named like "Show.S01E02.mkv".
+var DefaultEpisodeRules = []EpisodeRule{
+	{
+		Name:    "sxxexx",
+		Pattern: `S(?P<season>\d+)E(?P<episode>\d+)`,
+	},
+}
+
+type episodeRule struct {
+	name      string
+	directory string
+	regex     *regexp.Regexp
+	season    int
+}
+
+func compileEpisodeRules(rules []EpisodeRule) ([]episodeRule, error) {
+	compiled := make([]episodeRule, 0, len(rules))
+	for i, rule := range rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("rule%d", i)
+		}
+
+		regex, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid episode rule %s pattern %q: %v", name, rule.Pattern, err)
+		}
+
+		hasSeasonEpisode := regex.SubexpIndex("season") >= 0 && regex.SubexpIndex("episode") >= 0
+		hasAbsolute := regex.SubexpIndex("absolute") >= 0
+		if !hasSeasonEpisode && !hasAbsolute {
+			return nil, fmt.Errorf("episode rule %s pattern %q needs season and episode groups or an absolute group", name, rule.Pattern)
+		}
+
+		season := 1
+		if rule.Season > 0 {
+			season = rule.Season
+		}
+
+		directory := strings.Trim(filepath.ToSlash(rule.Directory), "/")
+		if directory != "" {
+			directory += "/"
+		}
+
+		compiled = append(compiled, episodeRule{
+			name:      name,
+			directory: directory,
+			regex:     regex,
+			season:    season,
+		})
+	}
+	return compiled, nil
+}
+
+// matchEpisode matches the file against the episode rules, returning the
+// season, episode and name of the first rule that matched.
+func (p *Preprocessor) matchEpisode(inputDir string, filePath string) (season int, episode int, rule string, ok bool) {
+	rel, err := filepath.Rel(inputDir, filePath)
+	if err != nil {
+		rel = filePath
+	}
+	rel = filepath.ToSlash(rel)
+
+	for _, r := range p.episodeRules {
+		if !strings.HasPrefix(rel, r.directory) {
+			continue
+		}
+
+		matches := r.regex.FindStringSubmatch(rel)
+		if matches == nil {
+			continue
+		}
+
+		if idx := r.regex.SubexpIndex("absolute"); idx >= 0 && matches[idx] != "" {
+			episode, err = strconv.Atoi(matches[idx])
+			if err != nil {
+				continue
+			}
+			return r.season, episode, r.name, true
+		}
+
+		seasonIdx, episodeIdx := r.regex.SubexpIndex("season"), r.regex.SubexpIndex("episode")
+		if seasonIdx < 0 || episodeIdx < 0 {
+			continue
+		}
+		season, err = strconv.Atoi(matches[seasonIdx])
+		if err != nil {
+			continue
+		}
+		episode, err = strconv.Atoi(matches[episodeIdx])
+		if err != nil {
+			continue
+		}
+		return season, episode, r.name, true
+	}
+
+	return 0, 0, "", false
+}
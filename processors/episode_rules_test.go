@@ -0,0 +1,254 @@
+package processor
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jaym/clyper/metadata"
+)
+
+func TestEpisodeRules(t *testing.T) {
+	p, err := NewPreprocessor(PreprocessorConfig{EpisodeRules: []EpisodeRule{
+		{Name: "anime", Directory: "One Piece", Pattern: ` - (?P<absolute>\d+) `},
+		{Name: "dirs", Pattern: `Season (?P<season>\d+)/Episode (?P<episode>\d+)`},
+		{Name: "x", Pattern: `(?P<season>\d+)x(?P<episode>\d+)`},
+		{Pattern: `Book (?P<absolute>\d+)`, Season: 3},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		season  int
+		episode int
+		rule    string
+		ok      bool
+	}{
+		{path: "One Piece/One Piece - 1071 [1080p].mkv", season: 1, episode: 1071, rule: "anime", ok: true},
+		// The anime rule is limited to its directory
+		{path: "Naruto/Naruto - 12 [1080p].mkv"},
+		{path: "Show/Season 2/Episode 10.mkv", season: 2, episode: 10, rule: "dirs", ok: true},
+		{path: "Show 3x07.mkv", season: 3, episode: 7, rule: "x", ok: true},
+		// Unnamed rules are named by their position
+		{path: "Avatar Book 5.mkv", season: 3, episode: 5, rule: "rule3", ok: true},
+		// The first rule that matches wins
+		{path: "Season 1/Episode 2 1x03.mkv", season: 1, episode: 2, rule: "dirs", ok: true},
+		{path: "Show.S01E02.mkv"},
+	}
+
+	inputDir := filepath.Join(t.TempDir(), "input")
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			season, episode, rule, ok := p.matchEpisode(inputDir, filepath.Join(inputDir, filepath.FromSlash(tt.path)))
+			if ok != tt.ok || season != tt.season || episode != tt.episode || rule != tt.rule {
+				t.Errorf("got %v S%02dE%02d %q, want %v S%02dE%02d %q", ok, season, episode, rule, tt.ok, tt.season, tt.episode, tt.rule)
+			}
+		})
+	}
+}
+
+func TestDefaultEpisodeRules(t *testing.T) {
+	p, err := NewPreprocessor(PreprocessorConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string][2]int{
+		"Show.S01E02.mkv":               {1, 2},
+		"Show/Season 1/S10E123.mkv":     {10, 123},
+		"Show.S00E04.Behind.Scenes.mp4": {0, 4},
+	} {
+		season, episode, rule, ok := p.matchEpisode("/input", "/input/"+path)
+		if !ok || season != want[0] || episode != want[1] || rule != "sxxexx" {
+			t.Errorf("%s: got %v S%02dE%02d %q", path, ok, season, episode, rule)
+		}
+	}
+	if _, _, _, ok := p.matchEpisode("/input", "/input/Show.1x02.mkv"); ok {
+		t.Errorf("default rules matched Show.1x02.mkv")
+	}
+}
+
+func TestCompileEpisodeRulesErrors(t *testing.T) {
+	for _, rule := range []EpisodeRule{
+		{Name: "invalid", Pattern: `(?P<season>\d+`},
+		{Name: "no groups", Pattern: `S\d+E\d+`},
+		{Name: "season only", Pattern: `S(?P<season>\d+)`},
+	} {
+		if _, err := compileEpisodeRules([]EpisodeRule{rule}); err == nil {
+			t.Errorf("rule %q compiled", rule.Name)
+		}
+	}
+}
+
+func writeManifest(t *testing.T, dir string, name string, manifest string) {
+	t.Helper()
+
+	if err := os.WriteFile(filepath.Join(dir, name+ManifestSuffix), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManifests(t *testing.T) {
+	inputDir := t.TempDir()
+	p, err := NewPreprocessor(PreprocessorConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		manifest string
+		want     preprocessJob
+		wantErr  bool
+	}{
+		{
+			// A movie with no year in its name is its own show
+			name:     "heat_final_cut.mkv",
+			manifest: `{"kind": "movie", "title": "Heat", "year": 1995}`,
+			want:     preprocessJob{show: "heat-1995", showName: "Heat (1995)", season: 0, episode: 1, kind: metadata.KindMovie, title: "Heat (1995)"},
+		},
+		{
+			// The manifest can place a movie in a show
+			name:     "Movie (2001).mkv",
+			manifest: `{"show": "the-show", "show_name": "The Show", "season": 0, "episode": 7}`,
+			want:     preprocessJob{show: "the-show", showName: "The Show", season: 0, episode: 7, kind: metadata.KindMovie, title: "Movie (2001)"},
+		},
+		{
+			// Fields left out keep what the file name says
+			name:     "Show.S02E03.mkv",
+			manifest: `{"title": "The One With The Manifest"}`,
+			want:     preprocessJob{show: metadata.DefaultShowSlug, showName: metadata.DefaultShowSlug, season: 2, episode: 3, kind: metadata.KindEpisode, title: "The One With The Manifest"},
+		},
+		{
+			name:     "extras.mkv",
+			manifest: `{"kind": "special", "title": "Bloopers", "episode": 2}`,
+			want:     preprocessJob{show: metadata.DefaultShowSlug, showName: metadata.DefaultShowSlug, season: 0, episode: 2, kind: metadata.KindSpecial, title: "Bloopers"},
+		},
+		{
+			name:     "no title.mkv",
+			manifest: `{"kind": "movie"}`,
+			wantErr:  true,
+		},
+		{
+			name:     "bad kind.mkv",
+			manifest: `{"kind": "trailer", "title": "Heat"}`,
+			wantErr:  true,
+		},
+		{
+			name:     "broken.mkv",
+			manifest: `{"kind": `,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filePath := writeVideo(t, inputDir, tt.name, "")
+			writeManifest(t, inputDir, tt.name[:len(tt.name)-len(filepath.Ext(tt.name))], tt.manifest)
+
+			job, ok, err := p.identifyFile(inputDir, filePath)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", job)
+				}
+				return
+			}
+			if err != nil || !ok {
+				t.Fatalf("identifyFile returned %v, %v", ok, err)
+			}
+			tt.want.path = filePath
+			tt.want.rule = "manifest"
+			if job != tt.want {
+				t.Errorf("got %+v, want %+v", job, tt.want)
+			}
+		})
+	}
+}
+
+func TestScan(t *testing.T) {
+	inputDir := t.TempDir()
+	p, err := NewPreprocessor(PreprocessorConfig{ShowFromDirectory: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{
+		"The Office/Season 1/The.Office.S01E02.mkv",
+		"The Office/Season 1/The.Office.S01E01.mkv",
+		"The Office/Season 1/The.Office.S01E01.en.srt",
+		"The Office/Extras/The.Office.S01E01.Extended.mkv",
+		"The Office/Extras/Office.S1E1.mkv",
+		"Heat (1995).mkv",
+		"readme.txt",
+	} {
+		writeVideo(t, inputDir, name, "")
+	}
+	writeManifest(t, inputDir, "Heat (1995)", `{"title": "Heat", "year": 1995}`)
+
+	result, err := p.Scan(inputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []string
+	for _, e := range result.Entries {
+		rel, _ := filepath.Rel(inputDir, e.Path)
+		entries = append(entries, filepath.ToSlash(rel)+" "+e.Show+" "+e.Kind+" "+e.Rule)
+	}
+	want := []string{
+		"Heat (1995).mkv heat-1995 movie manifest",
+		"The Office/Extras/Office.S1E1.mkv the-office episode sxxexx",
+		"The Office/Extras/The.Office.S01E01.Extended.mkv the-office episode sxxexx",
+		"The Office/Season 1/The.Office.S01E01.mkv the-office episode sxxexx",
+		"The Office/Season 1/The.Office.S01E02.mkv the-office episode sxxexx",
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("entries =\n%q\nwant\n%q", entries, want)
+	}
+
+	// Three files are S01E01, their paths are sorted
+	if len(result.Collisions) != 1 {
+		t.Fatalf("collisions = %+v", result.Collisions)
+	}
+	c := result.Collisions[0]
+	wantPaths := []string{
+		filepath.Join(inputDir, "The Office/Extras/Office.S1E1.mkv"),
+		filepath.Join(inputDir, "The Office/Extras/The.Office.S01E01.Extended.mkv"),
+		filepath.Join(inputDir, "The Office/Season 1/The.Office.S01E01.mkv"),
+	}
+	if c.Show != "the-office" || c.Season != 1 || c.Episode != 1 || !reflect.DeepEqual(c.Paths, wantPaths) {
+		t.Errorf("collision = %+v", c)
+	}
+}
+
+func TestFindCollisions(t *testing.T) {
+	jobs := []preprocessJob{
+		{path: "/b/z.mkv", show: "b", season: 1, episode: 1},
+		{path: "/b/a.mkv", show: "b", season: 1, episode: 1},
+		{path: "/a/2.mkv", show: "a", season: 2, episode: 1},
+		{path: "/a/1.mkv", show: "a", season: 2, episode: 1},
+		{path: "/a/3.mkv", show: "a", season: 1, episode: 5},
+		{path: "/a/4.mkv", show: "a", season: 1, episode: 5},
+		{path: "/a/5.mkv", show: "a", season: 1, episode: 6},
+		// The same episode of another show is not a collision
+		{path: "/c/1.mkv", show: "c", season: 1, episode: 6},
+	}
+
+	want := []Collision{
+		{Show: "a", Season: 1, Episode: 5, Paths: []string{"/a/3.mkv", "/a/4.mkv"}},
+		{Show: "a", Season: 2, Episode: 1, Paths: []string{"/a/1.mkv", "/a/2.mkv"}},
+		{Show: "b", Season: 1, Episode: 1, Paths: []string{"/b/a.mkv", "/b/z.mkv"}},
+	}
+	if got := findCollisions(jobs); !reflect.DeepEqual(got, want) {
+		t.Errorf("findCollisions =\n%+v\nwant\n%+v", got, want)
+	}
+	if got := findCollisions(jobs[4:]); len(got) != 1 {
+		t.Errorf("findCollisions = %+v", got)
+	}
+	if got := findCollisions(nil); got == nil || len(got) != 0 {
+		t.Errorf("findCollisions(nil) = %#v, want an empty slice", got)
+	}
+}
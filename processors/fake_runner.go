@@ -0,0 +1,78 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	ffmpeg_go "github.com/u2takey/ffmpeg-go"
+)
+
+// FakeCall is a command a FakeRunner was asked to run.
+type FakeCall struct {
+	// Program is "ffmpeg" or "ffprobe".
+	Program string
+	Args    []string
+}
+
+// FakeRunner is a Runner that records the commands it is given instead of
+// running them, so processors can be tested without ffmpeg installed. It
+// is safe for concurrent use.
+type FakeRunner struct {
+	// ProbeFunc returns the output of ffprobe for fileName, which is probed
+	// with args. Probes fail when it is nil.
+	ProbeFunc func(fileName string, args []string) (string, error)
+	// RunFunc is called with the arguments of each ffmpeg run, for example
+	// to write the files ffmpeg would have or to fail. Runs succeed when it
+	// is nil.
+	RunFunc func(args []string) error
+
+	mu    sync.Mutex
+	calls []FakeCall
+}
+
+// Calls returns the commands the runner has been given, in order.
+func (f *FakeRunner) Calls() []FakeCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FakeCall(nil), f.calls...)
+}
+
+func (f *FakeRunner) record(program string, args []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, FakeCall{Program: program, Args: args})
+}
+
+func (f *FakeRunner) Probe(ctx context.Context, fileName string, kwargs ...ffmpeg_go.KwArgs) (string, error) {
+	args := probeArgs(fileName, kwargs...)
+	f.record("ffprobe", args)
+	if ctx.Err() != nil {
+		return "", context.Cause(ctx)
+	}
+	if f.ProbeFunc == nil {
+		return "", fmt.Errorf("no ffprobe output for %s", fileName)
+	}
+	return f.ProbeFunc(fileName, args)
+}
+
+// Run reports the render as done to the ProgressFunc of ctx once RunFunc
+// succeeds.
+func (f *FakeRunner) Run(ctx context.Context, stream *ffmpeg_go.Stream, duration time.Duration) error {
+	args := ffmpegArgs(stream)
+	f.record("ffmpeg", args)
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	if f.RunFunc != nil {
+		err := f.RunFunc(args)
+		if err != nil {
+			return err
+		}
+	}
+	if progress := progressFromContext(ctx); progress != nil && duration > 0 {
+		progress(1)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	ffmpeg_go "github.com/u2takey/ffmpeg-go"
+)
+
+func TestFakeRunner(t *testing.T) {
+	failed := errors.New("failed")
+	runner := &FakeRunner{RunFunc: func(args []string) error {
+		if slices.Contains(args, "fail.gif") {
+			return failed
+		}
+		return nil
+	}}
+
+	var reports []float64
+	ctx := WithProgress(context.Background(), func(done float64) {
+		reports = append(reports, done)
+	})
+	if err := runner.Run(ctx, ffmpeg_go.Input("in.mkv").Output("out.gif"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(reports, []float64{1}) {
+		t.Errorf("progress = %v, want the render reported done", reports)
+	}
+	if err := runner.Run(ctx, ffmpeg_go.Input("in.mkv").Output("fail.gif"), time.Second); !errors.Is(err, failed) {
+		t.Errorf("err = %v, want the error of RunFunc", err)
+	}
+	if _, err := runner.Probe(ctx, "in.mkv"); err == nil {
+		t.Error("probe without a ProbeFunc succeeded")
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := runner.Run(cancelled, ffmpeg_go.Input("in.mkv").Output("out.gif"), 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want the cause of the cancelled context", err)
+	}
+
+	calls := runner.Calls()
+	want := []FakeCall{
+		{Program: "ffmpeg", Args: []string{"-hide_banner", "-nostats", "-i", "in.mkv", "out.gif"}},
+		{Program: "ffmpeg", Args: []string{"-hide_banner", "-nostats", "-i", "in.mkv", "fail.gif"}},
+		{Program: "ffprobe", Args: []string{"-of", "json", "-show_format", "-show_streams", "in.mkv"}},
+		{Program: "ffmpeg", Args: []string{"-hide_banner", "-nostats", "-i", "in.mkv", "out.gif"}},
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("calls = %q, want %q", calls, want)
+	}
+	for i := range want {
+		if calls[i].Program != want[i].Program || !slices.Equal(calls[i].Args, want[i].Args) {
+			t.Errorf("call %d = %q, want %q", i, calls[i], want[i])
+		}
+	}
+}
+
+func TestSubtitleExtractor(t *testing.T) {
+	runner := newFakeVideoRunner()
+	extractor := NewSubtitleExtractor(SubtitleExtractorConfig{Runner: runner})
+	outputDir := t.TempDir()
+	video := writeVideo(t, t.TempDir(), "video.mkv", "hello")
+
+	md, err := extractor.Run(context.Background(), video, outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Name != "subtitles.srt" {
+		t.Errorf("name = %q, want subtitles.srt", md.Name)
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, md.Name)); err != nil {
+		t.Error(err)
+	}
+	calls := runner.Calls()
+	if len(calls) != 2 || calls[0].Program != "ffprobe" {
+		t.Fatalf("calls = %q, want a probe and a run", calls)
+	}
+	// The English subtitles are stream 2 of testProbeOutput
+	if got := argValue(calls[1].Args, "-map"); got != "0:2" {
+		t.Errorf("-map = %q, want 0:2", got)
+	}
+
+	// Videos without English subtitles have nothing to extract
+	runner.ProbeFunc = func(fileName string, args []string) (string, error) {
+		return `{"streams": [{"index": 0, "codec_type": "video"}, {"index": 1, "codec_type": "subtitle", "tags": {"language": "spa"}}]}`, nil
+	}
+	if _, err := extractor.Run(context.Background(), video, outputDir); err == nil {
+		t.Error("extracted subtitles from a video without English subtitles")
+	}
+}
+
+func TestDownscaler(t *testing.T) {
+	runner := &FakeRunner{}
+	downscaler := NewDownscaler(DownscalerConfig{Width: 640, Runner: runner})
+
+	md, err := downscaler.Run(context.Background(), "/videos/in.mkv", "/out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Name != "downscaled.mp4" {
+		t.Errorf("name = %q, want downscaled.mp4", md.Name)
+	}
+	calls := runner.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("ran %d commands, want 1", len(calls))
+	}
+	args := calls[0].Args
+	if got := argValue(args, "-vf"); got != "scale=640:-1" {
+		t.Errorf("-vf = %q, want scale=640:-1", got)
+	}
+	if !slices.Contains(args, "-an") || args[len(args)-1] != "/out/downscaled.mp4" {
+		t.Errorf("args = %q, want a silent video in the output dir", args)
+	}
+}
+
+func TestThumbnailer(t *testing.T) {
+	runner := &FakeRunner{RunFunc: writeFakeOutputs}
+	thumbnailer := NewThumbnailer(ThumbnailerConfig{FramesPerSecond: 1, Height: 180, Runner: runner})
+	outputDir := t.TempDir()
+
+	md, err := thumbnailer.Run(context.Background(), "/videos/in.mkv", outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := argValue(runner.Calls()[0].Args, "-vf"); got != "fps=1,scale=-1:180" {
+		t.Errorf("-vf = %q, want fps=1,scale=-1:180", got)
+	}
+	// writeFakeOutputs writes two frames
+	if len(md.Thumbnails) != 2 {
+		t.Fatalf("thumbnails = %+v, want 2", md.Thumbnails)
+	}
+	for _, thumb := range md.Thumbnails {
+		if _, err := os.Stat(thumb.Name); err != nil {
+			t.Error(err)
+		}
+	}
+}
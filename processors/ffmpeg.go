@@ -0,0 +1,243 @@
+package processor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	ffmpeg_go "github.com/u2takey/ffmpeg-go"
+)
+
+// killWaitDelay is how long the output of a killed command is waited for
+// before it is given up on.
+const killWaitDelay = 5 * time.Second
+
+// stderrTailSize is how much of the end of stderr is kept to report
+// failures with.
+const stderrTailSize = 64 * 1024
+
+// TimeoutError is returned when an ffmpeg, ffprobe or OCR run takes longer
+// than the timeout configured for it. It matches context.DeadlineExceeded.
+type TimeoutError struct {
+	// Op is what was running, such as "gif" or "downscale".
+	Op      string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", e.Op, e.Timeout)
+}
+
+func (e *TimeoutError) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
+
+// withTimeout returns a context that is done after timeout, with a
+// *TimeoutError for op as its cause. A timeout of zero means no limit.
+func withTimeout(ctx context.Context, op string, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, timeout, &TimeoutError{Op: op, Timeout: timeout})
+}
+
+// command returns a command that is killed, along with any processes it
+// started, when ctx is done.
+func command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	killProcessGroup(cmd)
+	cmd.WaitDelay = killWaitDelay
+	return cmd
+}
+
+// ProgressFunc is called with the fraction, from 0 to 1, of a render that
+// is done.
+type ProgressFunc func(done float64)
+
+type progressKey struct{}
+
+// WithProgress returns a context that has the renders started with it
+// report their progress to fn.
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+func progressFromContext(ctx context.Context) ProgressFunc {
+	fn, _ := ctx.Value(progressKey{}).(ProgressFunc)
+	return fn
+}
+
+// Runner runs ffmpeg and ffprobe for the processors and the preprocessor.
+// ExecRunner runs the real programs, FakeRunner stands in for them in
+// tests.
+type Runner interface {
+	// Probe runs ffprobe on fileName with -show_format, -show_streams and
+	// -of json, along with kwargs, and returns its output.
+	Probe(ctx context.Context, fileName string, kwargs ...ffmpeg_go.KwArgs) (string, error)
+	// Run runs the ffmpeg command of stream. If ctx has a ProgressFunc it
+	// is told how much of duration, the length of the output, has been
+	// written.
+	Run(ctx context.Context, stream *ffmpeg_go.Stream, duration time.Duration) error
+}
+
+// DefaultRunner is used when no Runner is configured.
+var DefaultRunner Runner = ExecRunner{}
+
+// runnerOrDefault returns runner, or DefaultRunner if it is nil.
+func runnerOrDefault(runner Runner) Runner {
+	if runner == nil {
+		return DefaultRunner
+	}
+	return runner
+}
+
+// ExecRunner runs ffprobe from the PATH, and ffmpeg from the FfmpegPath of
+// the stream. Commands are killed, along with any processes they started,
+// when ctx is done, and fail with its cause, a *TimeoutError if it timed
+// out. Other failures are reported as an *FFmpegError.
+type ExecRunner struct{}
+
+func (ExecRunner) Probe(ctx context.Context, fileName string, kwargs ...ffmpeg_go.KwArgs) (string, error) {
+	cmd := command(ctx, "ffprobe", probeArgs(fileName, kwargs...)...)
+	var stdout bytes.Buffer
+	stderr := &stderrTail{max: stderrTailSize}
+	cmd.Stdout = &stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if err != nil && ctx.Err() != nil {
+		return "", context.Cause(ctx)
+	}
+	if err != nil {
+		return "", newFFmpegError(cmd, err, stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+// Run also fails with an *FFmpegError when ffmpeg succeeds without encoding
+// anything.
+func (ExecRunner) Run(ctx context.Context, stream *ffmpeg_go.Stream, duration time.Duration) error {
+	args := ffmpegArgs(stream)
+	progress := progressFromContext(ctx)
+	if progress != nil && duration > 0 {
+		args = append([]string{"-progress", "pipe:1"}, args...)
+	}
+	cmd := command(ctx, stream.FfmpegPath, args...)
+	stderr := &stderrTail{max: stderrTailSize}
+	cmd.Stderr = stderr
+
+	var stdout io.Reader
+	var report *bufio.Scanner
+	if progress != nil && duration > 0 {
+		pipe, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		stdout = pipe
+		report = bufio.NewScanner(stdout)
+	}
+
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	// The progress report has to be read to the end before Wait
+	for report != nil && report.Scan() {
+		key, value, _ := strings.Cut(report.Text(), "=")
+		// out_time_ms is in microseconds too
+		if key != "out_time_us" && key != "out_time_ms" {
+			continue
+		}
+		us, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		progress(min(1, max(0, float64(us)/float64(duration.Microseconds()))))
+	}
+	if stdout != nil {
+		// Keep ffmpeg from blocking on a report the scanner gave up on
+		io.Copy(io.Discard, stdout) // nolint: errcheck
+	}
+
+	err = cmd.Wait()
+	if err != nil && ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return newFFmpegError(cmd, err, stderr.String())
+}
+
+// probeArgs returns the ffprobe arguments of Runner.Probe.
+func probeArgs(fileName string, kwargs ...ffmpeg_go.KwArgs) []string {
+	args := ffmpeg_go.ConvertKwargsToCmdLineArgs(ffmpeg_go.MergeKwArgs(append([]ffmpeg_go.KwArgs{{
+		"show_format":  "",
+		"show_streams": "",
+		"of":           "json",
+	}}, kwargs...)))
+	return append(args, fileName)
+}
+
+// ffmpegArgs returns the ffmpeg arguments of stream.
+func ffmpegArgs(stream *ffmpeg_go.Stream) []string {
+	// stderr is only kept to report failures with, so leave out the noise
+	return append([]string{"-hide_banner", "-nostats"}, stream.GetArgs()...)
+}
+
+// ProbeStream is a stream of a video, as reported by ffprobe.
+type ProbeStream struct {
+	Index int `json:"index"`
+	// CodecType is "video", "audio" or "subtitle".
+	CodecType   string `json:"codec_type"`
+	CodecName   string `json:"codec_name"`
+	Disposition struct {
+		Forced int `json:"forced"`
+	} `json:"disposition"`
+	Tags struct {
+		Language string `json:"language"`
+	} `json:"tags"`
+	// AvgFrameRate is the frame rate of video streams, as a fraction such
+	// as "24000/1001".
+	AvgFrameRate string `json:"avg_frame_rate"`
+}
+
+// FrameRate returns the frame rate of the stream in frames per second, or 0
+// if it is not known.
+func (s ProbeStream) FrameRate() float64 {
+	num, den, ok := strings.Cut(s.AvgFrameRate, "/")
+	if !ok {
+		den = "1"
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d <= 0 || n <= 0 {
+		return 0
+	}
+	return n / d
+}
+
+// ProbeStreams lists the streams of fileName. It also returns the ffprobe
+// output, to report failures with.
+func ProbeStreams(ctx context.Context, runner Runner, fileName string) ([]ProbeStream, string, error) {
+	output, err := runner.Probe(ctx, fileName)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var probe struct {
+		Streams []ProbeStream `json:"streams"`
+	}
+	err = json.Unmarshal([]byte(output), &probe)
+	if err != nil {
+		return nil, output, fmt.Errorf("error unmarshalling ffprobe output: %v", err)
+	}
+	return probe.Streams, output, nil
+}
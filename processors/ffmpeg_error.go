@@ -0,0 +1,160 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// FFmpegErrorKind classifies why ffmpeg failed.
+type FFmpegErrorKind string
+
+const (
+	FFmpegErrorUnknown FFmpegErrorKind = "unknown"
+	// FFmpegErrorMissingCodec is returned when ffmpeg was built without an
+	// encoder or decoder it needed.
+	FFmpegErrorMissingCodec FFmpegErrorKind = "missing_codec"
+	// FFmpegErrorMissingFont is returned when the caption font could not be
+	// loaded.
+	FFmpegErrorMissingFont FFmpegErrorKind = "missing_font"
+	// FFmpegErrorInvalidSeek is returned when the requested time is not in
+	// the video, so nothing was encoded.
+	FFmpegErrorInvalidSeek FFmpegErrorKind = "invalid_seek"
+)
+
+// ffmpegErrorPatterns are stderr messages that identify a kind of failure,
+// checked in order. Nothing being encoded comes first, as font warnings are
+// printed along with it.
+var ffmpegErrorPatterns = []struct {
+	kind    FFmpegErrorKind
+	message string
+}{
+	{FFmpegErrorInvalidSeek, "Output file is empty, nothing was encoded"},
+	{FFmpegErrorInvalidSeek, "-to value smaller than -ss"},
+	{FFmpegErrorInvalidSeek, "Invalid duration specification"},
+	{FFmpegErrorMissingCodec, "Unknown encoder"},
+	{FFmpegErrorMissingCodec, "Unknown decoder"},
+	{FFmpegErrorMissingCodec, "Encoder not found"},
+	{FFmpegErrorMissingCodec, "Decoder not found"},
+	{FFmpegErrorMissingCodec, "is not supported by the bitstream filter"},
+	{FFmpegErrorMissingFont, "Cannot find a valid font"},
+	{FFmpegErrorMissingFont, "Could not load font"},
+	{FFmpegErrorMissingFont, "Error opening font"},
+	{FFmpegErrorMissingFont, "fontselect: failed to find any fallback"},
+	{FFmpegErrorMissingFont, "No usable fontconfig configuration file found"},
+}
+
+// ffmpegStderrLines is how many lines of stderr an FFmpegError keeps.
+const ffmpegStderrLines = 20
+
+// FFmpegError is returned when ffmpeg or ffprobe fails.
+type FFmpegError struct {
+	// Args is the command that was run, starting with the program.
+	Args []string
+	// ExitCode is the exit status, 0 if ffmpeg exited cleanly but did not
+	// produce anything.
+	ExitCode int
+	// Stderr is the end of what the command printed to stderr.
+	Stderr string
+	// Message is the line of stderr that best describes the failure.
+	Message string
+	Kind    FFmpegErrorKind
+}
+
+func (e *FFmpegError) Error() string {
+	msg := fmt.Sprintf("%s exited with status %d", e.Args[0], e.ExitCode)
+	if e.Kind != FFmpegErrorUnknown {
+		msg += " (" + string(e.Kind) + ")"
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// newFFmpegError returns the *FFmpegError for cmd, which failed with err
+// after printing stderr. It returns nil if cmd succeeded, unless stderr
+// says nothing was encoded. Other messages, such as the font warnings
+// libass prints for glyphs it has no font for, do not fail a run that
+// succeeded.
+func newFFmpegError(cmd *exec.Cmd, err error, stderr string) error {
+	kind, message := classifyFFmpegError(stderr)
+	if err == nil && kind != FFmpegErrorInvalidSeek {
+		return nil
+	}
+
+	exitCode := 0
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			// ffmpeg could not be started
+			return err
+		}
+		exitCode = exitErr.ExitCode()
+	}
+	return &FFmpegError{
+		Args:     cmd.Args,
+		ExitCode: exitCode,
+		Stderr:   tailLines(stderr, ffmpegStderrLines),
+		Message:  message,
+		Kind:     kind,
+	}
+}
+
+// nothingEncoded reports whether err is Runner.Run failing because ffmpeg
+// exited cleanly without encoding anything. Commands with several outputs
+// fail like that when any one of them is empty, such as an empty subtitle
+// track, even though the others were written.
+func nothingEncoded(err error) bool {
+	var ffmpegErr *FFmpegError
+	return errors.As(err, &ffmpegErr) && ffmpegErr.ExitCode == 0 && ffmpegErr.Kind == FFmpegErrorInvalidSeek
+}
+
+// classifyFFmpegError returns the kind of failure stderr describes, and
+// the line that describes it. Unknown failures are described by the last
+// line.
+func classifyFFmpegError(stderr string) (FFmpegErrorKind, string) {
+	lines := strings.Split(tailLines(stderr, -1), "\n")
+	for _, pattern := range ffmpegErrorPatterns {
+		for _, line := range lines {
+			if strings.Contains(line, pattern.message) {
+				return pattern.kind, line
+			}
+		}
+	}
+	return FFmpegErrorUnknown, lines[len(lines)-1]
+}
+
+// tailLines returns the last n non-empty lines of s, or all of them if n is
+// negative.
+func tailLines(s string, n int) string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if n >= 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// stderrTail keeps the last max bytes written to it.
+type stderrTail struct {
+	max int
+	buf []byte
+}
+
+func (t *stderrTail) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *stderrTail) String() string {
+	return string(t.buf)
+}
@@ -0,0 +1,91 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestClassifyFFmpegError(t *testing.T) {
+	for _, tc := range []struct {
+		stderr  string
+		kind    FFmpegErrorKind
+		message string
+	}{
+		{"Stream mapping:\n[vost#0:0 @ 0x1] Unknown encoder 'libwebp'\n", FFmpegErrorMissingCodec, "[vost#0:0 @ 0x1] Unknown encoder 'libwebp'"},
+		{"[Parsed_subtitles_0 @ 0x1] fontselect: failed to find any fallback with glyph 0x2669 for font: (Arial, 400, 0)\n", FFmpegErrorMissingFont, "[Parsed_subtitles_0 @ 0x1] fontselect: failed to find any fallback with glyph 0x2669 for font: (Arial, 400, 0)"},
+		{"fontselect: failed to find any fallback\nOutput file is empty, nothing was encoded\n", FFmpegErrorInvalidSeek, "Output file is empty, nothing was encoded"},
+		{"in.mkv: No such file or directory\n\n", FFmpegErrorUnknown, "in.mkv: No such file or directory"},
+		{"", FFmpegErrorUnknown, ""},
+	} {
+		kind, message := classifyFFmpegError(tc.stderr)
+		if kind != tc.kind || message != tc.message {
+			t.Errorf("classifyFFmpegError(%q) = %s, %q, want %s, %q", tc.stderr, kind, message, tc.kind, tc.message)
+		}
+	}
+}
+
+// exitError returns the error of a command that exits with code.
+func exitError(t *testing.T, code int) error {
+	t.Helper()
+
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("needs sh")
+	}
+	err := exec.Command("sh", "-c", fmt.Sprintf("exit %d", code)).Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("err = %v, want an *exec.ExitError", err)
+	}
+	return err
+}
+
+func TestNewFFmpegError(t *testing.T) {
+	cmd := exec.Command("ffmpeg", "-i", "in.mkv", "out.gif")
+
+	// Warnings do not fail a run that succeeded
+	if err := newFFmpegError(cmd, nil, "fontselect: failed to find any fallback with glyph 0x2669\n"); err != nil {
+		t.Errorf("succeeded with a font warning: err = %v", err)
+	}
+
+	err := newFFmpegError(cmd, nil, "Output file is empty, nothing was encoded\n")
+	var ffmpegErr *FFmpegError
+	if !errors.As(err, &ffmpegErr) || ffmpegErr.Kind != FFmpegErrorInvalidSeek || ffmpegErr.ExitCode != 0 {
+		t.Errorf("nothing encoded: err = %v, want an invalid seek", err)
+	}
+
+	var stderr strings.Builder
+	for i := range 30 {
+		fmt.Fprintf(&stderr, "line %d\n", i)
+	}
+	err = newFFmpegError(cmd, exitError(t, 3), stderr.String())
+	if !errors.As(err, &ffmpegErr) {
+		t.Fatalf("err = %v, want an *FFmpegError", err)
+	}
+	if ffmpegErr.ExitCode != 3 || ffmpegErr.Kind != FFmpegErrorUnknown || ffmpegErr.Message != "line 29" {
+		t.Errorf("err = %+v, want exit status 3 described by the last line", ffmpegErr)
+	}
+	if lines := strings.Split(ffmpegErr.Stderr, "\n"); len(lines) != ffmpegStderrLines || lines[0] != "line 10" {
+		t.Errorf("stderr kept %d lines from %q, want the last %d", len(lines), lines[0], ffmpegStderrLines)
+	}
+	if got, want := err.Error(), "ffmpeg exited with status 3: line 29"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+
+	// Commands that could not be started are not ffmpeg failures
+	notFound := errors.New("exec: not found")
+	if err := newFFmpegError(cmd, notFound, ""); err != notFound {
+		t.Errorf("err = %v, want the error starting the command", err)
+	}
+}
+
+func TestStderrTail(t *testing.T) {
+	tail := &stderrTail{max: 8}
+	fmt.Fprint(tail, "0123")
+	fmt.Fprint(tail, "456789ab")
+	if got := tail.String(); got != "456789ab" {
+		t.Errorf("tail = %q, want the last 8 bytes", got)
+	}
+}
@@ -0,0 +1,116 @@
+//go:build unix
+
+package processor
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ffmpeg_go "github.com/u2takey/ffmpeg-go"
+)
+
+// writeScript writes an executable shell script named name to dir.
+func writeScript(t *testing.T, dir string, name string, script string) string {
+	t.Helper()
+
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// scriptStream returns an ffmpeg command that runs script instead of
+// ffmpeg.
+func scriptStream(t *testing.T, script string) *ffmpeg_go.Stream {
+	t.Helper()
+
+	stream := ffmpeg_go.Input("in.mkv").Output("out.gif")
+	stream.FfmpegPath = writeScript(t, t.TempDir(), "ffmpeg", script)
+	return stream
+}
+
+func TestExecRunnerTimeout(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "survived")
+	// The child is in the process group, so it goes down with the script
+	// before it can leave the marker
+	stream := scriptStream(t, "(sleep 0.5; touch "+marker+") &\nwait\n")
+
+	ctx, cancel := withTimeout(context.Background(), "gif", 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := ExecRunner{}.Run(ctx, stream, 0)
+
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Op != "gif" {
+		t.Fatalf("err = %v, want a *TimeoutError for gif", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("a *TimeoutError does not match context.DeadlineExceeded")
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("Run took %s to give up", elapsed)
+	}
+
+	time.Sleep(time.Second)
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("a child of ffmpeg kept running after it was killed")
+	}
+}
+
+func TestExecRunnerCancel(t *testing.T) {
+	stream := scriptStream(t, "sleep 30\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	err := ExecRunner{}.Run(ctx, stream, 0)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestExecRunnerProgress(t *testing.T) {
+	stream := scriptStream(t, "echo out_time_us=500000\necho out_time_ms=2000000\necho progress=end\n")
+
+	var reports []float64
+	ctx := WithProgress(context.Background(), func(done float64) {
+		reports = append(reports, done)
+	})
+	if err := (ExecRunner{}).Run(ctx, stream, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 || reports[0] != 0.5 || reports[1] != 1 {
+		t.Errorf("progress = %v, want [0.5 1]", reports)
+	}
+}
+
+func TestExecRunnerFailure(t *testing.T) {
+	stream := scriptStream(t, "echo 'Unknown encoder libwebp' >&2\nexit 1\n")
+
+	err := ExecRunner{}.Run(context.Background(), stream, 0)
+	var ffmpegErr *FFmpegError
+	if !errors.As(err, &ffmpegErr) {
+		t.Fatalf("err = %v, want an *FFmpegError", err)
+	}
+	if ffmpegErr.ExitCode != 1 || ffmpegErr.Kind != FFmpegErrorMissingCodec {
+		t.Errorf("err = %+v, want exit status 1 and a missing codec", ffmpegErr)
+	}
+}
+
+func TestExecRunnerProbe(t *testing.T) {
+	dir := t.TempDir()
+	writeScript(t, dir, "ffprobe", `echo '{"streams": [{"index": 0, "codec_type": "video"}]}'`+"\n")
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	streams, _, err := ProbeStreams(context.Background(), ExecRunner{}, "in.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 1 || streams[0].CodecType != "video" {
+		t.Errorf("streams = %+v, want one video stream", streams)
+	}
+}
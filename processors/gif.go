@@ -1,39 +1,82 @@
 package processor
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math/bits"
 	"os"
 	"path"
 	"strings"
+	"time"
 
+	"github.com/rs/zerolog/log"
 	ffmpeg_go "github.com/u2takey/ffmpeg-go"
 )
 
 const MaxGifDurationMS = 10000
 const DefaultDisiredMaxSize = 2 * 1024 * 1024
 
+// Caption is a line of text shown over part of an animation. Start and End
+// are in milliseconds from the start of the animation.
+type Caption struct {
+	Start int
+	End   int
+	Text  string
+	// Top draws the caption at the top of the frame instead of the bottom.
+	Top bool
+}
+
 type GifOptions struct {
-	Text           string `mapstructure:"text"`
-	FontName       string `mapstructure:"font_name"`
-	FontColor      string `mapstructure:"font_color"`
-	FontsDir       string `mapstructure:"fonts_dir"`
-	DesiredMaxSize int    `mapstructure:"desired_max_size"`
+	// Format is the image format of the animation. Defaults to GIF.
+	Format AnimationFormat `mapstructure:"format"`
+	Text   string          `mapstructure:"text"`
+	// Captions, if set, are shown at their own offsets instead of Text
+	// being shown for the whole animation.
+	Captions       []Caption `mapstructure:"-"`
+	FontName       string    `mapstructure:"font_name"`
+	FontColor      string    `mapstructure:"font_color"`
+	FontsDir       string    `mapstructure:"fonts_dir"`
+	DesiredMaxSize int       `mapstructure:"desired_max_size"`
+	// Timeout caps how long the render, size search included, may take.
+	// Zero means no limit. It is not part of the output, so it is left
+	// out of render cache keys.
+	Timeout time.Duration `mapstructure:"timeout" json:"-"`
+	// Runner runs ffmpeg. Defaults to DefaultRunner.
+	Runner Runner `mapstructure:"-" json:"-"`
 }
 
 var ErrInvalidTimeRange = errors.New("invalid time range")
 
-func MakeGif(inputFile string, outputFile string, startTime int, endTime int, opts GifOptions) error {
+// MakeAnimation renders the video between startTime and endTime, in
+// milliseconds, as an animated image in opts.Format. It searches
+// animationLadder, capped at the frame rate of the video, for the best
+// quality parameters that keep the file under opts.DesiredMaxSize, and
+// returns what it chose. If nothing fits, the smallest rendering is kept. ffmpeg is killed if ctx is cancelled, or with
+// a *TimeoutError once opts.Timeout has passed.
+func MakeAnimation(ctx context.Context, inputFile string, outputFile string, startTime int, endTime int, opts GifOptions) (*AnimationResult, error) {
 	if endTime < startTime {
-		return ErrInvalidTimeRange
+		return nil, ErrInvalidTimeRange
 	}
 
 	// 10 seconds is the max we will allow
 	if endTime-startTime > MaxGifDurationMS {
-		return ErrInvalidTimeRange
+		return nil, ErrInvalidTimeRange
+	}
+
+	format := opts.Format
+	if format == "" {
+		format = AnimationFormatGIF
+	}
+	encoder, ok := animationEncoders[format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported animation format %q", format)
 	}
 
+	ctx, cancel := withTimeout(ctx, string(format), opts.Timeout)
+	defer cancel()
+
 	input := ffmpeg_go.Input(inputFile, ffmpeg_go.KwArgs{
 		"ss": fmt.Sprintf("%dms", startTime),
 		"to": fmt.Sprintf("%dms", endTime),
@@ -42,82 +85,192 @@ func MakeGif(inputFile string, outputFile string, startTime int, endTime int, op
 	// Make a temp directory
 	tmpDir, err := os.MkdirTemp("", "clyper")
 	if err != nil {
-		return fmt.Errorf("failed to create temp dir: %v", err)
+		return nil, fmt.Errorf("failed to create temp dir: %v", err)
 	}
 	defer os.RemoveAll(tmpDir)
-	// Write srt file
-	srtFile := path.Join(tmpDir, "subtitles.srt")
-	err = os.WriteFile(srtFile, []byte(fmt.Sprintf("1\n00:00:00,000 --> 00:01:00,000\n%s", strings.ToUpper(opts.Text))), 0644)
+
+	withSubs, err := addCaptions(input, tmpDir, opts.Text, opts.Captions, captionStyle{
+		fontName:  opts.FontName,
+		fontColor: opts.FontColor,
+		fontsDir:  opts.FontsDir,
+	})
 	if err != nil {
-		return fmt.Errorf("failed to write srt file: %v", err)
+		return nil, err
 	}
 
-	kwargs := ffmpeg_go.KwArgs{}
-	forceStyle := []string{"FontSize=24", "Alignment=2", "MarginL=10", "MarginR=10", "MarginV=20"}
-	if opts.FontName != "" {
-		forceStyle = append(forceStyle, fmt.Sprintf("Fontname=%s", opts.FontName))
+	wantedMaxSize := DefaultDisiredMaxSize
+	if opts.DesiredMaxSize > 0 {
+		wantedMaxSize = opts.DesiredMaxSize
 	}
-	if opts.FontColor != "" {
-		forceStyle = append(forceStyle, fmt.Sprintf("PrimaryColour=&H%s", opts.FontColor))
+
+	// With the frame rates capped at the video's, every rung of the ladder
+	// is smaller than the one before it, so binary search for the first
+	// that fits. If the frame rate is not known, try every rung in turn.
+	runner := runnerOrDefault(opts.Runner)
+	sourceFPS, err := sourceFrameRate(ctx, runner, inputFile)
+	if ctx.Err() != nil {
+		return nil, context.Cause(ctx)
 	}
-	if len(forceStyle) > 0 {
-		kwargs["force_style"] = strings.Join(forceStyle, ",")
+	if err != nil {
+		log.Warn().Err(err).Str("input", inputFile).Msg("Failed to probe the frame rate, searching every rung")
 	}
+	ladder := animationLadderFor(sourceFPS)
+	sorted := sourceFPS > 0
 
-	if opts.FontsDir != "" {
-		kwargs["fontsdir"] = opts.FontsDir
+	sizes := map[int]int64{}
+	duration := time.Duration(endTime-startTime) * time.Millisecond
+	progress := progressFromContext(ctx)
+	// The search renders at most this many times
+	maxAttempts := len(ladder)
+	if sorted {
+		maxAttempts = bits.Len(uint(len(ladder)))
+	}
+	render := func(rung int) (int64, error) {
+		if size, ok := sizes[rung]; ok {
+			return size, nil
+		}
+		renderCtx := ctx
+		if progress != nil {
+			attempt := len(sizes)
+			renderCtx = WithProgress(ctx, func(done float64) {
+				progress(min(1, (float64(attempt)+done)/float64(maxAttempts)))
+			})
+		}
+		file := path.Join(tmpDir, fmt.Sprintf("%d.%s", rung, format))
+		err := renderAnimation(renderCtx, runner, withSubs, file, duration, encoder, format, ladder[rung])
+		if err != nil {
+			return 0, err
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get file size: %v", err)
+		}
+		sizes[rung] = info.Size()
+		return info.Size(), nil
 	}
 
-	withSubs := input.Filter("subtitles", ffmpeg_go.Args{srtFile}, kwargs)
+	best := -1
+	for lo, hi := 0, len(ladder)-1; sorted && lo <= hi; {
+		mid := (lo + hi) / 2
+		size, err := render(mid)
+		if err != nil {
+			return nil, err
+		}
+		if size <= int64(wantedMaxSize) {
+			best = mid
+			hi = mid - 1
+		} else {
+			lo = mid + 1
+		}
+	}
+	for rung := 0; !sorted && rung < len(ladder); rung++ {
+		size, err := render(rung)
+		if err != nil {
+			return nil, err
+		}
+		if size <= int64(wantedMaxSize) {
+			best = rung
+			break
+		}
+	}
+	fits := best >= 0
+	if !fits {
+		best = len(ladder) - 1
+	}
+	size, err := render(best)
+	if err != nil {
+		return nil, err
+	}
 
-	split := withSubs.Split()
-	palette := split.Get("0").Filter("palettegen", ffmpeg_go.Args{"max_colors=64"}).Split()
+	err = renameOrCopy(path.Join(tmpDir, fmt.Sprintf("%d.%s", best, format)), outputFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rename file: %v", err)
+	}
 
-	multiFpsSplit := split.Get("1").Split()
+	return &AnimationResult{
+		Params:   ladder[best],
+		Size:     size,
+		Fits:     fits,
+		Attempts: len(sizes),
+	}, nil
+}
 
-	outputOrigFpsFile := path.Join(tmpDir, "orig_fps.gif")
-	outputOrigFps := ffmpeg_go.Filter([]*ffmpeg_go.Stream{
-		multiFpsSplit.Get("0"),
-		palette.Get("0"),
-	}, "paletteuse", ffmpeg_go.Args{}).
-		Output(outputOrigFpsFile)
+// MakeGif renders the video between startTime and endTime, in
+// milliseconds, as a GIF.
+//
+// Deprecated: Use MakeAnimation.
+func MakeGif(inputFile string, outputFile string, startTime int, endTime int, opts GifOptions) error {
+	opts.Format = AnimationFormatGIF
+	_, err := MakeAnimation(context.Background(), inputFile, outputFile, startTime, endTime, opts)
+	return err
+}
 
-	output12FpsFile := path.Join(tmpDir, "12_fps.gif")
-	output12Fps := ffmpeg_go.Filter([]*ffmpeg_go.Stream{
-		multiFpsSplit.Get("1").Filter("fps", ffmpeg_go.Args{"fps=12"}),
-		palette.Get("1"),
-	}, "paletteuse", ffmpeg_go.Args{}).
-		Output(output12FpsFile)
+// captionStyle is the font captions are drawn in.
+type captionStyle struct {
+	fontName  string
+	fontColor string
+	fontsDir  string
+}
 
-	err = ffmpeg_go.MergeOutputs(outputOrigFps, output12Fps).OverWriteOutput().ErrorToStdOut().Run()
+// addCaptions draws captions over input, or text for its whole duration if
+// captions is nil. The subtitle file is written to tmpDir.
+func addCaptions(input *ffmpeg_go.Stream, tmpDir string, text string, captions []Caption, style captionStyle) (*ffmpeg_go.Stream, error) {
+	srtFile := path.Join(tmpDir, "subtitles.srt")
+	if captions == nil {
+		captions = []Caption{{Start: 0, End: 60000, Text: text}}
+	}
+	written, err := writeCaptions(srtFile, captions)
 	if err != nil {
-		return fmt.Errorf("failed to create gif: %v", err)
+		return nil, fmt.Errorf("failed to write srt file: %v", err)
+	}
+	// ffmpeg cannot open an empty subtitle file, so clips without any
+	// captions skip the filter
+	if written == 0 {
+		return input, nil
 	}
 
-	// Select the gif closest to 2MB
-	origFpsSize, err := os.Stat(outputOrigFpsFile)
-	if err != nil {
-		return fmt.Errorf("failed to get file size: %v", err)
+	kwargs := ffmpeg_go.KwArgs{}
+	forceStyle := []string{"FontSize=24", "Alignment=2", "MarginL=10", "MarginR=10", "MarginV=20"}
+	if style.fontName != "" {
+		forceStyle = append(forceStyle, fmt.Sprintf("Fontname=%s", style.fontName))
+	}
+	if style.fontColor != "" {
+		forceStyle = append(forceStyle, fmt.Sprintf("PrimaryColour=&H%s", style.fontColor))
+	}
+	if len(forceStyle) > 0 {
+		kwargs["force_style"] = strings.Join(forceStyle, ",")
 	}
 
-	wantedMaxSize := DefaultDisiredMaxSize
-	if opts.DesiredMaxSize > 0 {
-		wantedMaxSize = opts.DesiredMaxSize
+	if style.fontsDir != "" {
+		kwargs["fontsdir"] = style.fontsDir
 	}
 
-	if origFpsSize.Size() < int64(wantedMaxSize) {
-		err = renameOrCopy(outputOrigFpsFile, outputFile)
-		if err != nil {
-			return fmt.Errorf("failed to rename file: %v", err)
+	return input.Filter("subtitles", ffmpeg_go.Args{srtFile}, kwargs), nil
+}
+
+// writeCaptions writes captions to an SRT file, upper cased, and returns
+// how many it wrote. Captions without text are left out.
+func writeCaptions(srtFile string, captions []Caption) (int, error) {
+	var srt strings.Builder
+	index := 1
+	for _, caption := range captions {
+		text := strings.TrimSpace(caption.Text)
+		if text == "" || caption.End <= caption.Start {
+			continue
 		}
-	} else {
-		err = renameOrCopy(output12FpsFile, outputFile)
-		if err != nil {
-			return fmt.Errorf("failed to rename file: %v", err)
+		text = strings.ToUpper(text)
+		if caption.Top {
+			// libass reads ASS alignment overrides in SRT too
+			text = `{\an8}` + text
 		}
+		fmt.Fprintf(&srt, "%d\n%s --> %s\n%s\n\n", index, formatSRTTimestamp(caption.Start), formatSRTTimestamp(caption.End), text)
+		index++
 	}
+	return index - 1, os.WriteFile(srtFile, []byte(srt.String()), 0644)
+}
 
-	return nil
+func formatSRTTimestamp(ms int) string {
+	return fmt.Sprintf("%02d:%02d:%02d,%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
 }
 
 func renameOrCopy(src, dst string) error {
@@ -0,0 +1,220 @@
+package processor
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// PGS segment types
+const (
+	pgsPaletteSegment     = 0x14
+	pgsObjectSegment      = 0x15
+	pgsCompositionSegment = 0x16
+	pgsEndSegment         = 0x80
+)
+
+// PGSDecoder decodes Blu-ray (hdmv_pgs_subtitle) subtitle streams.
+type PGSDecoder struct{}
+
+func (PGSDecoder) Decode(ctx context.Context, runner Runner, inputFilePath string, streamIndex int) ([]BitmapSubtitle, error) {
+	packets, _, err := probeSubtitlePackets(ctx, runner, inputFilePath, streamIndex)
+	if err != nil {
+		return nil, err
+	}
+	return decodePGS(packets)
+}
+
+type pgsObject struct {
+	width  int
+	height int
+	rle    []byte
+}
+
+type pgsCompositionObject struct {
+	objectID uint16
+	x        int
+	y        int
+}
+
+type pgsComposition struct {
+	paletteOnly bool
+	paletteID   uint8
+	objects     []pgsCompositionObject
+}
+
+// decodePGS decodes the display sets of a PGS stream. Each packet holds the
+// segments of one display set, without the "PG" headers of .sup files. A
+// subtitle is shown until the next display set replaces or clears it.
+func decodePGS(packets []subtitlePacket) ([]BitmapSubtitle, error) {
+	palettes := map[uint8]color.Palette{}
+	objects := map[uint16]*pgsObject{}
+
+	var subtitles []BitmapSubtitle
+	open := false
+	var composition pgsComposition
+	for _, packet := range packets {
+		data := packet.Data
+		for len(data) >= 3 {
+			segmentType := data[0]
+			size := int(binary.BigEndian.Uint16(data[1:3]))
+			if len(data) < 3+size {
+				return nil, fmt.Errorf("truncated pgs segment at %s", packet.PTS)
+			}
+			segment := data[3 : 3+size]
+			data = data[3+size:]
+
+			switch segmentType {
+			case pgsCompositionSegment:
+				if len(segment) < 11 {
+					return nil, fmt.Errorf("short pgs composition segment at %s", packet.PTS)
+				}
+				composition = pgsComposition{
+					paletteOnly: segment[8]&0x80 != 0,
+					paletteID:   segment[9],
+				}
+				numObjects := int(segment[10])
+				segment = segment[11:]
+				for i := 0; i < numObjects && len(segment) >= 8; i++ {
+					composition.objects = append(composition.objects, pgsCompositionObject{
+						objectID: binary.BigEndian.Uint16(segment[0:2]),
+						x:        int(binary.BigEndian.Uint16(segment[4:6])),
+						y:        int(binary.BigEndian.Uint16(segment[6:8])),
+					})
+					// Skip the cropping rectangle
+					if segment[3]&0x80 != 0 {
+						segment = segment[min(16, len(segment)):]
+					} else {
+						segment = segment[8:]
+					}
+				}
+			case pgsPaletteSegment:
+				if len(segment) < 2 {
+					continue
+				}
+				palette, ok := palettes[segment[0]]
+				if !ok {
+					palette = make(color.Palette, 256)
+					for i := range palette {
+						palette[i] = color.NRGBA{}
+					}
+					palettes[segment[0]] = palette
+				}
+				for entries := segment[2:]; len(entries) >= 5; entries = entries[5:] {
+					r, g, b := color.YCbCrToRGB(entries[1], entries[3], entries[2])
+					palette[entries[0]] = color.NRGBA{R: r, G: g, B: b, A: entries[4]}
+				}
+			case pgsObjectSegment:
+				if len(segment) < 4 {
+					continue
+				}
+				id := binary.BigEndian.Uint16(segment[0:2])
+				if segment[3]&0x80 != 0 {
+					if len(segment) < 11 {
+						return nil, fmt.Errorf("short pgs object segment at %s", packet.PTS)
+					}
+					objects[id] = &pgsObject{
+						width:  int(binary.BigEndian.Uint16(segment[7:9])),
+						height: int(binary.BigEndian.Uint16(segment[9:11])),
+						rle:    append([]byte{}, segment[11:]...),
+					}
+				} else if object, ok := objects[id]; ok {
+					object.rle = append(object.rle, segment[4:]...)
+				}
+			case pgsEndSegment:
+				if composition.paletteOnly {
+					continue
+				}
+				if open {
+					subtitles[len(subtitles)-1].End = packet.PTS
+					open = false
+				}
+				if len(composition.objects) == 0 {
+					continue
+				}
+				img, err := renderPGSComposition(composition, objects, palettes[composition.paletteID])
+				if err != nil {
+					return nil, fmt.Errorf("error rendering pgs subtitle at %s: %v", packet.PTS, err)
+				}
+				subtitles = append(subtitles, BitmapSubtitle{Start: packet.PTS, Image: img})
+				open = true
+			}
+		}
+	}
+
+	return closeBitmapSubtitles(subtitles), nil
+}
+
+func renderPGSComposition(composition pgsComposition, objects map[uint16]*pgsObject, palette color.Palette) (image.Image, error) {
+	if palette == nil {
+		return nil, fmt.Errorf("missing palette %d", composition.paletteID)
+	}
+
+	var bounds image.Rectangle
+	for _, c := range composition.objects {
+		object, ok := objects[c.objectID]
+		if !ok {
+			return nil, fmt.Errorf("missing object %d", c.objectID)
+		}
+		bounds = bounds.Union(image.Rect(c.x, c.y, c.x+object.width, c.y+object.height))
+	}
+
+	img := image.NewNRGBA(bounds)
+	for _, c := range composition.objects {
+		object := objects[c.objectID]
+		pixels := decodePGSRLE(object.rle, object.width, object.height)
+		for y := 0; y < object.height; y++ {
+			for x := 0; x < object.width; x++ {
+				img.Set(c.x+x, c.y+y, palette[pixels[y*object.width+x]])
+			}
+		}
+	}
+	return img, nil
+}
+
+// decodePGSRLE decodes the run length encoded palette indexes of an object.
+func decodePGSRLE(rle []byte, width int, height int) []byte {
+	pixels := make([]byte, 0, width*height)
+	for i := 0; i < len(rle) && len(pixels) < width*height; {
+		b := rle[i]
+		i++
+		if b != 0 {
+			pixels = append(pixels, b)
+			continue
+		}
+		if i >= len(rle) {
+			break
+		}
+
+		flags := rle[i]
+		i++
+		if flags == 0 {
+			// End of line
+			if width > 0 && len(pixels)%width != 0 {
+				pixels = append(pixels, make([]byte, width-len(pixels)%width)...)
+			}
+			continue
+		}
+
+		length := int(flags & 0x3f)
+		if flags&0x40 != 0 && i < len(rle) {
+			length = length<<8 | int(rle[i])
+			i++
+		}
+		var index byte
+		if flags&0x80 != 0 && i < len(rle) {
+			index = rle[i]
+			i++
+		}
+		for j := 0; j < length; j++ {
+			pixels = append(pixels, index)
+		}
+	}
+
+	if len(pixels) < width*height {
+		pixels = append(pixels, make([]byte, width*height-len(pixels))...)
+	}
+	return pixels[:width*height]
+}
@@ -1,15 +1,22 @@
 package processor
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/asticode/go-astisub"
 	"github.com/jaym/clyper/metadata"
@@ -22,13 +29,68 @@ type PreprocessorConfig struct {
 	Downscaler        *DownscalerConfig        `mapstructure:"downscaler"`
 	Thumbnailer       *ThumbnailerConfig       `mapstructure:"thumbnailr"`
 	SubtitleExtractor *SubtitleExtractorConfig `mapstructure:"subtitle_extractor"`
+	// SubtitleLanguages are the languages, as ISO 639-2 codes such as
+	// "eng" or "spa", whose subtitles are extracted and indexed. Empty
+	// extracts every language. Streams without a language tag are "und".
+	SubtitleLanguages []string `mapstructure:"subtitle_languages"`
+	// OCR converts image based subtitle streams, such as Blu-ray PGS and
+	// DVD subtitles, to text. Those streams are skipped when it is not set.
+	OCR *OCRConfig `mapstructure:"ocr"`
+	// SubtitleDecoders decode image based subtitle streams for OCR, by
+	// ffprobe codec name. Defaults to DefaultSubtitleDecoders.
+	SubtitleDecoders map[string]SubtitleDecoder `mapstructure:"-"`
+	// SidecarSubtitles decides how .srt, .ass, .ssa and .vtt files next to
+	// a video are used. Defaults to SidecarSubtitlesFallback.
+	SidecarSubtitles SidecarSubtitlePolicy `mapstructure:"sidecar_subtitles"`
+	// SidecarLanguage is the language of sidecar files whose name does not
+	// include one, e.g. "Show.S01E01.srt". Defaults to
+	// metadata.DefaultLanguage, the language the API captions with.
+	SidecarLanguage string `mapstructure:"sidecar_language"`
+	// Show is the slug of the show every processed file belongs to. When
+	// empty, the show is derived from the directory layout if
+	// ShowFromDirectory is set, and is metadata.DefaultShowSlug otherwise.
+	Show string `mapstructure:"show"`
+	// ShowName is the display name of Show. Defaults to Show.
+	ShowName string `mapstructure:"show_name"`
+	// ShowFromDirectory takes the show from the first directory below the
+	// input directory, e.g. "<input>/The Office/S01E01.mkv" belongs to
+	// the show "the-office". Files directly in the input directory belong
+	// to the default show.
+	ShowFromDirectory bool `mapstructure:"show_from_directory"`
+	// EpisodeRules map file paths to season and episode numbers. The first
+	// rule that matches wins. Defaults to DefaultEpisodeRules.
+	EpisodeRules []EpisodeRule `mapstructure:"episode_rules"`
+	// TitleRules recognise movies and specials in files that no episode
+	// rule matches. Defaults to DefaultTitleRules. A sidecar
+	// manifest (see ManifestSuffix) takes precedence over both.
+	TitleRules []TitleRule `mapstructure:"title_rules"`
+	// Jobs is the number of files processed concurrently. Defaults to 1.
+	Jobs int `mapstructure:"jobs"`
+	// Incremental updates the existing metadata database instead of
+	// rebuilding it. Only episodes that changed are rewritten, and episodes
+	// whose files are no longer in the input directory are removed.
+	Incremental bool `mapstructure:"incremental"`
+	// ContinueOnError keeps going when a file fails to process. The database
+	// is built from the episodes that succeeded and the failures are listed
+	// in the ProcessReport.
+	ContinueOnError bool `mapstructure:"continue_on_error"`
+	// ProbeTimeout caps how long each ffprobe run of a file may take. Zero
+	// means no limit.
+	ProbeTimeout time.Duration `mapstructure:"probe_timeout"`
+	// FFmpegTimeout caps how long the ffmpeg run that downscales a file and
+	// extracts its thumbnails and subtitles may take. Zero means no limit.
+	FFmpegTimeout time.Duration `mapstructure:"ffmpeg_timeout"`
+	// Runner runs ffmpeg and ffprobe. Defaults to DefaultRunner.
+	Runner Runner `mapstructure:"-" json:"-"`
 }
 
 type Preprocessor struct {
-	config *PreprocessorConfig
+	config       *PreprocessorConfig
+	episodeRules []episodeRule
+	titleRules   []titleRule
 }
 
-func NewPreprocessor(cfg PreprocessorConfig) *Preprocessor {
+func NewPreprocessor(cfg PreprocessorConfig) (*Preprocessor, error) {
 	downscalerWidth := -1
 	downscalerHeight := -1
 	if cfg.Downscaler != nil {
@@ -55,6 +117,68 @@ func NewPreprocessor(cfg PreprocessorConfig) *Preprocessor {
 		}
 	}
 
+	jobs := 1
+	if cfg.Jobs > 0 {
+		jobs = cfg.Jobs
+	}
+
+	sidecarSubtitles := SidecarSubtitlesFallback
+	if cfg.SidecarSubtitles != "" {
+		sidecarSubtitles = cfg.SidecarSubtitles
+	}
+	if err := validateSidecarSubtitlePolicy(sidecarSubtitles); err != nil {
+		return nil, err
+	}
+
+	sidecarLanguage := metadata.DefaultLanguage
+	if cfg.SidecarLanguage != "" {
+		sidecarLanguage = strings.ToLower(cfg.SidecarLanguage)
+	}
+
+	var ocr *OCRConfig
+	if cfg.OCR != nil {
+		ocr = &OCRConfig{
+			Command:   DefaultOCRCommand,
+			Languages: map[string]string{},
+		}
+		if cfg.OCR.Command != nil {
+			// recogniseText runs the first element
+			if len(cfg.OCR.Command) == 0 || cfg.OCR.Command[0] == "" {
+				return nil, fmt.Errorf("ocr command is empty")
+			}
+			ocr.Command = cfg.OCR.Command
+		}
+		for language, ocrLanguage := range DefaultOCRLanguages {
+			ocr.Languages[language] = ocrLanguage
+		}
+		for language, ocrLanguage := range cfg.OCR.Languages {
+			ocr.Languages[strings.ToLower(language)] = ocrLanguage
+		}
+	}
+
+	subtitleDecoders := cfg.SubtitleDecoders
+	if subtitleDecoders == nil {
+		subtitleDecoders = DefaultSubtitleDecoders
+	}
+
+	episodeRules := cfg.EpisodeRules
+	if episodeRules == nil {
+		episodeRules = DefaultEpisodeRules
+	}
+	compiledEpisodeRules, err := compileEpisodeRules(episodeRules)
+	if err != nil {
+		return nil, err
+	}
+
+	titleRules := cfg.TitleRules
+	if titleRules == nil {
+		titleRules = DefaultTitleRules
+	}
+	compiledTitleRules, err := compileTitleRules(titleRules)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Preprocessor{config: &PreprocessorConfig{
 		Downscaler: &DownscalerConfig{
 			Width:  downscalerWidth,
@@ -66,21 +190,30 @@ func NewPreprocessor(cfg PreprocessorConfig) *Preprocessor {
 			FramesPerSecond: thumbnailerFps,
 		},
 		SubtitleExtractor: cfg.SubtitleExtractor,
-	}}
-}
-
-type ffmpegStreamProbe struct {
-	Streams []struct {
-		Index     int    `json:"index"`
-		CodecType string `json:"codec_type"`
-		Tags      struct {
-			Language string `json:"language"`
-		}
-	} `json:"streams"`
+		SubtitleLanguages: cfg.SubtitleLanguages,
+		OCR:               ocr,
+		SubtitleDecoders:  subtitleDecoders,
+		SidecarSubtitles:  sidecarSubtitles,
+		SidecarLanguage:   sidecarLanguage,
+		Show:              cfg.Show,
+		ShowName:          cfg.ShowName,
+		ShowFromDirectory: cfg.ShowFromDirectory,
+		EpisodeRules:      episodeRules,
+		TitleRules:        titleRules,
+		Jobs:              jobs,
+		Incremental:       cfg.Incremental,
+		ContinueOnError:   cfg.ContinueOnError,
+		ProbeTimeout:      cfg.ProbeTimeout,
+		FFmpegTimeout:     cfg.FFmpegTimeout,
+		Runner:            runnerOrDefault(cfg.Runner),
+	}, episodeRules: compiledEpisodeRules, titleRules: compiledTitleRules}, nil
 }
 
 const (
-	EpisodeMetadataVersion = 1
+	// EpisodeMetadataVersion is bumped when episodes processed by an older
+	// version have to be processed again. Version 2 keeps the audio of the
+	// downscaled video.
+	EpisodeMetadataVersion = 2
 )
 
 var EpisodeMetadataFilename = fmt.Sprintf("METADATA.%d.json", EpisodeMetadataVersion)
@@ -88,59 +221,143 @@ var EpisodeMetadataFilename = fmt.Sprintf("METADATA.%d.json", EpisodeMetadataVer
 type PreprocessorError struct {
 	Msg           string
 	ffprobeOutput string
+	// err is the error of the ffmpeg run that failed, if any.
+	err error
 }
 
 func (e *PreprocessorError) Error() string {
 	return e.Msg
 }
 
+func (e *PreprocessorError) Unwrap() error {
+	return e.err
+}
+
 func (e *PreprocessorError) VerboseError() string {
 	return fmt.Sprintf("FFProbe Output:\n%s\n\n%s", e.Msg, e.ffprobeOutput)
 }
 
-func (p *Preprocessor) Process(inputDir string, outputDir string) error {
+// ErrFilesFailed is returned by Process in ContinueOnError mode when the
+// database was built but some files could not be processed.
+var ErrFilesFailed = errors.New("some files failed to process")
+
+// FileFailure describes a file that could not be processed.
+type FileFailure struct {
+	Path    string `json:"path"`
+	Show    string `json:"show"`
+	Season  int    `json:"season"`
+	Episode int    `json:"episode"`
+	Error   string `json:"error"`
+	// FFProbeOutput is the ffprobe output for the file, if the failure
+	// was a PreprocessorError that captured it.
+	FFProbeOutput string `json:"ffprobe_output,omitempty"`
+	// FFmpegError is the kind, such as missing_codec, and FFmpegStderr the
+	// end of the stderr of the ffmpeg or ffprobe run that failed, if any.
+	FFmpegError  FFmpegErrorKind `json:"ffmpeg_error,omitempty"`
+	FFmpegStderr string          `json:"ffmpeg_stderr,omitempty"`
+}
+
+// ProcessReport summarizes a Process run.
+type ProcessReport struct {
+	// Processed is the number of files processed successfully.
+	Processed int `json:"processed"`
+	// Failed lists the files that were skipped because of an error.
+	Failed []FileFailure `json:"failed"`
+}
+
+// preprocessJob is a single video file to be processed.
+type preprocessJob struct {
+	path     string
+	show     string
+	showName string
+	season   int
+	episode  int
+	kind     string
+	title    string
+	// rule names what identified the file, for `preprocess scan`.
+	rule string
+}
+
+// episodeID identifies an episode across shows.
+type episodeID struct {
+	show    string
+	season  int
+	episode int
+}
+
+type preprocessResult struct {
+	index    int
+	job      preprocessJob
+	metadata *metadata.EpisodeMetadata
+	err      error
+}
+
+// Process processes every episode in inputDir and writes the results and
+// the metadata database to store. The returned report is non-nil whenever
+// the input directory could be scanned. When ctx is done the running ffmpeg
+// processes are killed and the database is left as it was.
+func (p *Preprocessor) Process(ctx context.Context, inputDir string, store objstore.ObjectStore) (*ProcessReport, error) {
 	log.Info().
 		Interface("config", p.config).
 		Str("inputDir", inputDir).
-		Str("outputDir", outputDir).
 		Msg("processing files")
 
 	// The inputDir is the directory containing the video files to be processed.
-	// It will be recursively scanned for video files. The video file names
-	// must have the season and episode number in the format SXXEXX.
-
-	err := os.MkdirAll(path.Join(outputDir, "internal"), 0755)
+	// It will be recursively scanned for video files. Episodes are recognised
+	// by the episode rules, movies and specials by the title rules or a
+	// sidecar manifest.
+	jobs, err := p.findEpisodeFiles(inputDir)
 	if err != nil {
-		return fmt.Errorf("error creating internal output directory: %v", err)
+		return nil, fmt.Errorf("error processing files: %v", err)
 	}
+	if collisions := findCollisions(jobs); len(collisions) > 0 {
+		for _, c := range collisions {
+			log.Error().Strs("paths", c.Paths).Str("show", c.Show).Int("season", c.Season).Int("episode", c.Episode).Msg("files map to the same episode")
+		}
+		return nil, fmt.Errorf("%w: %d episodes", ErrEpisodeCollision, len(collisions))
+	}
+	report := &ProcessReport{Failed: []FileFailure{}}
 
-	metadataDbPath := path.Join(outputDir, "internal/metadata.db")
-	objStoreReader := objstore.NewLocalFSObjectReader(outputDir)
-	metadataDbBuilder, err := metadata.NewDatabaseBuilder(metadataDbPath, objStoreReader)
+	var metadataDbBuilder *metadata.DatabaseBuilder
+	if p.config.Incremental {
+		metadataDbBuilder, err = metadata.NewIncrementalDatabaseBuilder(metadata.DefaultDatabaseKey, store)
+	} else {
+		metadataDbBuilder, err = metadata.NewDatabaseBuilder(metadata.DefaultDatabaseKey, store)
+	}
 	if err != nil {
-		return fmt.Errorf("error creating metadata database builder: %v", err)
+		return report, fmt.Errorf("error creating metadata database builder: %v", err)
 	}
-	// Walk the input directory
-	err = filepath.WalkDir(inputDir, func(path string, d os.DirEntry, err error) error {
+	defer metadataDbBuilder.Close() // nolint: errcheck
+
+	// Episodes already in the database. Only populated in incremental mode.
+	var storedEpisodes []metadata.StoredEpisode
+	storedEpisodesByKey := map[episodeID]metadata.StoredEpisode{}
+	if p.config.Incremental {
+		storedEpisodes, err = metadataDbBuilder.Episodes()
 		if err != nil {
-			return fmt.Errorf("error walking input directory: %v", err)
+			return report, fmt.Errorf("error listing episodes in metadata database: %v", err)
 		}
-
-		if d.IsDir() {
-			return nil
+		for _, ep := range storedEpisodes {
+			storedEpisodesByKey[episodeID{ep.Show, ep.Season, ep.Episode}] = ep
 		}
+	}
+	seenEpisodes := map[episodeID]bool{}
 
-		season, episode, err := extractSeasonAndEpisode(path)
+	err = p.processAll(ctx, jobs, store, func(job preprocessJob, md *metadata.EpisodeMetadata, err error) error {
+		epKey := episodeID{job.show, job.season, job.episode}
+		seenEpisodes[epKey] = true
 		if err != nil {
-			log.Warn().Str("path", path).Msg("skipping file")
+			// A failed episode keeps whatever the database already had
+			// for it, which in incremental mode is the previous version.
+			report.Failed = append(report.Failed, newFileFailure(job, err))
+			log.Error().Err(err).Str("path", job.path).Msg("skipping file that failed to process")
 			return nil
 		}
+		report.Processed++
 
-		log.Info().Str("path", path).Int("season", season).Int("episode", episode).Msg("processing file")
-		// Process the file
-		md, err := p.processFile(path, outputDir, season, episode)
-		if err != nil {
-			return fmt.Errorf("error processing file: %v", err)
+		if stored, ok := storedEpisodesByKey[epKey]; ok && stored.Matches(md) {
+			log.Info().Str("show", md.Show).Int("season", md.Season).Int("episode", md.Episode).Msg("episode unchanged in database")
+			return nil
 		}
 
 		// Insert the metadata into the database
@@ -148,53 +365,258 @@ func (p *Preprocessor) Process(inputDir string, outputDir string) error {
 		if err != nil {
 			return fmt.Errorf("error adding episode metadata to database: %v", err)
 		}
-
 		return nil
 	})
-
+	if ctx.Err() != nil {
+		// Files that were stopped part way are not failures of their own
+		return report, context.Cause(ctx)
+	}
 	if err != nil {
-		return fmt.Errorf("error processing files: %v", err)
+		return report, fmt.Errorf("error processing files: %w", err)
+	}
+
+	for _, stored := range storedEpisodes {
+		if seenEpisodes[episodeID{stored.Show, stored.Season, stored.Episode}] {
+			continue
+		}
+		log.Info().Str("show", stored.Show).Int("season", stored.Season).Int("episode", stored.Episode).Msg("removing episode from database")
+		err = metadataDbBuilder.RemoveEpisode(stored.Show, stored.Season, stored.Episode)
+		if err != nil {
+			return report, fmt.Errorf("error removing episode from metadata database: %v", err)
+		}
 	}
 
 	err = metadataDbBuilder.Build()
 	if err != nil {
-		return fmt.Errorf("error building metadata database: %v", err)
+		return report, fmt.Errorf("error building metadata database: %v", err)
+	}
+
+	if len(report.Failed) > 0 {
+		return report, fmt.Errorf("%w: %d of %d", ErrFilesFailed, len(report.Failed), len(jobs))
 	}
 
-	return nil
+	return report, nil
 }
 
-func (p *Preprocessor) processFile(inputFilePath string, outputDir string, season int, episode int) (*metadata.EpisodeMetadata, error) {
-	probeStr, err := ffmpeg_go.Probe(inputFilePath)
+func newFileFailure(job preprocessJob, err error) FileFailure {
+	failure := FileFailure{
+		Path:    job.path,
+		Show:    job.show,
+		Season:  job.season,
+		Episode: job.episode,
+		Error:   err.Error(),
+	}
+	var preprocessorErr *PreprocessorError
+	if errors.As(err, &preprocessorErr) {
+		failure.FFProbeOutput = preprocessorErr.ffprobeOutput
+	}
+	var ffmpegErr *FFmpegError
+	if errors.As(err, &ffmpegErr) {
+		failure.FFmpegError = ffmpegErr.Kind
+		failure.FFmpegStderr = ffmpegErr.Stderr
+	}
+	return failure
+}
+
+// findEpisodeFiles walks inputDir and returns the episodes, specials and
+// movies in it, ordered by show, season, episode and path.
+func (p *Preprocessor) findEpisodeFiles(inputDir string) ([]preprocessJob, error) {
+	var jobs []preprocessJob
+	err := filepath.WalkDir(inputDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("error walking input directory: %v", err)
+		}
+
+		// Sidecar files are picked up with their video
+		if d.IsDir() || isSidecarFile(path) {
+			return nil
+		}
+
+		job, ok, err := p.identifyFile(inputDir, path)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			log.Warn().Str("path", path).Msg("skipping file")
+			return nil
+		}
+
+		jobs = append(jobs, job)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	var probe ffmpegStreamProbe
-	err = json.Unmarshal([]byte(probeStr), &probe)
-	if err != nil {
+	sort.SliceStable(jobs, func(i, j int) bool {
+		if jobs[i].show != jobs[j].show {
+			return jobs[i].show < jobs[j].show
+		}
+		if jobs[i].season != jobs[j].season {
+			return jobs[i].season < jobs[j].season
+		}
+		if jobs[i].episode != jobs[j].episode {
+			return jobs[i].episode < jobs[j].episode
+		}
+		return jobs[i].path < jobs[j].path
+	})
+	return jobs, nil
+}
+
+// showForFile returns the slug and name of the show the file at filePath
+// belongs to.
+func (p *Preprocessor) showForFile(inputDir string, filePath string) (string, string) {
+	if p.config.Show != "" {
+		name := p.config.ShowName
+		if name == "" {
+			name = p.config.Show
+		}
+		return p.config.Show, name
+	}
+
+	if p.config.ShowFromDirectory {
+		rel, err := filepath.Rel(inputDir, filePath)
+		if err == nil {
+			dir, _, found := strings.Cut(filepath.ToSlash(rel), "/")
+			if slug := metadata.Slugify(dir); found && slug != "" {
+				return slug, dir
+			}
+		}
+	}
+
+	return metadata.DefaultShowSlug, metadata.DefaultShowSlug
+}
+
+// processAll processes jobs on a pool of p.config.Jobs workers. handle is
+// called from the calling goroutine, one job at a time and in the order of
+// jobs, regardless of the order the workers finish in. In ContinueOnError
+// mode failed jobs are passed to handle along with their error. Otherwise,
+// once a job fails no new jobs are started and the errors of all failed
+// jobs are returned together. No new jobs are started once ctx is done.
+func (p *Preprocessor) processAll(ctx context.Context, jobs []preprocessJob, store objstore.ObjectStore, handle func(preprocessJob, *metadata.EpisodeMetadata, error) error) error {
+	workers := p.config.Jobs
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+
+	jobCh := make(chan int)
+	resultCh := make(chan preprocessResult)
+	done := make(chan struct{})
+	var closeDone sync.Once
+	halt := func() { closeDone.Do(func() { close(done) }) }
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobCh {
+				// The feeder may have handed out a job just before a
+				// failure stopped it
+				select {
+				case <-done:
+					continue
+				default:
+				}
+
+				job := jobs[idx]
+				log.Info().Str("path", job.path).Str("show", job.show).Int("season", job.season).Int("episode", job.episode).Msg("processing file")
+				md, err := p.processFile(ctx, job, store)
+				if err != nil && !p.config.ContinueOnError {
+					halt()
+				}
+				resultCh <- preprocessResult{index: idx, job: job, metadata: md, err: err}
+			}
+		}()
+	}
+
+	// Feed the workers until all jobs are handed out or a job fails
+	go func() {
+		defer close(jobCh)
+		for idx := range jobs {
+			select {
+			case jobCh <- idx:
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(resultCh)
+	}()
+
+	// Results are buffered until every job before them has been handled
+	results := make([]*preprocessResult, len(jobs))
+	next := 0
+	stopped := false
+	var errs []error
+	stop := func(err error) {
+		errs = append(errs, err)
+		stopped = true
+		halt()
+	}
+
+	for result := range resultCh {
+		result := result
+		if result.err != nil && !p.config.ContinueOnError {
+			stop(fmt.Errorf("error processing file %s: %w", result.job.path, result.err))
+		}
+		results[result.index] = &result
+
+		for !stopped && next < len(results) && results[next] != nil {
+			err := handle(results[next].job, results[next].metadata, results[next].err)
+			results[next] = nil
+			next++
+			if err != nil {
+				stop(err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (p *Preprocessor) processFile(ctx context.Context, job preprocessJob, store objstore.ObjectStore) (*metadata.EpisodeMetadata, error) {
+	inputFilePath := job.path
+
+	probeCtx, cancel := withTimeout(ctx, "ffprobe", p.config.ProbeTimeout)
+	streams, probeStr, err := ProbeStreams(probeCtx, p.config.Runner, inputFilePath)
+	cancel()
+	if err != nil && probeStr != "" {
 		return nil, &PreprocessorError{
-			Msg:           fmt.Sprintf("error unmarshalling ffprobe output: %v", err),
+			Msg:           err.Error(),
 			ffprobeOutput: probeStr,
 		}
 	}
+	if err != nil {
+		return nil, err
+	}
 
-	// Find the english subtitle stream
-	subtitlesStream := -1
+	// Find the subtitle streams and sidecar files
+	sidecars, err := p.findSidecarSubtitles(inputFilePath)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint, err := sourceFingerprint(inputFilePath, sidecars)
+	if err != nil {
+		return nil, err
+	}
+	subtitleTracks := p.selectSubtitleTracks(p.embeddedSubtitleTracks(streams), sidecars)
 	videoStream := -1
-	for _, stream := range probe.Streams {
-		if stream.CodecType == "subtitle" && stream.Tags.Language == "eng" {
-			subtitlesStream = stream.Index
-			break
-		}
+	for _, stream := range streams {
 		if stream.CodecType == "video" {
 			videoStream = stream.Index
+			break
 		}
 	}
 
-	if subtitlesStream == -1 {
+	if len(subtitleTracks) == 0 {
 		return nil, &PreprocessorError{
-			Msg:           "could not find english subtitle stream",
+			Msg:           fmt.Sprintf("could not find a text subtitle stream or sidecar file in %s", p.subtitleLanguagesDescription()),
 			ffprobeOutput: probeStr,
 		}
 	}
@@ -206,67 +628,70 @@ func (p *Preprocessor) processFile(inputFilePath string, outputDir string, seaso
 		}
 	}
 
-	epKey := fmt.Sprintf("%02d/%02d", season, episode)
+	epKey := fmt.Sprintf("%s/%02d/%02d", job.show, job.season, job.episode)
 	episodeMetadataKey := fmt.Sprintf("internal/%s/%s", epKey, EpisodeMetadataFilename)
-	subtitlesOutputKey := fmt.Sprintf("internal/%s/subtitles.srt", epKey)
+	subtitlesOutputKeys := map[string]string{}
+	for _, track := range subtitleTracks {
+		subtitlesOutputKeys[track.language] = fmt.Sprintf("internal/%s/subtitles.%s.srt", epKey, track.language)
+	}
 	downscaleOutputKey := fmt.Sprintf("internal/%s/downscale_%d_%d.mkv", epKey, p.config.Downscaler.Width, p.config.Downscaler.Height)
 
 	// Extract the season and episode number from the file name
 	episodeMetadata := &metadata.EpisodeMetadata{
-		Season:       season,
-		Episode:      episode,
+		Show:         job.show,
+		ShowName:     job.showName,
+		Season:       job.season,
+		Episode:      job.episode,
+		Kind:         job.kind,
+		Title:        job.title,
 		VideoFileKey: downscaleOutputKey,
-		SubsFileKey:  subtitlesOutputKey,
-	}
+		SubsFileKey:  subtitlesOutputKeys[subtitleTracks[0].language],
+		SubsFileKeys: subtitlesOutputKeys,
 
-	// Write the episode metadata to a file
-	episodeMetadataPath := path.Join(outputDir, episodeMetadataKey)
+		SourceFingerprint: fingerprint,
+	}
 
-	// Check if the episode has already been processed
-	if _, err := os.Stat(episodeMetadataPath); err == nil {
+	// Check if the episode has already been processed from the same source
+	cached, err := readEpisodeMetadata(store, episodeMetadataKey)
+	if err == nil && cached.SourceFingerprint == fingerprint && cached.VideoFileKey == downscaleOutputKey {
 		log.Info().Str("path", inputFilePath).Msg("episode already processed")
-		episodeMetadataFile, err := os.Open(episodeMetadataPath)
-		if err != nil {
-			return nil, fmt.Errorf("error opening episode metadata file: %v", err)
-		}
-		defer episodeMetadataFile.Close()
-
-		episodeMetadataBytes, err := io.ReadAll(episodeMetadataFile)
-		if err != nil {
-			return nil, fmt.Errorf("error reading episode metadata file: %v", err)
-		}
-
-		err = json.Unmarshal(episodeMetadataBytes, episodeMetadata)
-		if err != nil {
-			return nil, fmt.Errorf("error unmarshalling episode metadata: %v", err)
-		}
-
-		return episodeMetadata, nil
+		return cached, nil
+	} else if err == nil {
+		log.Info().Str("path", inputFilePath).Msg("episode source changed, processing it again")
+	} else if !errors.Is(err, objstore.ErrNotExist) {
+		return nil, err
 	}
 
-	// Ensure the output directories exist
-	err = os.MkdirAll(fmt.Sprintf("%s/internal/%s", outputDir, epKey), 0755)
+	// ffmpeg writes its outputs to a local working directory, they are
+	// uploaded to the object store once the episode is fully processed.
+	workDir, err := os.MkdirTemp("", "clyper-preprocess")
 	if err != nil {
-		return nil, fmt.Errorf("error creating internal output directory: %v", err)
+		return nil, fmt.Errorf("error creating working directory: %v", err)
 	}
+	defer os.RemoveAll(workDir)
 
-	err = os.MkdirAll(fmt.Sprintf("%s/public/%s", outputDir, epKey), 0755)
+	thumbDir := path.Join(workDir, "thumbs")
+	err = os.MkdirAll(thumbDir, 0755)
 	if err != nil {
-		return nil, fmt.Errorf("error creating public output directory: %v", err)
+		return nil, fmt.Errorf("error creating thumbnail directory: %v", err)
 	}
 
-	downscaleOutputPath := path.Join(outputDir, downscaleOutputKey)
+	downscaleOutputPath := path.Join(workDir, path.Base(downscaleOutputKey))
 
 	input := ffmpeg_go.Input(inputFilePath)
 	downscaleFilter := input.Filter("scale", ffmpeg_go.Args{fmt.Sprintf("%d:%d", p.config.Downscaler.Width, p.config.Downscaler.Height)})
 	downscaleSplit := downscaleFilter.Split()
-	downscaleOutput := downscaleSplit.Get("0").Output(
+	// The first audio track is kept for clips rendered with their sound,
+	// the ? keeps videos without audio from failing
+	downscaleOutput := ffmpeg_go.Output(
+		[]*ffmpeg_go.Stream{downscaleSplit.Get("0"), input.Get("a:0?")},
 		downscaleOutputPath,
 		ffmpeg_go.KwArgs{
-			"an":     "",
 			"c:v":    "libx264",
 			"crf":    "18",
 			"preset": "fast",
+			"c:a":    "aac",
+			"b:a":    "128k",
 		})
 	thumbnailsOutput := downscaleSplit.Get("1").Filter(
 		"fps",
@@ -279,24 +704,51 @@ func (p *Preprocessor) processFile(inputFilePath string, outputDir string, seaso
 			fmt.Sprintf("%d:%d", p.config.Thumbnailer.Width, p.config.Thumbnailer.Height),
 		},
 	).Output(
-		path.Join(outputDir, fmt.Sprintf("public/%s/_thumb_%%08d.jpg", epKey)),
+		path.Join(thumbDir, "_thumb_%08d.jpg"),
 		ffmpeg_go.KwArgs{
 			"q:v": "1",
 		},
 	)
 
-	subtitlesOutputPath := path.Join(outputDir, subtitlesOutputKey)
-	subtitlesOutput := input.Get(fmt.Sprintf("%d", subtitlesStream)).Output(subtitlesOutputPath)
+	outputs := []*ffmpeg_go.Stream{downscaleOutput, thumbnailsOutput}
+	for _, track := range subtitleTracks {
+		subtitlesOutputPath := path.Join(workDir, path.Base(subtitlesOutputKeys[track.language]))
+		if track.sidecarPath != "" {
+			log.Info().Str("path", track.sidecarPath).Str("language", track.language).Msg("using sidecar subtitles")
+			err = convertSidecarSubtitles(track.sidecarPath, subtitlesOutputPath)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if bitmapSubtitleCodecs[track.codec] {
+			err = p.ocrSubtitleTrack(ctx, inputFilePath, track, workDir, subtitlesOutputPath)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		outputs = append(outputs, input.Get(fmt.Sprintf("%d", track.index)).Output(subtitlesOutputPath))
+	}
 
-	err = ffmpeg_go.MergeOutputs(downscaleOutput, thumbnailsOutput, subtitlesOutput).OverWriteOutput().ErrorToStdOut().Run()
+	ffmpegCtx, cancel := withTimeout(ctx, "ffmpeg", p.config.FFmpegTimeout)
+	defer cancel()
+	err = p.config.Runner.Run(ffmpegCtx, ffmpeg_go.MergeOutputs(outputs...).OverWriteOutput(), 0)
+	if nothingEncoded(err) {
+		// A subtitle track without any cues, the other outputs were written
+		err = nil
+	}
+	if ctx.Err() != nil {
+		return nil, context.Cause(ctx)
+	}
 	if err != nil {
 		return nil, &PreprocessorError{
 			Msg: fmt.Sprintf("failed to run ffmpeg on %s: %v", inputFilePath, err),
+			err: err,
 		}
 	}
 
-	// Rename the thumbnails to include the timestamp and remove the leading underscore
-	thumbDir := fmt.Sprintf("%s/public/%s", outputDir, epKey)
+	// Upload the thumbnails under a name that includes the timestamp
 	files, err := os.ReadDir(thumbDir)
 	if err != nil {
 		return nil, fmt.Errorf("error listing files in output directory: %v", err)
@@ -317,16 +769,14 @@ func (p *Preprocessor) processFile(inputFilePath string, outputDir string, seaso
 			if err != nil {
 				return nil, fmt.Errorf("error converting frame number to integer: %v", err)
 			}
-			// Rename the files to include the timestamp and remove the leading underscore
 			ts := (iFrameNum * 1000) / p.config.Thumbnailer.FramesPerSecond
 			key := fmt.Sprintf("public/%s/thumb_%08d.jpg", epKey, ts)
-			newName := path.Join(outputDir, key)
 
-			log.Info().Str("old", file.Name()).Str("new", key).Msg("renaming thumbnail")
+			log.Info().Str("file", file.Name()).Str("key", key).Msg("uploading thumbnail")
 
-			err = os.Rename(path.Join(thumbDir, file.Name()), newName)
+			err = objstore.PutFile(store, key, path.Join(thumbDir, file.Name()))
 			if err != nil {
-				return nil, fmt.Errorf("error renaming file: %v", err)
+				return nil, fmt.Errorf("error uploading thumbnail: %v", err)
 			}
 
 			// Add the file names to the thumbnails slice
@@ -339,25 +789,33 @@ func (p *Preprocessor) processFile(inputFilePath string, outputDir string, seaso
 	}
 	episodeMetadata.Thumbs = thumbnails
 
-	subtitleMetadata, err := subtitleMetadata(subtitlesOutputPath, p.config.Thumbnailer.FramesPerSecond)
-	if err != nil {
-		return nil, fmt.Errorf("error extracting subtitle metadata: %v", err)
-	}
+	for _, track := range subtitleTracks {
+		subtitlesOutputPath := path.Join(workDir, path.Base(subtitlesOutputKeys[track.language]))
+		subtitleMetadata, err := subtitleMetadata(subtitlesOutputPath, track.language, p.config.Thumbnailer.FramesPerSecond)
+		if err != nil {
+			return nil, fmt.Errorf("error extracting %s subtitle metadata: %v", track.language, err)
+		}
+		episodeMetadata.Subtitles = append(episodeMetadata.Subtitles, subtitleMetadata...)
 
-	episodeMetadata.Subtitles = subtitleMetadata
+		err = objstore.PutFile(store, subtitlesOutputKeys[track.language], subtitlesOutputPath)
+		if err != nil {
+			return nil, fmt.Errorf("error uploading %s subtitles: %v", track.language, err)
+		}
+	}
 
-	episodeMetadataFile, err := os.Create(episodeMetadataPath)
+	err = objstore.PutFile(store, downscaleOutputKey, downscaleOutputPath)
 	if err != nil {
-		return nil, fmt.Errorf("error creating episode metadata file: %v", err)
+		return nil, fmt.Errorf("error uploading downscaled video: %v", err)
 	}
-	defer episodeMetadataFile.Close()
 
 	episodeMetadataBytes, err := json.Marshal(episodeMetadata)
 	if err != nil {
 		return nil, fmt.Errorf("error marshalling episode metadata: %v", err)
 	}
 
-	_, err = episodeMetadataFile.Write(episodeMetadataBytes)
+	// The metadata file is written last, its presence marks the episode as
+	// fully processed.
+	err = store.Put(episodeMetadataKey, bytes.NewReader(episodeMetadataBytes))
 	if err != nil {
 		return nil, fmt.Errorf("error writing episode metadata: %v", err)
 	}
@@ -365,28 +823,54 @@ func (p *Preprocessor) processFile(inputFilePath string, outputDir string, seaso
 	return episodeMetadata, nil
 }
 
-var episodeRegex = regexp.MustCompile(`S(\d+)E(\d+)`)
-
-func extractSeasonAndEpisode(inputFilePath string) (int, int, error) {
-	matches := episodeRegex.FindStringSubmatch(inputFilePath)
-	if len(matches) != 3 {
-		return 0, 0, fmt.Errorf("could not extract season and episode number from file name")
+// readEpisodeMetadata reads the episode metadata file stored at key.
+func readEpisodeMetadata(store objstore.ObjectReader, key string) (*metadata.EpisodeMetadata, error) {
+	episodeMetadataFile, err := store.Open(key)
+	if errors.Is(err, objstore.ErrNotExist) {
+		return nil, err
 	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening episode metadata file: %v", err)
+	}
+	defer episodeMetadataFile.Close()
 
-	season, err := strconv.Atoi(matches[1])
+	episodeMetadataBytes, err := io.ReadAll(episodeMetadataFile)
 	if err != nil {
-		return 0, 0, fmt.Errorf("error converting season number to integer: %v", err)
+		return nil, fmt.Errorf("error reading episode metadata file: %v", err)
 	}
 
-	episode, err := strconv.Atoi(matches[2])
+	episodeMetadata := &metadata.EpisodeMetadata{}
+	err = json.Unmarshal(episodeMetadataBytes, episodeMetadata)
 	if err != nil {
-		return 0, 0, fmt.Errorf("error converting episode number to integer: %v", err)
+		return nil, fmt.Errorf("error unmarshalling episode metadata: %v", err)
+	}
+	return episodeMetadata, nil
+}
+
+// sourceFingerprint identifies the current version of the video at
+// videoPath and its sidecar subtitle files by their names, sizes and
+// modification times, which change whenever a file is edited or replaced.
+// Hashing the contents would catch more, but means reading every video in
+// full on each incremental run.
+func sourceFingerprint(videoPath string, sidecars []subtitleTrack) (string, error) {
+	paths := []string{videoPath}
+	for _, track := range sidecars {
+		paths = append(paths, track.sidecarPath)
 	}
+	sort.Strings(paths[1:])
 
-	return season, episode, nil
+	h := sha256.New()
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return "", fmt.Errorf("error reading source file: %v", err)
+		}
+		fmt.Fprintf(h, "%s\t%d\t%d\n", filepath.Base(p), fi.Size(), fi.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func subtitleMetadata(subtitlesPath string, framesPerSecond int) ([]metadata.SubtitleMetadata, error) {
+func subtitleMetadata(subtitlesPath string, language string, framesPerSecond int) ([]metadata.SubtitleMetadata, error) {
 	subtitlesFile, err := os.Open(subtitlesPath)
 	if err != nil {
 		return nil, fmt.Errorf("error opening subtitles file: %v", err)
@@ -419,9 +903,10 @@ func subtitleMetadata(subtitlesPath string, framesPerSecond int) ([]metadata.Sub
 		text := textBuilder.String()
 
 		subtitleMetadata = append(subtitleMetadata, metadata.SubtitleMetadata{
-			Start: int(startTime),
-			End:   int(endTime),
-			Text:  text,
+			Start:    int(startTime),
+			End:      int(endTime),
+			Text:     text,
+			Language: language,
 		})
 	}
 
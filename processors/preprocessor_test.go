@@ -0,0 +1,714 @@
+package processor
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jaym/clyper/metadata"
+	"github.com/jaym/clyper/objstore"
+)
+
+// requireFTS5 skips tests that build a metadata database when go-sqlite3
+// was built without FTS5, which needs the fts5 build tag.
+func requireFTS5(t *testing.T) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec("CREATE VIRTUAL TABLE probe USING fts5(text)")
+	if err != nil && strings.Contains(err.Error(), "no such module") {
+		t.Skip("sqlite was built without FTS5, run the tests with -tags fts5")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testProbeOutput is the ffprobe output of a video with an English SRT
+// subtitle stream.
+const testProbeOutput = `{
+	"streams": [
+		{"index": 0, "codec_type": "video", "codec_name": "h264"},
+		{"index": 1, "codec_type": "audio", "codec_name": "aac"},
+		{"index": 2, "codec_type": "subtitle", "codec_name": "subrip", "tags": {"language": "eng"}}
+	],
+	"format": {"duration": "10.000000"}
+}`
+
+// writeFakeOutputs writes the files an ffmpeg run with args would have. The
+// subtitles say what the input file contains, so tests can tell which
+// version of a file was processed.
+func writeFakeOutputs(args []string) error {
+	var input string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-i" && i+1 < len(args) {
+			i++
+			input = args[i]
+			continue
+		}
+		if !filepath.IsAbs(arg) {
+			continue
+		}
+
+		var err error
+		switch {
+		case strings.Contains(arg, "%08d"):
+			for frame := 1; frame <= 2; frame++ {
+				err = os.WriteFile(fmt.Sprintf(arg, frame), []byte("jpg"), 0644)
+				if err != nil {
+					break
+				}
+			}
+		case strings.HasSuffix(arg, ".srt"):
+			var content []byte
+			content, err = os.ReadFile(input)
+			if err == nil {
+				err = os.WriteFile(arg, []byte(fmt.Sprintf("1\n00:00:01,000 --> 00:00:02,000\n%s\n\n", content)), 0644)
+			}
+		default:
+			err = os.WriteFile(arg, []byte("video"), 0644)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newFakeVideoRunner() *FakeRunner {
+	return &FakeRunner{
+		ProbeFunc: func(fileName string, args []string) (string, error) {
+			return testProbeOutput, nil
+		},
+		RunFunc: writeFakeOutputs,
+	}
+}
+
+// writeVideo writes a fake video at name below dir. Its content ends up in
+// the subtitles of the episode.
+func writeVideo(t *testing.T, dir string, name string, content string) string {
+	t.Helper()
+
+	p := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// ranFFmpegOn returns the base names of the inputs of the ffmpeg runs
+// recorded by runner, sorted.
+func ranFFmpegOn(runner *FakeRunner) []string {
+	var inputs []string
+	for _, call := range runner.Calls() {
+		if call.Program != "ffmpeg" {
+			continue
+		}
+		for i, arg := range call.Args {
+			if arg == "-i" && i+1 < len(call.Args) {
+				inputs = append(inputs, filepath.Base(call.Args[i+1]))
+				break
+			}
+		}
+	}
+	sort.Strings(inputs)
+	return inputs
+}
+
+// episodeSubtitles returns the English subtitles of every episode of the
+// default show in the database in store, keyed by "S01E02".
+func episodeSubtitles(t *testing.T, store *objstore.LocalFSObjectStore) map[string]string {
+	t.Helper()
+
+	dbPath, err := store.Path(metadata.DefaultDatabaseKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := metadata.OpenDatabase(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	episodes, err := db.ListEpisodes(ctx, metadata.DefaultShowSlug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := map[string]string{}
+	for _, ep := range episodes {
+		subs, err := db.ListSubtitles(ctx, metadata.DefaultShowSlug, ep.Season, ep.Episode, metadata.DefaultLanguage, 0, 1000000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var texts []string
+		for _, s := range subs {
+			texts = append(texts, strings.TrimSpace(s.Text))
+		}
+		results[fmt.Sprintf("S%02dE%02d", ep.Season, ep.Episode)] = strings.Join(texts, "|")
+	}
+	return results
+}
+
+func TestPreprocessorIncremental(t *testing.T) {
+	requireFTS5(t)
+
+	inputDir := t.TempDir()
+	store := objstore.NewLocalFSObjectStore(t.TempDir())
+	ctx := context.Background()
+
+	process := func() *FakeRunner {
+		t.Helper()
+		runner := newFakeVideoRunner()
+		p, err := NewPreprocessor(PreprocessorConfig{Incremental: true, Runner: runner})
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := p.Process(ctx, inputDir, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Processed != countVideos(t, inputDir) {
+			t.Fatalf("unexpected report %+v", report)
+		}
+		return runner
+	}
+
+	writeVideo(t, inputDir, "Show.S01E01.mkv", "first")
+	writeVideo(t, inputDir, "Show.S01E02.mkv", "second")
+	runner := process()
+	if got, want := ranFFmpegOn(runner), []string{"Show.S01E01.mkv", "Show.S01E02.mkv"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("first run processed %q, want %q", got, want)
+	}
+	if got, want := episodeSubtitles(t, store), map[string]string{"S01E01": "first", "S01E02": "second"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("database has %q, want %q", got, want)
+	}
+
+	// Nothing changed, so nothing is encoded again
+	runner = process()
+	if got := ranFFmpegOn(runner); len(got) != 0 {
+		t.Errorf("unchanged run processed %q", got)
+	}
+
+	// Replace E01, remove E02 and add E03. The replacement has the same
+	// size, only its modification time tells it apart.
+	e01 := writeVideo(t, inputDir, "Show.S01E01.mkv", "FIRST")
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(e01, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(inputDir, "Show.S01E02.mkv")); err != nil {
+		t.Fatal(err)
+	}
+	writeVideo(t, inputDir, "Show.S01E03.mkv", "third")
+
+	runner = process()
+	if got, want := ranFFmpegOn(runner), []string{"Show.S01E01.mkv", "Show.S01E03.mkv"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("changed run processed %q, want %q", got, want)
+	}
+	if got, want := episodeSubtitles(t, store), map[string]string{"S01E01": "FIRST", "S01E03": "third"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("database has %q, want %q", got, want)
+	}
+
+	// A new sidecar subtitle file changes the source of its episode too
+	err := os.WriteFile(filepath.Join(inputDir, "Show.S01E03.fr.srt"), []byte("1\n00:00:01,000 --> 00:00:02,000\ntroisième\n\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner = process()
+	if got, want := ranFFmpegOn(runner), []string{"Show.S01E03.mkv"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("run after adding a sidecar processed %q, want %q", got, want)
+	}
+}
+
+func countVideos(t *testing.T, dir string) int {
+	t.Helper()
+
+	matches, err := filepath.Glob(filepath.Join(dir, "*.mkv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(matches)
+}
+
+func TestSourceFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	video := writeVideo(t, dir, "Show.S01E01.mkv", "video")
+	sidecar := writeVideo(t, dir, "Show.S01E01.en.srt", "subs")
+	tracks := []subtitleTrack{{index: -1, sidecarPath: sidecar}}
+
+	base, err := sourceFingerprint(video, tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := sourceFingerprint(video, tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base != again {
+		t.Errorf("fingerprint of unchanged files changed from %s to %s", base, again)
+	}
+
+	withoutSidecar, err := sourceFingerprint(video, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if withoutSidecar == base {
+		t.Errorf("fingerprint ignores sidecar files")
+	}
+
+	writeVideo(t, dir, "Show.S01E01.en.srt", "longer subs")
+	edited, err := sourceFingerprint(video, tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited == base {
+		t.Errorf("fingerprint did not change when a sidecar was edited")
+	}
+
+	if _, err := sourceFingerprint(filepath.Join(dir, "missing.mkv"), nil); err == nil {
+		t.Errorf("fingerprint of a missing file succeeded")
+	}
+}
+
+// newTestJobs writes a fake video for each of count episodes of season 1
+// and returns the jobs to process them.
+func newTestJobs(t *testing.T, count int) []preprocessJob {
+	t.Helper()
+
+	dir := t.TempDir()
+	var jobs []preprocessJob
+	for i := 1; i <= count; i++ {
+		name := fmt.Sprintf("Show.S01E%02d.mkv", i)
+		jobs = append(jobs, preprocessJob{
+			path:     writeVideo(t, dir, name, name),
+			show:     metadata.DefaultShowSlug,
+			showName: metadata.DefaultShowSlug,
+			season:   1,
+			episode:  i,
+			kind:     metadata.KindEpisode,
+		})
+	}
+	return jobs
+}
+
+func TestProcessAllHandlesJobsInOrder(t *testing.T) {
+	const jobCount = 6
+	const workers = 3
+	jobs := newTestJobs(t, jobCount)
+
+	// Earlier episodes take longer, so the workers finish out of order
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	var finished []int
+	runner := &FakeRunner{
+		ProbeFunc: func(fileName string, args []string) (string, error) {
+			return testProbeOutput, nil
+		},
+		RunFunc: func(args []string) error {
+			ep := episodeOfArgs(args)
+			mu.Lock()
+			running++
+			maxRunning = max(maxRunning, running)
+			mu.Unlock()
+
+			time.Sleep(time.Duration(jobCount-ep) * 10 * time.Millisecond)
+
+			mu.Lock()
+			running--
+			finished = append(finished, ep)
+			mu.Unlock()
+			return writeFakeOutputs(args)
+		},
+	}
+	p, err := NewPreprocessor(PreprocessorConfig{Jobs: workers, Runner: runner})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var handled []int
+	store := objstore.NewLocalFSObjectStore(t.TempDir())
+	err = p.processAll(context.Background(), jobs, store, func(job preprocessJob, md *metadata.EpisodeMetadata, err error) error {
+		if err != nil {
+			t.Errorf("episode %d failed: %v", job.episode, err)
+		}
+		if md.Episode != job.episode {
+			t.Errorf("job for episode %d was handled with the metadata of episode %d", job.episode, md.Episode)
+		}
+		handled = append(handled, job.episode)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int{1, 2, 3, 4, 5, 6}; !reflect.DeepEqual(handled, want) {
+		t.Errorf("handled episodes %v, want %v", handled, want)
+	}
+	if sort.IntsAreSorted(finished) {
+		t.Errorf("workers finished in order %v, the test did not exercise reordering", finished)
+	}
+	if maxRunning != workers {
+		t.Errorf("%d files were processed at once, want %d", maxRunning, workers)
+	}
+}
+
+func TestProcessAllStopsOnFirstError(t *testing.T) {
+	jobs := newTestJobs(t, 6)
+	runner := &FakeRunner{
+		ProbeFunc: func(fileName string, args []string) (string, error) {
+			if strings.Contains(fileName, "E02") {
+				return "", errors.New("probe failed")
+			}
+			return testProbeOutput, nil
+		},
+		RunFunc: writeFakeOutputs,
+	}
+	p, err := NewPreprocessor(PreprocessorConfig{Runner: runner})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var handled []int
+	store := objstore.NewLocalFSObjectStore(t.TempDir())
+	err = p.processAll(context.Background(), jobs, store, func(job preprocessJob, md *metadata.EpisodeMetadata, err error) error {
+		handled = append(handled, job.episode)
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "Show.S01E02.mkv: probe failed") {
+		t.Fatalf("processAll returned %v", err)
+	}
+	if want := []int{1}; !reflect.DeepEqual(handled, want) {
+		t.Errorf("handled episodes %v, want %v", handled, want)
+	}
+	// With a single worker nothing after the failed file is started
+	if got := ranFFmpegOn(runner); !reflect.DeepEqual(got, []string{"Show.S01E01.mkv"}) {
+		t.Errorf("ran ffmpeg on %q after the failure", got)
+	}
+}
+
+func TestProcessAllStopsOnHandlerError(t *testing.T) {
+	jobs := newTestJobs(t, 3)
+	p, err := NewPreprocessor(PreprocessorConfig{Runner: newFakeVideoRunner()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errHandle := errors.New("database is full")
+	var handled []int
+	store := objstore.NewLocalFSObjectStore(t.TempDir())
+	err = p.processAll(context.Background(), jobs, store, func(job preprocessJob, md *metadata.EpisodeMetadata, err error) error {
+		handled = append(handled, job.episode)
+		return errHandle
+	})
+	if !errors.Is(err, errHandle) {
+		t.Fatalf("processAll returned %v, want the handler's error", err)
+	}
+	if want := []int{1}; !reflect.DeepEqual(handled, want) {
+		t.Errorf("handled episodes %v, want %v", handled, want)
+	}
+}
+
+// episodeOfArgs returns the episode number of the input of an ffmpeg run.
+func episodeOfArgs(args []string) int {
+	for i, arg := range args {
+		if arg == "-i" && i+1 < len(args) {
+			var season, episode int
+			fmt.Sscanf(filepath.Base(args[i+1]), "Show.S%02dE%02d.mkv", &season, &episode) // nolint: errcheck
+			return episode
+		}
+	}
+	return 0
+}
+
+// failingRunner fails ffmpeg for E02 with a missing encoder and returns
+// ffprobe output that is not JSON for E03.
+func failingRunner() *FakeRunner {
+	return &FakeRunner{
+		ProbeFunc: func(fileName string, args []string) (string, error) {
+			if strings.Contains(fileName, "E03") {
+				return "not json", nil
+			}
+			return testProbeOutput, nil
+		},
+		RunFunc: func(args []string) error {
+			if episodeOfArgs(args) == 2 {
+				return &FFmpegError{
+					Args:     append([]string{"ffmpeg"}, args...),
+					ExitCode: 1,
+					Stderr:   "Unknown encoder 'libx264'",
+					Message:  "Unknown encoder 'libx264'",
+					Kind:     FFmpegErrorMissingCodec,
+				}
+			}
+			return writeFakeOutputs(args)
+		},
+	}
+}
+
+func TestProcessContinueOnError(t *testing.T) {
+	requireFTS5(t)
+
+	inputDir := t.TempDir()
+	for i := 1; i <= 3; i++ {
+		writeVideo(t, inputDir, fmt.Sprintf("Show.S01E%02d.mkv", i), fmt.Sprintf("episode %d", i))
+	}
+	store := objstore.NewLocalFSObjectStore(t.TempDir())
+
+	p, err := NewPreprocessor(PreprocessorConfig{Jobs: 3, ContinueOnError: true, Runner: failingRunner()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := p.Process(context.Background(), inputDir, store)
+	// ErrFilesFailed is what makes `preprocess run` exit with status 2
+	if !errors.Is(err, ErrFilesFailed) {
+		t.Fatalf("Process returned %v, want ErrFilesFailed", err)
+	}
+	if err.Error() != "some files failed to process: 2 of 3" {
+		t.Errorf("Process returned %q", err)
+	}
+
+	if report.Processed != 1 || len(report.Failed) != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	codec, probe := report.Failed[0], report.Failed[1]
+	if codec.Episode != 2 || codec.FFmpegError != FFmpegErrorMissingCodec || codec.FFmpegStderr != "Unknown encoder 'libx264'" {
+		t.Errorf("unexpected failure for E02: %+v", codec)
+	}
+	if !strings.HasSuffix(codec.Path, "Show.S01E02.mkv") || codec.Show != metadata.DefaultShowSlug || codec.Season != 1 {
+		t.Errorf("unexpected failure for E02: %+v", codec)
+	}
+	if probe.Episode != 3 || probe.FFProbeOutput != "not json" || probe.FFmpegError != "" {
+		t.Errorf("unexpected failure for E03: %+v", probe)
+	}
+
+	// The database is built from the files that succeeded
+	if got, want := episodeSubtitles(t, store), map[string]string{"S01E01": "episode 1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("database has %q, want %q", got, want)
+	}
+}
+
+func TestProcessContinueOnErrorKeepsPreviousVersion(t *testing.T) {
+	requireFTS5(t)
+
+	inputDir := t.TempDir()
+	e02 := writeVideo(t, inputDir, "Show.S01E02.mkv", "old")
+	store := objstore.NewLocalFSObjectStore(t.TempDir())
+
+	p, err := NewPreprocessor(PreprocessorConfig{Incremental: true, ContinueOnError: true, Runner: newFakeVideoRunner()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.Process(context.Background(), inputDir, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new version of E02 fails, the database keeps the old one
+	writeVideo(t, inputDir, "Show.S01E02.mkv", "new version")
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(e02, later, later); err != nil {
+		t.Fatal(err)
+	}
+	p, err = NewPreprocessor(PreprocessorConfig{Incremental: true, ContinueOnError: true, Runner: failingRunner()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := p.Process(context.Background(), inputDir, store)
+	if !errors.Is(err, ErrFilesFailed) || len(report.Failed) != 1 {
+		t.Fatalf("Process returned %v, %+v", err, report)
+	}
+	if got, want := episodeSubtitles(t, store), map[string]string{"S01E02": "old"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("database has %q, want %q", got, want)
+	}
+}
+
+func TestProcessAbortsOnError(t *testing.T) {
+	requireFTS5(t)
+
+	inputDir := t.TempDir()
+	for i := 1; i <= 3; i++ {
+		writeVideo(t, inputDir, fmt.Sprintf("Show.S01E%02d.mkv", i), fmt.Sprintf("episode %d", i))
+	}
+	store := objstore.NewLocalFSObjectStore(t.TempDir())
+
+	runner := failingRunner()
+	p, err := NewPreprocessor(PreprocessorConfig{Runner: runner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := p.Process(context.Background(), inputDir, store)
+	if err == nil || errors.Is(err, ErrFilesFailed) {
+		t.Fatalf("Process returned %v, want an error other than ErrFilesFailed", err)
+	}
+	var ffmpegErr *FFmpegError
+	if !errors.As(err, &ffmpegErr) || ffmpegErr.Kind != FFmpegErrorMissingCodec {
+		t.Errorf("Process returned %v, want it to wrap the ffmpeg error", err)
+	}
+	if len(report.Failed) != 0 {
+		t.Errorf("aborted run reported failures %+v", report.Failed)
+	}
+	for _, call := range runner.Calls() {
+		if strings.Contains(strings.Join(call.Args, " "), "E03") {
+			t.Errorf("%s was run on E03 after E02 failed", call.Program)
+		}
+	}
+	if _, err := store.Stat(metadata.DefaultDatabaseKey); !errors.Is(err, objstore.ErrNotExist) {
+		t.Errorf("aborted run wrote a database: %v", err)
+	}
+}
+
+func TestPreprocessorEmptySubtitleTrack(t *testing.T) {
+	requireFTS5(t)
+
+	inputDir := t.TempDir()
+	writeVideo(t, inputDir, "Show.S01E01.mkv", "first")
+	store := objstore.NewLocalFSObjectStore(t.TempDir())
+
+	// The French track has no cues, so ffmpeg encodes nothing for it and
+	// reports that after writing the other outputs
+	runner := &FakeRunner{
+		ProbeFunc: func(fileName string, args []string) (string, error) {
+			return strings.Replace(testProbeOutput, `"language": "eng"}}`, `"language": "eng"}},
+		{"index": 3, "codec_type": "subtitle", "codec_name": "subrip", "tags": {"language": "fre"}}`, 1), nil
+		},
+		RunFunc: func(args []string) error {
+			err := writeFakeOutputs(args)
+			if err != nil {
+				return err
+			}
+			for _, arg := range args {
+				if strings.HasSuffix(arg, ".srt") && !strings.HasSuffix(arg, ".eng.srt") {
+					if err := os.WriteFile(arg, nil, 0644); err != nil {
+						return err
+					}
+				}
+			}
+			return &FFmpegError{
+				Args:    append([]string{"ffmpeg"}, args...),
+				Stderr:  "Output file is empty, nothing was encoded",
+				Message: "Output file is empty, nothing was encoded",
+				Kind:    FFmpegErrorInvalidSeek,
+			}
+		},
+	}
+	p, err := NewPreprocessor(PreprocessorConfig{Runner: runner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := p.Process(context.Background(), inputDir, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Processed != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if got, want := episodeSubtitles(t, store), map[string]string{"S01E01": "first"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("database has %q, want %q", got, want)
+	}
+}
+
+func TestPreprocessorKeepsAudioForClips(t *testing.T) {
+	requireFTS5(t)
+
+	inputDir := t.TempDir()
+	writeVideo(t, inputDir, "Show.S01E01.mkv", "first")
+	store := objstore.NewLocalFSObjectStore(t.TempDir())
+
+	runner := newFakeVideoRunner()
+	p, err := NewPreprocessor(PreprocessorConfig{Runner: runner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Process(context.Background(), inputDir, store); err != nil {
+		t.Fatal(err)
+	}
+	var preprocess []string
+	for _, call := range runner.Calls() {
+		if call.Program == "ffmpeg" {
+			preprocess = call.Args
+		}
+	}
+	mapsAudio := strings.Contains(strings.Join(preprocess, " "), "-map 0:a:0?")
+	if !mapsAudio || argValue(preprocess, "-c:a") != "aac" || slices.Contains(preprocess, "-an") {
+		t.Errorf("the downscaled video does not keep the audio: %q", preprocess)
+	}
+
+	md, err := readEpisodeMetadata(store, "internal/default/01/01/"+EpisodeMetadataFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	video, err := store.Path(md.VideoFileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clips := &FakeRunner{}
+	err = MakeClip(context.Background(), video, filepath.Join(t.TempDir(), "clip.mp4"), 1000, 3000, ClipOptions{Audio: true, Runner: clips})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := clips.Calls()[0].Args
+	if argValue(args, "-i") != video || !slices.Contains(args, "0:a?") || argValue(args, "-c:a") != "aac" {
+		t.Errorf("the clip does not keep the audio of the downscaled video: %q", args)
+	}
+}
+
+func TestProcessCancelledRemovesDatabase(t *testing.T) {
+	requireFTS5(t)
+
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	inputDir := t.TempDir()
+	writeVideo(t, inputDir, "Show.S01E01.mkv", "first")
+	store := objstore.NewLocalFSObjectStore(t.TempDir())
+
+	// A first run leaves a database for the incremental run to copy
+	p, err := NewPreprocessor(PreprocessorConfig{Incremental: true, Runner: newFakeVideoRunner()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Process(context.Background(), inputDir, store); err != nil {
+		t.Fatal(err)
+	}
+
+	writeVideo(t, inputDir, "Show.S01E02.mkv", "second")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runner := newFakeVideoRunner()
+	runner.RunFunc = func(args []string) error {
+		cancel()
+		return writeFakeOutputs(args)
+	}
+	p, err = NewPreprocessor(PreprocessorConfig{Incremental: true, Runner: runner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Process(ctx, inputDir, store); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Process returned %v, want context.Canceled", err)
+	}
+	left, err := filepath.Glob(filepath.Join(tmp, "clyper-db*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Errorf("cancelled run left %q behind", left)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package processor
+
+import "os/exec"
+
+// killProcessGroup is a no-op where process groups are not supported, cmd
+// itself is still killed when its context is done.
+func killProcessGroup(cmd *exec.Cmd) {}
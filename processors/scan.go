@@ -0,0 +1,97 @@
+package processor
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrEpisodeCollision is returned when several files map to the same
+// episode.
+var ErrEpisodeCollision = errors.New("several files map to the same episode")
+
+// ScanEntry describes what a file in the input directory maps to.
+type ScanEntry struct {
+	Path    string `json:"path"`
+	Show    string `json:"show"`
+	Season  int    `json:"season"`
+	Episode int    `json:"episode"`
+	Kind    string `json:"kind"`
+	Title   string `json:"title,omitempty"`
+	// Rule is the name of the episode rule, "title:<kind>" for title rules
+	// or "manifest" for sidecar manifests.
+	Rule string `json:"rule"`
+}
+
+// Collision lists files that map to the same episode.
+type Collision struct {
+	Show    string `json:"show"`
+	Season  int    `json:"season"`
+	Episode int    `json:"episode"`
+	// Paths are the colliding files, sorted.
+	Paths []string `json:"paths"`
+}
+
+type ScanResult struct {
+	Entries    []ScanEntry `json:"entries"`
+	Collisions []Collision `json:"collisions"`
+}
+
+// Scan reports what every recognised file in inputDir would be processed
+// as, without processing anything.
+func (p *Preprocessor) Scan(inputDir string) (*ScanResult, error) {
+	jobs, err := p.findEpisodeFiles(inputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ScanResult{
+		Entries:    make([]ScanEntry, 0, len(jobs)),
+		Collisions: findCollisions(jobs),
+	}
+	for _, job := range jobs {
+		result.Entries = append(result.Entries, ScanEntry{
+			Path:    job.path,
+			Show:    job.show,
+			Season:  job.season,
+			Episode: job.episode,
+			Kind:    job.kind,
+			Title:   job.title,
+			Rule:    job.rule,
+		})
+	}
+	return result, nil
+}
+
+// findCollisions returns the episodes more than one job maps to.
+func findCollisions(jobs []preprocessJob) []Collision {
+	paths := map[episodeID][]string{}
+	for _, job := range jobs {
+		id := episodeID{job.show, job.season, job.episode}
+		paths[id] = append(paths[id], job.path)
+	}
+
+	collisions := []Collision{}
+	for id, p := range paths {
+		if len(p) < 2 {
+			continue
+		}
+		sort.Strings(p)
+		collisions = append(collisions, Collision{
+			Show:    id.show,
+			Season:  id.season,
+			Episode: id.episode,
+			Paths:   p,
+		})
+	}
+
+	sort.Slice(collisions, func(i, j int) bool {
+		if collisions[i].Show != collisions[j].Show {
+			return collisions[i].Show < collisions[j].Show
+		}
+		if collisions[i].Season != collisions[j].Season {
+			return collisions[i].Season < collisions[j].Season
+		}
+		return collisions[i].Episode < collisions[j].Episode
+	})
+	return collisions
+}
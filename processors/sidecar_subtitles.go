@@ -0,0 +1,178 @@
+package processor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/asticode/go-astisub"
+)
+
+// SidecarSubtitlePolicy decides how subtitle files next to a video, such as
+// "Show.S01E01.en.srt" for "Show.S01E01.mkv", are combined with the
+// subtitle streams embedded in it.
+type SidecarSubtitlePolicy string
+
+const (
+	// SidecarSubtitlesFallback uses a sidecar file only for languages
+	// without an embedded stream. This is the default.
+	SidecarSubtitlesFallback SidecarSubtitlePolicy = "fallback"
+	// SidecarSubtitlesPrefer uses a sidecar file over an embedded stream of
+	// the same language.
+	SidecarSubtitlesPrefer SidecarSubtitlePolicy = "prefer"
+	// SidecarSubtitlesIgnore only uses embedded streams.
+	SidecarSubtitlesIgnore SidecarSubtitlePolicy = "ignore"
+)
+
+// sidecarSubtitleExtensions are the subtitle formats read from sidecar
+// files.
+var sidecarSubtitleExtensions = map[string]bool{
+	".srt": true,
+	".ass": true,
+	".ssa": true,
+	".vtt": true,
+}
+
+// languageCodes maps the ISO 639-1 codes and English names used in sidecar
+// file names, as well as ISO 639-2/T codes, to the ISO 639-2/B codes ffmpeg
+// tags streams with.
+var languageCodes = map[string]string{
+	"ar": "ara", "arabic": "ara",
+	"bg": "bul", "bulgarian": "bul",
+	"ca": "cat", "catalan": "cat",
+	"cs": "cze", "ces": "cze", "czech": "cze",
+	"da": "dan", "danish": "dan",
+	"de": "ger", "deu": "ger", "german": "ger",
+	"el": "gre", "ell": "gre", "greek": "gre",
+	"en": "eng", "english": "eng",
+	"es": "spa", "spanish": "spa",
+	"et": "est", "estonian": "est",
+	"fa": "per", "fas": "per", "persian": "per",
+	"fi": "fin", "finnish": "fin",
+	"fr": "fre", "fra": "fre", "french": "fre",
+	"he": "heb", "hebrew": "heb",
+	"hi": "hin", "hindi": "hin",
+	"hr": "hrv", "croatian": "hrv",
+	"hu": "hun", "hungarian": "hun",
+	"id": "ind", "indonesian": "ind",
+	"is": "ice", "isl": "ice", "icelandic": "ice",
+	"it": "ita", "italian": "ita",
+	"ja": "jpn", "japanese": "jpn",
+	"ko": "kor", "korean": "kor",
+	"lt": "lit", "lithuanian": "lit",
+	"lv": "lav", "latvian": "lav",
+	"ms": "may", "msa": "may", "malay": "may",
+	"nl": "dut", "nld": "dut", "dutch": "dut",
+	"no": "nor", "norwegian": "nor",
+	"pl": "pol", "polish": "pol",
+	"pt": "por", "portuguese": "por",
+	"ro": "rum", "ron": "rum", "romanian": "rum",
+	"ru": "rus", "russian": "rus",
+	"sk": "slo", "slk": "slo", "slovak": "slo",
+	"sl": "slv", "slovenian": "slv",
+	"sr": "srp", "serbian": "srp",
+	"sv": "swe", "swedish": "swe",
+	"th": "tha", "thai": "tha",
+	"tr": "tur", "turkish": "tur",
+	"uk": "ukr", "ukrainian": "ukr",
+	"vi": "vie", "vietnamese": "vie",
+	"zh": "chi", "zho": "chi", "chinese": "chi",
+}
+
+// sidecarFlags are file name parts that describe a subtitle file without
+// naming its language. "hi" is Hindi, not hearing impaired.
+var sidecarFlags = map[string]bool{
+	"forced":  true,
+	"sdh":     true,
+	"cc":      true,
+	"default": true,
+	"full":    true,
+}
+
+// normalizeLanguage returns the ISO 639-2/B code for a language named in a
+// sidecar file name.
+func normalizeLanguage(name string) (string, bool) {
+	name = strings.ToLower(name)
+	if sidecarFlags[name] {
+		return "", false
+	}
+	if code, ok := languageCodes[name]; ok {
+		return code, true
+	}
+	if len(name) == 3 && strings.Trim(name, "abcdefghijklmnopqrstuvwxyz") == "" {
+		return name, true
+	}
+	return "", false
+}
+
+// isSidecarFile reports whether the file at filePath accompanies a video
+// rather than being one.
+func isSidecarFile(filePath string) bool {
+	if strings.HasSuffix(filePath, ManifestSuffix) {
+		return true
+	}
+	return sidecarSubtitleExtensions[strings.ToLower(filepath.Ext(filePath))]
+}
+
+// findSidecarSubtitles returns the subtitle files next to the video at
+// videoPath. The language is taken from the file name, "Show.S01E01.en.srt"
+// and "Show.S01E01.eng.forced.srt" are English, and files without one are
+// in the configured SidecarLanguage.
+func (p *Preprocessor) findSidecarSubtitles(videoPath string) ([]subtitleTrack, error) {
+	if p.config.SidecarSubtitles == SidecarSubtitlesIgnore {
+		return nil, nil
+	}
+
+	dir := filepath.Dir(videoPath)
+	base := strings.TrimSuffix(filepath.Base(videoPath), filepath.Ext(videoPath))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error listing sidecar subtitles: %v", err)
+	}
+
+	var tracks []subtitleTrack
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if entry.IsDir() || !sidecarSubtitleExtensions[strings.ToLower(ext)] || !strings.HasPrefix(name, base+".") {
+			continue
+		}
+
+		track := subtitleTrack{
+			index:       -1,
+			language:    p.config.SidecarLanguage,
+			sidecarPath: filepath.Join(dir, name),
+		}
+		for _, part := range strings.Split(strings.TrimSuffix(name[len(base):], ext), ".") {
+			if strings.EqualFold(part, "forced") {
+				track.forced = true
+			} else if language, ok := normalizeLanguage(part); ok {
+				track.language = language
+			}
+		}
+		tracks = append(tracks, track)
+	}
+	return tracks, nil
+}
+
+// convertSidecarSubtitles converts the sidecar subtitle file at src to SRT
+// at dst, so it is stored and parsed like an extracted stream.
+func convertSidecarSubtitles(src string, dst string) error {
+	subs, err := astisub.OpenFile(src)
+	if err != nil {
+		return fmt.Errorf("error reading sidecar subtitles %s: %v", src, err)
+	}
+	if len(subs.Items) == 0 {
+		return fmt.Errorf("sidecar subtitles %s are empty", src)
+	}
+	return subs.Write(dst)
+}
+
+func validateSidecarSubtitlePolicy(policy SidecarSubtitlePolicy) error {
+	switch policy {
+	case SidecarSubtitlesFallback, SidecarSubtitlesPrefer, SidecarSubtitlesIgnore:
+		return nil
+	}
+	return fmt.Errorf("invalid sidecar subtitle policy %q", policy)
+}
@@ -0,0 +1,120 @@
+package processor
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestNormalizeLanguage(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"en", "eng", true},
+		{"EN", "eng", true},
+		{"English", "eng", true},
+		{"eng", "eng", true},
+		{"fr", "fre", true},
+		{"fra", "fre", true},
+		{"fre", "fre", true},
+		{"pt", "por", true},
+		// "hi" is Hindi, not hearing impaired
+		{"hi", "hin", true},
+		// Unknown three letter codes are taken as they are
+		{"tlh", "tlh", true},
+		{"forced", "", false},
+		{"sdh", "", false},
+		{"cc", "", false},
+		{"", "", false},
+		{"e1", "", false},
+		{"s01e01", "", false},
+		{"klingon", "", false},
+	} {
+		got, ok := normalizeLanguage(tc.name)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("normalizeLanguage(%q) = %q, %v, want %q, %v", tc.name, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestFindSidecarSubtitles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"Show.S01E01.mkv",
+		"Show.S01E01.srt",
+		"Show.S01E01.en.srt",
+		"Show.S01E01.eng.forced.ass",
+		"Show.S01E01.Spanish.vtt",
+		"Show.S01E01.fr.sdh.SSA",
+		"Show.S01E01.de.txt",
+		"Show.S01E02.en.srt",
+		"Show.S01E011.en.srt",
+		"Other.en.srt",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "Show.S01E01.it.srt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	type sidecar struct {
+		name     string
+		language string
+		forced   bool
+	}
+	find := func(t *testing.T, cfg PreprocessorConfig) []sidecar {
+		t.Helper()
+
+		p, err := NewPreprocessor(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tracks, err := p.findSidecarSubtitles(filepath.Join(dir, "Show.S01E01.mkv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sidecars []sidecar
+		for _, track := range tracks {
+			if track.index != -1 {
+				t.Errorf("%s has stream index %d", track.sidecarPath, track.index)
+			}
+			sidecars = append(sidecars, sidecar{filepath.Base(track.sidecarPath), track.language, track.forced})
+		}
+		sort.Slice(sidecars, func(i, j int) bool { return sidecars[i].name < sidecars[j].name })
+		return sidecars
+	}
+
+	t.Run("default", func(t *testing.T) {
+		want := []sidecar{
+			{"Show.S01E01.Spanish.vtt", "spa", false},
+			{"Show.S01E01.en.srt", "eng", false},
+			{"Show.S01E01.eng.forced.ass", "eng", true},
+			{"Show.S01E01.fr.sdh.SSA", "fre", false},
+			// Files without a language are in the default language the
+			// API captions with
+			{"Show.S01E01.srt", "eng", false},
+		}
+		if got := find(t, PreprocessorConfig{}); !reflect.DeepEqual(got, want) {
+			t.Errorf("sidecars = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("sidecar language", func(t *testing.T) {
+		got := find(t, PreprocessorConfig{SidecarLanguage: "SPA"})
+		if got[4] != (sidecar{"Show.S01E01.srt", "spa", false}) {
+			t.Errorf("sidecar without a language = %v, want it in spa", got[4])
+		}
+	})
+
+	t.Run("ignore", func(t *testing.T) {
+		if got := find(t, PreprocessorConfig{SidecarSubtitles: SidecarSubtitlesIgnore}); got != nil {
+			t.Errorf("sidecars = %v, want none", got)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	ffmpeg_go "github.com/u2takey/ffmpeg-go"
+)
+
+// StillFormat is the image format a still is encoded in.
+type StillFormat string
+
+const (
+	StillFormatJPEG StillFormat = "jpg"
+	StillFormatPNG  StillFormat = "png"
+)
+
+// ParseStillFormat returns the still format for a file extension, with or
+// without the leading dot.
+func ParseStillFormat(ext string) (StillFormat, error) {
+	switch strings.ToLower(strings.TrimPrefix(ext, ".")) {
+	case "jpg", "jpeg":
+		return StillFormatJPEG, nil
+	case "png":
+		return StillFormatPNG, nil
+	}
+	return "", fmt.Errorf("unsupported image format %q, expected jpg or png", ext)
+}
+
+// ContentType returns the MIME type of stills in format.
+func (f StillFormat) ContentType() string {
+	if f == StillFormatJPEG {
+		return "image/jpeg"
+	}
+	return "image/" + string(f)
+}
+
+var stillEncoderArgs = map[StillFormat]ffmpeg_go.KwArgs{
+	StillFormatJPEG: {"c:v": "mjpeg", "q:v": "2", "pix_fmt": "yuvj420p"},
+	StillFormatPNG:  {"c:v": "png"},
+}
+
+type StillOptions struct {
+	Format     StillFormat
+	TopText    string
+	BottomText string
+	FontName   string
+	FontColor  string
+	FontsDir   string
+	// Timeout caps how long the render may take. Zero means no limit.
+	Timeout time.Duration `json:"-"`
+	// Runner runs ffmpeg. Defaults to DefaultRunner.
+	Runner Runner `json:"-"`
+}
+
+// MakeStill renders the frame shown at timestamp, in milliseconds, at the
+// resolution of the video, with TopText and BottomText drawn over it in the
+// style of animation captions. ffmpeg is killed if ctx is cancelled, or with
+// a *TimeoutError once opts.Timeout has passed.
+func MakeStill(ctx context.Context, inputFile string, outputFile string, timestamp int, opts StillOptions) error {
+	if timestamp < 0 {
+		return ErrInvalidTimeRange
+	}
+
+	format := opts.Format
+	if format == "" {
+		format = StillFormatJPEG
+	}
+	encoderArgs, ok := stillEncoderArgs[format]
+	if !ok {
+		return fmt.Errorf("unsupported image format %q", format)
+	}
+
+	ctx, cancel := withTimeout(ctx, "still", opts.Timeout)
+	defer cancel()
+
+	input := ffmpeg_go.Input(inputFile, ffmpeg_go.KwArgs{
+		"ss": fmt.Sprintf("%dms", timestamp),
+	})
+
+	tmpDir, err := os.MkdirTemp("", "clyper")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	frame, err := addCaptions(input, tmpDir, "", []Caption{
+		{Start: 0, End: 60000, Text: opts.TopText, Top: true},
+		{Start: 0, End: 60000, Text: opts.BottomText},
+	}, captionStyle{
+		fontName:  opts.FontName,
+		fontColor: opts.FontColor,
+		fontsDir:  opts.FontsDir,
+	})
+	if err != nil {
+		return err
+	}
+
+	kwargs := ffmpeg_go.KwArgs{"frames:v": "1", "f": "image2", "update": "1"}
+	for k, v := range encoderArgs {
+		kwargs[k] = v
+	}
+	err = runnerOrDefault(opts.Runner).Run(ctx, frame.Output(outputFile, kwargs).OverWriteOutput(), 0)
+	if err != nil {
+		return fmt.Errorf("failed to create still: %w", err)
+	}
+	return nil
+}
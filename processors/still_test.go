@@ -0,0 +1,83 @@
+package processor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestParseStillFormat(t *testing.T) {
+	for ext, want := range map[string]StillFormat{".jpg": StillFormatJPEG, "JPEG": StillFormatJPEG, "png": StillFormatPNG} {
+		format, err := ParseStillFormat(ext)
+		if err != nil || format != want {
+			t.Errorf("ParseStillFormat(%q) = %q, %v, want %q", ext, format, err, want)
+		}
+	}
+	for _, ext := range []string{"", ".gif", "webp"} {
+		if _, err := ParseStillFormat(ext); err == nil {
+			t.Errorf("ParseStillFormat(%q) succeeded", ext)
+		}
+	}
+	if got := StillFormatJPEG.ContentType(); got != "image/jpeg" {
+		t.Errorf("JPEG content type = %q, want image/jpeg", got)
+	}
+}
+
+var srtArgRe = regexp.MustCompile(`subtitles=([^:]*\.srt)`)
+
+func TestMakeStill(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		opts  StillOptions
+		codec string
+		// srt is the subtitle file drawn over the frame, empty for none
+		srt string
+	}{
+		{"uncaptioned jpg", StillOptions{}, "mjpeg", ""},
+		{"bottom png", StillOptions{Format: StillFormatPNG, BottomText: "bottom"}, "png", "1\n00:00:00,000 --> 00:01:00,000\nBOTTOM\n\n"},
+		{"top and bottom", StillOptions{TopText: "top", BottomText: "bottom"}, "mjpeg", "1\n00:00:00,000 --> 00:01:00,000\n{\\an8}TOP\n\n2\n00:00:00,000 --> 00:01:00,000\nBOTTOM\n\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var srt string
+			runner := &FakeRunner{RunFunc: func(args []string) error {
+				if match := srtArgRe.FindStringSubmatch(argValue(args, "-filter_complex")); match != nil {
+					content, err := os.ReadFile(match[1])
+					if err != nil {
+						return err
+					}
+					srt = string(content)
+				}
+				return nil
+			}}
+			tc.opts.Runner = runner
+			err := MakeStill(context.Background(), "/videos/in.mkv", filepath.Join(t.TempDir(), "still"), 1500, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			calls := runner.Calls()
+			if len(calls) != 1 {
+				t.Fatalf("ran %d commands, want 1", len(calls))
+			}
+			args := calls[0].Args
+			if got := argValue(args, "-ss"); got != "1500ms" {
+				t.Errorf("-ss = %q, want 1500ms", got)
+			}
+			if got := argValue(args, "-frames:v"); got != "1" {
+				t.Errorf("-frames:v = %q, want 1", got)
+			}
+			if got := argValue(args, "-c:v"); got != tc.codec {
+				t.Errorf("-c:v = %q, want %q", got, tc.codec)
+			}
+			if srt != tc.srt {
+				t.Errorf("srt = %q, want %q", srt, tc.srt)
+			}
+		})
+	}
+
+	err := MakeStill(context.Background(), "/videos/in.mkv", filepath.Join(t.TempDir(), "still"), -1, StillOptions{Runner: &FakeRunner{}})
+	if err != ErrInvalidTimeRange {
+		t.Errorf("negative timestamp: err = %v, want ErrInvalidTimeRange", err)
+	}
+}
@@ -1,22 +1,31 @@
 package processor
 
 import (
-	"bufio"
+	"context"
 	"fmt"
-	"os/exec"
-	"regexp"
-	"strings"
+	"strconv"
+	"time"
+
+	ffmpeg_go "github.com/u2takey/ffmpeg-go"
 )
 
 type SubtitleExtractor struct {
+	// timeout caps how long ffmpeg may run
+	timeout time.Duration
+	// runner runs ffmpeg
+	runner Runner
 }
 
 type SubtitleExtractorConfig struct {
+	// Timeout caps how long ffmpeg may run. Zero means no limit.
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Runner runs ffmpeg. Defaults to DefaultRunner.
+	Runner Runner `mapstructure:"-" json:"-"`
 }
 
 // NewSubtitleExtractor creates a new SubtitleExtractor instance.
 func NewSubtitleExtractor(cfg SubtitleExtractorConfig) *SubtitleExtractor {
-	return &SubtitleExtractor{}
+	return &SubtitleExtractor{timeout: cfg.Timeout, runner: runnerOrDefault(cfg.Runner)}
 }
 
 type SubtitleMetadata struct {
@@ -24,24 +33,22 @@ type SubtitleMetadata struct {
 	Name string `json:"name"`
 }
 
-// Run runs the subtitle extractor processor.
-func (s *SubtitleExtractor) Run(inputFilePath string, outputDir string) (*SubtitleMetadata, error) {
-	subtitlesStream, err := findSubtitleStream(inputFilePath)
+// Run runs the subtitle extractor processor. ffmpeg is killed if ctx is
+// cancelled, or with a *TimeoutError once the timeout has passed.
+func (s *SubtitleExtractor) Run(ctx context.Context, inputFilePath string, outputDir string) (*SubtitleMetadata, error) {
+	ctx, cancel := withTimeout(ctx, "subtitles", s.timeout)
+	defer cancel()
+
+	subtitlesStream, err := findSubtitleStream(ctx, s.runner, inputFilePath)
 	if err != nil {
-		return nil, fmt.Errorf("error finding subtitle stream: %v", err)
+		return nil, fmt.Errorf("error finding subtitle stream: %w", err)
 	}
 
 	outputPath := fmt.Sprintf("%s/subtitles.srt", outputDir)
-	cmd := exec.Command(
-		"ffmpeg",
-		"-i", inputFilePath,
-		"-map", fmt.Sprintf("0:%s", subtitlesStream),
-		outputPath,
-	)
-
-	output, err := cmd.CombinedOutput()
+	input := ffmpeg_go.Input(inputFilePath)
+	err = s.runner.Run(ctx, input.Get(strconv.Itoa(subtitlesStream)).Output(outputPath), 0)
 	if err != nil {
-		return nil, fmt.Errorf("error running ffmpeg: %v, output: %s", err, string(output))
+		return nil, fmt.Errorf("error extracting subtitles: %w", err)
 	}
 
 	return &SubtitleMetadata{
@@ -49,26 +56,18 @@ func (s *SubtitleExtractor) Run(inputFilePath string, outputDir string) (*Subtit
 	}, nil
 }
 
-var subtitleStreamRegex = regexp.MustCompile(`Stream #0:(\d+)\(eng\): Subtitle:`)
-
-func findSubtitleStream(inputFilePath string) (string, error) {
-	cmd := exec.Command(
-		"ffmpeg",
-		"-i", inputFilePath,
-	)
-
-	output, _ := cmd.CombinedOutput()
+// findSubtitleStream returns the index of the first english subtitle
+// stream of inputFilePath.
+func findSubtitleStream(ctx context.Context, runner Runner, inputFilePath string) (int, error) {
+	streams, _, err := ProbeStreams(ctx, runner, inputFilePath)
+	if err != nil {
+		return 0, err
+	}
 
-	// Find english subtitle stream
-	reader := strings.NewReader(string(output))
-	scanner := bufio.NewScanner(reader)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		matches := subtitleStreamRegex.FindStringSubmatch(line)
-		if len(matches) > 0 {
-			return matches[1], nil
+	for _, stream := range streams {
+		if stream.CodecType == "subtitle" && stream.Tags.Language == "eng" {
+			return stream.Index, nil
 		}
 	}
-
-	return "", fmt.Errorf("no subtitle stream found")
+	return 0, fmt.Errorf("no subtitle stream found")
 }
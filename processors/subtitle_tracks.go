@@ -0,0 +1,116 @@
+package processor
+
+import (
+	"strings"
+)
+
+// UndeterminedLanguage is the language of subtitle streams without a
+// language tag.
+const UndeterminedLanguage = "und"
+
+// bitmapSubtitleCodecs are subtitle codecs made of images, which ffmpeg
+// cannot convert to SRT. They are only indexed with OCR.
+var bitmapSubtitleCodecs = map[string]bool{
+	"hdmv_pgs_subtitle": true,
+	"dvd_subtitle":      true,
+	"dvb_subtitle":      true,
+	"xsub":              true,
+}
+
+// subtitleTrack is a source of subtitles in one language, either a stream
+// of the video or a sidecar file next to it.
+type subtitleTrack struct {
+	// index is the stream index of an embedded track, -1 for sidecars.
+	index       int
+	codec       string
+	language    string
+	forced      bool
+	sidecarPath string
+}
+
+// embeddedSubtitleTracks returns the subtitle streams of the video that
+// can be indexed, in stream order. Image based streams are only returned
+// when OCR is configured and a decoder for their codec is available.
+func (p *Preprocessor) embeddedSubtitleTracks(streams []ProbeStream) []subtitleTrack {
+	var tracks []subtitleTrack
+	for _, stream := range streams {
+		if stream.CodecType != "subtitle" {
+			continue
+		}
+		if bitmapSubtitleCodecs[stream.CodecName] {
+			if _, ok := p.config.SubtitleDecoders[stream.CodecName]; !ok || p.config.OCR == nil {
+				continue
+			}
+		}
+
+		language := strings.ToLower(stream.Tags.Language)
+		if language == "" {
+			language = UndeterminedLanguage
+		}
+		tracks = append(tracks, subtitleTrack{
+			index:    stream.Index,
+			codec:    stream.CodecName,
+			language: language,
+			forced:   stream.Disposition.Forced != 0,
+		})
+	}
+	return tracks
+}
+
+// selectSubtitleTracks picks one track per language from the embedded
+// streams and sidecar files, with the SidecarSubtitles policy deciding
+// which wins when both have a language. Image based streams need OCR, so
+// they are only used for languages without a text track. With
+// SubtitleLanguages configured only those languages are picked, in the
+// configured order; otherwise every language is, in the order found.
+// Forced tracks, which only carry foreign dialogue, are used only if they
+// are the sole track for their language.
+func (p *Preprocessor) selectSubtitleTracks(embedded []subtitleTrack, sidecars []subtitleTrack) []subtitleTrack {
+	var text, bitmap []subtitleTrack
+	for _, track := range embedded {
+		if bitmapSubtitleCodecs[track.codec] {
+			bitmap = append(bitmap, track)
+		} else {
+			text = append(text, track)
+		}
+	}
+
+	candidates := append(append([]subtitleTrack{}, text...), sidecars...)
+	if p.config.SidecarSubtitles == SidecarSubtitlesPrefer {
+		candidates = append(append([]subtitleTrack{}, sidecars...), text...)
+	}
+	candidates = append(candidates, bitmap...)
+
+	byLanguage := map[string]subtitleTrack{}
+	var languages []string
+	for _, track := range candidates {
+		existing, seen := byLanguage[track.language]
+		if !seen {
+			languages = append(languages, track.language)
+		}
+		if !seen || (existing.forced && !track.forced) {
+			byLanguage[track.language] = track
+		}
+	}
+
+	if len(p.config.SubtitleLanguages) > 0 {
+		languages = p.config.SubtitleLanguages
+	}
+
+	var tracks []subtitleTrack
+	for _, language := range languages {
+		if track, ok := byLanguage[strings.ToLower(language)]; ok {
+			tracks = append(tracks, track)
+		}
+	}
+	return tracks
+}
+
+// subtitleLanguagesDescription describes the configured languages for
+// error messages.
+func (p *Preprocessor) subtitleLanguagesDescription() string {
+	if len(p.config.SubtitleLanguages) == 0 {
+		return "any language"
+	}
+	return strings.Join(p.config.SubtitleLanguages, ", ")
+}
@@ -1,11 +1,14 @@
 package processor
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
+	"time"
+
+	ffmpeg_go "github.com/u2takey/ffmpeg-go"
 )
 
 const DefaultFramesPerSecond = 5
@@ -17,6 +20,10 @@ type Thumbnailer struct {
 	width int
 	// height is the height of the thumbnail
 	height int
+	// timeout caps how long ffmpeg may run
+	timeout time.Duration
+	// runner runs ffmpeg
+	runner Runner
 }
 
 type ThumbnailerConfig struct {
@@ -26,6 +33,10 @@ type ThumbnailerConfig struct {
 	Width int `mapstructure:"width"`
 	// Height is the height of the thumbnail
 	Height int `mapstructure:"height"`
+	// Timeout caps how long ffmpeg may run. Zero means no limit.
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Runner runs ffmpeg. Defaults to DefaultRunner.
+	Runner Runner `mapstructure:"-" json:"-"`
 }
 
 // NewThumbnailer creates a new Thumbnailer instance
@@ -46,6 +57,8 @@ func NewThumbnailer(cfg ThumbnailerConfig) *Thumbnailer {
 		framesPerSecond: framesPerSecond,
 		width:           width,
 		height:          height,
+		timeout:         cfg.Timeout,
+		runner:          runnerOrDefault(cfg.Runner),
 	}
 }
 
@@ -60,19 +73,18 @@ type ThumbnailsMetadata struct {
 	Thumbnails []ThumbnailMetadata `json:"thumbnails"`
 }
 
-// Run runs the thumbnailer processor.
-func (t *Thumbnailer) Run(videoPath string, outputDir string) (*ThumbnailsMetadata, error) {
-	cmd := exec.Command(
-		"ffmpeg",
-		"-i", videoPath,
-		"-vf", fmt.Sprintf("fps=%d,scale=%d:%d", t.framesPerSecond, t.width, t.height),
-		"-q:v", "1",
-		fmt.Sprintf("%s/_thumb_%%08d.jpg", outputDir),
-	)
+// Run runs the thumbnailer processor. ffmpeg is killed if ctx is cancelled,
+// or with a *TimeoutError once the timeout has passed.
+func (t *Thumbnailer) Run(ctx context.Context, videoPath string, outputDir string) (*ThumbnailsMetadata, error) {
+	ctx, cancel := withTimeout(ctx, "thumbnails", t.timeout)
+	defer cancel()
 
-	output, err := cmd.CombinedOutput()
+	err := t.runner.Run(ctx, ffmpeg_go.Input(videoPath).Output(fmt.Sprintf("%s/_thumb_%%08d.jpg", outputDir), ffmpeg_go.KwArgs{
+		"vf":  fmt.Sprintf("fps=%d,scale=%d:%d", t.framesPerSecond, t.width, t.height),
+		"q:v": "1",
+	}), 0)
 	if err != nil {
-		return nil, fmt.Errorf("error extracting frames: %v, output: %s", err, string(output))
+		return nil, fmt.Errorf("error extracting frames: %w", err)
 	}
 
 	thumbnails := []ThumbnailMetadata{}
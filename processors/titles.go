@@ -0,0 +1,222 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jaym/clyper/metadata"
+)
+
+// ManifestSuffix is the suffix of sidecar manifests. The manifest for
+// "Heat (1995).mkv" is "Heat (1995).clyper.json".
+const ManifestSuffix = ".clyper.json"
+
+// TitleRule recognises standalone titles, such as movies and specials, by
+// their file name.
+type TitleRule struct {
+	// Kind is metadata.KindMovie or metadata.KindSpecial.
+	Kind string `mapstructure:"kind"`
+	// Pattern is a regular expression matched against the file name. The
+	// named group "title" is required, "year" and "episode" are optional.
+	// Specials need an episode number, either from the "episode" group or
+	// from a manifest.
+	Pattern string `mapstructure:"pattern"`
+}
+
+// DefaultTitleRules recognise movies named like "Heat (1995).mkv" or
+// "Heat.1995.1080p.BluRay.mkv". The year is the last one in the name, so
+// titles that contain a number, like "Blade Runner 2049 (2017).mkv", keep
+// it.
+var DefaultTitleRules = []TitleRule{
+	{
+		Kind:    metadata.KindMovie,
+		Pattern: `^(?P<title>.+)[ ._-]*[(\[]?(?P<year>(?:19|20)\d{2})[)\]]?(?:[ ._-].*)?\.(?:mkv|mp4|m4v|avi|mov|webm)$`,
+	},
+}
+
+type titleRule struct {
+	kind  string
+	regex *regexp.Regexp
+}
+
+func compileTitleRules(rules []TitleRule) ([]titleRule, error) {
+	compiled := make([]titleRule, 0, len(rules))
+	for _, rule := range rules {
+		switch rule.Kind {
+		case metadata.KindMovie, metadata.KindSpecial:
+		default:
+			return nil, fmt.Errorf("invalid title rule kind %q", rule.Kind)
+		}
+
+		regex, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid title rule pattern %q: %v", rule.Pattern, err)
+		}
+		if regex.SubexpIndex("title") < 0 {
+			return nil, fmt.Errorf("title rule pattern %q has no title group", rule.Pattern)
+		}
+
+		compiled = append(compiled, titleRule{kind: rule.Kind, regex: regex})
+	}
+	return compiled, nil
+}
+
+// TitleManifest describes a video file that cannot be identified from its
+// name, or overrides what its name says. Fields left empty fall back to
+// what was derived from the file name.
+type TitleManifest struct {
+	Kind     string `json:"kind"`
+	Title    string `json:"title"`
+	Year     int    `json:"year,omitempty"`
+	Show     string `json:"show,omitempty"`
+	ShowName string `json:"show_name,omitempty"`
+	Season   *int   `json:"season,omitempty"`
+	Episode  *int   `json:"episode,omitempty"`
+}
+
+// readManifest reads the sidecar manifest of the video at videoPath. It
+// returns nil if there is none.
+func readManifest(videoPath string) (*TitleManifest, error) {
+	manifestPath := strings.TrimSuffix(videoPath, filepath.Ext(videoPath)) + ManifestSuffix
+	manifestBytes, err := os.ReadFile(manifestPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %v", err)
+	}
+
+	var manifest TitleManifest
+	err = json.Unmarshal(manifestBytes, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing manifest %s: %v", manifestPath, err)
+	}
+	return &manifest, nil
+}
+
+// matchTitle matches the file name against the title rules.
+func (p *Preprocessor) matchTitle(filePath string) (kind string, title string, year int, episode int, ok bool) {
+	name := filepath.Base(filePath)
+	for _, rule := range p.titleRules {
+		matches := rule.regex.FindStringSubmatch(name)
+		if matches == nil {
+			continue
+		}
+
+		title = cleanTitle(matches[rule.regex.SubexpIndex("title")])
+		if idx := rule.regex.SubexpIndex("year"); idx >= 0 && matches[idx] != "" {
+			year, _ = strconv.Atoi(matches[idx])
+		}
+		if idx := rule.regex.SubexpIndex("episode"); idx >= 0 && matches[idx] != "" {
+			episode, _ = strconv.Atoi(matches[idx])
+		}
+		return rule.kind, title, year, episode, true
+	}
+	return "", "", 0, 0, false
+}
+
+// cleanTitle turns "Heat.1995" style separators back into spaces, and drops
+// the opening bracket of a year that follows the title without a space.
+func cleanTitle(title string) string {
+	title = strings.NewReplacer(".", " ", "_", " ").Replace(title)
+	title = strings.TrimRight(title, " -([")
+	return strings.Join(strings.Fields(title), " ")
+}
+
+func displayTitle(title string, year int) string {
+	if year == 0 {
+		return title
+	}
+	return fmt.Sprintf("%s (%d)", title, year)
+}
+
+// identifyFile works out what the file at filePath is. ok is false for
+// files that are not recognised and should be skipped.
+func (p *Preprocessor) identifyFile(inputDir string, filePath string) (job preprocessJob, ok bool, err error) {
+	manifest, err := readManifest(filePath)
+	if err != nil {
+		return preprocessJob{}, false, err
+	}
+
+	job = preprocessJob{path: filePath, kind: metadata.KindEpisode}
+	job.show, job.showName = p.showForFile(inputDir, filePath)
+
+	year := 0
+	if season, episode, rule, matched := p.matchEpisode(inputDir, filePath); matched {
+		job.season, job.episode, job.rule = season, episode, rule
+		ok = true
+		if season == 0 {
+			job.kind = metadata.KindSpecial
+		}
+	} else if kind, title, titleYear, titleEpisode, matched := p.matchTitle(filePath); matched {
+		job.kind, job.title, job.episode = kind, title, titleEpisode
+		job.rule = "title:" + kind
+		year = titleYear
+		ok = true
+	}
+
+	if manifest != nil {
+		ok = true
+		job.rule = "manifest"
+		if manifest.Kind != "" {
+			job.kind = manifest.Kind
+		}
+		if manifest.Title != "" {
+			job.title = manifest.Title
+		}
+		if manifest.Year != 0 {
+			year = manifest.Year
+		}
+	}
+	if !ok {
+		return preprocessJob{}, false, nil
+	}
+
+	switch job.kind {
+	case metadata.KindEpisode:
+	case metadata.KindSpecial:
+		job.season = 0
+	case metadata.KindMovie:
+		// A movie is its own show unless the manifest says otherwise
+		job.title = displayTitle(job.title, year)
+		job.show, job.showName = metadata.Slugify(job.title), job.title
+		job.season, job.episode = 0, 1
+	default:
+		return preprocessJob{}, false, fmt.Errorf("invalid kind %q for %s", job.kind, filePath)
+	}
+
+	if manifest != nil {
+		if manifest.Show != "" {
+			job.show = manifest.Show
+			job.showName = manifest.ShowName
+			if job.showName == "" {
+				job.showName = manifest.Show
+			}
+		}
+		if manifest.Season != nil {
+			job.season = *manifest.Season
+		}
+		if manifest.Episode != nil {
+			job.episode = *manifest.Episode
+		}
+	}
+
+	if job.kind == metadata.KindMovie && job.title == "" {
+		return preprocessJob{}, false, fmt.Errorf("%s %s has no title", job.kind, filePath)
+	}
+	if job.kind == metadata.KindSpecial && job.episode == 0 {
+		return preprocessJob{}, false, fmt.Errorf("special %s has no episode number", filePath)
+	}
+	if job.show == "" {
+		return preprocessJob{}, false, fmt.Errorf("could not derive a show slug for %s", filePath)
+	}
+
+	return job, true, nil
+}
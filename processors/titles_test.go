@@ -0,0 +1,145 @@
+package processor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jaym/clyper/metadata"
+)
+
+func TestDefaultTitleRules(t *testing.T) {
+	p, err := NewPreprocessor(PreprocessorConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		title string
+		year  int
+		ok    bool
+	}{
+		{name: "Heat (1995).mkv", title: "Heat", year: 1995, ok: true},
+		{name: "Heat.1995.1080p.BluRay.mkv", title: "Heat", year: 1995, ok: true},
+		{name: "The_Matrix_1999.mp4", title: "The Matrix", year: 1999, ok: true},
+		{name: "Blade Runner 2049 (2017).mkv", title: "Blade Runner 2049", year: 2017, ok: true},
+		{name: "2001 A Space Odyssey [1968].webm", title: "2001 A Space Odyssey", year: 1968, ok: true},
+		{name: "Heat(1995).mkv", title: "Heat", year: 1995, ok: true},
+		{name: "Heat - 1995 - Director's Cut.mkv", title: "Heat", year: 1995, ok: true},
+		{name: "Heat.mkv"},
+		{name: "Heat (1995).srt"},
+		{name: "Heat (1895).mkv"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, title, year, episode, ok := p.matchTitle(filepath.Join("/movies", tt.name))
+			if ok != tt.ok {
+				t.Fatalf("matched = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if kind != metadata.KindMovie || title != tt.title || year != tt.year || episode != 0 {
+				t.Errorf("got %s %q (%d) episode %d, want movie %q (%d)", kind, title, year, episode, tt.title, tt.year)
+			}
+		})
+	}
+}
+
+func TestSpecialTitleRule(t *testing.T) {
+	p, err := NewPreprocessor(PreprocessorConfig{TitleRules: []TitleRule{{
+		Kind:    metadata.KindSpecial,
+		Pattern: `^Special (?P<episode>\d+) - (?P<title>.+)\.mkv$`,
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kind, title, year, episode, ok := p.matchTitle("/shows/Special 02 - Holiday_Party.mkv")
+	if !ok || kind != metadata.KindSpecial || title != "Holiday Party" || year != 0 || episode != 2 {
+		t.Errorf("got %v %s %q (%d) episode %d", ok, kind, title, year, episode)
+	}
+	// The defaults are replaced, so movies are no longer recognised
+	if _, _, _, _, ok := p.matchTitle("/movies/Heat (1995).mkv"); ok {
+		t.Errorf("configured title rules did not replace the defaults")
+	}
+}
+
+func TestCompileTitleRulesErrors(t *testing.T) {
+	for _, rule := range []TitleRule{
+		{Kind: metadata.KindEpisode, Pattern: `(?P<title>.+)`},
+		{Kind: "", Pattern: `(?P<title>.+)`},
+		{Kind: metadata.KindMovie, Pattern: `(?P<title>.+`},
+		{Kind: metadata.KindMovie, Pattern: `(?P<name>.+)`},
+	} {
+		if _, err := compileTitleRules([]TitleRule{rule}); err == nil {
+			t.Errorf("rule %+v compiled", rule)
+		}
+	}
+}
+
+func TestIdentifyTitles(t *testing.T) {
+	inputDir := t.TempDir()
+	p, err := NewPreprocessor(PreprocessorConfig{TitleRules: append([]TitleRule{{
+		Kind:    metadata.KindSpecial,
+		Pattern: `^(?P<title>.+) Special\.mkv$`,
+	}}, DefaultTitleRules...)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		want    preprocessJob
+		wantErr bool
+	}{
+		{
+			name: "Heat (1995).mkv",
+			want: preprocessJob{show: "heat-1995", showName: "Heat (1995)", season: 0, episode: 1, kind: metadata.KindMovie, title: "Heat (1995)", rule: "title:movie"},
+		},
+		{
+			// Episode rules win over title rules
+			name: "Show 1999 S02E03.mkv",
+			want: preprocessJob{show: metadata.DefaultShowSlug, showName: metadata.DefaultShowSlug, season: 2, episode: 3, kind: metadata.KindEpisode, rule: "sxxexx"},
+		},
+		{
+			// Season 0 episodes are specials
+			name: "Show S00E04.mkv",
+			want: preprocessJob{show: metadata.DefaultShowSlug, showName: metadata.DefaultShowSlug, season: 0, episode: 4, kind: metadata.KindSpecial, rule: "sxxexx"},
+		},
+		{
+			// Specials matched by a title rule need an episode number
+			name:    "Holiday Special.mkv",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filePath := writeVideo(t, inputDir, tt.name, "")
+			job, ok, err := p.identifyFile(inputDir, filePath)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", job)
+				}
+				return
+			}
+			if err != nil || !ok {
+				t.Fatalf("identifyFile returned %v, %v", ok, err)
+			}
+			tt.want.path = filePath
+			if job != tt.want {
+				t.Errorf("got %+v, want %+v", job, tt.want)
+			}
+		})
+	}
+
+	if _, ok, err := p.identifyFile(inputDir, writeVideo(t, inputDir, "notes.txt", "")); ok || err != nil {
+		t.Errorf("unrecognised file returned %v, %v", ok, err)
+	}
+	if err := os.Remove(filepath.Join(inputDir, "notes.txt")); err != nil {
+		t.Fatal(err)
+	}
+}